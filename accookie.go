@@ -0,0 +1,143 @@
+package pppoeproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// Reasons the PADRs are dropped with ACCookies
+const (
+	CookieMissing = "missing" // Without AC-Cookie
+	CookieInvalid = "invalid" // With an AC-Cookie not signed by the proxy for the host and AC
+	CookieExpired = "expired" // With an AC-Cookie signed too long ago
+)
+
+const (
+	// cookieLifetime is the time a host may take to send its PADR after
+	// the PADO
+	cookieLifetime = time.Minute
+
+	// cookieMACSize is the length of the truncated HMAC of a cookie
+	cookieMACSize = 16
+
+	// cookieHeaderSize is the length of the issue time, flag and HMAC
+	// preceding the cookie of the AC
+	cookieHeaderSize = 4 + 1 + cookieMACSize
+)
+
+// cookiesRejected counts the PADRs dropped because of their AC-Cookie
+var cookiesRejected = NewCounterVec("pppoeproxy_ac_cookie_rejected_total", "PADRs dropped because their AC-Cookie was not signed by the proxy", "direction", "reason")
+
+// cookieSigner signs the AC-Cookies the proxy sends hosts in PADOs in place
+// of the ones of the AC. The cookie of the AC is kept in the signed one, and
+// restored in the PADR sent back, so the AC sees its own.
+//
+// A signed cookie is the issue time in seconds, a flag set when the AC sent a
+// cookie, an HMAC of these with the addresses of the host and AC and the
+// cookie of the AC, then that cookie.
+type cookieSigner struct {
+	key [32]byte // Random, so cookies do not survive a restart
+}
+
+// newCookieSigner returns a signer with a random key
+func newCookieSigner() (*cookieSigner, error) {
+	s := &cookieSigner{}
+	if _, err := rand.Read(s.key[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// mac returns the HMAC of a cookie
+func (s *cookieSigner) mac(header, host, ac, cookie []byte) []byte {
+	h := hmac.New(sha256.New, s.key[:])
+	h.Write(header[:5])
+	h.Write(host)
+	h.Write(ac)
+	h.Write(cookie)
+	return h.Sum(nil)[:cookieMACSize]
+}
+
+// sign returns the cookie sent to host in place of cookie, the one of ac
+// (hasCookie is false if it sent none)
+func (s *cookieSigner) sign(host, ac, cookie []byte, hasCookie bool, now time.Time) []byte {
+	res := binary.BigEndian.AppendUint32(make([]byte, 0, cookieHeaderSize+len(cookie)), uint32(now.Unix()))
+	if hasCookie {
+		res = append(res, 1)
+	} else {
+		res = append(res, 0)
+	}
+	res = append(res, s.mac(res, host, ac, cookie)...)
+	return append(res, cookie...)
+}
+
+// verify checks a cookie returned by host to ac, and returns the cookie of the
+// AC, with whether it sent one, or the reason it is rejected
+func (s *cookieSigner) verify(host, ac, signed []byte, now time.Time) ([]byte, bool, string) {
+	if len(signed) < cookieHeaderSize || signed[4] > 1 {
+		return nil, false, CookieInvalid
+	}
+	cookie := signed[cookieHeaderSize:]
+	if !hmac.Equal(signed[5:cookieHeaderSize], s.mac(signed, host, ac, cookie)) {
+		return nil, false, CookieInvalid
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint32(signed[0:4])), 0)
+	if age := now.Sub(issued); age < -time.Second || age > cookieLifetime {
+		return nil, false, CookieExpired
+	}
+	return cookie, signed[4] == 1, ""
+}
+
+// guardCookie replaces the AC-Cookie of a PADO with one signed by the proxy,
+// and checks the one of a PADR, restoring the cookie of the AC. It returns
+// the frame to pass on, and false if a PADR must be dropped. Other frames,
+// and all frames without ACCookies, are passed on unchanged.
+func (p *Proxy) guardCookie(direction string, packet []byte) ([]byte, bool) {
+	if !p.cfg().ACCookies {
+		return packet, true
+	}
+	f, err := parsePPPoE(packet)
+	if err != nil || f.EtherType != PPPoEDiscovery || f.Code != PADO && f.Code != PADR {
+		return packet, true
+	}
+	idx := -1
+	for i, tag := range f.Tags {
+		if tag.Type == TagACCookie {
+			idx = i
+			break
+		}
+	}
+	now := time.Now()
+
+	if f.Code == PADO {
+		hasCookie := idx >= 0
+		var cookie []byte
+		if hasCookie {
+			cookie = f.Tags[idx].Value
+		} else {
+			f.Tags = append(f.Tags, pppoeTag{Type: TagACCookie})
+			idx = len(f.Tags) - 1
+		}
+		f.Tags[idx].Value = p.cookies.sign(f.Dst, f.Src, cookie, hasCookie, now)
+		return rebuildDiscovery(packet, f.Tags), true
+	}
+
+	if idx < 0 {
+		cookiesRejected.With(direction, CookieMissing).Inc()
+		return nil, false
+	}
+	cookie, hasCookie, reason := p.cookies.verify(f.Src, f.Dst, f.Tags[idx].Value, now)
+	if reason != "" {
+		cookiesRejected.With(direction, reason).Inc()
+		return nil, false
+	}
+	if hasCookie {
+		f.Tags[idx].Value = cookie
+	} else {
+		f.Tags = append(f.Tags[:idx], f.Tags[idx+1:]...)
+	}
+	return rebuildDiscovery(packet, f.Tags), true
+}
@@ -0,0 +1,66 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ParseAllowList parses a comma separated list of IPv4 and IPv6 addresses and
+// CIDR prefixes, such as "192.168.1.2,10.0.0.0/8,2001:db8::/32". IPv6
+// addresses may be bracketed. IPv4-mapped IPv6 rules such as ::ffff:10.0.0.1
+// are turned into IPv4 rules, since client addresses are unmapped.
+func ParseAllowList(s string) ([]netip.Prefix, error) {
+	var list []netip.Prefix
+	for _, entry := range splitList(s) {
+		if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+			entry = entry[1 : len(entry)-1]
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid allow rule %q: %v", entry, err)
+			}
+			prefix = prefix.Masked()
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			list = append(list, prefix)
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow rule %q: %v", entry, err)
+		}
+		addr = addr.Unmap().WithZone("")
+		list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return list, nil
+}
+
+// allowed reports whether addr matches one of the prefixes. IPv4 clients of
+// a dual-stack listener appear as IPv4-mapped IPv6 addresses and match IPv4
+// rules.
+func allowed(list []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range list {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the remote end of a connection
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(tcp.IP)
+		return ip.Unmap(), ok
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
@@ -0,0 +1,75 @@
+package pppoeproxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestAllowList(t *testing.T) {
+	tests := []struct {
+		rules  string
+		remote net.Addr
+		want   bool
+	}{
+		{"127.0.0.1", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40312}, true},
+		{"[::1]", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 40312}, true},
+		{"::1", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40312}, false},
+		{"2001:db8::/32", &net.TCPAddr{IP: net.ParseIP("2001:db8:1::5"), Port: 40312}, true},
+		{"2001:db8::/32", &net.TCPAddr{IP: net.ParseIP("2001:db9::5"), Port: 40312}, false},
+		{"[2001:db8::1]", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40312, Zone: "eth0"}, true},
+		{"fe80::1%eth0", &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 40312}, true},
+
+		// IPv4 clients of a dual-stack listener
+		{"192.0.2.10", &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.10"), Port: 40312}, true},
+		{"10.0.0.0/8", &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 40312}, true},
+		{"::ffff:192.0.2.10", &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40312}, true},
+		{"::ffff:10.0.0.0/104", &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 40312}, true},
+		{"::ffff:10.0.0.0/104", &net.TCPAddr{IP: net.ParseIP("11.1.2.3"), Port: 40312}, false},
+
+		// Addresses that are not a *net.TCPAddr are parsed
+		{"::1", &net.UnixAddr{Name: "[::1]:8100", Net: "unix"}, true},
+		{"192.0.2.10", &net.UnixAddr{Name: "[::ffff:192.0.2.10]:8100", Net: "unix"}, true},
+		{"10.0.0.1,2001:db8::/32, 192.0.2.0/24", &net.UnixAddr{Name: "192.0.2.99:8100", Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		list, err := ParseAllowList(tt.rules)
+		if err != nil {
+			t.Fatalf("ParseAllowList(%q): %v", tt.rules, err)
+		}
+		ip, ok := remoteIP(tt.remote)
+		if !ok {
+			t.Fatalf("remoteIP(%v) failed", tt.remote)
+		}
+		if got := allowed(list, ip); got != tt.want {
+			t.Errorf("%v allowed by %q = %v, want %v", tt.remote, tt.rules, got, tt.want)
+		}
+	}
+}
+
+func TestParseAllowList(t *testing.T) {
+	list, err := ParseAllowList("[::1], 2001:db8::1/32,::ffff:10.0.0.0/104,::ffff:192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.1/32"),
+	}
+	if len(list) != len(want) {
+		t.Fatalf("ParseAllowList = %v, want %v", list, want)
+	}
+	for i := range want {
+		if list[i] != want[i] {
+			t.Errorf("rule %d is %v, want %v", i, list[i], want[i])
+		}
+	}
+
+	for _, rules := range []string{"[::1]:8100", "192.0.2.1:8100", "2001:db8::/129", "10.0.0.0/33", "host.example", "[::1"} {
+		if _, err := ParseAllowList(rules); err == nil {
+			t.Errorf("ParseAllowList(%q) succeeded", rules)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package pppoeproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"slices"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeTLSConfig returns a TLS configuration obtaining the certificate of the
+// configured domain with ACME and renewing it before it expires. The
+// TLS-ALPN-01 challenge is answered on the same listener, which must thus be
+// reachable from the internet on port 443 of the domain.
+func acmeTLSConfig(config AdminAPIConfig) (*tls.Config, error) {
+	if config.ACMECache == "" {
+		// Without a cache, a certificate would be requested on each start
+		// and rate limits would be hit quickly
+		return nil, errors.New("ACME requires a cache directory for the account and certificates")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(config.ACMEDomain),
+		Cache:      autocert.DirCache(config.ACMECache),
+		Email:      config.ACMEEmail,
+	}
+	if config.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: config.ACMEDirectory}
+	}
+	tlsConfig := m.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	return tlsConfig, nil
+}
+
+// allowACMEChallenge lets the certificate authority validate the domain on a
+// listener requiring client certificates: it presents none
+func allowACMEChallenge(tlsConfig *tls.Config) {
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+			return nil, nil
+		}
+		challenge := tlsConfig.Clone()
+		challenge.GetConfigForClient = nil
+		challenge.ClientAuth = tls.NoClientCert
+		return challenge, nil
+	}
+}
@@ -0,0 +1,160 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// adminPADTReason is sent in the Generic-Error tag of PADTs for sessions
+// terminated by an administrator
+const adminPADTReason = "session terminated by administrator"
+
+// KickClient force-disconnects the tunnel peer with the given remote address.
+// A goodbye frame is sent first so the peer knows the disconnection was
+// deliberate. In client mode, kicking the server forces a reconnection.
+func (p *Proxy) KickClient(addr string) error {
+	for _, peer := range p.peers() {
+		if peer.remoteAddr != addr {
+			continue
+		}
+		log.Printf("Disconnecting tunnel peer %s on administrator request", addr)
+		peer.WritePacket(PacketTypeGoodbye, nil)
+		// The peer may already have closed the connection after the goodbye
+		peer.Close()
+		return nil
+	}
+	return fmt.Errorf("no tunnel peer %s", addr)
+}
+
+// FindSession returns the tracked session with the given ID. ac may be nil
+// when the session ID is only used by a single access concentrator.
+func (p *Proxy) FindSession(id uint16, ac net.HardwareAddr) (SessionInfo, error) {
+	var found []SessionInfo
+	for _, s := range p.sessions.List() {
+		if s.ID == id && (ac == nil || bytes.Equal(s.ACMAC, ac)) {
+			found = append(found, s)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return SessionInfo{}, fmt.Errorf("no session 0x%04x", id)
+	case 1:
+		return found[0], nil
+	default:
+		return SessionInfo{}, fmt.Errorf("session ID 0x%04x is used by %d access concentrators, specify the AC MAC address", id, len(found))
+	}
+}
+
+// KillSession terminates a tracked session on administrator request, sending
+// a PADT to both ends
+func (p *Proxy) KillSession(id uint16, ac net.HardwareAddr) error {
+	s, err := p.FindSession(id, ac)
+	if err != nil {
+		return err
+	}
+	log.Printf("Terminating session 0x%04x (host %s, ac %s) on administrator request", s.ID, s.HostMAC, s.ACMAC)
+	p.TerminateSession(s, ReasonAdmin, adminPADTReason)
+	return nil
+}
+
+// KillSessionByMAC terminates the session between host and ac on
+// administrator request, sending a PADT to both ends even if the proxy does
+// not track the session, such as a stuck session it lost track of
+func (p *Proxy) KillSessionByMAC(id uint16, host, ac net.HardwareAddr) error {
+	if id == 0 || id == 0xffff {
+		return fmt.Errorf("invalid session ID 0x%04x", id)
+	}
+	for _, mac := range []net.HardwareAddr{host, ac} {
+		if len(mac) != 6 || mac[0]&1 != 0 {
+			return fmt.Errorf("invalid unicast MAC address %q", mac)
+		}
+	}
+
+	s, err := p.FindSession(id, ac)
+	if err != nil || !bytes.Equal(s.HostMAC, host) {
+		s = SessionInfo{ID: id, HostMAC: host, ACMAC: ac}
+		log.Printf("Terminating untracked session 0x%04x (host %s, ac %s) on administrator request", id, host, ac)
+	} else {
+		log.Printf("Terminating session 0x%04x (host %s, ac %s) on administrator request", s.ID, s.HostMAC, s.ACMAC)
+	}
+	p.TerminateSession(s, ReasonAdmin, adminPADTReason)
+	return nil
+}
+
+// ProxyStatus summarizes the state of the proxy
+type ProxyStatus struct {
+	Mode        string        `json:"mode"`
+	Version     string        `json:"version"`
+	Interface   string        `json:"interface"`
+	Address     string        `json:"address"`
+	Uptime      time.Duration `json:"uptime_ns"`
+	Health      string        `json:"health"`                 // Empty when healthy, the problem found otherwise
+	Degraded    string        `json:"degraded,omitempty"`     // Problem not requiring a restart, such as the link being down
+	ActiveSlave string        `json:"active_slave,omitempty"` // Slave of a bond or team interface carrying the PPPoE traffic
+	TunnelUp    bool          `json:"tunnel_up"`
+	Peers       int           `json:"peers"`
+	Sessions    int           `json:"sessions"`
+}
+
+// Status returns a summary of the proxy state
+func (p *Proxy) Status() ProxyStatus {
+	cfg := p.cfg()
+	st := ProxyStatus{
+		Mode:        "client",
+		Version:     Version(),
+		Interface:   cfg.Interface,
+		Address:     cfg.Address,
+		Uptime:      time.Since(startTime),
+		TunnelUp:    tunnelUp.Value() == 1,
+		Peers:       len(p.peers()),
+		Sessions:    p.sessions.Len(),
+		ActiveSlave: ActiveSlave(cfg.Interface),
+	}
+	if p.isServer {
+		st.Mode = "server"
+	}
+	if err := p.Healthy(); err != nil {
+		st.Health = err.Error()
+	}
+	if p.linkDown.Load() {
+		st.Degraded = "link of " + cfg.Interface + " is down"
+	}
+	return st
+}
+
+// PeerInfo describes a connected tunnel peer
+type PeerInfo struct {
+	Address   string        `json:"address"`
+	Name      string        `json:"name,omitempty"`
+	Version   string        `json:"version,omitempty"` // Announced by the peer, empty for peers without hello support
+	Connected time.Time     `json:"connected"`
+	RTT       time.Duration `json:"rtt_ns"`
+	RTTAvg    time.Duration `json:"rtt_avg_ns"`
+	RTTMax    time.Duration `json:"rtt_max_ns"`
+	LinkDown  bool          `json:"link_down,omitempty"` // Peer reports its PPPoE link down
+}
+
+// Peers returns the connected tunnel peers sorted by address
+func (p *Proxy) Peers() []PeerInfo {
+	peers := p.peers()
+	res := make([]PeerInfo, 0, len(peers))
+	for _, c := range peers {
+		info := PeerInfo{Address: c.remoteAddr, Name: c.Name(), Version: c.PeerVersion(), Connected: c.connected, LinkDown: c.PeerLinkDown()}
+		info.RTT, info.RTTAvg, info.RTTMax = c.rtt.get()
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Address < res[j].Address })
+	return res
+}
+
+// Sessions returns the tracked sessions sorted by start time
+func (p *Proxy) Sessions() []SessionInfo {
+	sessions := p.sessions.List()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Started.Before(sessions[j].Started) })
+	return sessions
+}
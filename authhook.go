@@ -0,0 +1,185 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// authCalls counts the answers of the authorization endpoint
+var authCalls = NewCounterVec("pppoeproxy_auth_requests_total", "Tunnel client authorizations by result", "result")
+
+// authRequest is the body posted to the authorization endpoint
+type authRequest struct {
+	Peer      string `json:"peer"`
+	IP        string `json:"ip"`
+	Listener  string `json:"listener"`
+	Name      string `json:"name,omitempty"`     // From -clients, if a policy matches
+	Challenge string `json:"challenge"`          // Sent to the client, hex encoded
+	Response  string `json:"response,omitempty"` // Answer of the client with -auth-token, see challengeResponse
+}
+
+// authResponse is the answer of the authorization endpoint. When it names the
+// client, its policy replaces the one from ClientPolicies.
+type authResponse struct {
+	Allow        bool              `json:"allow"`
+	Name         string            `json:"name"`
+	MaxSessions  int               `json:"max_sessions"`
+	Rate         float64           `json:"rate"`
+	SessionRate  float64           `json:"session_rate"`
+	SessionBurst int               `json:"session_burst"`
+	Labels       map[string]string `json:"labels"`
+	HostMACs     []string          `json:"host_macs"`
+	VLANs        []uint16          `json:"vlans"`
+}
+
+// authChallengeSize is the number of random bytes of a challenge
+const authChallengeSize = 32
+
+// challengeClient sends a new challenge to a tunnel client and returns it
+func challengeClient(client *Client) ([]byte, error) {
+	challenge := make([]byte, authChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, client.WritePacket(PacketTypeChallenge, challenge)
+}
+
+// challengeResponse returns the answer to a challenge, the hex encoded
+// HMAC-SHA256 of the challenge keyed with the token. The token itself never
+// crosses the tunnel, and an answer is only valid for its challenge.
+func challengeResponse(token string, challenge []byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(challenge)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// answerChallenge reads the challenge a server authorizing its clients sends
+// first, and returns the hello field answering it with token. A server that
+// does not authorize its clients sends its hello first instead, which is
+// returned to be handled.
+func (p *Proxy) answerChallenge(client *Client, token string) ([]string, []byte) {
+	client.conn.SetReadDeadline(time.Now().Add(p.cfg().AuthTimeout))
+	defer client.conn.SetReadDeadline(time.Time{})
+	packetType, data, err := client.ReadPacket()
+	switch {
+	case err != nil:
+		log.Printf("No authentication challenge received from the server: %v", err)
+	case packetType == PacketTypeChallenge:
+		return []string{"auth=" + challengeResponse(token, data)}, nil
+	case packetType == PacketTypeHello:
+		log.Printf("Warning: the server does not authorize its clients, -auth-token is not used")
+		return nil, bytes.Clone(data)
+	default:
+		log.Printf("No authentication challenge received from the server, got packet type %d", packetType)
+	}
+	return nil, nil
+}
+
+// readHello returns the hello a tunnel client sends first, before the
+// authorization endpoint is asked about it. Clients that send anything else
+// first, or nothing within AuthTimeout, are rejected.
+func (p *Proxy) readHello(client *Client) ([]byte, error) {
+	client.conn.SetReadDeadline(time.Now().Add(p.cfg().AuthTimeout))
+	defer client.conn.SetReadDeadline(time.Time{})
+	packetType, data, err := client.ReadPacket()
+	if err != nil {
+		return nil, fmt.Errorf("error reading hello: %v", err)
+	}
+	if packetType != PacketTypeHello {
+		return nil, fmt.Errorf("no hello received")
+	}
+	return bytes.Clone(data), nil
+}
+
+// authorizeClient asks the configured endpoint whether a tunnel client may
+// connect, forwarding the challenge sent to the client and its response. It
+// returns the policy given by the endpoint, nil if it gave none. Clients are
+// rejected when the endpoint cannot be reached or does not answer with a 2xx
+// status.
+func (p *Proxy) authorizeClient(conn net.Conn, ip netip.Addr, challenge []byte, response string) (*ClientPolicy, error) {
+	cfg := p.cfg()
+	req := authRequest{
+		Peer:      conn.RemoteAddr().String(),
+		IP:        ip.String(),
+		Listener:  conn.LocalAddr().String(),
+		Challenge: hex.EncodeToString(challenge),
+		Response:  response,
+	}
+	if policy := p.clientPolicy(ip); policy != nil {
+		req.Name = policy.Name
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, cfg.AuthTimeout)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.AuthURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("User-Agent", "pppoeproxy/"+Version())
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		authCalls.With("error").Inc()
+		return nil, fmt.Errorf("authorization request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		authCalls.With("denied").Inc()
+		return nil, fmt.Errorf("denied by authorization endpoint (%s)", resp.Status)
+	}
+	var res authResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 65536)).Decode(&res); err != nil {
+		authCalls.With("error").Inc()
+		return nil, fmt.Errorf("invalid authorization response: %v", err)
+	}
+	if !res.Allow {
+		authCalls.With("denied").Inc()
+		return nil, fmt.Errorf("denied by authorization endpoint")
+	}
+	authCalls.With("allowed").Inc()
+
+	if res.Name == "" {
+		return nil, nil
+	}
+	if res.MaxSessions < 0 || res.Rate < 0 || res.SessionRate < 0 || res.SessionBurst < 0 {
+		return nil, fmt.Errorf("invalid limits in authorization response")
+	}
+	macs, err := parseMACList(strings.Join(res.HostMACs, ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization response: %v", err)
+	}
+	for _, id := range res.VLANs {
+		if id == 0 || id >= 0xfff {
+			return nil, fmt.Errorf("invalid authorization response: invalid VLAN ID %d", id)
+		}
+	}
+	return &ClientPolicy{
+		Name:         res.Name,
+		Prefixes:     []netip.Prefix{netip.PrefixFrom(ip, ip.BitLen())},
+		MaxSessions:  res.MaxSessions,
+		Rate:         res.Rate,
+		SessionRate:  res.SessionRate,
+		SessionBurst: res.SessionBurst,
+		Labels:       res.Labels,
+		HostMACs:     macs,
+		VLANs:        res.VLANs,
+	}, nil
+}
@@ -0,0 +1,46 @@
+package pppoeproxy
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Reconnection metrics
+var (
+	reconnectAttempts = NewCounter("pppoeproxy_reconnect_attempts_total", "Reconnection attempts to the server")
+	reconnectFailures = NewCounter("pppoeproxy_reconnect_failures_total", "Failed reconnection attempts to the server")
+	reconnectDelay    = NewGauge("pppoeproxy_reconnect_delay_seconds", "Delay before the next reconnection attempt")
+)
+
+// Backoff computes exponentially increasing delays with random jitter
+type Backoff struct {
+	Min     time.Duration // Delay before the first retry
+	Max     time.Duration // Ceiling for the delay
+	Factor  float64       // Multiplier applied after each failed attempt
+	Jitter  float64       // Fraction of the delay randomly added or removed (0-1)
+	attempt int
+}
+
+// Next returns the delay before the next attempt and advances the backoff
+func (b *Backoff) Next() time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(b.attempt))
+	if max := float64(b.Max); b.Max > 0 && d > max {
+		d = max
+	} else {
+		b.attempt++
+	}
+
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+	return time.Duration(d)
+}
+
+// Reset restarts the backoff from the minimum delay
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
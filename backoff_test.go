@@ -0,0 +1,27 @@
+package pppoeproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 10 * time.Second, Factor: 2}
+	for i, want := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if got := b.Next(); got != want*time.Second {
+			t.Fatalf("delay %d is %v, want %v", i, got, want*time.Second)
+		}
+	}
+	b.Reset()
+	if got := b.Next(); got != time.Second {
+		t.Fatalf("delay after a reset is %v", got)
+	}
+
+	// Jitter spreads the delays around the exponential ones
+	b = Backoff{Min: time.Second, Max: 4 * time.Second, Factor: 2, Jitter: 0.5}
+	for i, base := 0, time.Second; i < 100; i, base = i+1, min(2*base, 4*time.Second) {
+		if d := b.Next(); d < base/2 || d > base*3/2 {
+			t.Fatalf("delay %d is %v, want %v±50%%", i, d, base)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// socketControl returns the function run on tunnel sockets before they
+// connect or listen, binding them to the configured tunnel interface so the
+// tunnel traffic never leaves through another interface, and setting their
+// firewall mark (nil without either)
+func (p *Proxy) socketControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	iface := p.cfg().TunnelInterface
+	if iface == "" && mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				err = bindToDevice(fd, network, iface)
+			}
+			if err == nil && mark != 0 {
+				err = setMark(fd, mark)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// dialer returns the dialer used to connect to the server, from the
+// configured source address if any and with the configured firewall mark. Host names it resolves itself (SRV
+// targets) get the same fallback delay between address families as dialServer.
+func (p *Proxy) dialer() *net.Dialer {
+	d := &net.Dialer{Control: p.socketControl(p.cfg().TunnelMark), FallbackDelay: connectionAttemptDelay}
+	if p.localAddr != nil {
+		d.LocalAddr = p.localAddr
+	}
+	return d
+}
+
+// ParseBindAddress parses a source address for the connection to the server:
+// an IP address ("192.168.1.2", "2001:db8::2"), an address and port
+// ("192.168.1.2:9000", "[2001:db8::2]:9000") or only a port (":9000")
+func ParseBindAddress(s string) (*net.TCPAddr, error) {
+	if ip, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)), nil
+	}
+	if port, ok := strings.CutPrefix(s, ":"); ok {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind address %q: bad port", s)
+		}
+		return &net.TCPAddr{Port: int(n)}, nil
+	}
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address %q: %v", s, err)
+	}
+	return net.TCPAddrFromAddrPort(ap), nil
+}
+
+// listen opens a tunnel listener
+func (p *Proxy) listen(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: p.socketControl(0)}
+	return lc.Listen(p.ctx, "tcp", addr)
+}
@@ -0,0 +1,27 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice restricts a socket to an interface with IP_BOUND_IF, or
+// IPV6_BOUND_IF for IPv6 sockets
+func bindToDevice(fd uintptr, network, iface string) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(network, "6") {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, ifi.Index)
+	} else {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, ifi.Index)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to bind socket to %s: %v", iface, err)
+	}
+	return nil
+}
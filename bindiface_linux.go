@@ -0,0 +1,15 @@
+package pppoeproxy
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDevice restricts a socket to an interface with SO_BINDTODEVICE
+func bindToDevice(fd uintptr, network, iface string) error {
+	if err := unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface); err != nil {
+		return fmt.Errorf("failed to bind socket to %s: %v", iface, err)
+	}
+	return nil
+}
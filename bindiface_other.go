@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package pppoeproxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// bindToDevice reports that sockets cannot be bound to an interface
+func bindToDevice(fd uintptr, network, iface string) error {
+	return fmt.Errorf("binding sockets to an interface is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,76 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Bond metrics
+var bondFailovers = NewCounter("pppoeproxy_bond_failovers_total", "Changes of the slave of the bond or team interface carrying the PPPoE traffic")
+
+// bondIngress holds, by bond or team interface name, the index of the slave
+// the last PPPoE frame was received on, as reported with PACKET_ORIGDEV
+var bondIngress sync.Map
+
+// bondIngressOf returns the ingress slave of a bond or team interface
+func bondIngressOf(name string) *atomic.Int32 {
+	v, _ := bondIngress.LoadOrStore(name, new(atomic.Int32))
+	return v.(*atomic.Int32)
+}
+
+// BondWarning explains why capturing on the interface misses PPPoE frames
+// because it is a slave of a bond or team interface, or returns an empty
+// string
+func BondWarning(name string) string {
+	if IsInterfacePattern(name) {
+		return ""
+	}
+	if master := aggregateOf(name); master != "" {
+		return fmt.Sprintf("%s is a slave of %s: frames are only captured and injected on %s while it carries the traffic of %s, and not after a failover to another slave. Use -interface %s",
+			name, master, name, master, master)
+	}
+	return ""
+}
+
+// ActiveSlave returns the slave of a bond or team interface currently
+// carrying the PPPoE traffic: the active slave of an active-backup bond, or
+// the slave the last PPPoE frame was received on. It returns an empty string
+// if the interface is not a bond or team, or nothing was received yet.
+func ActiveSlave(name string) string {
+	if !isAggregate(name) {
+		return ""
+	}
+	if active := bondActiveSlave(name); active != "" {
+		return active
+	}
+	if index := bondIngressOf(name).Load(); index != 0 {
+		if ifi, err := net.InterfaceByIndex(int(index)); err == nil {
+			return ifi.Name
+		}
+	}
+	return ""
+}
+
+// bondMonitor reports the failovers of a bond or team interface
+type bondMonitor struct {
+	name   string
+	active string
+}
+
+// check logs and counts a change of the active slave
+func (m *bondMonitor) check() {
+	active := ActiveSlave(m.name)
+	if active == "" || active == m.active {
+		return
+	}
+	if m.active != "" {
+		bondFailovers.Inc()
+		log.Printf("PPPoE traffic of %s moved from slave %s to %s", m.name, m.active, active)
+	} else {
+		log.Printf("PPPoE traffic of %s carried by slave %s", m.name, active)
+	}
+	m.active = active
+}
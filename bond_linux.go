@@ -0,0 +1,57 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// interfaceDevType returns the device type of an interface, such as "bond",
+// "team" or "bridge", or an empty string for physical interfaces
+func interfaceDevType(name string) string {
+	f, err := os.Open(filepath.Join(sysClassNet, name, "uevent"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "DEVTYPE="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// isAggregate reports whether the interface is a bond or a team
+func isAggregate(name string) bool {
+	switch interfaceDevType(name) {
+	case "bond", "team":
+		return true
+	}
+	return false
+}
+
+// aggregateOf returns the bond or team the interface is a slave of, or an
+// empty string
+func aggregateOf(name string) string {
+	master, err := os.Readlink(filepath.Join(sysClassNet, name, "master"))
+	if err != nil {
+		return ""
+	}
+	if master = filepath.Base(master); isAggregate(master) {
+		return master
+	}
+	return ""
+}
+
+// bondActiveSlave returns the active slave of a bond in a mode having one,
+// such as active-backup, or an empty string
+func bondActiveSlave(name string) string {
+	data, err := os.ReadFile(filepath.Join(sysClassNet, name, "bonding", "active_slave"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
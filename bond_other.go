@@ -0,0 +1,18 @@
+//go:build !linux
+
+package pppoeproxy
+
+// isAggregate reports that bonds are not detected on this system
+func isAggregate(name string) bool {
+	return false
+}
+
+// aggregateOf reports that bonds are not detected on this system
+func aggregateOf(name string) string {
+	return ""
+}
+
+// bondActiveSlave reports that bonds are not detected on this system
+func bondActiveSlave(name string) string {
+	return ""
+}
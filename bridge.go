@@ -0,0 +1,46 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IsBridge reports whether the interface is a bridge (Linux only)
+func IsBridge(name string) bool {
+	return isBridge(name)
+}
+
+// BridgeWarning explains which PPPoE frames are missed when capturing on the
+// interface because it is a bridge or a bridge port, or returns an empty
+// string. ports tells whether the ports of a bridge are captured instead, see
+// OpenBridgePorts.
+func BridgeWarning(name string, ports bool) string {
+	if IsInterfacePattern(name) {
+		return ""
+	}
+	if isBridge(name) {
+		if ports || interfacePromisc(name) {
+			return ""
+		}
+		return fmt.Sprintf("%s is a bridge: frames bridged between its ports (%s) and addressed to other hosts, such as the PADO, PADS and session frames of PPPoE clients behind another port, are not captured. Capture on its ports with -bridge-ports, or make the bridge promiscuous",
+			name, strings.Join(bridgePorts(name), ", "))
+	}
+	if bridge := bridgeOf(name); bridge != "" {
+		return fmt.Sprintf("%s is a port of bridge %s: only the frames received on its link are captured, and injected frames go out of that link only, without reaching the other ports of the bridge or the host. Use -interface %s (with -bridge-ports) unless all the PPPoE hosts are behind %s",
+			name, bridge, bridge, name)
+	}
+	return ""
+}
+
+// OpenBridgePorts opens a raw socket on the ports of a bridge, so frames
+// entering the bridge are captured whichever port they are forwarded to. Ports
+// added to the bridge later are captured too. Like with an interface pattern,
+// frames are sent on the port their destination was seen on, or on all the
+// ports, and do not reach the host itself through the bridge.
+func OpenBridgePorts(bridge string, ethertype uint16) (RawSocket, error) {
+	if !isBridge(bridge) {
+		return nil, fmt.Errorf("%s is not a bridge", bridge)
+	}
+	match := func(name string) bool { return bridgeOf(name) == bridge }
+	return openMemberSocket("ports of "+bridge, match, ethertype), nil
+}
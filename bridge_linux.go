@@ -0,0 +1,54 @@
+package pppoeproxy
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysClassNet is where Linux describes the network interfaces
+const sysClassNet = "/sys/class/net"
+
+// isBridge reports whether the interface is a bridge
+func isBridge(name string) bool {
+	_, err := os.Stat(filepath.Join(sysClassNet, name, "bridge"))
+	return err == nil
+}
+
+// bridgeOf returns the bridge the interface is a port of, or an empty string
+func bridgeOf(name string) string {
+	if _, err := os.Stat(filepath.Join(sysClassNet, name, "brport")); err != nil {
+		return ""
+	}
+	master, err := os.Readlink(filepath.Join(sysClassNet, name, "master"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(master)
+}
+
+// bridgePorts returns the ports of a bridge
+func bridgePorts(bridge string) []string {
+	entries, err := os.ReadDir(filepath.Join(sysClassNet, bridge, "brif"))
+	if err != nil {
+		return nil
+	}
+	ports := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ports = append(ports, e.Name())
+	}
+	return ports
+}
+
+// interfacePromisc reports whether the interface is in promiscuous mode
+func interfacePromisc(name string) bool {
+	data, err := os.ReadFile(filepath.Join(sysClassNet, name, "flags"))
+	if err != nil {
+		return false
+	}
+	flags, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"), 16, 32)
+	return err == nil && flags&unix.IFF_PROMISC != 0
+}
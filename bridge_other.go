@@ -0,0 +1,23 @@
+//go:build !linux
+
+package pppoeproxy
+
+// isBridge reports that bridges are not detected on this system
+func isBridge(name string) bool {
+	return false
+}
+
+// bridgeOf reports that bridges are not detected on this system
+func bridgeOf(name string) string {
+	return ""
+}
+
+// bridgePorts reports that bridges are not detected on this system
+func bridgePorts(bridge string) []string {
+	return nil
+}
+
+// interfacePromisc reports that the interface flags are not read on this system
+func interfacePromisc(name string) bool {
+	return false
+}
@@ -0,0 +1,95 @@
+package pppoeproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a certificate loaded from files and reloads it when
+// they change, so certificates renewed by external tooling are used by new
+// handshakes without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified [2]time.Time // Modification times of the loaded files
+}
+
+// newCertReloader loads the certificate and key
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(r.modTimes()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modTimes returns the modification times of the certificate and key files,
+// zero for a file that cannot be read
+func (r *certReloader) modTimes() [2]time.Time {
+	var times [2]time.Time
+	for i, name := range []string{r.certFile, r.keyFile} {
+		if st, err := os.Stat(name); err == nil {
+			times[i] = st.ModTime()
+		}
+	}
+	return times
+}
+
+// load reads the certificate and key, recording the modification times they
+// were loaded at. Must be called with mu held, except before use.
+func (r *certReloader) load(modified [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modified = modified
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. When the files changed
+// since they were loaded, they are loaded again. A pair that fails to load,
+// such as while it is being replaced, keeps the previous certificate in use
+// and is retried on the next handshake.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	modified := r.modTimes()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if modified != r.modified {
+		if err := r.load(modified); err != nil {
+			log.Printf("Failed to reload certificate %s, keeping the previous one: %v", r.certFile, err)
+		} else {
+			log.Printf("Reloaded certificate %s%s", r.certFile, certExpiry(r.cert))
+		}
+	}
+	return r.cert, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certExpiry describes when a certificate expires, for log messages
+func certExpiry(cert *tls.Certificate) string {
+	if cert.Leaf == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (valid until %s)", cert.Leaf.NotAfter.Format(time.RFC3339))
+}
@@ -0,0 +1,144 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Faults injected by the chaos mode
+const (
+	ChaosDrop       = "drop"
+	ChaosReorder    = "reorder"
+	ChaosDisconnect = "disconnect"
+)
+
+// chaosFaults counts the faults injected by the chaos mode
+var chaosFaults = NewCounterVec("pppoeproxy_chaos_faults_total", "Faults injected in the tunnel by the chaos testing mode", "fault")
+
+// Chaos degrades the tunnel on purpose, to check how the PPP endpoints and
+// the recovery logic of the proxy cope with a bad network. Faults apply to the
+// frames this instance sends into the tunnel, so both ends must enable them
+// to degrade both directions. Not meant for production.
+type Chaos struct {
+	Delay      time.Duration // Added to the time each frame spends in the send queue
+	Jitter     time.Duration // Random variation of Delay, up to this much either way
+	Drop       float64       // Probability a frame is dropped (0-1)
+	Reorder    float64       // Probability a frame is held back and sent after the next one (0-1)
+	Disconnect time.Duration // Mean time between random tunnel disconnects (0 disables)
+}
+
+// ParseChaos parses a comma separated list of faults, e.g.
+// "delay=50ms,jitter=10ms,drop=1%,reorder=0.5%,disconnect=10m". Probabilities
+// are fractions or percentages.
+func ParseChaos(spec string) (*Chaos, error) {
+	c := &Chaos{}
+	for _, entry := range splitList(spec) {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid chaos setting %q, expected key=value", entry)
+		}
+		var err error
+		switch key {
+		case "delay":
+			c.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			c.Jitter, err = time.ParseDuration(value)
+		case "disconnect":
+			c.Disconnect, err = time.ParseDuration(value)
+		case "drop":
+			c.Drop, err = parseProbability(value)
+		case "reorder":
+			c.Reorder, err = parseProbability(value)
+		default:
+			return nil, fmt.Errorf("unknown chaos setting %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos %s %q: %v", key, value, err)
+		}
+	}
+	if c.Delay < 0 || c.Jitter < 0 || c.Disconnect < 0 {
+		return nil, fmt.Errorf("chaos durations cannot be negative")
+	}
+	return c, nil
+}
+
+// parseProbability parses a fraction between 0 and 1, or a percentage
+func parseProbability(s string) (float64, error) {
+	pct := strings.HasSuffix(s, "%")
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if pct {
+		v /= 100
+	}
+	if v < 0 || v > 1 {
+		return 0, fmt.Errorf("not between 0 and 100%%")
+	}
+	return v, nil
+}
+
+// String returns the faults in the format of ParseChaos
+func (c *Chaos) String() string {
+	return fmt.Sprintf("delay=%s,jitter=%s,drop=%g%%,reorder=%g%%,disconnect=%s", c.Delay, c.Jitter, c.Drop*100, c.Reorder*100, c.Disconnect)
+}
+
+// chaosHold is the frame the chaos mode held back on a send queue
+type chaosHold struct {
+	frame   txFrame
+	holding bool
+}
+
+// chaosFrames applies the chaos faults to a frame popped from the send queue
+// of peer, and appends the frames to send now to out: none when it is
+// dropped or held back, the frame and the one held back before it
+// otherwise. It returns false if the queue was closed while the frame was
+// delayed.
+func (p *Proxy) chaosFrames(c *Chaos, peer *Client, f txFrame, hold *chaosHold, out []txFrame) ([]txFrame, bool) {
+	if delay := emulatedDelay(c.Delay, c.Jitter); delay > 0 && !waitUntil(f.queued.Add(delay), peer.tx.closed) {
+		return out, false
+	}
+	if c.Drop > 0 && rand.Float64() < c.Drop {
+		chaosFaults.With(ChaosDrop).Inc()
+		return out, true
+	}
+	// Only hold a frame back when another one follows
+	if control, data := peer.tx.len(); !hold.holding && control+data > 0 && c.Reorder > 0 && rand.Float64() < c.Reorder {
+		chaosFaults.With(ChaosReorder).Inc()
+		hold.frame, hold.holding = f, true
+		return out, true
+	}
+	out = append(out, f)
+	if hold.holding {
+		out = append(out, hold.frame)
+		hold.frame, hold.holding = txFrame{}, false
+	}
+	return out, true
+}
+
+// chaosDisconnects closes a random tunnel connection at random times, every
+// Disconnect on average, until the proxy is closed
+func (p *Proxy) chaosDisconnects(c *Chaos) {
+	for {
+		timer := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(c.Disconnect)))
+		select {
+		case <-p.closedCh:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		peers := p.peers()
+		if len(peers) == 0 {
+			continue
+		}
+		peer := peers[rand.IntN(len(peers))]
+		log.Printf("Chaos: disconnecting tunnel peer %s", peer.remoteAddr)
+		chaosFaults.With(ChaosDisconnect).Inc()
+		// Without a goodbye, like a broken connection
+		peer.Close()
+	}
+}
@@ -0,0 +1,297 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Client policy metrics
+var (
+	clientInfo    = NewGaugeVec("pppoeproxy_tunnel_client_info", "Name and labels of each connected tunnel client with a policy", "peer", "name", "labels")
+	clientLimited = NewCounterVec("pppoeproxy_client_frames_limited_total", "Frames from tunnel clients dropped by their policy", "name", "reason")
+)
+
+// ClientPolicy gives the tunnel clients connecting from a set of addresses a
+// name and the limits applied to them (server mode)
+type ClientPolicy struct {
+	Name         string
+	Prefixes     []netip.Prefix
+	MaxSessions  int               // PPPoE sessions the client may negotiate (0 for no limit)
+	Rate         float64           // Frames per second the client may send (0 for no limit)
+	SessionRate  float64           // Bits per second injected for each of its PPPoE sessions (0 for Config.SessionRate)
+	SessionBurst int               // Bytes injected at once beyond SessionRate (0 for a tenth of a second at the rate)
+	Labels       map[string]string // Shown in logs and metrics
+
+	// Host MAC addresses the client may send frames from, so a site cannot
+	// impersonate the CPE of another one (empty for any)
+	HostMACs []net.HardwareAddr
+
+	// VLAN IDs of the outermost tag of the frames the client may send and
+	// is sent, untagged frames being neither (empty for any)
+	VLANs []uint16
+}
+
+// clientPolicyState is the policy applied to a connected client
+type clientPolicyState struct {
+	*ClientPolicy
+	labels  string       // Labels formatted as sorted "key=value" pairs
+	limiter *TokenBucket // nil without rate limit
+}
+
+// LoadClientPolicies reads client policies from a file made of one client per
+// line: its name, the addresses and CIDR prefixes it connects from (comma
+// separated, as for the allow list), then optional "key=value" settings.
+// "max-sessions" and "rate" set the limits, "session-rate" (bits per second,
+// with an optional k, M or G suffix) and "session-burst" (bytes) the shaping
+// of its sessions, "mac" the comma separated host MAC addresses the client
+// may send frames from, "vlan" the comma separated VLAN IDs of the frames it
+// sends and gets, other keys are labels. Empty lines and lines starting with
+// # are ignored.
+func LoadClientPolicies(path string) ([]ClientPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open client policies: %v", err)
+	}
+	defer f.Close()
+	policies, err := ParseClientPolicies(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return policies, nil
+}
+
+// ParseClientPolicies parses client policies in the format of LoadClientPolicies
+func ParseClientPolicies(r io.Reader) ([]ClientPolicy, error) {
+	var policies []ClientPolicy
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a name and addresses", line)
+		}
+		prefixes, err := ParseAllowList(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		policy := ClientPolicy{Name: fields[0], Prefixes: prefixes}
+		for _, setting := range fields[2:] {
+			key, value, ok := strings.Cut(setting, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value, got %q", line, setting)
+			}
+			switch key {
+			case "max-sessions":
+				policy.MaxSessions, err = strconv.Atoi(value)
+			case "rate":
+				policy.Rate, err = strconv.ParseFloat(value, 64)
+			case "session-rate":
+				policy.SessionRate, err = ParseBitRate(value)
+			case "session-burst":
+				policy.SessionBurst, err = strconv.Atoi(value)
+			case "mac":
+				policy.HostMACs, err = parseMACList(value)
+			case "vlan":
+				policy.VLANs, err = parseVLANList(value)
+			default:
+				if policy.Labels == nil {
+					policy.Labels = make(map[string]string)
+				}
+				policy.Labels[key] = value
+			}
+			if err != nil || policy.MaxSessions < 0 || policy.Rate < 0 || policy.SessionBurst < 0 {
+				return nil, fmt.Errorf("line %d: invalid %s %q", line, key, value)
+			}
+		}
+		policies = append(policies, policy)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// parseMACList parses a comma separated list of MAC addresses
+func parseMACList(s string) ([]net.HardwareAddr, error) {
+	var list []net.HardwareAddr
+	for _, entry := range splitList(s) {
+		mac, err := net.ParseMAC(entry)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid MAC address %q", entry)
+		}
+		list = append(list, mac)
+	}
+	return list, nil
+}
+
+// parseVLANList parses a comma separated list of VLAN IDs
+func parseVLANList(s string) ([]uint16, error) {
+	var list []uint16
+	for _, entry := range splitList(s) {
+		id, err := strconv.ParseUint(entry, 10, 12)
+		if err != nil || id == 0 || id == 0xfff {
+			return nil, fmt.Errorf("invalid VLAN ID %q", entry)
+		}
+		list = append(list, uint16(id))
+	}
+	return list, nil
+}
+
+// allowsVLAN reports whether the VLAN of a frame is one of the policy
+func (policy *ClientPolicy) allowsVLAN(frame []byte) bool {
+	if len(policy.VLANs) == 0 {
+		return true
+	}
+	id, tagged := outerVLAN(frame)
+	return tagged && slices.Contains(policy.VLANs, id)
+}
+
+// containsMAC reports whether mac is in list
+func containsMAC(list []net.HardwareAddr, mac []byte) bool {
+	return slices.ContainsFunc(list, func(m net.HardwareAddr) bool { return bytes.Equal(m, mac) })
+}
+
+// formatLabels returns labels as sorted, comma separated "key=value" pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// clientPolicy returns the first policy matching a client IP, or nil
+func (p *Proxy) clientPolicy(ip netip.Addr) *ClientPolicy {
+	policies := p.cfg().ClientPolicies
+	for i := range policies {
+		if allowed(policies[i].Prefixes, ip) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// applyClientPolicy looks up the policy of a client, unless the authorization
+// endpoint gave one, and attaches it. The rate
+// limiter is kept when the rate did not change, so reloading the policies does
+// not give clients a fresh burst.
+func (p *Proxy) applyClientPolicy(client *Client) {
+	policy := client.authPolicy
+	if policy == nil {
+		ip, _ := remoteIP(client.conn.RemoteAddr())
+		policy = p.clientPolicy(ip)
+	}
+	old := client.policy.Load()
+
+	var st *clientPolicyState
+	if policy != nil {
+		st = &clientPolicyState{ClientPolicy: policy, labels: formatLabels(policy.Labels)}
+		if policy.Rate > 0 {
+			if old != nil && old.Rate == policy.Rate {
+				st.limiter = old.limiter
+			} else {
+				st.limiter = NewTokenBucket(policy.Rate, policy.Rate)
+			}
+		}
+	}
+	client.policy.Store(st)
+
+	if old != nil {
+		clientInfo.Delete(client.remoteAddr, old.Name, old.labels)
+	}
+	if st != nil {
+		clientInfo.With(client.remoteAddr, st.Name, st.labels).Set(1)
+	}
+}
+
+// forgetClientPolicy removes the metric of a disconnected client
+func forgetClientPolicy(client *Client) {
+	if st := client.policy.Load(); st != nil {
+		clientInfo.Delete(client.remoteAddr, st.Name, st.labels)
+	}
+}
+
+// Name returns the name given to the client by its policy, or an empty string
+func (c *Client) Name() string {
+	if st := c.policy.Load(); st != nil {
+		return st.Name
+	}
+	return ""
+}
+
+// label returns the address of the client followed by its name and labels,
+// for log messages
+func (c *Client) label() string {
+	st := c.policy.Load()
+	switch {
+	case st == nil:
+		return c.remoteAddr
+	case st.labels == "":
+		return c.remoteAddr + " (" + st.Name + ")"
+	default:
+		return c.remoteAddr + " (" + st.Name + " " + st.labels + ")"
+	}
+}
+
+// sendsFrame reports whether a frame captured on the interface is sent to a
+// client: frames on other VLANs than the ones of its policy are not
+func (c *Client) sendsFrame(frame []byte) bool {
+	st := c.policy.Load()
+	return st == nil || st.allowsVLAN(frame)
+}
+
+// allowedByPolicy reports whether the policy of a client lets a frame it sent
+// through: frames from other host MACs than its own, on other VLANs or beyond
+// its rate are dropped, and so are PADRs once it negotiated as many sessions
+// as it may
+func (p *Proxy) allowedByPolicy(client *Client, packetType uint16, frame []byte) bool {
+	st := client.policy.Load()
+	if st == nil {
+		return true
+	}
+	if len(st.HostMACs) > 0 && len(frame) >= 12 && !containsMAC(st.HostMACs, frame[6:12]) {
+		clientLimited.With(st.Name, "host-mac").Inc()
+		if packetType == PacketTypeDiscovery {
+			log.Printf("Dropping discovery frame from %s: host MAC %s is not bound to it", client.label(), net.HardwareAddr(frame[6:12]))
+		}
+		return false
+	}
+	if !st.allowsVLAN(frame) {
+		clientLimited.With(st.Name, "vlan").Inc()
+		if packetType == PacketTypeDiscovery {
+			id, tagged := outerVLAN(frame)
+			if tagged {
+				log.Printf("Dropping discovery frame from %s: VLAN %d is not bound to it", client.label(), id)
+			} else {
+				log.Printf("Dropping discovery frame from %s: untagged", client.label())
+			}
+		}
+		return false
+	}
+	if st.limiter != nil && !st.limiter.Allow() {
+		clientLimited.With(st.Name, "rate").Inc()
+		return false
+	}
+	if off := pppoeOffset(frame); st.MaxSessions > 0 && packetType == PacketTypeDiscovery && len(frame) > off+1 && frame[off+1] == PADR {
+		if n := p.sessions.countOwner(client.remoteAddr); n >= st.MaxSessions {
+			clientLimited.With(st.Name, "max-sessions").Inc()
+			log.Printf("Dropping PADR from %s: %d session(s), the limit is %d", client.label(), n, st.MaxSessions)
+			p.refuseDiscovery(client, frame, RefuseMaxSessions, fmt.Sprintf("pppoeproxy: limit of %d session(s) reached", st.MaxSessions))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package pppoeproxy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestClientPolicyVLANs(t *testing.T) {
+	policies, err := ParseClientPolicies(strings.NewReader("tokyo 192.0.2.10 vlan=10,20 site=tokyo\nother 192.0.2.11\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 || !slices.Equal(policies[0].VLANs, []uint16{10, 20}) || policies[0].Labels["site"] != "tokyo" {
+		t.Fatalf("parsed %+v", policies)
+	}
+
+	frame := func(tags ...uint16) []byte {
+		f := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+		for _, id := range tags {
+			f = append(f, 0x81, 0x00, byte(id>>8)|0xe0, byte(id)) // With priority bits
+		}
+		return append(f, 0x88, 0x63, 0x11, PADI, 0x00, 0x00, 0x00, 0x00)
+	}
+	tests := []struct {
+		frame []byte
+		want  bool
+	}{
+		{frame(10), true},
+		{frame(20, 30), true},
+		{frame(30, 10), false},
+		{frame(11), false},
+		{frame(), false},
+	}
+	for _, tt := range tests {
+		if got := policies[0].allowsVLAN(tt.frame); got != tt.want {
+			t.Errorf("allowsVLAN(%x) = %v, want %v", tt.frame, got, tt.want)
+		}
+		if !policies[1].allowsVLAN(tt.frame) {
+			t.Errorf("a policy without VLANs refuses %x", tt.frame)
+		}
+	}
+
+	for _, line := range []string{"a 192.0.2.1 vlan=0", "a 192.0.2.1 vlan=4095", "a 192.0.2.1 vlan=x", "a 192.0.2.1 vlan=10,5000"} {
+		if _, err := ParseClientPolicies(strings.NewReader(line)); err == nil {
+			t.Errorf("%q parsed", line)
+		}
+	}
+}
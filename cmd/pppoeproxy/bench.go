@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// Bench settings
+const (
+	benchMagic      = 0x70707062      // Marks the generated frames, "pppb"
+	benchMinSize    = 14 + 6 + 2 + 20 // Ethernet, PPPoE and PPP headers, and an IPv4 header
+	benchMaxSamples = 1 << 20         // Latencies kept for the percentiles
+	benchDrainTime  = 500 * time.Millisecond
+	benchTrialTime  = time.Second // Length of the trials searching the sustainable rate
+	benchStartRate  = 1000
+	benchMaxRate    = 10000000
+)
+
+// benchResult holds the measurements of a bench run
+type benchResult struct {
+	rate           int // Frames per second offered
+	sent, received uint64
+	elapsed        time.Duration // From the first frame sent to the last received
+	latencies      []time.Duration
+	seen           uint64 // Latencies seen, the kept ones being a uniform sample
+}
+
+// addLatency records a latency, keeping a uniform sample of benchMaxSamples
+func (r *benchResult) addLatency(d time.Duration) {
+	r.seen++
+	if len(r.latencies) < benchMaxSamples {
+		r.latencies = append(r.latencies, d)
+	} else if i := rand.Uint64N(r.seen); i < benchMaxSamples {
+		r.latencies[i] = d
+	}
+}
+
+// loss returns the fraction of the frames sent that were not received
+func (r *benchResult) loss() float64 {
+	if r.sent == 0 {
+		return 0
+	}
+	return float64(r.sent-min(r.received, r.sent)) / float64(r.sent)
+}
+
+// benchFrame builds a generated session frame of the given size from src to
+// dst. The payload starts with benchMagic, the trial number and the send time.
+func benchFrame(dst, src net.HardwareAddr, size int, trial uint32) []byte {
+	frame := selftestFrame(dst, src, pppoeproxy.PPPoESession, 0, selftestSession, make([]byte, size-20))
+	binary.BigEndian.PutUint16(frame[20:22], pppoeproxy.PPPProtoIP)
+	binary.BigEndian.PutUint32(frame[22:26], benchMagic)
+	binary.BigEndian.PutUint32(frame[26:30], trial)
+	return frame
+}
+
+// parseBenchFrame returns the trial number and send time of a generated frame
+func parseBenchFrame(frame []byte) (uint32, time.Time, bool) {
+	if len(frame) < benchMinSize || binary.BigEndian.Uint16(frame[12:14]) != pppoeproxy.PPPoESession ||
+		binary.BigEndian.Uint32(frame[22:26]) != benchMagic {
+		return 0, time.Time{}, false
+	}
+	return binary.BigEndian.Uint32(frame[26:30]), time.Unix(0, int64(binary.BigEndian.Uint64(frame[30:38]))), true
+}
+
+// benchTrial sends frames built by benchFrame from one endpoint to the other
+// at rate frames per second (as fast as possible if 0) for duration, and
+// measures those received
+func benchTrial(from, to *selftestEndpoint, frame []byte, trial uint32, rate int, duration time.Duration) (*benchResult, error) {
+	res := &benchResult{rate: rate}
+	binary.BigEndian.PutUint32(frame[26:30], trial)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var first, last time.Time
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case f := <-to.frames:
+				n, sent, ok := parseBenchFrame(f)
+				if !ok || n != trial {
+					// Other traffic, or late frames of a previous trial
+					continue
+				}
+				last = time.Now()
+				res.received++
+				res.addLatency(last.Sub(sent))
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+	first = time.Now()
+	end := first.Add(duration)
+	var err error
+	for now := first; now.Before(end); now = time.Now() {
+		if interval > 0 {
+			if d := first.Add(time.Duration(res.sent) * interval).Sub(now); d > 0 {
+				time.Sleep(d)
+				continue
+			}
+		}
+		binary.BigEndian.PutUint64(frame[30:38], uint64(now.UnixNano()))
+		if err = from.send(frame); err != nil {
+			break
+		}
+		res.sent++
+	}
+
+	// Let the frames in flight arrive
+	time.Sleep(benchDrainTime)
+	close(stop)
+	<-done
+	res.elapsed = last.Sub(first)
+	return res, err
+}
+
+// benchSearch returns the highest rate at which the frames go through with a
+// loss of at most maxLoss, doubling the rate of short trials until frames are
+// lost, then bisecting
+func benchSearch(from, to *selftestEndpoint, frame []byte, trial *uint32, maxLoss float64) (int, error) {
+	good, bad := 0, 0
+	for rate := benchStartRate; rate <= benchMaxRate; rate *= 2 {
+		*trial++
+		res, err := benchTrial(from, to, frame, *trial, rate, benchTrialTime)
+		if err != nil {
+			return 0, err
+		}
+		fmt.Printf("  %9d frames/s: %.2f%% lost\n", rate, 100*res.loss())
+		if res.loss() > maxLoss {
+			bad = rate
+			break
+		}
+		good = rate
+	}
+	for bad > 0 && bad-good > max(good/20, 1) {
+		rate := (good + bad) / 2
+		*trial++
+		res, err := benchTrial(from, to, frame, *trial, rate, benchTrialTime)
+		if err != nil {
+			return 0, err
+		}
+		fmt.Printf("  %9d frames/s: %.2f%% lost\n", rate, 100*res.loss())
+		if res.loss() > maxLoss {
+			bad = rate
+		} else {
+			good = rate
+		}
+	}
+	return good, nil
+}
+
+// runBench implements "pppoeproxy bench": it runs a server and a client proxy
+// in-process like "selftest", establishes a session between a synthetic host
+// and AC, sends generated session frames through the proxies and reports the
+// forwarding rate and the latency added. It returns the process exit code.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	veth := fs.Bool("veth", false, "Run over two veth pairs created for the bench instead of in-memory segments (Linux, needs root)")
+	hostIfaces := fs.String("host-interfaces", "", "Connected interfaces of the host side, as <host end>,<proxy end>, instead of an in-memory segment")
+	acIfaces := fs.String("ac-interfaces", "", "Connected interfaces of the AC side, as <AC end>,<proxy end>, instead of an in-memory segment")
+	size := fs.Int("size", 1514, "Size of the generated frames, including the Ethernet header")
+	duration := fs.Duration("duration", 10*time.Second, "Time frames are sent for")
+	rate := fs.Int("rate", 0, "Frames sent per second (0 to search the highest rate losing at most -max-loss)")
+	maxLoss := fs.Float64("max-loss", 0.1, "Percentage of frames that can be lost at a sustainable rate")
+	upstream := fs.Bool("upstream", true, "Send the frames from the host to the AC, or from the AC to the host with -upstream=false")
+	verbose := fs.Bool("v", false, "Show the log of the proxies")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *veth && (*hostIfaces != "" || *acIfaces != "") || *size < benchMinSize || *size > 9000 || *duration <= 0 || *rate < 0 || *maxLoss < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	hostSeg, acSeg, remove, err := selftestSegments("bench", *veth, *hostIfaces, *acIfaces)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer remove()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, client, err := startSelftestProxies(ctx, hostSeg, acSeg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer client.Close()
+	defer server.Close()
+	for start := time.Now(); len(server.Peers()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*time.Second {
+			fmt.Fprintf(os.Stderr, "The client did not connect to the server\n")
+			return 1
+		}
+	}
+
+	host, err := newSelftestEndpoint(hostSeg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the host sockets: %v\n", err)
+		return 1
+	}
+	defer host.Close()
+	ac, err := newSelftestEndpoint(acSeg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the AC sockets: %v\n", err)
+		return 1
+	}
+	defer ac.Close()
+
+	// Establish the session the frames belong to
+	for _, step := range selftestSteps()[:4] {
+		from, to := ac, host
+		if step.fromHost {
+			from, to = host, ac
+		}
+		if err := from.send(step.frame); err != nil || !to.expect(step.frame, 2*time.Second) {
+			fmt.Fprintf(os.Stderr, "Failed to establish the session: %s did not go through\n", step.name)
+			return 1
+		}
+	}
+
+	from, to := host, ac
+	dst, src := selftestACMAC, selftestHostMAC
+	direction := "host to AC"
+	if !*upstream {
+		from, to = ac, host
+		dst, src = selftestHostMAC, selftestACMAC
+		direction = "AC to host"
+	}
+	frame := benchFrame(dst, src, *size, 0)
+	var trial uint32
+	if *rate == 0 {
+		fmt.Printf("Searching the sustainable rate of %d byte frames from the %s\n", *size, direction)
+		r, err := benchSearch(from, to, frame, &trial, *maxLoss/100)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send: %v\n", err)
+			return 1
+		}
+		if r == 0 {
+			fmt.Printf("Frames are lost even at %d frames/s\n", benchStartRate)
+			return 1
+		}
+		*rate = r
+	}
+
+	fmt.Printf("Sending %d byte frames from the %s at %d frames/s for %s\n", *size, direction, *rate, *duration)
+	res, err := benchTrial(from, to, frame, trial+1, *rate, *duration)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send: %v\n", err)
+		return 1
+	}
+	printBenchResult(res, *size)
+	return 0
+}
+
+// printBenchResult prints the summary report of a bench run
+func printBenchResult(res *benchResult, size int) {
+	fmt.Printf("Frames sent:      %d (%d frames/s offered)\n", res.sent, res.rate)
+	fmt.Printf("Frames received:  %d (%.2f%% lost)\n", res.received, 100*res.loss())
+	if res.received == 0 || res.elapsed <= 0 {
+		return
+	}
+	pps := float64(res.received) / res.elapsed.Seconds()
+	fmt.Printf("Forwarding rate:  %.0f frames/s, %.1f Mbit/s\n", pps, pps*float64(size)*8/1e6)
+
+	slices.Sort(res.latencies)
+	percentile := func(p float64) time.Duration {
+		return res.latencies[int(p*float64(len(res.latencies)-1))]
+	}
+	var sum time.Duration
+	for _, d := range res.latencies {
+		sum += d
+	}
+	fmt.Printf("Latency:          min %s, avg %s, p50 %s, p99 %s, max %s\n",
+		res.latencies[0], sum/time.Duration(len(res.latencies)), percentile(0.5), percentile(0.99), res.latencies[len(res.latencies)-1])
+}
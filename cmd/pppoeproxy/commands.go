@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/KarpelesLab/goupd"
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// command is a subcommand of pppoeproxy
+type command struct {
+	run   func(args []string) int
+	usage string
+}
+
+// commands lists the available subcommands
+var commands = map[string]command{
+	"run":          {run, "Run the proxy (default when no command is given)"},
+	"status":       {ctlShortcut("status"), "Show the status of a running instance"},
+	"sessions":     {ctlShortcut("sessions"), "List the sessions of a running instance"},
+	"ctl":          {runCtl, "Send a command to a running instance"},
+	"replay":       {runReplay, "Replay a recording made with -record"},
+	"selftest":     {runSelftest, "Check that PPPoE frames go through a server and a client run in-process"},
+	"bench":        {runBench, "Measure the forwarding rate and latency of a server and a client run in-process"},
+	"lab":          {runLab, "Run a scenario through a server and a client in network namespaces wired with veth pairs (Linux, needs root)"},
+	"check-config": {checkConfig, "Validate the command line and configuration file"},
+	"version":      {printVersion, "Print version information"},
+}
+
+// hiddenFlags are left out of the usage, being meant for testing only
+var hiddenFlags = map[string]bool{"chaos": true}
+
+func main() {
+	flag.Usage = usage
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+
+	// Without a command, the arguments are the flags of "run"
+	os.Exit(run(os.Args[1:]))
+}
+
+// usage prints the list of commands and the flags of "run"
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-14s %s\n", name, commands[name].usage)
+	}
+
+	fmt.Fprintf(out, "\nFlags of run:\n")
+	visible := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	visible.SetOutput(out)
+	flag.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// ctlShortcut returns a command sending the given control command to a
+// running instance
+func ctlShortcut(name string) func(args []string) int {
+	return func(args []string) int {
+		return runCtl(append(args, name))
+	}
+}
+
+// checkConfig implements "check-config": it loads the command line flags and
+// configuration file like "run" and reports any problem without starting
+func checkConfig(args []string) int {
+	if err := parseFlags(args); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	if err := validateFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	if _, err := buildConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	if _, err := pppoeproxy.FindInterfaces(*interfaceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: interface %s: %v\n", *interfaceName, err)
+	}
+	if w := pppoeproxy.BridgeWarning(*interfaceName, *bridgePorts); w != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+	if w := pppoeproxy.BondWarning(*interfaceName); w != "" {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+
+	fmt.Println("Configuration OK")
+	return 0
+}
+
+// printVersion implements "version"
+func printVersion(args []string) int {
+	fmt.Printf("%s %s (commit %s, built %s, channel %s, %s %s/%s)\n", goupd.PROJECT_NAME, pppoeproxy.Version(), goupd.GIT_TAG, goupd.DATE_TAG, goupd.CHANNEL, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
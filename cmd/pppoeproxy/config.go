@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// reloadableFlags lists the settings that can be changed on SIGHUP without a restart
+var reloadableFlags = map[string]bool{
+	"allow":                  true,
+	"clients":                true,
+	"auth-url":               true,
+	"auth-timeout":           true,
+	"auth-token":             true,
+	"rtt-warn":               true,
+	"session-idle-timeout":   true,
+	"keepalive":              true,
+	"keepalive-misses":       true,
+	"client-ping":            true,
+	"client-timeout":         true,
+	"write-timeout":          true,
+	"write-stalls":           true,
+	"tcp-keepalive":          true,
+	"tcp-keepalive-idle":     true,
+	"tcp-keepalive-interval": true,
+	"tcp-keepalive-count":    true,
+	"dscp":                   true,
+	"reconnect-min":          true,
+	"reconnect-max":          true,
+	"reconnect-factor":       true,
+	"reconnect-jitter":       true,
+	"reconnect-rotate":       true,
+	"allow-sessions":         true,
+	"deny-sessions":          true,
+	"allow-ppp":              true,
+	"deny-ppp":               true,
+	"tag-rules":              true,
+	"ac-cookies":             true,
+	"discovery-errors":       true,
+	"session-rate":           true,
+	"session-burst":          true,
+	"tunnel-rate-out":        true,
+	"tunnel-rate-in":         true,
+	"tunnel-burst":           true,
+	"tunnel-queue-drop":      true,
+	"session-queue-drop":     true,
+	"hook":                   true,
+	"hook-timeout":           true,
+	"log-file":               true,
+	"log-max-size":           true,
+	"log-rotate":             true,
+	"log-keep":               true,
+	"debug-hexdump":          true,
+	"debug-code":             true,
+	"debug-session":          true,
+	"debug-mac":              true,
+	"debug-filter":           true,
+	"debug-rate":             true,
+}
+
+// cmdlineFlags holds the flags explicitly set on the command line, which take
+// precedence over the configuration file
+var cmdlineFlags = make(map[string]bool)
+
+// settingsMu serializes the changes of settings at runtime (SIGHUP, control
+// socket, admin and gRPC APIs), which go through the global flag values
+var settingsMu sync.Mutex
+
+// logWriter is the current log file, if logging to a file
+var logWriter *RotatingFile
+
+// loadConfigFile reads a configuration file made of "name = value" lines,
+// where name is the name of a command line flag. Empty lines and lines
+// starting with # are ignored.
+func loadConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, lineNo)
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid quoted value: %v", path, lineNo, err)
+			}
+		}
+
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown setting %q", path, lineNo, name)
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	return values, nil
+}
+
+// envPrefix is the prefix of the environment variables setting options
+const envPrefix = "PPPOEPROXY_"
+
+// envName returns the environment variable for a flag, e.g. PPPOEPROXY_RTT_WARN
+// for -rtt-warn
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadSettings applies the environment variables and the configuration file
+// (if any) to the flags that were not set on the command line, in that order
+// of precedence. Flags set by neither are reset to their default so removing
+// a line from the file reverts the setting.
+func loadSettings() error {
+	if !cmdlineFlags["config"] {
+		if v, ok := os.LookupEnv(envName("config")); ok {
+			*configPath = v
+		}
+	}
+
+	var values map[string]string
+	if *configPath != "" {
+		var err error
+		if values, err = loadConfigFile(*configPath); err != nil {
+			return err
+		}
+	}
+
+	var setErr error
+	flag.VisitAll(func(f *flag.Flag) {
+		if setErr != nil || cmdlineFlags[f.Name] || f.Name == "config" {
+			return
+		}
+		source := "the configuration file"
+		value, ok := os.LookupEnv(envName(f.Name))
+		if ok {
+			source = envName(f.Name)
+		} else if value, ok = values[f.Name]; !ok {
+			value = f.DefValue
+		}
+		if err := f.Value.Set(value); err != nil {
+			setErr = fmt.Errorf("invalid value %q for %s (from %s): %v", value, f.Name, source, err)
+		}
+	})
+	return setErr
+}
+
+// snapshotFlags returns the current value of every flag
+func snapshotFlags() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// restoreFlags sets flags back to the values of a snapshot
+func restoreFlags(values map[string]string) {
+	for name, value := range values {
+		flag.Set(name, value)
+	}
+}
+
+// buildConfig creates the proxy configuration from the current flags
+func buildConfig() (pppoeproxy.Config, error) {
+	config := pppoeproxy.Config{
+		Interface:   *interfaceName,
+		IsServer:    *mode == "server",
+		Address:     *address,
+		AllowedIP:   *allowedIP,
+		Advertise:   *advertise,
+		StateFile:   *stateFile,
+		IPMapFile:   *ipMapFile,
+		JournalFile: *journal,
+		RTTWarn:     *rttWarn,
+
+		SessionIdleTimeout: *sessionIdle,
+
+		AuthURL:     *authURL,
+		AuthTimeout: *authTimeout,
+		AuthToken:   *authToken,
+
+		TunnelInterface: *tunnelIface,
+		TunnelMark:      uint32(*tunnelMark),
+		BindAddress:     *bindAddr,
+
+		KeepaliveInterval: *keepalive,
+		KeepaliveMisses:   *keepaliveMisses,
+		WriteTimeout:      *writeTimeout,
+		WriteStalls:       *writeStalls,
+
+		ClientPingInterval: *clientPing,
+		ClientTimeout:      *clientTimeout,
+
+		TCPKeepaliveIdle:     *tcpKeepIdle,
+		TCPKeepaliveInterval: *tcpKeepInterval,
+		TCPKeepaliveCount:    *tcpKeepCount,
+
+		ReconnectMin:    *reconnectMin,
+		ReconnectMax:    *reconnectMax,
+		ReconnectFactor: *reconnectFactor,
+		ReconnectJitter: *reconnectJitter,
+		ReconnectRotate: *reconnectRotate,
+
+		ReconnectQueue:     *reconnectQueue,
+		ReconnectQueueData: *reconnectQData,
+
+		SessionBurst:  *sessionBurst,
+		TunnelBurst:   *tunnelBurst,
+		TunnelCredits: *tunnelCredits,
+
+		SequenceFrames:  *sequence,
+		TimestampFrames: *timestamps,
+
+		TunnelDelayOut:  *tunnelDelayOut,
+		TunnelJitterOut: *tunnelJitterOut,
+		TunnelDelayIn:   *tunnelDelayIn,
+		TunnelJitterIn:  *tunnelJitterIn,
+
+		PADOTimeout:     *padoTimeout,
+		StrictParsing:   *strict,
+		ACCookies:       *acCookies,
+		DiscoveryErrors: *discoveryErrs,
+
+		Hook:        *hook,
+		HookTimeout: *hookTimeout,
+	}
+
+	if _, err := pppoeproxy.ParseAllowList(config.AllowedIP); err != nil {
+		return config, err
+	}
+	var err error
+	if config.AuthURL, err = resolveSecret(config.AuthURL); err != nil {
+		return config, fmt.Errorf("invalid -auth-url: %v", err)
+	}
+	if config.AuthToken, err = resolveSecret(config.AuthToken); err != nil {
+		return config, fmt.Errorf("invalid -auth-token: %v", err)
+	}
+	if strings.ContainsAny(config.AuthToken, "\r\n") {
+		return config, fmt.Errorf("invalid -auth-token: it cannot span several lines")
+	}
+	if *clientsFile != "" {
+		if config.ClientPolicies, err = pppoeproxy.LoadClientPolicies(*clientsFile); err != nil {
+			return config, err
+		}
+	}
+
+	if config.Hook != "" && *seccomp {
+		// Hook commands would inherit the filter and fail
+		return config, fmt.Errorf("hooks cannot be used with -seccomp")
+	}
+
+	if config.KeepaliveInterval < 0 || config.KeepaliveMisses < 0 || config.WriteTimeout < 0 || config.WriteStalls < 0 || config.ClientPingInterval < 0 || config.ClientTimeout < 0 {
+		return config, fmt.Errorf("invalid keepalive or write timeout settings")
+	}
+	if config.TCPKeepaliveIdle <= 0 || config.TCPKeepaliveInterval <= 0 || config.TCPKeepaliveCount <= 0 {
+		return config, fmt.Errorf("invalid TCP keepalive settings")
+	}
+	if !*tcpKeepalive {
+		config.TCPKeepaliveIdle = -1
+	}
+	if config.ReconnectQueue < 0 || config.ReconnectQueueData < 0 {
+		return config, fmt.Errorf("invalid reconnect queue settings")
+	}
+	if config.TunnelDelayOut < 0 || config.TunnelJitterOut < 0 || config.TunnelDelayIn < 0 || config.TunnelJitterIn < 0 {
+		return config, fmt.Errorf("invalid tunnel delay settings")
+	}
+	if config.PADOTimeout < 0 {
+		return config, fmt.Errorf("invalid -pado-timeout")
+	}
+	if *chaos != "" {
+		if config.Chaos, err = pppoeproxy.ParseChaos(*chaos); err != nil {
+			return config, err
+		}
+	}
+	if config.SessionRate, err = pppoeproxy.ParseBitRate(*sessionRate); err != nil || config.SessionBurst < 0 {
+		return config, fmt.Errorf("invalid session shaping settings")
+	}
+	if config.TunnelRateOut, err = pppoeproxy.ParseBitRate(*tunnelRateOut); err != nil || config.TunnelBurst < 0 {
+		return config, fmt.Errorf("invalid tunnel rate settings")
+	}
+	if config.TunnelRateIn, err = pppoeproxy.ParseBitRate(*tunnelRateIn); err != nil {
+		return config, fmt.Errorf("invalid tunnel rate settings")
+	}
+	if *tunnelMark > math.MaxUint32 {
+		return config, fmt.Errorf("invalid -tunnel-mark: %d does not fit 32 bits", *tunnelMark)
+	}
+	if config.DSCP, err = pppoeproxy.ParseDSCP(*dscp); err != nil {
+		return config, err
+	}
+	if config.TunnelQueueDrop, err = pppoeproxy.ParseDropPolicy(*tunnelQDrop); err != nil {
+		return config, fmt.Errorf("invalid -tunnel-queue-drop: %v", err)
+	}
+	if config.SessionQueueDrop, err = pppoeproxy.ParseDropPolicy(*sessionQDrop); err != nil {
+		return config, fmt.Errorf("invalid -session-queue-drop: %v", err)
+	}
+	if config.ReconnectMin <= 0 || config.ReconnectFactor < 1 || config.ReconnectJitter < 0 || config.ReconnectJitter > 1 {
+		return config, fmt.Errorf("invalid reconnect backoff settings")
+	}
+
+	if *allowSessions != "" || *denySessions != "" {
+		if config.SessionFilter, err = pppoeproxy.ParseSessionFilter(*allowSessions, *denySessions); err != nil {
+			return config, fmt.Errorf("invalid session filter: %v", err)
+		}
+	}
+
+	if *allowPPP != "" || *denyPPP != "" {
+		if config.PPPFilter, err = pppoeproxy.ParsePPPFilter(*allowPPP, *denyPPP); err != nil {
+			return config, fmt.Errorf("invalid PPP protocol filter: %v", err)
+		}
+	}
+
+	if *tagRules != "" {
+		if config.TagRules, err = pppoeproxy.ParseTagRules(*tagRules); err != nil {
+			return config, fmt.Errorf("invalid -tag-rules: %v", err)
+		}
+	}
+
+	if *dumpFilter != "" {
+		if config.LogFilter, err = pppoeproxy.ParseFrameFilter(*dumpFilter); err != nil {
+			return config, err
+		}
+	}
+
+	if *debugDump {
+		filter, err := pppoeproxy.ParseDumpFilter(*dumpCodes, *dumpSessions, *dumpMACs)
+		if err != nil {
+			return config, fmt.Errorf("invalid hexdump filter: %v", err)
+		}
+		filter.Expr = config.LogFilter
+		config.Dumper = pppoeproxy.NewDumper(filter, *dumpRate)
+	}
+
+	return config, nil
+}
+
+// setupLogging directs log output to the configured log file or stderr
+func setupLogging() error {
+	old := logWriter
+
+	if *logFile == "" {
+		log.SetOutput(os.Stderr)
+		logWriter = nil
+	} else {
+		f, err := NewRotatingFile(*logFile, *logMaxSize*1024*1024, *logRotate, *logKeep)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+		logWriter = f
+	}
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// handleReloadSignal reloads the configuration whenever SIGHUP is received
+func handleReloadSignal(proxy *pppoeproxy.Proxy) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	go func() {
+		for range c {
+			reloadConfig(proxy)
+		}
+	}()
+}
+
+// reloadConfig re-reads the configuration file and applies the settings that
+// can be changed at runtime, logging every change
+func reloadConfig(proxy *pppoeproxy.Proxy) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	log.Printf("Reloading configuration")
+
+	before := snapshotFlags()
+	if err := loadSettings(); err != nil {
+		log.Printf("Config reload failed, keeping current settings: %v", err)
+		restoreFlags(before)
+		return
+	}
+
+	after := snapshotFlags()
+	names := make([]string, 0, len(after))
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	loggingChanged := false
+	changes := 0
+	for _, name := range names {
+		value := after[name]
+		if value == before[name] {
+			continue
+		}
+		if !reloadableFlags[name] {
+			log.Printf("Config reload: %s but requires a restart, ignored", describeChange(name, before[name], value))
+			flag.Set(name, before[name])
+			continue
+		}
+		log.Printf("Config reload: %s", describeChange(name, before[name], value))
+		changes++
+		if strings.HasPrefix(name, "log-") {
+			loggingChanged = true
+		}
+	}
+
+	config, err := buildConfig()
+	if err != nil {
+		log.Printf("Config reload failed, keeping current settings: %v", err)
+		restoreFlags(before)
+		return
+	}
+
+	applyLogging(loggingChanged)
+	proxy.UpdateConfig(config)
+	log.Printf("Configuration reloaded, %d setting(s) changed", changes)
+}
+
+// applyLogging reconfigures logging after its settings changed, or reopens
+// the log file otherwise so external rotation tools can be used too
+func applyLogging(changed bool) {
+	if changed {
+		if err := setupLogging(); err != nil {
+			log.Printf("Config reload: failed to reconfigure logging: %v", err)
+		}
+	} else if logWriter != nil {
+		if err := logWriter.Reopen(); err != nil {
+			log.Printf("Config reload: failed to reopen log file: %v", err)
+		}
+	}
+}
+
+// updateSettings changes settings of a running proxy, given by flag name.
+// Only runtime-tunable settings are accepted and nothing is changed if any
+// value is invalid. It returns the names of the settings that changed. A
+// later reload of the configuration file overrides these changes.
+func updateSettings(proxy *pppoeproxy.Proxy, values map[string]string) ([]string, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		if !reloadableFlags[name] {
+			return nil, fmt.Errorf("setting %q cannot be changed at runtime", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	before := snapshotFlags()
+	for _, name := range names {
+		if err := flag.Set(name, values[name]); err != nil {
+			restoreFlags(before)
+			return nil, fmt.Errorf("invalid value %q for %s: %v", values[name], name, err)
+		}
+	}
+
+	config, err := buildConfig()
+	if err != nil {
+		restoreFlags(before)
+		return nil, err
+	}
+
+	var changed []string
+	loggingChanged := false
+	for _, name := range names {
+		value := flag.Lookup(name).Value.String()
+		if value == before[name] {
+			continue
+		}
+		log.Printf("Setting %s", describeChange(name, before[name], value))
+		changed = append(changed, name)
+		if strings.HasPrefix(name, "log-") {
+			loggingChanged = true
+		}
+	}
+
+	if loggingChanged {
+		applyLogging(true)
+	}
+	proxy.UpdateConfig(config)
+	return changed, nil
+}
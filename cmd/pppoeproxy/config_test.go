@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// testProxy returns a client proxy on a fake segment, whose server cannot be
+// reached
+func testProxy(t *testing.T) *pppoeproxy.Proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	seg := pppoeproxy.NewFakeSegment()
+	discoverySock, _ := seg.Open("test", pppoeproxy.PPPoEDiscovery)
+	sessionSock, _ := seg.Open("test", pppoeproxy.PPPoESession)
+	proxy, err := pppoeproxy.NewProxy(ctx, pppoeproxy.Config{Interface: "test", Address: addr},
+		pppoeproxy.NewDiscoveryHandlerWithSocket(ctx, discoverySock, false),
+		pppoeproxy.NewSessionHandlerWithSocket(ctx, sessionSock, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	return proxy
+}
+
+func TestSettingsConcurrentUpdates(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	proxy := testProxy(t)
+	defer flag.Set("rtt-warn", flag.Lookup("rtt-warn").DefValue)
+
+	// Reloads revert -rtt-warn to its default while updates change it, the
+	// proxy always ends up with the value of the flag
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				reloadConfig(proxy)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := updateSettings(proxy, map[string]string{"rtt-warn": "1s"}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := proxy.Config().RTTWarn; got != *rttWarn {
+		t.Fatalf("proxy has -rtt-warn %v, the flag is %v", got, *rttWarn)
+	}
+	if *rttWarn != time.Second && *rttWarn != 500*time.Millisecond {
+		t.Fatalf("-rtt-warn is %v", *rttWarn)
+	}
+}
+
+func TestDescribeChange(t *testing.T) {
+	if got, want := describeChange("rtt-warn", "500ms", "1s"), `rtt-warn changed from "500ms" to "1s"`; got != want {
+		t.Errorf("describeChange = %q, want %q", got, want)
+	}
+	for name := range secretFlags {
+		if got := describeChange(name, "old-secret", "new-secret"); got != name+" changed" {
+			t.Errorf("describeChange(%q) = %q", name, got)
+		}
+		if flag.Lookup(name) == nil {
+			t.Errorf("secret setting %q is not a flag", name)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// runCtl implements "pppoeproxy ctl": it sends a command to a running
+// instance through its control socket and prints the reply. It returns the
+// process exit code.
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := fs.String("socket", pppoeproxy.DefaultControlSocket, "Control socket of the running instance")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s ctl [-socket path] <command> [arguments]\n", os.Args[0])
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "Commands: status, sessions, clients, stats, kick <peer>, terminate <session ID> [AC MAC [host MAC]], reload, update, restart\n")
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	reply, err := pppoeproxy.SendControlCommand(*socket, strings.Join(fs.Args(), " "))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if msg, ok := strings.CutPrefix(reply, "error: "); ok {
+		fmt.Fprint(os.Stderr, msg)
+		return 1
+	}
+	fmt.Print(reply)
+	return 0
+}
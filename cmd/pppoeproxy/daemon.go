@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// daemonEnv marks the re-executed child process when running with -daemon
+const daemonEnv = "PPPOEPROXY_DAEMONIZED"
+
+// daemonize re-executes the current program detached from the terminal in a
+// new session and exits the parent. Go cannot safely fork, so the child is a
+// fresh copy of the process started with the same arguments. stdout/stderr of
+// the child go to the log file if one is configured, or /dev/null otherwise.
+// It returns immediately in the child.
+func daemonize() error {
+	if os.Getenv(daemonEnv) == "1" {
+		os.Unsetenv(daemonEnv)
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %v", err)
+	}
+
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	out := devNull
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = devNull
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start daemon: %v", err)
+	}
+
+	fmt.Printf("pppoeproxy started in background, pid %d\n", cmd.Process.Pid)
+	os.Exit(0)
+	return nil
+}
+
+// writePidFile writes the current PID to path, refusing to overwrite the
+// pidfile of another running instance
+func writePidFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processExists(pid) {
+			return fmt.Errorf("already running with pid %d (%s)", pid, path)
+		}
+	}
+
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the pidfile if it still contains our PID
+func removePidFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(path)
+	}
+}
+
+// processExists checks whether a process with the given PID is alive
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
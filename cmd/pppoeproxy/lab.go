@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Network namespaces of the lab proxies, and the interfaces wiring them: the
+// synthetic host and AC use the first end of their pair in the initial
+// namespace, the proxies the second one in theirs, and the tunnel runs over
+// a third pair between the two namespaces
+const (
+	labClientNS   = "pppl-client"
+	labServerNS   = "pppl-server"
+	labHost       = "pppl-host"
+	labHostProxy  = "pppl-hostp"
+	labAC         = "pppl-ac"
+	labACProxy    = "pppl-acp"
+	labWANClient  = "pppl-wanc"
+	labWANServer  = "pppl-wans"
+	labClientIP   = "10.254.254.1"
+	labServerIP   = "10.254.254.2"
+	labTunnelPort = "8000"
+	labRetransmit = 500 * time.Millisecond // Interval "forward" sends a frame again at, like a PPPoE client would
+)
+
+// labDefaultScenario establishes a session, checks it survives a restart of
+// the client proxy, then terminates it
+const labDefaultScenario = `# Establish a session
+forward padi
+forward pado
+forward padr
+forward pads
+forward lcp-request
+forward lcp-ack
+forward ip-up
+forward ip-down
+# The tunnel comes back after the client proxy restarts
+restart client
+forward ip-up 10s
+forward ip-down
+# Terminate the session
+forward padt
+`
+
+// labFrame is a synthetic frame scenarios refer to by name
+type labFrame struct {
+	fromHost bool
+	frame    []byte
+}
+
+// labFrames returns the frames scenarios can send, those of the self-test and
+// IPv4 data frames in both directions
+func labFrames() map[string]labFrame {
+	steps := selftestSteps()
+	frames := make(map[string]labFrame)
+	for i, name := range []string{"padi", "pado", "padr", "pads", "lcp-request", "lcp-ack", "padt"} {
+		frames[name] = labFrame{steps[i].fromHost, steps[i].frame}
+	}
+	frames["ip-up"] = labFrame{true, benchFrame(selftestACMAC, selftestHostMAC, 100, 0)}
+	frames["ip-down"] = labFrame{false, benchFrame(selftestHostMAC, selftestACMAC, 100, 0)}
+	return frames
+}
+
+// labStep is a line of a scenario
+type labStep struct {
+	line    int
+	text    string
+	command string // forward, send, expect, restart or sleep
+	frame   labFrame
+	proxy   string // client or server, for restart
+	timeout time.Duration
+}
+
+// parseLabScenario parses a scenario, one command per line:
+//
+//	forward <frame> [timeout]  send a frame from its endpoint until the other one receives it
+//	send <frame>               send a frame once from its endpoint
+//	expect <frame> [timeout]   wait for a frame at its destination
+//	restart client|server      stop and start a proxy again
+//	sleep <duration>
+//
+// Frames are padi, pado, padr, pads, lcp-request, lcp-ack, ip-up (host to
+// AC), ip-down (AC to host) and padt. Empty lines and lines starting with #
+// are ignored.
+func parseLabScenario(r io.Reader, timeout time.Duration) ([]labStep, error) {
+	frames := labFrames()
+	var steps []labStep
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(text)
+		if len(fields) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		step := labStep{line: line, text: text, command: fields[0], timeout: timeout}
+		args := fields[1:]
+		var err error
+		switch step.command {
+		case "forward", "expect", "send":
+			maxArgs := 2
+			if step.command == "send" {
+				maxArgs = 1
+			}
+			if len(args) < 1 || len(args) > maxArgs {
+				err = fmt.Errorf("usage: %s <frame>", step.command)
+				break
+			}
+			f, ok := frames[args[0]]
+			if !ok {
+				err = fmt.Errorf("unknown frame %q", args[0])
+				break
+			}
+			step.frame = f
+			if len(args) == 2 {
+				step.timeout, err = time.ParseDuration(args[1])
+			}
+		case "restart":
+			if len(args) != 1 || args[0] != "client" && args[0] != "server" {
+				err = errors.New("usage: restart client|server")
+				break
+			}
+			step.proxy = args[0]
+		case "sleep":
+			if len(args) != 1 {
+				err = errors.New("usage: sleep <duration>")
+				break
+			}
+			step.timeout, err = time.ParseDuration(args[0])
+		default:
+			err = fmt.Errorf("unknown command %q", step.command)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		steps = append(steps, step)
+	}
+	return steps, scanner.Err()
+}
+
+// labProxy is a proxy instance run in a network namespace of the lab
+type labProxy struct {
+	ns   string
+	args []string
+	out  io.Writer
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// start runs the proxy
+func (lp *labProxy) start() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("ip", append([]string{"netns", "exec", lp.ns, exe, "run"}, lp.args...)...)
+	cmd.Stdout, cmd.Stderr = lp.out, lp.out
+	// Settings of the environment would apply to both proxies
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, envPrefix) {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	lp.cmd, lp.done = cmd, make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(lp.done)
+	}()
+	return nil
+}
+
+// stop terminates the proxy, killing it if it does not exit in time
+func (lp *labProxy) stop() {
+	if lp.cmd == nil {
+		return
+	}
+	lp.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-lp.done:
+	case <-time.After(10 * time.Second):
+		lp.cmd.Process.Kill()
+		<-lp.done
+	}
+	lp.cmd = nil
+}
+
+// labOutput collects the output of the proxies, shown live with -v or on
+// failure otherwise
+type labOutput struct {
+	mu   sync.Mutex
+	w    io.Writer
+	buf  bytes.Buffer
+	live bool
+}
+
+// proxy returns a writer prefixing each line written by a proxy with its name
+func (o *labOutput) proxy(name string) io.Writer {
+	pr, pw := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			o.mu.Lock()
+			line := fmt.Sprintf("[%s] %s\n", name, scanner.Text())
+			if o.live {
+				io.WriteString(o.w, line)
+			} else {
+				o.buf.WriteString(line)
+			}
+			o.mu.Unlock()
+		}
+	}()
+	return pw
+}
+
+// flush writes the collected output
+func (o *labOutput) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.w.Write(o.buf.Bytes())
+	o.buf.Reset()
+}
+
+// createLab creates the namespaces and interfaces of the lab and returns a
+// function deleting them
+func createLab() (func(), error) {
+	remove := func() {
+		for _, ns := range []string{labClientNS, labServerNS} {
+			exec.Command("ip", "netns", "del", ns).Run()
+		}
+		for _, name := range []string{labHost, labAC, labWANClient} {
+			exec.Command("ip", "link", "del", name).Run()
+		}
+	}
+	// Left over by a previous run with -keep
+	remove()
+
+	cmds := [][]string{
+		{"netns", "add", labClientNS},
+		{"netns", "add", labServerNS},
+		{"link", "add", labHost, "type", "veth", "peer", "name", labHostProxy},
+		{"link", "add", labAC, "type", "veth", "peer", "name", labACProxy},
+		{"link", "add", labWANClient, "type", "veth", "peer", "name", labWANServer},
+		{"link", "set", labHostProxy, "netns", labClientNS},
+		{"link", "set", labWANClient, "netns", labClientNS},
+		{"link", "set", labACProxy, "netns", labServerNS},
+		{"link", "set", labWANServer, "netns", labServerNS},
+		{"link", "set", labHost, "up", "promisc", "on"},
+		{"link", "set", labAC, "up", "promisc", "on"},
+		{"-n", labClientNS, "link", "set", "lo", "up"},
+		{"-n", labClientNS, "link", "set", labHostProxy, "up", "promisc", "on"},
+		{"-n", labClientNS, "addr", "add", labClientIP + "/30", "dev", labWANClient},
+		{"-n", labClientNS, "link", "set", labWANClient, "up"},
+		{"-n", labServerNS, "link", "set", "lo", "up"},
+		{"-n", labServerNS, "link", "set", labACProxy, "up", "promisc", "on"},
+		{"-n", labServerNS, "addr", "add", labServerIP + "/30", "dev", labWANServer},
+		{"-n", labServerNS, "link", "set", labWANServer, "up"},
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			remove()
+			return nil, fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return remove, nil
+}
+
+// runLab implements "pppoeproxy lab": it creates network namespaces and veth
+// pairs, runs a server and a client proxy in them as separate processes, a
+// synthetic host and AC on each side, and plays a scenario. It returns the
+// process exit code.
+func runLab(args []string) int {
+	fs := flag.NewFlagSet("lab", flag.ExitOnError)
+	scenarioFile := fs.String("scenario", "", "Scenario to play (default: establish a session, restart the client proxy and terminate the session)")
+	timeout := fs.Duration("timeout", 5*time.Second, "Default time frames have to go through")
+	clientFlags := fs.String("client-flags", "", "Additional flags of the client proxy, e.g. \"-strict -sequence\"")
+	serverFlags := fs.String("server-flags", "", "Additional flags of the server proxy")
+	keep := fs.Bool("keep", false, "Keep the namespaces and interfaces after the scenario, for inspection")
+	verbose := fs.Bool("v", false, "Show the log of the proxies as they run")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s lab [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *timeout <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var scenario io.Reader = strings.NewReader(labDefaultScenario)
+	if *scenarioFile != "" {
+		f, err := os.Open(*scenarioFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer f.Close()
+		scenario = f
+	}
+	steps, err := parseLabScenario(scenario, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid scenario: %v\n", err)
+		return 2
+	}
+
+	remove, err := createLab()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create the lab: %v\n", err)
+		return 1
+	}
+	if *keep {
+		fmt.Printf("Keeping namespaces %s and %s, delete them with \"ip netns del\"\n", labClientNS, labServerNS)
+	} else {
+		defer remove()
+	}
+
+	out := &labOutput{w: os.Stderr, live: *verbose}
+	proxies := map[string]*labProxy{
+		"server": {ns: labServerNS, out: out.proxy("server"), args: append([]string{
+			"-mode", "server", "-interface", labACProxy, "-address", labServerIP + ":" + labTunnelPort,
+			"-allow", labClientIP, "-auto-update=false",
+		}, strings.Fields(*serverFlags)...)},
+		"client": {ns: labClientNS, out: out.proxy("client"), args: append([]string{
+			"-mode", "client", "-interface", labHostProxy, "-address", labServerIP + ":" + labTunnelPort,
+			"-reconnect-min", "100ms", "-reconnect-max", "1s", "-auto-update=false",
+		}, strings.Fields(*clientFlags)...)},
+	}
+	for _, name := range []string{"server", "client"} {
+		if err := proxies[name].start(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start the %s proxy: %v\n", name, err)
+			return 1
+		}
+		defer proxies[name].stop()
+	}
+
+	host, err := newSelftestEndpoint(ifaceSelftestSegment(labHost, labHostProxy))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the host sockets: %v\n", err)
+		return 1
+	}
+	defer host.Close()
+	ac, err := newSelftestEndpoint(ifaceSelftestSegment(labAC, labACProxy))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the AC sockets: %v\n", err)
+		return 1
+	}
+	defer ac.Close()
+
+	start := time.Now()
+	for _, step := range steps {
+		from, to := ac, host
+		if step.frame.fromHost {
+			from, to = host, ac
+		}
+		began := time.Now()
+		var err error
+		switch step.command {
+		case "forward":
+			err = labForward(from, to, step.frame.frame, step.timeout)
+		case "send":
+			err = from.send(step.frame.frame)
+		case "expect":
+			if !to.expect(step.frame.frame, step.timeout) {
+				err = fmt.Errorf("not received within %s", step.timeout)
+			}
+		case "restart":
+			proxies[step.proxy].stop()
+			err = proxies[step.proxy].start()
+		case "sleep":
+			time.Sleep(step.timeout)
+		}
+		if err != nil {
+			fmt.Printf("FAIL  %-36s %v\n", step.text, err)
+			if !*verbose {
+				out.flush()
+			}
+			fmt.Printf("Scenario failed at line %d\n", step.line)
+			return 1
+		}
+		fmt.Printf("PASS  %-36s %s\n", step.text, time.Since(began).Round(time.Microsecond))
+	}
+	fmt.Printf("Scenario passed: %d steps in %s\n", len(steps), time.Since(start).Round(time.Millisecond))
+	return 0
+}
+
+// labForward sends a frame from one endpoint, again every labRetransmit,
+// until the other endpoint receives it
+func labForward(from, to *selftestEndpoint, frame []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := from.send(frame); err != nil {
+			return err
+		}
+		wait := min(labRetransmit, time.Until(deadline))
+		if to.expect(frame, wait) {
+			return nil
+		}
+		if time.Until(deadline) <= 0 {
+			return fmt.Errorf("not received within %s", timeout)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateTimeFormat is the suffix appended to rotated log files
+const rotateTimeFormat = "20060102-150405.000"
+
+// RotatingFile is an io.Writer that writes to a file and rotates it once it
+// exceeds a maximum size or age, keeping a bounded number of old files
+type RotatingFile struct {
+	path     string
+	maxSize  int64         // Rotate when the file grows beyond this size (0 disables)
+	interval time.Duration // Rotate when the file is older than this (0 disables)
+	keep     int           // Number of rotated files to keep (0 keeps all)
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotatingFile opens (or creates) the log file at path
+func NewRotatingFile(path string, maxSize int64, interval time.Duration, keep int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		interval: interval,
+		keep:     keep,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current log file for appending
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+
+	f.file = file
+	f.size = st.Size()
+	f.opened = st.ModTime()
+	if f.size == 0 {
+		f.opened = time.Now()
+	}
+	return nil
+}
+
+// Write writes p to the log file, rotating it first if needed
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing messages
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// shouldRotate reports whether writing n more bytes requires a rotation
+func (f *RotatingFile) shouldRotate(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+n > f.maxSize {
+		return true
+	}
+	if f.interval > 0 && time.Since(f.opened) >= f.interval {
+		return true
+	}
+	return false
+}
+
+// rotate renames the current file and opens a new one
+func (f *RotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+
+	rotated := f.path + "." + time.Now().Format(rotateTimeFormat)
+	if err := os.Rename(f.path, rotated); err != nil && !os.IsNotExist(err) {
+		// Reopen the original file so logging can continue
+		if oerr := f.open(); oerr != nil {
+			return oerr
+		}
+		return fmt.Errorf("failed to rename log file: %v", err)
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.cleanup()
+	return nil
+}
+
+// cleanup removes rotated files beyond the retention count
+func (f *RotatingFile) cleanup() {
+	if f.keep <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+
+	// Only consider files carrying our timestamp suffix
+	var rotated []string
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, f.path+".")
+		if _, err := time.Parse(rotateTimeFormat, suffix); err == nil {
+			rotated = append(rotated, m)
+		}
+	}
+
+	if len(rotated) <= f.keep {
+		return
+	}
+
+	// Timestamp suffixes sort chronologically
+	sort.Strings(rotated)
+	for _, m := range rotated[:len(rotated)-f.keep] {
+		os.Remove(m)
+	}
+}
+
+// Reopen closes and reopens the log file, for use after external rotation
+func (f *RotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close closes the log file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
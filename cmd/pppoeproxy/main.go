@@ -0,0 +1,469 @@
+// Command pppoeproxy runs a PPPoE proxy; see the README for its options.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/KarpelesLab/pppoeproxy"
+	"github.com/KarpelesLab/shutdown"
+)
+
+var (
+	configPath      = flag.String("config", "", "Configuration file with one \"name = value\" setting per line")
+	interfaceName   = flag.String("interface", "", "Interface to bind to, or a glob pattern such as eth1.* binding to every matching interface")
+	waitIface       = flag.Duration("wait-interface", 0, "Wait up to this duration for the interface to appear at startup (negative to wait forever)")
+	bridgePorts     = flag.Bool("bridge-ports", false, "When the interface is a bridge, capture on its ports to see the frames bridged between them (Linux)")
+	mode            = flag.String("mode", "client", "Mode (client or server)")
+	address         = flag.String("address", "", "Address to connect to (client), or comma separated addresses to listen on (server)")
+	tunnelIface     = flag.String("tunnel-interface", "", "Bind the tunnel connections to this interface so they never go out another one (Linux and macOS)")
+	tunnelMark      = flag.Uint("tunnel-mark", 0, "Firewall mark (SO_MARK) of the connections to the server, e.g. 0x10, so policy routing can steer them (client mode, Linux)")
+	dscp            = flag.String("dscp", "0", "DSCP of the tunnel packets, as a number or a name such as EF or AF41, so QoS policies can prioritize the tunnel (0 for the system default)")
+	bindAddr        = flag.String("bind", "", "Source address and/or port of the tunnel connection, e.g. 192.168.1.2, 192.168.1.2:9000 or :9000 (client mode)")
+	advertise       = flag.String("advertise", "", "Advertise the server with mDNS under this name, for clients using -address mdns: (server mode)")
+	allowedIP       = flag.String("allow", "127.0.0.1", "Comma separated IPv4/IPv6 addresses and CIDR prefixes allowed to connect (server mode only)")
+	clientsFile     = flag.String("clients", "", "File naming the tunnel clients and setting their limits, one per line (server mode)")
+	authURL         = flag.String("auth-url", "", "HTTP endpoint authorizing each tunnel client, which is rejected unless it answers {\"allow\": true} (server mode)")
+	authTimeout     = flag.Duration("auth-timeout", 5*time.Second, "Timeout of requests to -auth-url")
+	authToken       = flag.String("auth-token", "", "Credential sent to the server, checked by its -auth-url (client mode, env:NAME or file:/path)")
+	geoipDB         = flag.String("geoip-db", "", "MaxMind DB files (e.g. GeoLite2-Country and GeoLite2-ASN), comma separated, to restrict tunnel clients by country or AS (server mode)")
+	geoipAllow      = flag.String("geoip-allow", "", "Comma separated country codes and AS numbers (e.g. JP,AS2516) tunnel clients must match")
+	geoipDeny       = flag.String("geoip-deny", "", "Comma separated country codes and AS numbers rejected")
+	rttWarn         = flag.Duration("rtt-warn", 500*time.Millisecond, "Log a warning when the tunnel RTT exceeds this value (0 to disable)")
+	metricsAddr     = flag.String("metrics", "", "Address to expose Prometheus metrics on (disabled if empty)")
+	controlPath     = flag.String("control", "", "Unix socket for the \"ctl\" command interface (disabled if empty)")
+	grpcAddr        = flag.String("grpc", "", "Address for the gRPC control API (disabled if empty)")
+	grpcCert        = flag.String("grpc-cert", "", "TLS certificate for the gRPC API (plaintext if empty)")
+	grpcKey         = flag.String("grpc-key", "", "TLS private key for the gRPC API")
+	grpcClientCA    = flag.String("grpc-client-ca", "", "Require gRPC API clients to present a certificate signed by this CA bundle")
+	adminAddr       = flag.String("admin", "", "Address for the HTTPS admin API (disabled if empty)")
+	adminCert       = flag.String("admin-cert", "", "TLS certificate for the admin API")
+	adminKey        = flag.String("admin-key", "", "TLS private key for the admin API")
+	adminACME       = flag.String("admin-acme-domain", "", "Obtain the admin API certificate for this domain with ACME instead of -admin-cert and -admin-key")
+	adminACMEEmail  = flag.String("admin-acme-email", "", "Contact address registered with the ACME certificate authority")
+	adminACMECache  = flag.String("admin-acme-cache", "", "Directory the ACME account key and certificates are kept in")
+	adminACMEURL    = flag.String("admin-acme-directory", "", "ACME directory URL (default: Let's Encrypt)")
+	jwtIssuer       = flag.String("jwt-issuer", "", "Accept admin and gRPC API bearer tokens issued by this OAuth/OIDC issuer")
+	jwtAudience     = flag.String("jwt-audience", "", "Audience the admin and gRPC API bearer tokens must be issued for")
+	jwksURL         = flag.String("jwks-url", "", "URL of the keys verifying admin and gRPC API bearer tokens (JWKS)")
+	adminClientCA   = flag.String("admin-client-ca", "", "CA bundle authenticating admin API client certificates")
+	adminReqCert    = flag.Bool("admin-require-client-cert", false, "Reject admin API connections without a client certificate signed by -admin-client-ca")
+	adminTokens     = flag.String("admin-tokens", "", "File with the bearer tokens accepted by the admin API, one per line")
+	snmpAddr        = flag.String("snmp", "", "UDP address for the built-in SNMPv2c agent (disabled if empty)")
+	snmpCommunity   = flag.String("snmp-community", "public", "SNMP community string")
+	snmpOID         = flag.String("snmp-oid", pppoeproxy.DefaultSNMPBaseOID, "Base OID for the objects exposed via SNMP")
+	logFile         = flag.String("log-file", "", "Write logs to this file instead of stderr")
+	logMaxSize      = flag.Int64("log-max-size", 10, "Rotate the log file when it exceeds this size in MB (0 to disable)")
+	logRotate       = flag.Duration("log-rotate", 0, "Rotate the log file at this interval, e.g. 24h (0 to disable)")
+	logKeep         = flag.Int("log-keep", 5, "Number of rotated log files to keep (0 keeps all)")
+	debugDump       = flag.Bool("debug-hexdump", false, "Hexdump forwarded frames with decoded headers")
+	dumpCodes       = flag.String("debug-code", "", "Only hexdump frames with these PPPoE codes (e.g. PADI,PADO,SESSION or 0x09)")
+	dumpSessions    = flag.String("debug-session", "", "Only hexdump frames with these session IDs (comma separated)")
+	dumpMACs        = flag.String("debug-mac", "", "Only hexdump frames from or to these MAC addresses (comma separated)")
+	dumpFilter      = flag.String("debug-filter", "", "Only log and hexdump frames matching this expression, e.g. \"session == 0x1234 && (code == PADT || ppp == LCP)\"")
+	dumpRate        = flag.Float64("debug-rate", 10, "Maximum number of frames hexdumped per second (0 for unlimited)")
+	stateFile       = flag.String("state-file", "", "Save the session table to this file and restore it at startup, so restarts keep the sessions")
+	ipMapFile       = flag.String("ip-map-file", "", "Keep this JSON file up to date with the IPv4 address of each PPPoE session, for firewall or routing automation")
+	journal         = flag.String("journal", "", "Append the session lifecycle events to this file, queryable with the admin API")
+	sessionIdle     = flag.Duration("session-idle-timeout", 30*time.Minute, "End the tracked sessions without any frame for this long (0 to disable)")
+	record          = flag.String("record", "", "Record all tunnel frames with timestamps to this file, for \"replay\"")
+	pcapInput       = flag.String("pcap-input", "", "Feed the frames of this pcap or pcapng capture to the proxy, as if received on the interface, to reproduce a problem")
+	pcapOnly        = flag.Bool("pcap-only", false, "Only receive the frames of -pcap-input, without opening the interface (frames to send are discarded)")
+	pcapSpeed       = flag.Float64("pcap-speed", 1, "Playback speed of -pcap-input relative to the capture (0 feeds the frames as fast as possible)")
+	pcapMaxGap      = flag.Duration("pcap-max-gap", 0, "Shorten the idle periods of -pcap-input to at most this duration (0 to keep them)")
+	traceFrames     = flag.Int("trace-frames", 1000, "Keep this many of the last frames forwarded in memory, retrievable as pcapng with the admin API (0 to disable)")
+	traceSnapLen    = flag.Int("trace-snaplen", 128, "Bytes kept of each frame by -trace-frames")
+	sample          = flag.Int("sample", 0, "Export a flow record for one in this many forwarded frames to -sample-to (0 to disable)")
+	sampleTo        = flag.String("sample-to", "", "File the sampled flow records are appended to, or udp:host:port for a collector")
+	autoUpdate      = flag.Bool("auto-update", true, "Periodically check for updates and restart into the new version (release builds only)")
+	daemon          = flag.Bool("daemon", false, "Run in the background, detached from the terminal")
+	pidFile         = flag.String("pidfile", "", "Write the process ID to this file")
+	seccomp         = flag.Bool("seccomp", false, "Restrict the process to the system calls it needs after initialization")
+	seccompAction   = flag.String("seccomp-action", "errno", "Action for disallowed system calls: errno, kill or log")
+	shutdownPADT    = flag.Bool("shutdown-padt", false, "Send PADT for all tracked sessions when shutting down")
+	keepalive       = flag.Duration("keepalive", 60*time.Second, "Interval between keepalive pings sent to the server (client mode, 0 to disable)")
+	keepaliveMisses = flag.Int("keepalive-misses", 3, "Close the tunnel after this many keepalive intervals without data from the peer (0 to disable)")
+	clientPing      = flag.Duration("client-ping", 60*time.Second, "Interval between keepalive pings sent to each client (server mode, 0 to disable)")
+	clientTimeout   = flag.Duration("client-timeout", 0, "Drop clients that sent no data for this duration (server mode, 0 for -keepalive x -keepalive-misses)")
+	writeTimeout    = flag.Duration("write-timeout", 10*time.Second, "Drop a tunnel packet when it cannot be written within this duration (0 to disable)")
+	writeStalls     = flag.Int("write-stalls", 3, "Close the tunnel after this many consecutive write timeouts (0 to disable)")
+	tcpKeepalive    = flag.Bool("tcp-keepalive", true, "Enable TCP keepalive on tunnel connections")
+	tcpKeepIdle     = flag.Duration("tcp-keepalive-idle", 15*time.Second, "Idle time before the first TCP keepalive probe")
+	tcpKeepInterval = flag.Duration("tcp-keepalive-interval", 15*time.Second, "Interval between TCP keepalive probes")
+	tcpKeepCount    = flag.Int("tcp-keepalive-count", 9, "Unanswered TCP keepalive probes before the tunnel connection is dropped")
+	reconnectMin    = flag.Duration("reconnect-min", 2*time.Second, "Delay before the first reconnection attempt (client mode)")
+	reconnectMax    = flag.Duration("reconnect-max", 60*time.Second, "Maximum delay between reconnection attempts (client mode)")
+	reconnectFactor = flag.Float64("reconnect-factor", 2, "Multiplier applied to the reconnection delay after each failure")
+	reconnectJitter = flag.Float64("reconnect-jitter", 0.2, "Fraction of the reconnection delay randomized (0-1)")
+	reconnectRotate = flag.Bool("reconnect-rotate", false, "Start each connection attempt with the next address the server name resolves to (client mode)")
+	reconnectQueue  = flag.Int("reconnect-queue", 16, "Discovery and PPP control frames kept while reconnecting and sent once connected (client mode, 0 to disable)")
+	reconnectQData  = flag.Int("reconnect-queue-data", 0, "Other session frames kept while reconnecting (client mode)")
+	allowSessions   = flag.String("allow-sessions", "", "Only proxy these PPPoE sessions: comma separated session IDs, MAC addresses and host/AC MAC address pairs")
+	denySessions    = flag.String("deny-sessions", "", "Ignore these PPPoE sessions, e.g. those of a PPPoE client on the proxy host: session IDs, MAC addresses and MAC address pairs")
+	allowPPP        = flag.String("allow-ppp", "", "Only proxy the session frames of these PPP protocols, by name or number, prefixed with rx: or tx: for one direction (e.g. LCP,PAP,CHAP,IPCP,IP)")
+	denyPPP         = flag.String("deny-ppp", "", "Drop the session frames of these PPP protocols, by name or number, prefixed with rx: or tx: for one direction (e.g. IPv6CP,IPv6)")
+	tagRules        = flag.String("tag-rules", "", "Strip, set or add discovery tags, as comma separated <action>:<tag>[=<value>] rules prefixed with rx: or tx: for one direction (e.g. strip:Vendor-Specific,tx:set:Service-Name=internet)")
+	acCookies       = flag.Bool("ac-cookies", false, "Replace the AC-Cookie of the PADOs proxied with one signed by the proxy, and drop the PADRs not returning it")
+	discoveryErrs   = flag.Bool("discovery-errors", true, "Answer the PADIs and PADRs the proxy does not forward with a Generic-Error tag giving the reason")
+	sessionRate     = flag.String("session-rate", "0", "Shape the frames injected for each PPPoE session to this many bits per second, e.g. 20M (0 to disable)")
+	sessionBurst    = flag.Int("session-burst", 0, "Bytes injected at once for a session beyond -session-rate (0 for a tenth of a second at the rate)")
+	tunnelRateOut   = flag.String("tunnel-rate-out", "0", "Cap the frames sent into the tunnel to this many bits per second for all peers, e.g. 50M (0 to disable)")
+	tunnelRateIn    = flag.String("tunnel-rate-in", "0", "Cap the data read from the tunnel to this many bits per second for all peers, e.g. 50M (0 to disable)")
+	tunnelBurst     = flag.Int("tunnel-burst", 0, "Bytes sent or read at once beyond -tunnel-rate-out and -tunnel-rate-in (0 for a tenth of a second at the rate)")
+	tunnelCredits   = flag.Int("tunnel-credits", 1024, "Frames of each kind (control and data) a tunnel peer may send ahead of their injection, granted again as they are injected (0 to disable)")
+	tunnelQDrop     = flag.String("tunnel-queue-drop", "keep-control", "Frame dropped when the send queues of a tunnel peer are full: tail, head or keep-control")
+	sessionQDrop    = flag.String("session-queue-drop", "tail", "Frame dropped when the queue of a shaped session is full: tail, head or keep-control")
+	sequence        = flag.Bool("sequence", false, "Number the frames sent into the tunnel so the peer counts lost and reordered frames")
+	timestamps      = flag.Bool("timestamps", false, "Send the capture time of the frames into the tunnel so the peer measures the one-way forwarding latency (needs synchronized clocks)")
+	tunnelDelayOut  = flag.Duration("tunnel-delay-out", 0, "Emulate a slower WAN by delaying the frames sent into the tunnel by this much (0 to disable)")
+	tunnelJitterOut = flag.Duration("tunnel-jitter-out", 0, "Vary the delay of the frames sent into the tunnel randomly by up to this much either way")
+	tunnelDelayIn   = flag.Duration("tunnel-delay-in", 0, "Emulate a slower WAN by delaying the frames read from the tunnel by this much (0 to disable)")
+	tunnelJitterIn  = flag.Duration("tunnel-jitter-in", 0, "Vary the delay of the frames read from the tunnel randomly by up to this much either way")
+	padoTimeout     = flag.Duration("pado-timeout", 10*time.Second, "Report hosts that get no PADO in reply to their PADI within this duration (0 to disable)")
+	strict          = flag.Bool("strict", false, "Drop the frames with malformed or inconsistent PPPoE and PPP headers, counted by reason")
+	chaos           = flag.String("chaos", "", "Degrade the tunnel for testing, e.g. delay=50ms,jitter=10ms,drop=1%,reorder=0.5%,disconnect=10m (hidden)")
+	hook            = flag.String("hook", "", "Command run on lifecycle events (session up/down, tunnel up/down, client connected/disconnected)")
+	hookTimeout     = flag.Duration("hook-timeout", 30*time.Second, "Maximum run time of the hook command (0 for no limit)")
+	exitReport      = flag.Bool("report", true, "Log a statistics report when shutting down")
+	shutdownWait    = flag.Duration("shutdown-timeout", 5*time.Second, "Maximum time to wait for tunnel peers to disconnect when shutting down")
+)
+
+// run implements the "run" command, starting the proxy
+func run(args []string) int {
+	if err := parseFlags(args); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	if *daemon {
+		if err := daemonize(); err != nil {
+			log.Fatalf("Failed to daemonize: %v", err)
+		}
+	}
+
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			log.Fatalf("Failed to write pidfile: %v", err)
+		}
+		defer removePidFile(*pidFile)
+	}
+
+	if err := setupLogging(); err != nil {
+		log.Fatalf("Failed to initialize logging: %v", err)
+	}
+	defer func() {
+		if logWriter != nil {
+			logWriter.Close()
+		}
+	}()
+
+	if err := validateFlags(); err != nil {
+		log.Fatal(err)
+	}
+	warnSecretFiles()
+
+	// Shutdown is driven by signals and Drain rather than cancellation
+	ctx := context.Background()
+
+	if *waitIface != 0 {
+		sdNotify("STATUS=Waiting for interface " + *interfaceName)
+		if err := pppoeproxy.WaitForInterface(ctx, *interfaceName, *waitIface); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Initialize discovery and session handlers, on the ports of the bridge
+	// with -bridge-ports
+	if w := pppoeproxy.BridgeWarning(*interfaceName, *bridgePorts); w != "" {
+		log.Printf("Warning: %s", w)
+	}
+	if w := pppoeproxy.BondWarning(*interfaceName); w != "" {
+		log.Printf("Warning: %s", w)
+	}
+	openSocket := pppoeproxy.OpenRawSocket
+	if *bridgePorts && pppoeproxy.IsBridge(*interfaceName) {
+		openSocket = pppoeproxy.OpenBridgePorts
+	}
+	if *pcapInput != "" {
+		openSocket = pcapSocketOpener(openSocket)
+	}
+	discoverySock, err := openSocket(*interfaceName, pppoeproxy.PPPoEDiscovery)
+	if err != nil {
+		log.Fatalf("Failed to initialize discovery handler: %v", err)
+	}
+	discoveryHandler := pppoeproxy.NewDiscoveryHandlerWithSocket(ctx, discoverySock, *mode == "server")
+	defer discoveryHandler.Close()
+
+	sessionSock, err := openSocket(*interfaceName, pppoeproxy.PPPoESession)
+	if err != nil {
+		log.Fatalf("Failed to initialize session handler: %v", err)
+	}
+	sessionHandler := pppoeproxy.NewSessionHandlerWithSocket(ctx, sessionSock, *mode == "server")
+	defer sessionHandler.Close()
+
+	if *metricsAddr != "" {
+		if err := pppoeproxy.ServeMetrics(*metricsAddr); err != nil {
+			log.Fatalf("Failed to initialize metrics: %v", err)
+		}
+	}
+
+	if *snmpAddr != "" {
+		community, err := resolveSecret(*snmpCommunity)
+		if err != nil {
+			log.Fatalf("Invalid SNMP community: %v", err)
+		}
+		agent, err := pppoeproxy.NewSNMPAgent(*snmpAddr, community, *snmpOID)
+		if err != nil {
+			log.Fatalf("Failed to initialize SNMP agent: %v", err)
+		}
+		defer agent.Close()
+	}
+
+	// Initialize proxy
+	config, err := buildConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if config.IsServer {
+		config.Listeners = inheritedListeners(pppoeproxy.ListenAddresses(config.Address))
+	}
+	if *record != "" {
+		if config.Recorder, err = pppoeproxy.NewRecorder(*record); err != nil {
+			log.Fatalf("Failed to initialize recording: %v", err)
+		}
+		defer config.Recorder.Close()
+		log.Printf("Recording tunnel frames to %s", *record)
+	}
+	if *traceFrames > 0 {
+		config.Tracer = pppoeproxy.NewTracer(*traceFrames, *traceSnapLen)
+	}
+	if *sample > 0 {
+		if config.Sampler, err = pppoeproxy.NewSampler(*sample, *sampleTo); err != nil {
+			log.Fatalf("Failed to initialize sampling: %v", err)
+		}
+		defer config.Sampler.Close()
+		log.Printf("Exporting flow records of 1 in %d frames to %s", *sample, *sampleTo)
+	}
+	if *geoipDB != "" {
+		if config.GeoIP, err = pppoeproxy.NewGeoIPFilter(*geoipDB, *geoipAllow, *geoipDeny); err != nil {
+			log.Fatalf("Failed to initialize GeoIP filter: %v", err)
+		}
+		defer config.GeoIP.Close()
+	}
+	proxy, err := pppoeproxy.NewProxy(ctx, config, discoveryHandler, sessionHandler)
+	if err != nil {
+		log.Fatalf("Failed to initialize proxy: %v", err)
+	}
+	defer proxy.Close()
+
+	// A packet loop failing repeatedly is not going to recover, exit with an
+	// error so the supervisor restarts the proxy
+	var failed atomic.Bool
+	proxy.SetErrorFunc(func(err *pppoeproxy.Error) {
+		if err.Kind == pppoeproxy.ErrorRecv && !failed.Swap(true) {
+			go shutdown.Fatalf("%w", err)
+		}
+	})
+
+	setupSelfUpdate(proxy, *autoUpdate)
+
+	// Setup signal handling for graceful shutdown and configuration reload
+	shutdown.SetupSignals()
+	handleReloadSignal(proxy)
+
+	if *controlPath != "" {
+		ctl, err := pppoeproxy.NewControlServer(*controlPath, proxy, func() { reloadConfig(proxy) })
+		if err != nil {
+			log.Fatalf("Failed to initialize control socket: %v", err)
+		}
+		defer ctl.Close()
+		handleUpdateCommands(ctl)
+	}
+
+	var jwt *pppoeproxy.JWTValidator
+	if *jwtIssuer != "" || *jwtAudience != "" || *jwksURL != "" {
+		if jwt, err = pppoeproxy.NewJWTValidator(*jwtIssuer, *jwtAudience, *jwksURL); err != nil {
+			log.Fatalf("Invalid JWT settings: %v", err)
+		}
+	}
+
+	if *grpcAddr != "" {
+		api, err := pppoeproxy.NewGRPCServer(pppoeproxy.GRPCConfig{
+			Addr:         *grpcAddr,
+			JWT:          jwt,
+			CertFile:     *grpcCert,
+			KeyFile:      *grpcKey,
+			ClientCAFile: *grpcClientCA,
+		}, proxy, func(values map[string]string) ([]string, error) {
+			return updateSettings(proxy, values)
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize gRPC API: %v", err)
+		}
+		defer api.Close()
+	}
+
+	if *adminAddr != "" {
+		adminConfig := pppoeproxy.AdminAPIConfig{
+			Addr:         *adminAddr,
+			CertFile:     *adminCert,
+			KeyFile:      *adminKey,
+			ClientCAFile: *adminClientCA,
+			TokenFile:    *adminTokens,
+			JWT:          jwt,
+
+			RequireClientCert: *adminReqCert,
+
+			ACMEDomain:    *adminACME,
+			ACMEEmail:     *adminACMEEmail,
+			ACMECache:     *adminACMECache,
+			ACMEDirectory: *adminACMEURL,
+		}
+		api, err := pppoeproxy.NewAdminAPI(adminConfig, proxy, func() { reloadConfig(proxy) }, func(values map[string]string) ([]string, error) {
+			return updateSettings(proxy, values)
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize admin API: %v", err)
+		}
+		defer api.Close()
+	}
+
+	log.Printf("PPPoE proxy started in %s mode on interface %s", *mode, *interfaceName)
+	if *mode == "server" {
+		log.Printf("Listening on %s", *address)
+	} else {
+		log.Printf("Connecting to %s", *address)
+	}
+
+	// Sockets are bound and the tunnel path is initialized
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+	}
+	runWatchdog(proxy)
+
+	if *seccomp {
+		if err := installSeccomp(*seccompAction); err != nil {
+			log.Fatalf("Failed to install seccomp filter: %v", err)
+		}
+		log.Printf("seccomp filter installed (action: %s)", *seccompAction)
+	}
+
+	// Wait for termination signal
+	shutdown.Wait()
+	log.Println("Shutting down...")
+	sdNotify("STOPPING=1")
+	proxy.Drain(*shutdownPADT, *shutdownWait)
+	if *exitReport {
+		var report strings.Builder
+		proxy.WriteReport(&report)
+		log.Printf("%s", strings.TrimRight(report.String(), "\n"))
+	}
+	if failed.Load() {
+		return 1
+	}
+	return 0
+}
+
+// parseFlags parses the command line flags of the run and check-config
+// commands, then applies the environment and configuration file
+func parseFlags(args []string) error {
+	flag.CommandLine.Parse(args)
+	flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+	return loadSettings()
+}
+
+// pcapSocketOpener returns a socket opener feeding the frames of -pcap-input
+// before those of the sockets opened by open, or instead of them with
+// -pcap-only
+func pcapSocketOpener(open func(string, uint16) (pppoeproxy.RawSocket, error)) func(string, uint16) (pppoeproxy.RawSocket, error) {
+	replay := pppoeproxy.PcapReplay{Path: *pcapInput, Speed: *pcapSpeed, MaxGap: *pcapMaxGap}
+	return func(name string, ethertype uint16) (pppoeproxy.RawSocket, error) {
+		var live pppoeproxy.RawSocket
+		if !*pcapOnly {
+			var err error
+			if live, err = open(name, ethertype); err != nil {
+				return nil, err
+			}
+		}
+		sock, err := replay.Open(ethertype, live)
+		if err != nil && live != nil {
+			live.Close()
+		}
+		return sock, err
+	}
+}
+
+// validateFlags checks that the settings required to start are present
+func validateFlags() error {
+	if *interfaceName == "" {
+		return errors.New("interface name must be specified")
+	}
+	if _, err := path.Match(*interfaceName, ""); err != nil {
+		return fmt.Errorf("invalid interface pattern %q: %v", *interfaceName, err)
+	}
+	if *mode != "client" && *mode != "server" {
+		return errors.New("mode must be 'client' or 'server'")
+	}
+	if *address == "" {
+		return errors.New("address must be specified")
+	}
+	if *tunnelIface != "" && *tunnelIface == *interfaceName {
+		return errors.New("the tunnel interface must differ from the PPPoE interface")
+	}
+	if *bindAddr != "" {
+		if *mode != "client" {
+			return errors.New("-bind can only be used in client mode")
+		}
+		if _, err := pppoeproxy.ParseBindAddress(*bindAddr); err != nil {
+			return err
+		}
+	}
+	if *seccomp && *autoUpdate {
+		// Restarting into the new version executes the program
+		return errors.New("-seccomp requires -auto-update=false")
+	}
+	if *traceFrames < 0 || *traceSnapLen < 14 {
+		return errors.New("-trace-frames cannot be negative and -trace-snaplen must keep the Ethernet header")
+	}
+	if *sample < 0 || (*sample > 0 && *sampleTo == "") {
+		return errors.New("-sample requires a positive rate and -sample-to")
+	}
+	if *advertise != "" && *mode != "server" {
+		return errors.New("-advertise can only be used in server mode")
+	}
+	if (*clientsFile != "" || *authURL != "" || *geoipDB != "") && *mode != "server" {
+		return errors.New("-clients, -auth-url and -geoip-db can only be used in server mode")
+	}
+	if *authToken != "" && *mode == "server" {
+		return errors.New("-auth-token can only be used in client mode")
+	}
+	if (*pcapOnly || *pcapSpeed != 1 || *pcapMaxGap != 0) && *pcapInput == "" {
+		return errors.New("-pcap-only, -pcap-speed and -pcap-max-gap require -pcap-input")
+	}
+	if *pcapSpeed < 0 || *pcapMaxGap < 0 {
+		return errors.New("-pcap-speed and -pcap-max-gap cannot be negative")
+	}
+	if pppoeproxy.IsDiscoveryAddress(*address) {
+		if *mode == "server" {
+			return errors.New("SRV and mDNS addresses can only be used in client mode")
+		}
+		return nil
+	}
+	addrs := pppoeproxy.ListenAddresses(*address)
+	if len(addrs) > 1 && *mode != "server" {
+		return errors.New("multiple addresses can only be used in server mode")
+	}
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q (IPv6 addresses must be bracketed, e.g. [2001:db8::1]:8000): %v", addr, err)
+		}
+	}
+	return nil
+}
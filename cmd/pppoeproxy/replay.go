@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// replayTarget sends replayed frames somewhere
+type replayTarget interface {
+	send(frame pppoeproxy.RecordedFrame) error
+	Close() error
+}
+
+// runReplay implements "pppoeproxy replay": it plays back a recording made
+// with -record, either injecting the frames on an interface or sending them
+// to a tunnel server as a tunnel client would. It returns the process exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	ifaceName := fs.String("interface", "", "Inject the frames on this network interface")
+	peer := fs.String("peer", "", "Send the frames to the tunnel server at this address")
+	direction := fs.String("direction", "", "Frames to replay: rx (captured on the interface), tx (received from the tunnel) or all (default: tx with -interface, rx with -peer)")
+	speed := fs.Float64("speed", 1, "Playback speed relative to the recording (0 sends the frames as fast as possible)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay (-interface name | -peer address) [flags] <recording>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || (*ifaceName == "") == (*peer == "") || *speed < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	dirs := map[string]bool{}
+	switch *direction {
+	case "":
+		if *ifaceName != "" {
+			dirs[pppoeproxy.DirectionTx] = true
+		} else {
+			dirs[pppoeproxy.DirectionRx] = true
+		}
+	case pppoeproxy.DirectionRx, pppoeproxy.DirectionTx:
+		dirs[*direction] = true
+	case "all":
+		dirs[pppoeproxy.DirectionRx], dirs[pppoeproxy.DirectionTx] = true, true
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid direction %q\n", *direction)
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer f.Close()
+	rec, err := pppoeproxy.NewRecordingReader(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+
+	var target replayTarget
+	if *ifaceName != "" {
+		target, err = newInterfaceTarget(*ifaceName)
+	} else {
+		target, err = newPeerTarget(*peer)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer target.Close()
+
+	// Frames are sent relative to the first one replayed
+	var start, first time.Time
+	sent := 0
+	for {
+		frame, err := rec.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+			return 1
+		}
+		if !dirs[frame.Direction] {
+			continue
+		}
+
+		if sent == 0 {
+			start, first = time.Now(), frame.Time
+		} else if *speed > 0 {
+			at := start.Add(time.Duration(float64(frame.Time.Sub(first)) / *speed))
+			time.Sleep(time.Until(at))
+		}
+		if err := target.send(frame); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		sent++
+	}
+
+	log.Printf("Replayed %d frames in %s", sent, time.Since(start).Round(time.Millisecond))
+	return 0
+}
+
+// interfaceTarget injects replayed frames on a network interface
+type interfaceTarget struct {
+	discovery *pppoeproxy.DiscoveryHandler
+	session   *pppoeproxy.SessionHandler
+}
+
+func newInterfaceTarget(name string) (*interfaceTarget, error) {
+	discovery, err := pppoeproxy.NewDiscoveryHandler(context.Background(), name, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize discovery handler: %v", err)
+	}
+	session, err := pppoeproxy.NewSessionHandler(context.Background(), name, false)
+	if err != nil {
+		discovery.Close()
+		return nil, fmt.Errorf("failed to initialize session handler: %v", err)
+	}
+	return &interfaceTarget{discovery: discovery, session: session}, nil
+}
+
+func (t *interfaceTarget) send(frame pppoeproxy.RecordedFrame) error {
+	if frame.Type == pppoeproxy.PacketTypeDiscovery {
+		return t.discovery.InjectPacket(frame.Data)
+	}
+	return t.session.InjectPacket(frame.Data)
+}
+
+func (t *interfaceTarget) Close() error {
+	t.discovery.Close()
+	return t.session.Close()
+}
+
+// peerTarget sends replayed frames to a tunnel server
+type peerTarget struct {
+	client *pppoeproxy.Client
+}
+
+func newPeerTarget(addr string) (*peerTarget, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server: %v", err)
+	}
+	client := pppoeproxy.NewClient(conn)
+	if err := client.SendHello(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	// Answer pings and drain whatever the server sends so it never stalls
+	go func() {
+		for {
+			packetType, data, err := client.ReadPacket()
+			if err != nil {
+				return
+			}
+			if packetType == pppoeproxy.PacketTypePing {
+				client.WritePacket(pppoeproxy.PacketTypePong, data)
+			}
+		}
+	}()
+	log.Printf("Connected to server at %s", addr)
+	return &peerTarget{client: client}, nil
+}
+
+func (t *peerTarget) send(frame pppoeproxy.RecordedFrame) error {
+	return t.client.WritePacket(frame.Type, frame.Data)
+}
+
+func (t *peerTarget) Close() error {
+	t.client.WritePacket(pppoeproxy.PacketTypeGoodbye, nil)
+	return t.client.Close()
+}
@@ -0,0 +1,129 @@
+//go:build amd64 || arm64
+
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccompCommonSyscalls are the system calls needed by the Go runtime and the
+// proxy once initialized, available under the same name on amd64 and arm64
+var seccompCommonSyscalls = []uintptr{
+	// Basic I/O
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV,
+	unix.SYS_PREAD64, unix.SYS_PWRITE64, unix.SYS_CLOSE, unix.SYS_FCNTL,
+	unix.SYS_IOCTL, unix.SYS_LSEEK, unix.SYS_FSTAT, unix.SYS_NEWFSTATAT,
+	unix.SYS_STATX, unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_DUP3,
+	unix.SYS_PIPE2, unix.SYS_GETDENTS64,
+
+	// Files used after startup (log rotation, pidfile, config reload, IP
+	// map, recordings, ACME cache)
+	unix.SYS_OPENAT, unix.SYS_RENAMEAT, unix.SYS_UNLINKAT, unix.SYS_READLINKAT,
+	unix.SYS_FACCESSAT, unix.SYS_FACCESSAT2, unix.SYS_MKDIRAT, unix.SYS_FCHMODAT,
+	unix.SYS_FTRUNCATE,
+
+	// Memory management
+	unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MPROTECT, unix.SYS_MADVISE,
+	unix.SYS_BRK, unix.SYS_MINCORE,
+
+	// Threads, signals and scheduling. clone is checked separately, as it
+	// also creates processes.
+	unix.SYS_EXIT, unix.SYS_EXIT_GROUP,
+	unix.SYS_FUTEX, unix.SYS_GETTID, unix.SYS_GETPID, unix.SYS_GETPPID,
+	unix.SYS_TGKILL, unix.SYS_KILL, unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK,
+	unix.SYS_RT_SIGRETURN, unix.SYS_SIGALTSTACK, unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY, unix.SYS_NANOSLEEP, unix.SYS_CLOCK_GETTIME,
+	unix.SYS_CLOCK_NANOSLEEP, unix.SYS_GETTIMEOFDAY, unix.SYS_RESTART_SYSCALL,
+	unix.SYS_PRCTL, unix.SYS_RSEQ, unix.SYS_SET_ROBUST_LIST, unix.SYS_PRLIMIT64,
+	unix.SYS_TIMER_CREATE, unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_DELETE,
+	unix.SYS_SETITIMER, unix.SYS_GETRANDOM, unix.SYS_UNAME,
+
+	// Polling
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT,
+	unix.SYS_EVENTFD2, unix.SYS_PPOLL, unix.SYS_PSELECT6,
+
+	// Networking (raw sockets, tunnel, metrics/SNMP listeners, sd_notify)
+	unix.SYS_SOCKET, unix.SYS_BIND, unix.SYS_CONNECT, unix.SYS_LISTEN,
+	unix.SYS_ACCEPT4, unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME,
+	unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKOPT, unix.SYS_SENDTO, unix.SYS_RECVFROM,
+	unix.SYS_SENDMSG, unix.SYS_RECVMSG, unix.SYS_SHUTDOWN,
+}
+
+// seccompActions maps the -seccomp-action values to filter return values
+var seccompActions = map[string]uint32{
+	"errno": unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM),
+	"kill":  unix.SECCOMP_RET_KILL_PROCESS,
+	"log":   unix.SECCOMP_RET_LOG,
+}
+
+// installSeccomp restricts the process to the system calls it needs once
+// initialized. Disallowed calls fail with EPERM, kill the process or are only
+// logged depending on action. The filter applies to all threads.
+//
+// No program can be executed and clone may only create threads, so a
+// compromised process cannot start a shell. Hooks and restarts, which execute
+// programs, are refused with the filter.
+func installSeccomp(action string) error {
+	ret, ok := seccompActions[action]
+	if !ok {
+		return fmt.Errorf("unknown seccomp action %q", action)
+	}
+	allowed := append(append([]uintptr{}, seccompCommonSyscalls...), seccompArchSyscalls...)
+
+	// struct seccomp_data: int nr; __u32 arch; ...
+	prog := []unix.SockFilter{
+		// Kill the process if the filter is used from another architecture (e.g. x32/ia32 syscalls)
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: seccompAuditArch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+
+		// clone is allowed for threads only, not new processes. Its flags
+		// are the first argument, whose low 32 bits come first on
+		// little-endian amd64 and arm64.
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 4, K: unix.SYS_CLONE},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 16},
+		{Code: unix.BPF_JMP | unix.BPF_JSET | unix.BPF_K, Jf: 1, K: unix.CLONE_THREAD},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+		{Code: unix.BPF_RET | unix.BPF_K, K: ret},
+
+		// The flags of clone3 are in memory the filter cannot read. It
+		// fails as unsupported so that glibc creates its threads with
+		// clone instead.
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: unix.SYS_CLONE3},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)},
+	}
+	for i, nr := range allowed {
+		// Jump to the final ALLOW on match, fall through to the next check otherwise
+		prog = append(prog, unix.SockFilter{
+			Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K,
+			Jt:   uint8(len(allowed) - i),
+			K:    uint32(nr),
+		})
+	}
+	prog = append(prog,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: ret},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+	)
+
+	if len(allowed) > 255 {
+		return fmt.Errorf("too many syscalls in seccomp filter")
+	}
+
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %v", err)
+	}
+
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %v", errno)
+	}
+	return nil
+}
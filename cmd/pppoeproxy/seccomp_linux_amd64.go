@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompAuditArch is the audit architecture the filter is built for
+const seccompAuditArch = unix.AUDIT_ARCH_X86_64
+
+// seccompArchSyscalls are the legacy system calls only present on amd64
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_ACCESS,
+	unix.SYS_READLINK, unix.SYS_RENAME, unix.SYS_UNLINK, unix.SYS_PIPE,
+	unix.SYS_EPOLL_WAIT, unix.SYS_EPOLL_CREATE, unix.SYS_POLL, unix.SYS_SELECT,
+	unix.SYS_ARCH_PRCTL, unix.SYS_TIME, unix.SYS_GETRLIMIT, unix.SYS_ACCEPT,
+}
@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// seccompAuditArch is the audit architecture the filter is built for
+const seccompAuditArch = unix.AUDIT_ARCH_AARCH64
+
+// seccompArchSyscalls are the arm64 system calls missing from the common
+// list. The runtime and standard library only use the variants of the common
+// list there (openat, newfstatat, renameat, epoll_pwait, ppoll, pipe2...).
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_GETRLIMIT, unix.SYS_ACCEPT,
+}
@@ -0,0 +1,13 @@
+//go:build linux && !amd64 && !arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// installSeccomp is not available on architectures without a syscall list
+func installSeccomp(action string) error {
+	return fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// installSeccomp is not available outside of Linux
+func installSeccomp(action string) error {
+	return fmt.Errorf("seccomp is not supported on %s", runtime.GOOS)
+}
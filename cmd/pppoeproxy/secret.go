@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// secretFlags lists the settings that may hold a secret, whose values are
+// never logged
+var secretFlags = map[string]bool{
+	"auth-token":     true,
+	"auth-url":       true,
+	"snmp-community": true,
+}
+
+// describeChange describes the change of a setting for the log, without the
+// values of secretFlags
+func describeChange(name, from, to string) string {
+	if secretFlags[name] {
+		return name + " changed"
+	}
+	return fmt.Sprintf("%s changed from %q to %q", name, from, to)
+}
+
+// resolveSecret returns the value of a setting that may reference a secret
+// instead of holding it, so it does not show in the process list: "env:NAME"
+// is replaced with the NAME environment variable and "file:/path" with the
+// content of the file, which must not be accessible to other users. Other
+// values are returned unchanged.
+func resolveSecret(value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return secret, nil
+	}
+	if path, ok := strings.CutPrefix(value, "file:"); ok {
+		if err := checkSecretPermissions(path); err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// checkSecretPermissions returns an error if a secret file can be read or
+// written by users other than its owner. Windows permissions are not checked.
+func checkSecretPermissions(path string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && st.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s is accessible to other users (mode %04o), restrict it with chmod 600", path, st.Mode().Perm())
+	}
+	return nil
+}
+
+// warnSecretFiles warns about key and token files accessible to other users
+func warnSecretFiles() {
+	for _, path := range []string{*adminKey, *adminTokens, *grpcKey} {
+		if path == "" {
+			continue
+		}
+		if err := checkSecretPermissions(path); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+}
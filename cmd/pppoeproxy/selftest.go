@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// Addresses and session ID of the synthetic PPPoE endpoints
+var (
+	selftestHostMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x5e, 0x01}
+	selftestACMAC   = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x5e, 0x02}
+)
+
+const selftestSession = 0x1234
+
+// Names of the veth pairs created by "selftest -veth": the test endpoint uses
+// the first end of each pair, the proxy the second
+var selftestVeths = [][2]string{{"pppst-host", "pppst-hostp"}, {"pppst-ac", "pppst-acp"}}
+
+// selftestSegment gives the raw sockets of one side of the self-test
+type selftestSegment struct {
+	name     string                                               // Interface the proxy binds to
+	endpoint func(ethertype uint16) (pppoeproxy.RawSocket, error) // Sockets of the synthetic host or AC
+	proxy    func(ethertype uint16) (pppoeproxy.RawSocket, error) // Sockets of the proxy
+}
+
+// fakeSelftestSegment returns a side of the self-test on an in-memory segment
+func fakeSelftestSegment(name string) selftestSegment {
+	seg := pppoeproxy.NewFakeSegment()
+	open := func(ethertype uint16) (pppoeproxy.RawSocket, error) { return seg.Open(name, ethertype) }
+	return selftestSegment{name: name, endpoint: open, proxy: open}
+}
+
+// ifaceSelftestSegment returns a side of the self-test on a pair of connected
+// interfaces, such as the two ends of a veth pair
+func ifaceSelftestSegment(endpoint, proxy string) selftestSegment {
+	return selftestSegment{
+		name: proxy,
+		endpoint: func(ethertype uint16) (pppoeproxy.RawSocket, error) {
+			return pppoeproxy.OpenRawSocket(endpoint, ethertype)
+		},
+		proxy: func(ethertype uint16) (pppoeproxy.RawSocket, error) {
+			return pppoeproxy.OpenRawSocket(proxy, ethertype)
+		},
+	}
+}
+
+// selftestEndpoint is a synthetic PPPoE host or AC
+type selftestEndpoint struct {
+	discovery pppoeproxy.RawSocket
+	session   pppoeproxy.RawSocket
+	frames    chan []byte // Frames received on both sockets
+}
+
+// newSelftestEndpoint opens the sockets of an endpoint on seg
+func newSelftestEndpoint(seg selftestSegment) (*selftestEndpoint, error) {
+	discovery, err := seg.endpoint(pppoeproxy.PPPoEDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	session, err := seg.endpoint(pppoeproxy.PPPoESession)
+	if err != nil {
+		discovery.Close()
+		return nil, err
+	}
+	e := &selftestEndpoint{discovery: discovery, session: session, frames: make(chan []byte, 64)}
+	for _, sock := range []pppoeproxy.RawSocket{discovery, session} {
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, err := sock.Recv(buf)
+				if err != nil {
+					return
+				}
+				e.frames <- append([]byte(nil), buf[:n]...)
+			}
+		}()
+	}
+	return e, nil
+}
+
+// send transmits a frame on the socket of its ethertype
+func (e *selftestEndpoint) send(frame []byte) error {
+	if binary.BigEndian.Uint16(frame[12:14]) == pppoeproxy.PPPoESession {
+		return e.session.Send(frame)
+	}
+	return e.discovery.Send(frame)
+}
+
+// expect waits for a frame equal to want, ignoring the other frames seen on
+// the segment
+func (e *selftestEndpoint) expect(want []byte, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case frame := <-e.frames:
+			if string(frame) == string(want) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (e *selftestEndpoint) Close() error {
+	e.discovery.Close()
+	return e.session.Close()
+}
+
+// selftestFrame builds a PPPoE frame from src to dst with the given payload
+func selftestFrame(dst, src net.HardwareAddr, ethertype uint16, code uint8, session uint16, payload []byte) []byte {
+	frame := make([]byte, 0, 20+len(payload))
+	frame = append(frame, dst...)
+	frame = append(frame, src...)
+	frame = binary.BigEndian.AppendUint16(frame, ethertype)
+	frame = append(frame, 0x11, code)
+	frame = binary.BigEndian.AppendUint16(frame, session)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+// selftestStep is a frame sent by one endpoint and expected at the other
+type selftestStep struct {
+	name     string
+	fromHost bool
+	frame    []byte
+}
+
+// selftestSteps returns the synthetic exchange, from discovery to LCP
+// negotiation and termination
+func selftestSteps() []selftestStep {
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	host, ac := selftestHostMAC, selftestACMAC
+	serviceName := []byte{0x01, 0x01, 0x00, 0x00}
+	acName := append([]byte{0x01, 0x02, 0x00, 0x08}, "selftest"...)
+	lcpRequest := []byte{0xc0, 0x21, 0x01, 0x01, 0x00, 0x0e, 0x01, 0x04, 0x05, 0xd4, 0x05, 0x06, 0x12, 0x34, 0x56, 0x78}
+	lcpAck := append([]byte{0xc0, 0x21, 0x02}, lcpRequest[3:]...)
+
+	return []selftestStep{
+		{"PADI (host to AC)", true, selftestFrame(broadcast, host, pppoeproxy.PPPoEDiscovery, pppoeproxy.PADI, 0, serviceName)},
+		{"PADO (AC to host)", false, selftestFrame(host, ac, pppoeproxy.PPPoEDiscovery, pppoeproxy.PADO, 0, append(acName, serviceName...))},
+		{"PADR (host to AC)", true, selftestFrame(ac, host, pppoeproxy.PPPoEDiscovery, pppoeproxy.PADR, 0, serviceName)},
+		{"PADS (AC to host)", false, selftestFrame(host, ac, pppoeproxy.PPPoEDiscovery, pppoeproxy.PADS, selftestSession, serviceName)},
+		{"LCP Configure-Request (host to AC)", true, selftestFrame(ac, host, pppoeproxy.PPPoESession, 0, selftestSession, lcpRequest)},
+		{"LCP Configure-Ack (AC to host)", false, selftestFrame(host, ac, pppoeproxy.PPPoESession, 0, selftestSession, lcpAck)},
+		{"PADT (host to AC)", true, selftestFrame(ac, host, pppoeproxy.PPPoEDiscovery, pppoeproxy.PADT, selftestSession, nil)},
+	}
+}
+
+// createSelftestVeths creates the veth pairs of "selftest -veth" and returns
+// a function deleting them
+func createSelftestVeths() (func(), error) {
+	remove := func() {
+		for _, pair := range selftestVeths {
+			exec.Command("ip", "link", "del", pair[0]).Run()
+		}
+	}
+	for _, pair := range selftestVeths {
+		cmds := [][]string{
+			{"link", "add", pair[0], "type", "veth", "peer", "name", pair[1]},
+			{"link", "set", pair[0], "up", "promisc", "on"},
+			{"link", "set", pair[1], "up", "promisc", "on"},
+		}
+		for _, args := range cmds {
+			if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+				remove()
+				return nil, fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+	return remove, nil
+}
+
+// runSelftest implements "pppoeproxy selftest": it runs a server and a client
+// proxy in-process, connected through a local tunnel, and checks that a
+// synthetic PPPoE exchange between a host and an AC goes through. It returns
+// the process exit code.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	veth := fs.Bool("veth", false, "Run over two veth pairs created for the test instead of in-memory segments (Linux, needs root)")
+	hostIfaces := fs.String("host-interfaces", "", "Connected interfaces of the host side, as <host end>,<proxy end>, instead of an in-memory segment")
+	acIfaces := fs.String("ac-interfaces", "", "Connected interfaces of the AC side, as <AC end>,<proxy end>, instead of an in-memory segment")
+	timeout := fs.Duration("timeout", 2*time.Second, "Time each frame has to go through")
+	verbose := fs.Bool("v", false, "Show the log of the proxies")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s selftest [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 0 || *veth && (*hostIfaces != "" || *acIfaces != "") {
+		fs.Usage()
+		return 2
+	}
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	hostSeg, acSeg, remove, err := selftestSegments("selftest", *veth, *hostIfaces, *acIfaces)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer remove()
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server, client, err := startSelftestProxies(ctx, hostSeg, acSeg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// Frames from the AC side are only forwarded once the server admitted
+	// the client
+	for len(server.Peers()) == 0 {
+		if time.Since(start) > *timeout {
+			fmt.Printf("FAIL  %-36s\n", "tunnel connection")
+			return 1
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Printf("PASS  %-36s %s\n", "tunnel connection", time.Since(start).Round(time.Microsecond))
+
+	host, err := newSelftestEndpoint(hostSeg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the host sockets: %v\n", err)
+		return 1
+	}
+	defer host.Close()
+	ac, err := newSelftestEndpoint(acSeg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the AC sockets: %v\n", err)
+		return 1
+	}
+	defer ac.Close()
+
+	steps := selftestSteps()
+	passed := 0
+	for _, step := range steps {
+		from, to := ac, host
+		if step.fromHost {
+			from, to = host, ac
+		}
+		sent := time.Now()
+		if err := from.send(step.frame); err != nil {
+			fmt.Printf("FAIL  %-36s %v\n", step.name, err)
+			break
+		}
+		if !to.expect(step.frame, *timeout) {
+			fmt.Printf("FAIL  %-36s not received within %s\n", step.name, *timeout)
+			break
+		}
+		fmt.Printf("PASS  %-36s %s\n", step.name, time.Since(sent).Round(time.Microsecond))
+		passed++
+	}
+
+	if passed < len(steps) {
+		fmt.Printf("Self-test failed: %d/%d frames went through\n", passed, len(steps))
+		return 1
+	}
+	fmt.Printf("Self-test passed: %d frames went through in %s\n", len(steps), time.Since(start).Round(time.Microsecond))
+	return 0
+}
+
+// selftestSegments returns the host and AC sides of the self-test, named after
+// prefix: in-memory segments by default, veth pairs created for the test, or
+// the given pairs of connected interfaces. The function returned deletes the
+// veth pairs.
+func selftestSegments(prefix string, veth bool, hostIfaces, acIfaces string) (host, ac selftestSegment, remove func(), err error) {
+	host, ac, remove = fakeSelftestSegment(prefix+"-host"), fakeSelftestSegment(prefix+"-ac"), func() {}
+	if veth {
+		if remove, err = createSelftestVeths(); err != nil {
+			return host, ac, nil, fmt.Errorf("failed to create veth pairs: %w", err)
+		}
+		host = ifaceSelftestSegment(selftestVeths[0][0], selftestVeths[0][1])
+		ac = ifaceSelftestSegment(selftestVeths[1][0], selftestVeths[1][1])
+	}
+	for _, side := range []struct {
+		value string
+		seg   *selftestSegment
+	}{{hostIfaces, &host}, {acIfaces, &ac}} {
+		if side.value == "" {
+			continue
+		}
+		names := strings.Split(side.value, ",")
+		if len(names) != 2 {
+			remove()
+			return host, ac, nil, fmt.Errorf("invalid interface pair %q", side.value)
+		}
+		*side.seg = ifaceSelftestSegment(names[0], names[1])
+	}
+	return host, ac, remove, nil
+}
+
+// startSelftestProxies starts a server proxy on the AC side and a client proxy
+// on the host side, connected over the loopback interface
+func startSelftestProxies(ctx context.Context, hostSeg, acSeg selftestSegment) (server, client *pppoeproxy.Proxy, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	server, err = startSelftestProxy(ctx, acSeg, pppoeproxy.Config{IsServer: true, Address: l.Addr().String(), Listeners: []net.Listener{l}, AllowedIP: "127.0.0.1"})
+	if err != nil {
+		l.Close()
+		return nil, nil, fmt.Errorf("failed to start the server: %w", err)
+	}
+	client, err = startSelftestProxy(ctx, hostSeg, pppoeproxy.Config{Address: l.Addr().String()})
+	if err != nil {
+		server.Close()
+		return nil, nil, fmt.Errorf("failed to start the client: %w", err)
+	}
+	return server, client, nil
+}
+
+// startSelftestProxy starts a proxy on one side of the self-test
+func startSelftestProxy(ctx context.Context, seg selftestSegment, config pppoeproxy.Config) (*pppoeproxy.Proxy, error) {
+	discoverySock, err := seg.proxy(pppoeproxy.PPPoEDiscovery)
+	if err != nil {
+		return nil, err
+	}
+	sessionSock, err := seg.proxy(pppoeproxy.PPPoESession)
+	if err != nil {
+		discoverySock.Close()
+		return nil, err
+	}
+	config.Interface = seg.name
+	discovery := pppoeproxy.NewDiscoveryHandlerWithSocket(ctx, discoverySock, config.IsServer)
+	session := pppoeproxy.NewSessionHandlerWithSocket(ctx, sessionSock, config.IsServer)
+	return pppoeproxy.NewProxy(ctx, config, discovery, session)
+}
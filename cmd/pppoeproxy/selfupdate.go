@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KarpelesLab/goupd"
+	"github.com/KarpelesLab/pppoeproxy"
+	"golang.org/x/sys/unix"
+)
+
+// listenFDEnv passes the tunnel listeners to the new process across a
+// self-update restart, as comma separated "<fd>:<address>" entries
+const listenFDEnv = "PPPOEPROXY_LISTEN_FD"
+
+// selfExe is the path of the executable, resolved at startup since an update
+// replaces the file while the program runs
+var selfExe, _ = os.Executable()
+
+// setupSelfUpdate makes restarts (after an update or on request) keep the
+// tunnel listeners open, and enables the automatic update checks if requested
+func setupSelfUpdate(proxy *pppoeproxy.Proxy, autoUpdate bool) {
+	goupd.RestartFunction = func() error {
+		return restartProgram(proxy)
+	}
+	if autoUpdate {
+		goupd.AutoUpdate(false)
+	}
+}
+
+// errRestartSeccomp is returned by the commands restarting the program, which
+// the seccomp filter does not allow
+var errRestartSeccomp = errors.New("restarts are not possible with -seccomp")
+
+// handleUpdateCommands adds the "update" and "restart" commands to the
+// control socket
+func handleUpdateCommands(ctl *pppoeproxy.ControlServer) {
+	ctl.Handle("update", func(w io.Writer, args []string) error {
+		if *seccomp {
+			return errRestartSeccomp
+		}
+		go goupd.RunAutoUpdateCheck()
+		fmt.Fprintf(w, "update check started\n")
+		return nil
+	})
+	ctl.Handle("restart", func(w io.Writer, args []string) error {
+		if *seccomp {
+			return errRestartSeccomp
+		}
+		fmt.Fprintf(w, "restarting\n")
+		// Reply before the process is replaced
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			goupd.Restart()
+		}()
+		return nil
+	})
+}
+
+// restartProgram re-executes the (updated) program in place. The process ID
+// does not change and the tunnel listeners are inherited by the new process, so
+// reconnecting clients are never refused. Tunnel peers are sent a goodbye so
+// they reconnect immediately; PPPoE sessions are not terminated.
+func restartProgram(p *pppoeproxy.Proxy) error {
+	if selfExe == "" {
+		return fmt.Errorf("failed to locate executable")
+	}
+
+	log.Printf("Restarting %s", selfExe)
+	files, err := p.Handoff()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	env := append(os.Environ(), daemonEnv+"=1")
+	addrs := pppoeproxy.ListenAddresses(p.Config().Address)
+	var entries []string
+	for i, f := range files {
+		if f == nil || i >= len(addrs) {
+			continue
+		}
+		// Keep the descriptor open across exec
+		if _, err := unix.FcntlInt(f.Fd(), unix.F_SETFD, 0); err != nil {
+			p.Resume()
+			return fmt.Errorf("failed to clear close-on-exec on listener: %v", err)
+		}
+		entries = append(entries, fmt.Sprintf("%d:%s", f.Fd(), addrs[i]))
+	}
+	if len(entries) > 0 {
+		env = append(env, listenFDEnv+"="+strings.Join(entries, ","))
+	}
+
+	p.Config().Recorder.Close()
+	if logWriter != nil {
+		logWriter.Close()
+	}
+
+	err = syscall.Exec(selfExe, os.Args, env)
+	p.Resume()
+	return fmt.Errorf("failed to restart: %v", err)
+}
+
+// inheritedListeners returns the tunnel listeners passed by the previous
+// process across a self-update restart, by position in addrs. Addresses not
+// listened on before have a nil entry, and listeners for addresses no longer
+// used are closed.
+func inheritedListeners(addrs []string) []net.Listener {
+	v, ok := os.LookupEnv(listenFDEnv)
+	if !ok {
+		return nil
+	}
+	os.Unsetenv(listenFDEnv)
+
+	listeners := make([]net.Listener, len(addrs))
+	for _, entry := range strings.Split(v, ",") {
+		fdStr, listenAddr, _ := strings.Cut(entry, ":")
+		fd, err := strconv.Atoi(fdStr)
+		if err != nil {
+			continue
+		}
+		f := os.NewFile(uintptr(fd), "listener")
+		i := slices.Index(addrs, listenAddr)
+		if i < 0 || listeners[i] != nil {
+			log.Printf("Not reusing inherited listener for %s, no longer listened on", listenAddr)
+			f.Close()
+			continue
+		}
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Printf("Failed to reuse inherited listener for %s: %v", listenAddr, err)
+			continue
+		}
+		log.Printf("Reusing listener for %s inherited from the previous process", listenAddr)
+		listeners[i] = l
+	}
+	return listeners
+}
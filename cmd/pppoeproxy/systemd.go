@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/KarpelesLab/pppoeproxy"
+)
+
+// sdNotify sends a state notification to systemd if running under a unit
+// with Type=notify. It is a no-op when NOTIFY_SOCKET is not set.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// A leading @ denotes a socket in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval at which systemd expects watchdog
+// pings, or 0 if the watchdog is not enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// WATCHDOG_PID, when set, must match our own PID
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half the configured interval as
+// long as the proxy reports itself healthy, so systemd restarts it if it wedges
+func runWatchdog(proxy *pppoeproxy.Proxy) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	log.Printf("systemd watchdog enabled, interval %s", interval)
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		healthy := true
+		for range ticker.C {
+			if err := proxy.Healthy(); err != nil {
+				if healthy {
+					log.Printf("Health check failed, withholding watchdog ping: %v", err)
+				}
+				healthy = false
+				continue
+			}
+			if !healthy {
+				log.Printf("Health check recovered")
+			}
+			healthy = true
+
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				log.Printf("Error sending watchdog ping: %v", err)
+			}
+		}
+	}()
+}
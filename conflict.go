@@ -0,0 +1,111 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Session conflict kinds
+const (
+	ConflictDuplicateID = "duplicate-id" // A PADS assigned the ID of a tracked session with other MAC addresses
+	ConflictNoPADS      = "no-pads"      // Session frames were seen for a session no PADS established
+)
+
+// Stray frames of an unknown session are reported once per strayReportInterval,
+// remembering at most maxStraySessions sessions
+const (
+	strayReportInterval = 5 * time.Minute
+	maxStraySessions    = 1024
+)
+
+// sessionConflicts counts the session ID conflicts detected
+var sessionConflicts = NewCounterVec("pppoeproxy_session_conflicts_total", "Session ID conflicts detected, a sign of state desynchronization or spoofing", "kind")
+
+func init() {
+	sessionConflicts.With(ConflictDuplicateID)
+	sessionConflicts.With(ConflictNoPADS)
+}
+
+// strayTracker limits the reports of frames of unknown sessions
+type strayTracker struct {
+	mu       sync.Mutex
+	reported map[sessionKey]time.Time // Last report, by session ID and AC MAC
+}
+
+// checkPADS reports a PADS assigning a session ID already used by a tracked
+// session between other MAC addresses. It must be called before the table
+// observes the PADS, which replaces a session with the same ID and AC.
+func (p *Proxy) checkPADS(packet []byte) {
+	off := pppoeOffset(packet)
+	if len(packet) < off+pppoeHeaderSize || packet[off] != 0x11 || packet[off+1] != PADS {
+		return
+	}
+	id := binary.BigEndian.Uint16(packet[off+2 : off+4])
+	if id == 0 {
+		return
+	}
+	host := net.HardwareAddr(packet[0:6])
+	ac := net.HardwareAddr(packet[6:12])
+	old, ok := p.sessions.conflicting(id, host, ac)
+	if !ok {
+		return
+	}
+	p.reportConflict(ConflictDuplicateID, id, host, ac, &old)
+}
+
+// checkStray reports the session frame travelling in direction that belongs
+// to no tracked session. The frames captured on the interface come from the
+// hosts in client mode and from the ACs in server mode.
+func (p *Proxy) checkStray(direction string, packet []byte) {
+	ethertype, off := framePayload(packet)
+	if ethertype != PPPoESession || len(packet) < off+pppoeHeaderSize {
+		return
+	}
+	id := binary.BigEndian.Uint16(packet[off+2 : off+4])
+	host := net.HardwareAddr(packet[6:12])
+	ac := net.HardwareAddr(packet[0:6])
+	if (direction == DirectionRx) == p.isServer {
+		host, ac = ac, host
+	}
+
+	key := sessionKey{ID: id}
+	copy(key.AC[:], ac)
+	now := time.Now()
+	p.stray.mu.Lock()
+	if last, ok := p.stray.reported[key]; ok && now.Sub(last) < strayReportInterval {
+		p.stray.mu.Unlock()
+		return
+	}
+	if p.stray.reported == nil || len(p.stray.reported) >= maxStraySessions {
+		// Sessions still active will be reported again
+		p.stray.reported = make(map[sessionKey]time.Time)
+	}
+	p.stray.reported[key] = now
+	p.stray.mu.Unlock()
+
+	p.reportConflict(ConflictNoPADS, id, host, ac, nil)
+}
+
+// reportConflict logs, counts and passes a session conflict to the hook. old
+// is the tracked session the ID conflicts with, if any.
+func (p *Proxy) reportConflict(kind string, id uint16, host, ac net.HardwareAddr, old *SessionInfo) {
+	sessionConflicts.With(kind).Inc()
+	env := []string{
+		fmt.Sprintf("SESSION_ID=0x%04x", id),
+		"HOST_MAC=" + host.String(),
+		"AC_MAC=" + ac.String(),
+		"REASON=" + kind,
+	}
+	if old != nil {
+		log.Printf("session-conflict id=0x%04x host=%s ac=%s kind=%s conflict_host=%s conflict_ac=%s",
+			id, host, ac, kind, old.HostMAC, old.ACMAC)
+		env = append(env, "CONFLICT_HOST_MAC="+old.HostMAC.String(), "CONFLICT_AC_MAC="+old.ACMAC.String())
+	} else {
+		log.Printf("session-conflict id=0x%04x host=%s ac=%s kind=%s", id, host, ac, kind)
+	}
+	p.hooks.Fire(HookSessionConflict, env...)
+}
@@ -1,4 +1,4 @@
-package main
+package pppoeproxy
 
 // Ethernet protocol types
 const (
@@ -8,10 +8,18 @@ const (
 
 // Protocol packet types
 const (
-	PacketTypePing      = 0 // Ping packet for keepalive
-	PacketTypePong      = 1 // Pong response to ping
-	PacketTypeDiscovery = 2 // Discovery packet type for tunnel
-	PacketTypeSession   = 3 // Session packet type for tunnel
+	PacketTypePing        = 0  // Ping packet for keepalive
+	PacketTypePong        = 1  // Pong response to ping
+	PacketTypeDiscovery   = 2  // Discovery packet type for tunnel
+	PacketTypeSession     = 3  // Session packet type for tunnel
+	PacketTypeGoodbye     = 4  // Peer is shutting down and will close the connection
+	PacketTypeHello       = 5  // Version information, sent once when the connection is established
+	PacketTypeSequenced   = 6  // Discovery or session frame preceded by a sequence number and its packet type
+	PacketTypeSessions    = 7  // PPPoE sessions known to the sender, sent after the hello
+	PacketTypeLinkState   = 8  // "up" or "down" when the link of the sender's PPPoE interface changes
+	PacketTypeTimestamped = 9  // Discovery, session or sequenced payload preceded by the capture time of the frame and its packet type
+	PacketTypeChallenge   = 10 // Random bytes sent first by a server authorizing its clients, answered in the hello with a response keyed by the client token
+	PacketTypeCredit      = 11 // Frames of each kind injected since the last grant, each a new credit for the sender: control then data, as 32-bit numbers
 )
 
 // PPPoE Packet types
@@ -22,3 +30,35 @@ const (
 	PADS = 0x65 // PPPoE Active Discovery Session-confirmation
 	PADT = 0xa7 // PPPoE Active Discovery Terminate
 )
+
+// PPPoE discovery tag types (RFC 2516)
+const (
+	TagEndOfList      = 0x0000
+	TagServiceName    = 0x0101
+	TagACName         = 0x0102
+	TagHostUniq       = 0x0103
+	TagACCookie       = 0x0104
+	TagVendorSpecific = 0x0105
+	TagRelaySessionID = 0x0110
+	TagServiceNameErr = 0x0201
+	TagACSystemError  = 0x0202
+	TagGenericError   = 0x0203
+)
+
+// Header sizes
+const (
+	ethernetHeaderSize = 14 // Destination MAC, source MAC and ethertype
+	pppoeHeaderSize    = 6  // Version/type, code, session ID and length
+)
+
+// PPP protocol numbers
+const (
+	PPPProtoIP     = 0x0021 // Internet Protocol version 4
+	PPPProtoIPv6   = 0x0057 // Internet Protocol version 6
+	PPPProtoIPCP   = 0x8021 // IP Control Protocol
+	PPPProtoIPv6CP = 0x8057 // IPv6 Control Protocol
+	PPPProtoCCP    = 0x80fd // Compression Control Protocol
+	PPPProtoLCP    = 0xc021 // Link Control Protocol
+	PPPProtoPAP    = 0xc023 // Password Authentication Protocol
+	PPPProtoCHAP   = 0xc223 // Challenge Handshake Authentication Protocol
+)
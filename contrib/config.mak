@@ -1,3 +1,6 @@
 PROJECT_NAME=pppoeproxy
 DIST_ARCHS=linux_amd64 linux_arm64
 export CGO_ENABLED=0
+
+# Embed the version, commit and build date (see version.go)
+GOLDFLAGS+=-X github.com/KarpelesLab/pppoeproxy.version=$(shell git describe --tags --always --dirty 2>/dev/null) -X github.com/KarpelesLab/goupd.GIT_TAG=$(GIT_TAG) -X github.com/KarpelesLab/goupd.DATE_TAG=$(DATE_TAG)
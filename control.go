@@ -0,0 +1,309 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// DefaultControlSocket is the control socket path used by "pppoeproxy ctl"
+// when none is given
+const DefaultControlSocket = "/run/pppoeproxy.sock"
+
+// controlTimeout bounds how long a control connection may take
+const controlTimeout = 10 * time.Second
+
+// ControlServer serves administrative commands on a local Unix socket. Each
+// connection carries a single command line and receives a plain text reply;
+// replies to failed commands start with "error: ".
+type ControlServer struct {
+	path     string
+	proxy    *Proxy
+	reload   func()
+	listener net.Listener
+	mu       sync.RWMutex
+	extra    map[string]ControlCommand
+}
+
+// ControlCommand implements an additional control command: it writes its
+// reply to w or returns an error
+type ControlCommand func(w io.Writer, args []string) error
+
+// NewControlServer listens on the Unix socket at path. reload is invoked for
+// the "reload" command.
+func NewControlServer(path string, proxy *Proxy, reload func()) (*ControlServer, error) {
+	// Remove a stale socket left by a previous instance
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %v", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set control socket permissions: %v", err)
+	}
+
+	s := &ControlServer{path: path, proxy: proxy, reload: reload, listener: l, extra: make(map[string]ControlCommand)}
+	go s.serve()
+	log.Printf("Control socket listening on %s", path)
+	return s, nil
+}
+
+// Close stops the control server and removes the socket
+func (s *ControlServer) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return err
+}
+
+// SendControlCommand sends a command line to the control socket of a running
+// instance and returns the reply
+func SendControlCommand(socket, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, controlTimeout)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to control socket: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		return "", fmt.Errorf("failed to send command: %v", err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to read reply: %v", err)
+	}
+	return string(reply), nil
+}
+
+// Handle adds a command to the built-in ones
+func (s *ControlServer) Handle(name string, fn ControlCommand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.extra[name] = fn
+}
+
+// serve accepts control connections
+func (s *ControlServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle runs the command sent on a control connection
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		fmt.Fprintf(conn, "error: empty command\n")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := s.run(&buf, args[0], args[1:]); err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+	conn.Write(buf.Bytes())
+}
+
+// run executes a control command, writing its output to w
+func (s *ControlServer) run(w io.Writer, cmd string, args []string) error {
+	switch cmd {
+	case "status":
+		return s.status(w)
+	case "sessions":
+		return s.listSessions(w)
+	case "clients":
+		return s.listClients(w)
+	case "stats":
+		return s.stats(w)
+	case "report":
+		return s.proxy.WriteReport(w)
+	case "kick":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: kick <peer address>")
+		}
+		if err := s.proxy.KickClient(args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "disconnected %s\n", args[0])
+		return nil
+	case "terminate":
+		return s.terminate(w, args)
+	case "reload":
+		if s.reload == nil {
+			return fmt.Errorf("reload is not supported")
+		}
+		s.reload()
+		fmt.Fprintf(w, "configuration reloaded\n")
+		return nil
+	case "help":
+		names := []string{"status", "sessions", "clients", "stats", "report", "kick", "terminate", "reload"}
+		s.mu.RLock()
+		extra := make([]string, 0, len(s.extra))
+		for name := range s.extra {
+			extra = append(extra, name)
+		}
+		s.mu.RUnlock()
+		sort.Strings(extra)
+		fmt.Fprintf(w, "commands: %s\n", strings.Join(append(names, extra...), ", "))
+		return nil
+	}
+
+	s.mu.RLock()
+	fn, ok := s.extra[cmd]
+	s.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return fn(w, args)
+}
+
+// terminate ends the session given as "<session ID> [AC MAC address [host
+// MAC address]]", the host MAC address allowing untracked sessions
+func (s *ControlServer) terminate(w io.Writer, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("usage: terminate <session ID> [AC MAC address [host MAC address]]")
+	}
+	id, err := strconv.ParseUint(args[0], 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid session ID %q", args[0])
+	}
+	var ac net.HardwareAddr
+	if len(args) >= 2 {
+		if ac, err = net.ParseMAC(args[1]); err != nil {
+			return fmt.Errorf("invalid MAC address %q", args[1])
+		}
+	}
+
+	if len(args) == 3 {
+		host, perr := net.ParseMAC(args[2])
+		if perr != nil {
+			return fmt.Errorf("invalid MAC address %q", args[2])
+		}
+		err = s.proxy.KillSessionByMAC(uint16(id), host, ac)
+	} else {
+		err = s.proxy.KillSession(uint16(id), ac)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "terminated session 0x%04x\n", id)
+	return nil
+}
+
+// status writes a summary of the proxy state
+func (s *ControlServer) status(w io.Writer) error {
+	st := s.proxy.Status()
+	health := "ok"
+	if st.Health != "" {
+		health = st.Health
+	} else if st.Degraded != "" {
+		health = "degraded: " + st.Degraded
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "mode:\t%s\n", st.Mode)
+	fmt.Fprintf(tw, "version:\t%s\n", st.Version)
+	fmt.Fprintf(tw, "interface:\t%s\n", st.Interface)
+	if st.ActiveSlave != "" {
+		fmt.Fprintf(tw, "active slave:\t%s\n", st.ActiveSlave)
+	}
+	fmt.Fprintf(tw, "address:\t%s\n", st.Address)
+	fmt.Fprintf(tw, "uptime:\t%s\n", st.Uptime.Round(time.Second))
+	fmt.Fprintf(tw, "health:\t%s\n", health)
+	if st.Mode == "client" {
+		state := "down"
+		if st.TunnelUp {
+			state = "up"
+		}
+		fmt.Fprintf(tw, "tunnel:\t%s\n", state)
+	}
+	fmt.Fprintf(tw, "peers:\t%d\n", st.Peers)
+	fmt.Fprintf(tw, "sessions:\t%d\n", st.Sessions)
+	return tw.Flush()
+}
+
+// listSessions writes the tracked PPPoE sessions
+func (s *ControlServer) listSessions(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tHOST\tAC\tOWNER\tIP\tAUTH\tDURATION\tFRAMES RX/TX\tBYTES RX/TX\n")
+	for _, ses := range s.proxy.Sessions() {
+		ip := "-"
+		if ses.IP.IsValid() {
+			ip = ses.IP.String()
+		}
+		auth := "-"
+		if ses.AuthProtocol != "" {
+			auth = ses.AuthProtocol + " " + authResultName(ses.AuthSuccess)
+			if ses.AuthFailures > 0 {
+				auth += fmt.Sprintf(" (%d failed)", ses.AuthFailures)
+			}
+		}
+		fmt.Fprintf(tw, "0x%04x\t%s\t%s\t%s\t%s\t%s\t%s\t%d/%d\t%d/%d\n",
+			ses.ID, ses.HostMAC, ses.ACMAC, ses.Owner, ip, auth, time.Since(ses.Started).Round(time.Second),
+			ses.FramesRx, ses.FramesTx, ses.BytesRx, ses.BytesTx)
+	}
+	return tw.Flush()
+}
+
+// listClients writes the connected tunnel peers
+func (s *ControlServer) listClients(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "PEER\tNAME\tVERSION\tCONNECTED\tRTT\tRTT AVG\tRTT MAX\n")
+	for _, c := range s.proxy.Peers() {
+		v := c.Version
+		if v == "" {
+			v = "-"
+		}
+		name := c.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Address, name, v, time.Since(c.Connected).Round(time.Second), c.RTT, c.RTTAvg, c.RTTMax)
+	}
+	return tw.Flush()
+}
+
+// stats writes the forwarding counters
+func (s *ControlServer) stats(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "TYPE\tDIRECTION\tFRAMES\tBYTES\n")
+	for _, typ := range []string{"discovery", "session"} {
+		for _, dir := range []string{DirectionRx, DirectionTx} {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", typ, dir, framesTotal.With(typ, dir).Value(), bytesTotal.With(typ, dir).Value())
+		}
+	}
+	fmt.Fprintf(tw, "\nERROR\tCOUNT\n")
+	for _, kind := range errorKinds {
+		fmt.Fprintf(tw, "%s\t%d\n", kind, errorsTotal.With(kind).Value())
+	}
+	fmt.Fprintf(tw, "\nreconnect attempts\t%d\n", reconnectAttempts.Value())
+	fmt.Fprintf(tw, "dead peers\t%d\n", deadPeers.Value())
+	fmt.Fprintf(tw, "write timeouts\t%d\n", writeTimeouts.Value())
+	return tw.Flush()
+}
@@ -0,0 +1,193 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// creditPayloadSize is the size of a PacketTypeCredit payload: the credits
+// granted for control frames, then for data frames
+const creditPayloadSize = 8
+
+// creditsExhausted counts the times tunnel peers ran out of credits
+var creditsExhausted = NewCounterVec("pppoeproxy_tunnel_credits_exhausted_total", "Times the frames of a kind sent to a tunnel peer used up the credits it granted, holding the next ones in the send queue", "queue")
+
+// Credit-based flow control of the tunnel. A peer announcing credit=<n> in its
+// hello understands credit packets and, unless n is 0, accepts n frames of
+// each kind (control and data, as classified by
+// isControlFrame) ahead of their injection, and grants a credit for each frame
+// read from the tunnel once it was injected or dropped. The sender holds the
+// frames of a kind without credits in its send queues, bounded by
+// -tunnel-queue-drop, rather than in the socket buffers, where they would
+// delay the control frames and grow without bound on a receiver that cannot
+// inject fast enough. Frames of the other kind keep flowing.
+
+// isControlFrame reports whether a discovery or session frame is a control
+// frame: a discovery frame, or a session frame of a PPP control protocol
+func isControlFrame(packetType uint16, packet []byte) bool {
+	if packetType == PacketTypeDiscovery {
+		return true
+	}
+	info := decodeFrame(packet)
+	return info.HasPPP && isControlProtocol(info.Protocol)
+}
+
+// tunnelFrameControl reports whether a discovery, session, sequenced or
+// timestamped packet read from a tunnel peer carries a control frame
+func tunnelFrameControl(packetType uint16, data []byte) bool {
+	if packetType == PacketTypeTimestamped && len(data) >= timestampHeaderSize {
+		packetType, data = binary.BigEndian.Uint16(data[8:10]), data[timestampHeaderSize:]
+	}
+	if packetType == PacketTypeSequenced && len(data) >= sequenceHeaderSize {
+		packetType, data = binary.BigEndian.Uint16(data[4:6]), data[sequenceHeaderSize:]
+	}
+	return isControlFrame(packetType, data)
+}
+
+// rxCredits counts the frames read from a tunnel peer, to grant it new
+// credits as they are injected
+type rxCredits struct {
+	mu            sync.Mutex
+	window        int  // Credits announced in our hello, 0 without flow control
+	peer          bool // The peer understands credit packets
+	control, data int  // Frames injected since the last grant
+}
+
+// consume counts a frame read from the peer as injected, and returns the
+// credits to grant once a quarter of the window was used by either kind
+func (c *rxCredits) consume(control bool) (grantControl, grantData int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.window <= 0 || !c.peer {
+		return 0, 0, false
+	}
+	if control {
+		c.control++
+	} else {
+		c.data++
+	}
+	if max(c.control, c.data) < max(c.window/4, 1) {
+		return 0, 0, false
+	}
+	grantControl, grantData = c.control, c.data
+	c.control, c.data = 0, 0
+	return grantControl, grantData, true
+}
+
+// creditHelloField returns the hello field announcing the credits a peer is
+// granted, 0 if flow control is disabled, and starts counting the frames read
+// from the peer to grant it more
+func (p *Proxy) creditHelloField(client *Client) string {
+	window := max(p.cfg().TunnelCredits, 0)
+	client.rxCredits.mu.Lock()
+	client.rxCredits.window = window
+	client.rxCredits.mu.Unlock()
+	return "credit=" + strconv.Itoa(window)
+}
+
+// handleCreditHello applies the credit field of the hello of a peer: the
+// frames sent to it are limited to the credits it announced, and it is
+// granted credits if it understands them. The hello precedes the frames of
+// the peer, so both ends count the frames from the start of the connection.
+func handleCreditHello(client *Client, field string) {
+	window, err := strconv.Atoi(field)
+	if err != nil {
+		return
+	}
+	client.rxCredits.mu.Lock()
+	client.rxCredits.peer = true
+	client.rxCredits.mu.Unlock()
+	if window > 0 {
+		client.tx.limitCredits(window)
+	}
+}
+
+// grantCredit counts a discovery, session, sequenced or timestamped packet
+// read from a tunnel peer as injected, and grants the peer new credits when
+// due
+func (p *Proxy) grantCredit(client *Client, packetType uint16, data []byte) {
+	control, other, ok := client.rxCredits.consume(tunnelFrameControl(packetType, data))
+	if !ok {
+		return
+	}
+	payload := binary.BigEndian.AppendUint32(nil, uint32(control))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(other))
+	if err := client.WritePacket(PacketTypeCredit, payload); err != nil {
+		log.Printf("Error granting credits to %s: %v", client.remoteAddr, err)
+	}
+}
+
+// handleCredit adds the credits granted by a tunnel peer
+func (p *Proxy) handleCredit(client *Client, data []byte) {
+	if len(data) != creditPayloadSize {
+		log.Printf("Invalid credit packet from %s: %d bytes", client.remoteAddr, len(data))
+		return
+	}
+	client.tx.grant(int(binary.BigEndian.Uint32(data[0:4])), int(binary.BigEndian.Uint32(data[4:8])))
+}
+
+// limitCredits starts limiting the frames sent to the credits announced by
+// the peer for each kind, less the frames already sent, which the peer
+// counts as well
+func (q *txQueue) limitCredits(window int) {
+	q.mu.Lock()
+	q.limited = true
+	q.controlCredits = window - q.controlSent
+	q.dataCredits = window - q.dataSent
+	q.mu.Unlock()
+	q.signal()
+}
+
+// grant adds credits granted by the peer
+func (q *txQueue) grant(control, data int) {
+	q.mu.Lock()
+	q.controlCredits += control
+	q.dataCredits += data
+	q.mu.Unlock()
+	q.signal()
+}
+
+// spend charges the credit of a frame sent to the peer. Frames are charged as
+// they are written rather than when popped, as the chaos mode duplicates and
+// drops some.
+func (q *txQueue) spend(control bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	credits := &q.dataCredits
+	if control {
+		q.controlSent++
+		credits = &q.controlCredits
+	} else {
+		q.dataSent++
+	}
+	*credits--
+	if q.limited && *credits == 0 {
+		if control {
+			creditsExhausted.With(txQueueControl).Inc()
+		} else {
+			creditsExhausted.With(txQueueData).Inc()
+		}
+	}
+}
+
+// credits returns the frames of each kind the peer accepts, and whether it
+// limits them
+func (q *txQueue) credits() (control, data int, limited bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.controlCredits, q.dataCredits, q.limited
+}
+
+// sendableLocked reports whether a frame of the given kind may be sent. q.mu
+// must be held.
+func (q *txQueue) sendableLocked(control bool) bool {
+	if !q.limited {
+		return true
+	}
+	if control {
+		return q.controlCredits > 0
+	}
+	return q.dataCredits > 0
+}
@@ -0,0 +1,55 @@
+//go:build !gopacket
+
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// FrameDecoder names the decoder used for the dump filter and hexdumps. Builds
+// with the gopacket tag decode frames with gopacket layers instead of fixed
+// offsets.
+const FrameDecoder = "builtin"
+
+// decodeFrame reads the headers of a PPPoE frame at fixed offsets after the
+// VLAN tags
+func decodeFrame(packet []byte) frameInfo {
+	info := frameInfo{Length: len(packet)}
+	if len(packet) < ethernetHeaderSize {
+		return info
+	}
+	info.HasEther = true
+	info.Dst = net.HardwareAddr(packet[0:6])
+	info.Src = net.HardwareAddr(packet[6:12])
+	var off int
+	info.EtherType, off = framePayload(packet)
+	for tag := ethernetHeaderSize; tag < off; tag += vlanTagSize {
+		info.VLANs = append(info.VLANs, binary.BigEndian.Uint16(packet[tag:tag+2])&0x0fff)
+	}
+
+	if len(packet) < off+pppoeHeaderSize {
+		return info
+	}
+	pppoe := packet[off:]
+	info.HasPPPoE = true
+	info.Version = pppoe[0] >> 4
+	info.Type = pppoe[0] & 0x0f
+	info.Code = pppoe[1]
+	info.Session = binary.BigEndian.Uint16(pppoe[2:4])
+	info.PayloadLength = binary.BigEndian.Uint16(pppoe[4:6])
+
+	if info.EtherType != PPPoESession || len(pppoe) < 8 {
+		return info
+	}
+	info.HasPPP = true
+	info.Protocol = binary.BigEndian.Uint16(pppoe[6:8])
+
+	if isControlProtocol(info.Protocol) && len(pppoe) >= 12 {
+		info.HasControl = true
+		info.CtlCode = pppoe[8]
+		info.CtlID = pppoe[9]
+		info.CtlLength = binary.BigEndian.Uint16(pppoe[10:12])
+	}
+	return info
+}
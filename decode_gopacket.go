@@ -0,0 +1,50 @@
+//go:build gopacket
+
+package pppoeproxy
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// FrameDecoder names the decoder used for the dump filter and hexdumps
+const FrameDecoder = "gopacket"
+
+// decodeFrame decodes the headers of a frame with gopacket layers, following
+// 802.1Q tags and honoring the PPPoE length field
+func decodeFrame(packet []byte) frameInfo {
+	info := frameInfo{Length: len(packet)}
+	p := gopacket.NewPacket(packet, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	for _, layer := range p.Layers() {
+		switch l := layer.(type) {
+		case *layers.Ethernet:
+			info.HasEther = true
+			info.Dst = l.DstMAC
+			info.Src = l.SrcMAC
+			info.EtherType = uint16(l.EthernetType)
+		case *layers.Dot1Q:
+			info.VLANs = append(info.VLANs, l.VLANIdentifier)
+			info.EtherType = uint16(l.Type)
+		case *layers.PPPoE:
+			info.HasPPPoE = true
+			info.Version = l.Version
+			info.Type = l.Type
+			info.Code = uint8(l.Code)
+			info.Session = l.SessionId
+			info.PayloadLength = l.Length
+		case *layers.PPP:
+			info.HasPPP = true
+			info.Protocol = uint16(l.PPPType)
+			if payload := l.Payload; isControlProtocol(info.Protocol) && len(payload) >= 4 {
+				info.HasControl = true
+				info.CtlCode = payload[0]
+				info.CtlID = payload[1]
+				info.CtlLength = binary.BigEndian.Uint16(payload[2:4])
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,181 @@
+package pppoeproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// srvPrefix marks a server address given as a DNS SRV record name
+const srvPrefix = "srv:"
+
+// connectionAttemptDelay is the time given to a connection attempt before the
+// next address is tried in parallel (RFC 8305 section 5)
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// dialServer connects to the server address. A host name is resolved again
+// on every attempt, so a server whose address changes (e.g. dynamic DNS) is
+// found on the next reconnection. The addresses are tried alternating IPv6
+// and IPv4 and racing each other (Happy Eyeballs), so a broken address family
+// only delays the connection by a fraction of a second. With ReconnectRotate,
+// each attempt starts with the next of the resolved addresses, so a server
+// that stopped answering does not delay every attempt.
+func (p *Proxy) dialServer(ctx context.Context) (net.Conn, error) {
+	if name, ok := strings.CutPrefix(p.address, srvPrefix); ok {
+		return dialSRV(ctx, p.dialer(), name)
+	}
+	if name, ok := strings.CutPrefix(p.address, mdnsPrefix); ok {
+		return dialMDNS(ctx, p.dialer(), name)
+	}
+
+	dialer := p.dialer()
+	host, port, err := net.SplitHostPort(p.address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.DialContext(ctx, "tcp", p.address)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if p.localAddr != nil && p.localAddr.IP != nil {
+		// Only addresses of the source address family can be reached
+		is4 := p.localAddr.IP.To4() != nil
+		addrs = slices.DeleteFunc(addrs, func(a netip.Addr) bool { return a.Unmap().Is4() != is4 })
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	if p.cfg().ReconnectRotate {
+		start := int(p.dialRotation.Add(1)-1) % len(addrs)
+		addrs = slices.Concat(addrs[start:], addrs[:start])
+	}
+	targets := make([]string, 0, len(addrs))
+	for _, addr := range interleaveFamilies(addrs) {
+		targets = append(targets, net.JoinHostPort(addr.Unmap().String(), port))
+	}
+	return raceDial(ctx, dialer, p.address, targets)
+}
+
+// interleaveFamilies reorders addresses to alternate between IPv6 and IPv4,
+// starting with the family of the first address and otherwise keeping the
+// resolver's order (RFC 8305 section 4)
+func interleaveFamilies(addrs []netip.Addr) []netip.Addr {
+	var first, second []netip.Addr
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() == addrs[0].Unmap().Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	res := make([]netip.Addr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
+}
+
+// raceDial connects to the first of targets that answers. A new attempt is
+// started every connectionAttemptDelay, or as soon as one fails, without
+// aborting the previous ones; the losing connections are closed.
+func raceDial(ctx context.Context, dialer *net.Dialer, name string, targets []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		addr string
+		err  error
+	}
+	results := make(chan result, len(targets))
+	next, pending := 0, 0
+	startNext := func() {
+		addr := targets[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- result{conn, addr, err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	var errs []error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close the connections of attempts completing meanwhile
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			log.Printf("Failed to connect to %s (%s): %v", name, r.addr, r.err)
+			errs = append(errs, r.err)
+			if next < len(targets) && ctx.Err() == nil {
+				startNext()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(targets) {
+				startNext()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialSRV looks up the SRV records of name and connects to the first target
+// that answers. Targets are tried by priority, and in a random order weighted
+// by their weight within a priority (RFC 2782), so clients are spread over
+// the servers of a priority and fail over to the next priority.
+func dialSRV(ctx context.Context, dialer *net.Dialer, name string) (net.Conn, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records found for %s", name)
+	}
+
+	var errs []error
+	for _, srv := range records {
+		addr := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("Failed to connect to %s (priority %d, weight %d): %v", addr, srv.Priority, srv.Weight, err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
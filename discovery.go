@@ -1,12 +1,16 @@
-package main
+package pppoeproxy
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
-
-	"golang.org/x/sys/unix"
+	"sync/atomic"
+	"time"
 )
 
 // ForwardFunc is a function that forwards a packet
@@ -14,81 +18,115 @@ type ForwardFunc func(packet []byte)
 
 // DiscoveryHandler handles PPPoE discovery packets
 type DiscoveryHandler struct {
-	fd           int
-	isServer     bool
-	interfaceIdx int
-	forwardFunc  ForwardFunc
-	mu           sync.Mutex
+	sock        RawSocket
+	isServer    bool
+	forwardFunc ForwardFunc
+	errorFunc   ErrorFunc
+	logFilter   atomic.Pointer[FrameFilter] // Selects the frames logged, nil logging all
+	injectFails injectFailures
+	mu          sync.Mutex
+	loop        *loopSupervisor
+	captured    time.Time     // Capture time of the frame being forwarded, only used by the receive loop and the forward function
+	running     atomic.Bool   // Set while the receive loop is running
+	done        chan struct{} // Closed when the receive loop exits
+	closeOnce   sync.Once
+	stop        func() bool // Unregisters the context cancellation hook
 }
 
-// NewDiscoveryHandler creates a new handler for PPPoE discovery packets
-func NewDiscoveryHandler(interfaceName string, isServer bool) (*DiscoveryHandler, error) {
-	// Get interface index
-	iface, err := net.InterfaceByName(interfaceName)
-	if err != nil {
-		return nil, fmt.Errorf("interface not found: %v", err)
-	}
-
-	// Create raw socket for PPPoE discovery packets
-	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(PPPoEDiscovery)))
+// NewDiscoveryHandler creates a new handler for PPPoE discovery packets. The handler
+// is closed when ctx is cancelled.
+func NewDiscoveryHandler(ctx context.Context, interfaceName string, isServer bool) (*DiscoveryHandler, error) {
+	sock, err := OpenRawSocket(interfaceName, PPPoEDiscovery)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create socket: %v", err)
-	}
-
-	// Bind to the interface
-	addr := unix.SockaddrLinklayer{
-		Protocol: htons(PPPoEDiscovery),
-		Ifindex:  iface.Index,
-	}
-
-	if err := unix.Bind(fd, &addr); err != nil {
-		unix.Close(fd)
-		return nil, fmt.Errorf("failed to bind socket: %v", err)
+		return nil, err
 	}
+	return NewDiscoveryHandlerWithSocket(ctx, sock, isServer), nil
+}
 
+// NewDiscoveryHandlerWithSocket creates a handler for PPPoE discovery packets
+// using an already opened socket, such as a FakeSegment socket in tests. The
+// handler owns the socket and closes it.
+func NewDiscoveryHandlerWithSocket(ctx context.Context, sock RawSocket, isServer bool) *DiscoveryHandler {
 	handler := &DiscoveryHandler{
-		fd:           fd,
-		isServer:     isServer,
-		interfaceIdx: iface.Index,
+		sock:     sock,
+		isServer: isServer,
+		loop:     newLoopSupervisor("discovery"),
+		done:     make(chan struct{}),
 	}
 
 	// Start packet processing
+	handler.running.Store(true)
 	go handler.processPackets()
+	handler.stop = context.AfterFunc(ctx, func() { handler.Close() })
 
-	return handler, nil
+	return handler
 }
 
-// Close closes the socket
+// Close closes the socket and stops the receive loop. It may be called more
+// than once.
 func (h *DiscoveryHandler) Close() error {
-	return unix.Close(h.fd)
+	var err error
+	h.closeOnce.Do(func() {
+		h.stop()
+		h.loop.close()
+		err = h.sock.Close()
+	})
+	return err
+}
+
+// Running reports whether the receive loop is still running
+func (h *DiscoveryHandler) Running() bool {
+	return h.running.Load()
+}
+
+// Wait blocks until the receive loop has exited after Close
+func (h *DiscoveryHandler) Wait() {
+	<-h.done
 }
 
 // processPackets receives and processes PPPoE discovery packets
 func (h *DiscoveryHandler) processPackets() {
+	defer close(h.done)
+	defer h.running.Store(false)
+
 	buf := make([]byte, 2048)
 	for {
-		n, _, err := unix.Recvfrom(h.fd, buf, 0)
+		n, captured, err := recvTimestamp(h.sock, buf)
 		if err != nil {
-			if err == unix.EINTR {
-				continue
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			errorsTotal.With(ErrorRecv).Inc()
+			delay, persistent := h.loop.failed(err)
+			log.Printf("Error receiving discovery packet, restarting the packet loop in %s: %v", delay.Round(time.Millisecond), err)
+			if persistent != nil {
+				h.reportError(ErrorRecv, persistent)
 			}
-			log.Printf("Error receiving packet: %v", err)
-			return
+			if !h.loop.restart(delay) {
+				return
+			}
+			continue
 		}
+		h.loop.received.Store(true)
 
 		if n < 20 { // Ethernet header (14) + minimum PPPoE header (6)
 			continue
 		}
 
 		packet := buf[:n]
+		h.captured = captured
 		h.handlePacket(packet)
 	}
 }
 
 // handlePacket processes a PPPoE discovery packet
 func (h *DiscoveryHandler) handlePacket(packet []byte) {
-	// Skip the Ethernet header (14 bytes)
-	pppoeHeader := packet[14:]
+	// Skip the Ethernet header and any VLAN tag
+	off := pppoeOffset(packet)
+	if len(packet) < off+pppoeHeaderSize {
+		return
+	}
+	pppoeHeader := packet[off:]
 
 	// Check if this is a PPPoE Discovery packet
 	if pppoeHeader[0] != 0x11 { // PPPoE version 1, type 1
@@ -115,9 +153,12 @@ func (h *DiscoveryHandler) handlePacket(packet []byte) {
 		packetType = fmt.Sprintf("Unknown (0x%02x)", code)
 	}
 
-	log.Printf("PPPoE Discovery packet received: %s, %d bytes", packetType, len(packet))
+	if h.logFilter.Load().Match(packet) {
+		log.Printf("PPPoE Discovery packet received: %s, %d bytes", packetType, len(packet))
+	}
 
 	// Forward the packet to the appropriate endpoint
+	countFrame("discovery", DirectionRx, len(packet))
 	h.forwardPacket(packet)
 }
 
@@ -140,22 +181,50 @@ func (h *DiscoveryHandler) SetForwardFunc(f ForwardFunc) {
 	h.forwardFunc = f
 }
 
+// SetLogFilter sets the expression selecting the frames logged as they are
+// received or injected, nil logging all
+func (h *DiscoveryHandler) SetLogFilter(f *FrameFilter) {
+	h.logFilter.Store(f)
+}
+
+// SetErrorFunc sets the function called when the receive loop fails or frames
+// persistently fail to be injected
+func (h *DiscoveryHandler) SetErrorFunc(f ErrorFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errorFunc = f
+}
+
+// reportError passes an error to the error function, if one is set
+func (h *DiscoveryHandler) reportError(kind string, err error) {
+	h.mu.Lock()
+	errorFunc := h.errorFunc
+	h.mu.Unlock()
+
+	if errorFunc != nil {
+		errorFunc(&Error{Kind: kind, Err: err})
+	}
+}
+
+// injectFailed records an injection error, reporting it once injection has
+// failed persistently
+func (h *DiscoveryHandler) injectFailed(err error) {
+	errorsTotal.With(ErrorInject).Inc()
+	if h.injectFails.failed() {
+		h.reportError(ErrorInject, fmt.Errorf("%d consecutive discovery frames could not be injected: %w", persistentInjectFailures, err))
+	}
+}
+
 // InjectPacket injects a packet into the interface
-func (h *DiscoveryHandler) InjectPacket(packet []byte) {
+func (h *DiscoveryHandler) InjectPacket(packet []byte) error {
 	if len(packet) < 14 {
 		log.Printf("Packet too short to inject: %d bytes", len(packet))
-		return
-	}
-
-	// Prepare sockaddr for packet injection
-	sa := unix.SockaddrLinklayer{
-		Protocol: htons(PPPoEDiscovery),
-		Ifindex:  h.interfaceIdx,
+		return fmt.Errorf("packet too short to inject: %d bytes", len(packet))
 	}
 
 	// Check the packet type
-	if len(packet) >= 15 { // 14 bytes Ethernet header + at least 1 byte for code
-		code := packet[15] // PPPoE packet type code at offset 15
+	if off := pppoeOffset(packet); len(packet) > off+1 { // Ethernet header + version/type + code
+		code := packet[off+1] // PPPoE packet type code
 
 		var packetType string
 		switch code {
@@ -174,17 +243,58 @@ func (h *DiscoveryHandler) InjectPacket(packet []byte) {
 		}
 
 		// Send packet to interface
-		if err := unix.Sendto(h.fd, packet, 0, &sa); err != nil {
+		if err := h.sock.Send(packet); err != nil {
+			h.injectFailed(err)
 			log.Printf("Error injecting discovery packet (%s): %v", packetType, err)
-		} else {
-			log.Printf("Injected %s PPPoE discovery packet, %d bytes", packetType, len(packet))
+			return err
 		}
-	} else {
-		// Send packet to interface (malformed packet case)
-		if err := unix.Sendto(h.fd, packet, 0, &sa); err != nil {
-			log.Printf("Error injecting malformed discovery packet: %v", err)
-		} else {
-			log.Printf("Injected malformed PPPoE discovery packet, %d bytes", len(packet))
+		h.injectFails.succeeded()
+		countFrame("discovery", DirectionTx, len(packet))
+		if h.logFilter.Load().Match(packet) {
+			log.Printf("Injected %s PPPoE discovery packet, %d bytes", packetType, len(packet))
 		}
+		return nil
+	}
+
+	// Send packet to interface (malformed packet case)
+	if err := h.sock.Send(packet); err != nil {
+		h.injectFailed(err)
+		log.Printf("Error injecting malformed discovery packet: %v", err)
+		return err
+	}
+	h.injectFails.succeeded()
+	countFrame("discovery", DirectionTx, len(packet))
+	if h.logFilter.Load().Match(packet) {
+		log.Printf("Injected malformed PPPoE discovery packet, %d bytes", len(packet))
+	}
+	return nil
+}
+
+// buildPADT builds a PADT frame for the given session from src to dst. If
+// reason is not empty it is sent in a Generic-Error tag.
+func buildPADT(sessionID uint16, dst, src net.HardwareAddr, reason string) []byte {
+	payloadLen := 0
+	if reason != "" {
+		payloadLen = 4 + len(reason)
+	}
+
+	packet := make([]byte, ethernetHeaderSize+pppoeHeaderSize+payloadLen)
+	copy(packet[0:6], dst)
+	copy(packet[6:12], src)
+	binary.BigEndian.PutUint16(packet[12:14], PPPoEDiscovery)
+
+	pppoe := packet[ethernetHeaderSize:]
+	pppoe[0] = 0x11 // Version 1, type 1
+	pppoe[1] = PADT
+	binary.BigEndian.PutUint16(pppoe[2:4], sessionID)
+	binary.BigEndian.PutUint16(pppoe[4:6], uint16(payloadLen))
+
+	if reason != "" {
+		tag := pppoe[pppoeHeaderSize:]
+		binary.BigEndian.PutUint16(tag[0:2], TagGenericError)
+		binary.BigEndian.PutUint16(tag[2:4], uint16(len(reason)))
+		copy(tag[4:], reason)
 	}
+
+	return packet
 }
@@ -0,0 +1,42 @@
+// Package pppoeproxy forwards PPPoE discovery and session frames between two
+// Ethernet segments through a TCP tunnel.
+//
+// One end runs in server mode on the segment of the access concentrator and
+// the other in client mode on the segment of the PPPoE hosts. Run starts
+// the packet handlers and the proxy and blocks until the context is
+// cancelled:
+//
+//	err := pppoeproxy.Run(ctx, pppoeproxy.Config{
+//		Interface: "eth0",
+//		Address:   "192.168.1.1:8000",
+//	})
+//
+// The parts can also be created separately, to use the proxy while it runs.
+// Each of them is closed when its context is cancelled:
+//
+//	discovery, err := pppoeproxy.NewDiscoveryHandler(ctx, "eth0", false)
+//	...
+//	session, err := pppoeproxy.NewSessionHandler(ctx, "eth0", false)
+//	...
+//	proxy, err := pppoeproxy.NewProxy(ctx, config, discovery, session)
+//	...
+//	proxy.Wait()
+//
+// Handlers created with NewDiscoveryHandlerWithSocket and
+// NewSessionHandlerWithSocket can use the sockets of a FakeSegment instead of
+// a real interface, to exercise the proxy in tests without root privileges.
+//
+// Settings left to their zero value are disabled, except the reconnection
+// backoff which defaults to the values used by the command line tool.
+// Frames can be filtered, rewritten or inspected by registering Middleware,
+// which every frame goes through before being forwarded into the tunnel or
+// injected on the interface:
+//
+//	proxy.Use(func(direction string, packet []byte) ([]byte, bool) {
+//		// Drop PADT frames coming from the tunnel
+//		return packet, direction == pppoeproxy.DirectionRx || packet[15] != pppoeproxy.PADT
+//	})
+//
+// The command line tool in cmd/pppoeproxy adds configuration handling,
+// daemonization and self-updates on top of this package.
+package pppoeproxy
@@ -0,0 +1,169 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// shutdownPADTReason is sent in the Generic-Error tag of PADTs generated on shutdown
+const shutdownPADTReason = "pppoeproxy shutting down"
+
+// peers returns the tunnel connections currently established
+func (p *Proxy) peers() []*Client {
+	if p.isServer {
+		p.clientsMu.RLock()
+		defer p.clientsMu.RUnlock()
+		res := make([]*Client, 0, len(p.clients))
+		for _, c := range p.clients {
+			res = append(res, c)
+		}
+		return res
+	}
+
+	p.serverMu.Lock()
+	defer p.serverMu.Unlock()
+	if p.server == nil {
+		return nil
+	}
+	return []*Client{p.server}
+}
+
+// TerminateSession tears down a PPPoE session by sending a PADT to both ends:
+// one is injected on the local interface and the other is sent through the
+// tunnel for the peer to inject. The session is then removed from the table.
+func (p *Proxy) TerminateSession(s SessionInfo, reason, padtReason string) {
+	toAC := buildPADT(s.ID, s.ACMAC, s.HostMAC, padtReason)
+	toHost := buildPADT(s.ID, s.HostMAC, s.ACMAC, padtReason)
+
+	// The AC is on the server side of the tunnel, the host on the client side
+	local, remote := toHost, toAC
+	if p.isServer {
+		local, remote = toAC, toHost
+	}
+
+	p.discoveryHandler.InjectPacket(local)
+
+	for _, peer := range p.peers() {
+		if s.Owner != "" && peer.remoteAddr != s.Owner {
+			continue
+		}
+		// Sent ahead of the queued frames, but charged like them
+		peer.tx.spend(true)
+		if err := peer.WritePacket(PacketTypeDiscovery, remote); err != nil {
+			p.reportError(ErrorTunnelWrite, peer.remoteAddr, err)
+			log.Printf("Error sending PADT to %s: %v", peer.remoteAddr, err)
+		}
+	}
+
+	var key sessionKey
+	key.ID = s.ID
+	copy(key.AC[:], s.ACMAC)
+	p.sessions.end(key, reason)
+}
+
+// Drain gracefully winds down the proxy before Close: it stops accepting new
+// tunnel clients, optionally terminates tracked sessions with PADTs, sends a
+// goodbye frame to tunnel peers and waits up to timeout for them to
+// disconnect. Frames being written when Drain is called are completed first.
+func (p *Proxy) Drain(sendPADT bool, timeout time.Duration) {
+	p.draining.Store(true)
+	deadline := time.After(timeout)
+
+	// Stop accepting new clients and reconnecting
+	p.closeListeners()
+	p.stopReconnect()
+
+	if sendPADT {
+		sessions := p.sessions.List()
+		for _, s := range sessions {
+			p.TerminateSession(s, ReasonShutdown, shutdownPADTReason)
+		}
+		if len(sessions) > 0 {
+			log.Printf("Sent PADT for %d session(s)", len(sessions))
+		}
+	}
+
+	// WritePacket holds the write lock, so any frame in flight is completed
+	// before the goodbye is sent
+	peers := p.peers()
+	for _, peer := range peers {
+		if err := peer.WritePacket(PacketTypeGoodbye, nil); err != nil {
+			log.Printf("Error sending goodbye to %s: %v", peer.remoteAddr, err)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	log.Printf("Waiting up to %s for %d tunnel peer(s) to disconnect", timeout, len(peers))
+	if p.isServer {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			p.clientsMu.RLock()
+			remaining := len(p.clients)
+			p.clientsMu.RUnlock()
+			if remaining == 0 {
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-deadline:
+				log.Printf("Drain timeout, %d client(s) still connected", remaining)
+				return
+			}
+		}
+	}
+
+	p.serverMu.Lock()
+	done := p.serverDone
+	p.serverMu.Unlock()
+	select {
+	case <-done:
+	case <-deadline:
+		log.Printf("Drain timeout, server did not close the connection")
+	}
+}
+
+// Handoff prepares the replacement of the proxy by a new process, such as a
+// restart after an update. It returns duplicates of the tunnel listeners for
+// the new process, in the order of their addresses (none in client mode, nil
+// for a listener that cannot be duplicated), and sends a goodbye to the tunnel
+// peers so they reconnect right away; PPPoE sessions are kept. Resume undoes
+// it if the replacement failed.
+func (p *Proxy) Handoff() ([]*os.File, error) {
+	files := make([]*os.File, len(p.listeners))
+	for i, l := range p.listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			for _, f := range files[:i] {
+				if f != nil {
+					f.Close()
+				}
+			}
+			return nil, fmt.Errorf("failed to duplicate listener: %v", err)
+		}
+		files[i] = f
+	}
+
+	p.draining.Store(true)
+	for _, peer := range p.peers() {
+		peer.WritePacket(PacketTypeGoodbye, nil)
+	}
+	// The new process restores the sessions from the state file
+	p.saveState()
+	return files, nil
+}
+
+// Resume returns to normal operation after a failed Handoff
+func (p *Proxy) Resume() {
+	p.draining.Store(false)
+}
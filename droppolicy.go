@@ -0,0 +1,81 @@
+package pppoeproxy
+
+import "fmt"
+
+// Queue drop metrics
+var queueDrops = NewCounterVec("pppoeproxy_queue_dropped_total", "Frames dropped because a bounded queue was full, by queue, drop policy and kind of the dropped frame", "queue", "policy", "kind")
+
+// DropPolicy selects the frame dropped when a bounded queue is full
+type DropPolicy string
+
+// Drop policies
+const (
+	DropTail        DropPolicy = "tail"         // The arriving frame
+	DropHead        DropPolicy = "head"         // The oldest queued frame of the same kind, preferring fresh frames
+	DropKeepControl DropPolicy = "keep-control" // A data frame: the oldest one queued for an arriving control frame, the arriving one otherwise
+)
+
+// ParseDropPolicy parses a drop policy name
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch policy := DropPolicy(s); policy {
+	case DropTail, DropHead, DropKeepControl:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid drop policy %q (tail, head or keep-control)", s)
+}
+
+// or returns the policy, or def if it is not set
+func (policy DropPolicy) or(def DropPolicy) DropPolicy {
+	if policy == "" {
+		return def
+	}
+	return policy
+}
+
+// countDrop counts a frame dropped from a queue
+func (policy DropPolicy) countDrop(queue string, f txFrame) {
+	kind := txQueueData
+	if f.control {
+		kind = txQueueControl
+	}
+	queueDrops.With(queue, string(policy), kind).Inc()
+}
+
+// dropIndex returns the index of the frame to drop from a full queue holding
+// frames in arrival order to make room for f, or -1 to drop f. Control frames
+// are never dropped for a data frame.
+func (policy DropPolicy) dropIndex(queue []txFrame, f txFrame) int {
+	switch policy {
+	case DropHead:
+		// The oldest frame of the same kind, or the oldest data frame for
+		// a control frame
+		oldestData := -1
+		for i, queued := range queue {
+			if queued.control == f.control {
+				return i
+			}
+			if oldestData < 0 && !queued.control {
+				oldestData = i
+			}
+		}
+		return oldestData
+	case DropKeepControl:
+		if !f.control {
+			return -1
+		}
+		for i, queued := range queue {
+			if !queued.control {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// shift removes the first frame of a queue
+func shift(queue *[]txFrame) txFrame {
+	f := (*queue)[0]
+	(*queue)[0] = txFrame{}
+	*queue = (*queue)[1:]
+	return f
+}
@@ -0,0 +1,61 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// dscpNames maps the standard DSCP names to their values (RFC 2474, RFC
+// 2597, RFC 3246)
+var dscpNames = map[string]int{
+	"EF": 46,
+	"VA": 44,
+}
+
+// ParseDSCP parses a DSCP value: a number from 0 to 63, or a name such as EF,
+// AF41 or CS6
+func ParseDSCP(s string) (int, error) {
+	name := strings.ToUpper(s)
+	if v, ok := dscpNames[name]; ok {
+		return v, nil
+	}
+	if class, ok := strings.CutPrefix(name, "CS"); ok && len(class) == 1 && class[0] >= '0' && class[0] <= '7' {
+		return int(class[0]-'0') << 3, nil
+	}
+	if af, ok := strings.CutPrefix(name, "AF"); ok && len(af) == 2 && af[0] >= '1' && af[0] <= '4' && af[1] >= '1' && af[1] <= '3' {
+		return int(af[0]-'0')<<3 | int(af[1]-'0')<<1, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || v > 63 {
+		return 0, fmt.Errorf("invalid DSCP %q", s)
+	}
+	return int(v), nil
+}
+
+// setDSCP marks the packets of a tunnel connection with a DSCP value, in the
+// TOS field of IPv4 packets and the traffic class of IPv6 packets
+func setDSCP(conn net.Conn, dscp int) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	tos := dscp << 2 // Leaving the ECN bits to the system
+	var err error
+	if addr.IP.To4() != nil {
+		if err = ipv4.NewConn(conn).SetTOS(tos); err != nil {
+			// IPv4 client of a dual-stack listener
+			err = ipv6.NewConn(conn).SetTrafficClass(tos)
+		}
+	} else {
+		err = ipv6.NewConn(conn).SetTrafficClass(tos)
+	}
+	if err != nil {
+		log.Printf("Error setting DSCP on %s: %v", addr, err)
+	}
+}
@@ -0,0 +1,157 @@
+package pppoeproxy
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// StateDump is the complete runtime state of the proxy, for troubleshooting
+type StateDump struct {
+	Time       time.Time          `json:"time"`
+	Status     ProxyStatus        `json:"status"`
+	Config     map[string]any     `json:"config"`
+	Interfaces []InterfaceDump    `json:"interfaces"`
+	Loops      []LoopDump         `json:"packet_loops"`
+	Peers      []PeerDump         `json:"peers"`
+	Sessions   []apiSession       `json:"sessions"`
+	Endpoints  []EndpointDump     `json:"endpoints"`
+	Reconnect  int                `json:"reconnect_queue"` // Frames waiting for the connection to the server (client mode)
+	Metrics    map[string]float64 `json:"metrics"`         // Every metric series, as exposed to Prometheus
+}
+
+// InterfaceDump describes an interface the PPPoE frames are proxied on
+type InterfaceDump struct {
+	Name  string `json:"name"`
+	Index int    `json:"index"`
+	MTU   int    `json:"mtu"`
+	MAC   string `json:"mac"`
+	Flags string `json:"flags"`
+}
+
+// LoopDump describes a packet loop and its socket
+type LoopDump struct {
+	Type      string `json:"type"` // "discovery" or "session"
+	Running   bool   `json:"running"`
+	Health    string `json:"health,omitempty"`     // Repeated failures, empty when healthy
+	LastError string `json:"last_error,omitempty"` // Last receive error
+}
+
+// PeerDump describes a tunnel peer and its send queues
+type PeerDump struct {
+	PeerInfo
+	QueuedControl int `json:"queued_control"` // Discovery and PPP control frames waiting to be sent
+	QueuedData    int `json:"queued_data"`    // Other session frames waiting to be sent
+
+	// Frames of each kind the peer accepts, when it announced credits
+	CreditsControl *int `json:"credits_control,omitempty"`
+	CreditsData    *int `json:"credits_data,omitempty"`
+}
+
+// EndpointDump describes a MAC address seen on the proxied segment
+type EndpointDump struct {
+	MAC       string    `json:"mac"`
+	Role      string    `json:"role"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Dump returns the complete runtime state of the proxy: configuration,
+// interfaces, packet loops, tunnel peers and their queues, sessions,
+// endpoints and metrics
+func (p *Proxy) Dump() StateDump {
+	cfg := p.cfg()
+	d := StateDump{
+		Time:      time.Now(),
+		Status:    p.Status(),
+		Config:    dumpConfig(cfg),
+		Peers:     []PeerDump{},
+		Sessions:  []apiSession{},
+		Endpoints: []EndpointDump{},
+		Reconnect: p.reconnectQueue.len(),
+		Metrics:   snapshotMetrics(),
+	}
+
+	if ifaces, err := FindInterfaces(cfg.Interface); err == nil {
+		for _, ifi := range ifaces {
+			d.Interfaces = append(d.Interfaces, InterfaceDump{
+				Name:  ifi.Name,
+				Index: ifi.Index,
+				MTU:   ifi.MTU,
+				MAC:   ifi.HardwareAddr.String(),
+				Flags: ifi.Flags.String(),
+			})
+		}
+	}
+
+	for _, loop := range []struct {
+		running bool
+		sup     *loopSupervisor
+	}{
+		{p.discoveryHandler.Running(), p.discoveryHandler.loop},
+		{p.sessionHandler.Running(), p.sessionHandler.loop},
+	} {
+		l := LoopDump{Type: loop.sup.kind, Running: loop.running}
+		if err := loop.sup.health(); err != nil {
+			l.Health = err.Error()
+		}
+		loop.sup.mu.Lock()
+		if loop.sup.lastErr != nil {
+			l.LastError = loop.sup.lastErr.Error()
+		}
+		loop.sup.mu.Unlock()
+		d.Loops = append(d.Loops, l)
+	}
+
+	queues := make(map[string]*txQueue)
+	for _, c := range p.peers() {
+		queues[c.remoteAddr] = c.tx
+	}
+	for _, info := range p.Peers() {
+		peer := PeerDump{PeerInfo: info}
+		if q := queues[info.Address]; q != nil {
+			peer.QueuedControl, peer.QueuedData = q.len()
+			if control, data, ok := q.credits(); ok {
+				peer.CreditsControl, peer.CreditsData = &control, &data
+			}
+		}
+		d.Peers = append(d.Peers, peer)
+	}
+
+	for _, s := range p.Sessions() {
+		d.Sessions = append(d.Sessions, newAPISession(s))
+	}
+
+	for _, e := range p.endpoints.List() {
+		d.Endpoints = append(d.Endpoints, EndpointDump{MAC: e.MAC.String(), Role: e.Role, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen})
+	}
+	sort.Slice(d.Endpoints, func(i, j int) bool { return d.Endpoints[i].MAC < d.Endpoints[j].MAC })
+
+	return d
+}
+
+// dumpConfig returns the settings of cfg by field name. Durations are given
+// as strings, optional features (filters, recorder, GeoIP...) as whether they
+// are enabled, lists as their length, and the authorization URL, which may
+// embed credentials, and token only as whether they are set.
+func dumpConfig(cfg *Config) map[string]any {
+	res := make(map[string]any)
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		f := v.Field(i)
+		switch {
+		case name == "AuthURL" || name == "AuthToken":
+			res[name] = f.String() != ""
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			res[name] = time.Duration(f.Int()).String()
+		case f.Kind() == reflect.Pointer || f.Kind() == reflect.Interface:
+			res[name] = !f.IsNil()
+		case f.Kind() == reflect.Slice:
+			res[name] = f.Len()
+		default:
+			res[name] = f.Interface()
+		}
+	}
+	return res
+}
@@ -0,0 +1,149 @@
+package pppoeproxy
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Endpoint roles
+const (
+	RoleHost = "host" // PPPoE client (CPE)
+	RoleAC   = "ac"   // PPPoE access concentrator
+)
+
+// Endpoint metrics
+var (
+	endpointsSeen     = NewGaugeVec("pppoeproxy_endpoints", "Number of distinct MAC addresses seen", "interface", "role")
+	endpointFirstSeen = NewGaugeVec("pppoeproxy_endpoint_first_seen_timestamp_seconds", "Time a MAC address was first seen", "interface", "role", "mac")
+	endpointLastSeen  = NewGaugeVec("pppoeproxy_endpoint_last_seen_timestamp_seconds", "Time a MAC address was last seen", "interface", "role", "mac")
+)
+
+// EndpointInfo describes a MAC address seen on the proxied segment
+type EndpointInfo struct {
+	MAC       net.HardwareAddr
+	Role      string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// endpoint is a tracked endpoint along with its last-seen gauge
+type endpoint struct {
+	EndpointInfo
+	lastSeen *Gauge
+}
+
+// EndpointTracker records the distinct hosts and ACs seen on an interface
+type EndpointTracker struct {
+	iface     string
+	mu        sync.Mutex
+	endpoints map[string]*endpoint // Keyed by role and MAC
+}
+
+// NewEndpointTracker creates a tracker for the given interface
+func NewEndpointTracker(iface string) *EndpointTracker {
+	endpointsSeen.With(iface, RoleHost)
+	endpointsSeen.With(iface, RoleAC)
+	return &EndpointTracker{
+		iface:     iface,
+		endpoints: make(map[string]*endpoint),
+	}
+}
+
+// ObserveDiscovery records the sender of a discovery packet (including the
+// Ethernet header) based on the packet code
+func (t *EndpointTracker) ObserveDiscovery(packet []byte) {
+	off := pppoeOffset(packet)
+	if len(packet) < off+pppoeHeaderSize {
+		return
+	}
+
+	switch packet[off+1] {
+	case PADI, PADR:
+		t.seen(RoleHost, packet[6:12])
+	case PADO, PADS:
+		t.seen(RoleAC, packet[6:12])
+	case PADT:
+		// PADT can come from either side, only refresh known endpoints
+		t.refresh(packet[6:12])
+	}
+}
+
+// ObserveSession refreshes the last-seen time of the endpoints of a session packet
+func (t *EndpointTracker) ObserveSession(packet []byte) {
+	if ethertype, _ := framePayload(packet); ethertype != PPPoESession {
+		return
+	}
+	t.refresh(packet[6:12])
+}
+
+// seen records that mac was seen acting in the given role
+func (t *EndpointTracker) seen(role string, mac []byte) {
+	key := role + string(mac)
+	now := time.Now()
+
+	t.mu.Lock()
+	e, ok := t.endpoints[key]
+	if !ok {
+		e = &endpoint{
+			EndpointInfo: EndpointInfo{
+				MAC:       net.HardwareAddr(append([]byte{}, mac...)),
+				Role:      role,
+				FirstSeen: now,
+			},
+		}
+		e.lastSeen = endpointLastSeen.With(t.iface, role, e.MAC.String())
+		t.endpoints[key] = e
+		endpointsSeen.With(t.iface, role).Add(1)
+		endpointFirstSeen.With(t.iface, role, e.MAC.String()).Set(float64(now.Unix()))
+	}
+	e.LastSeen = now
+	e.lastSeen.Set(float64(now.Unix()))
+	t.mu.Unlock()
+
+	if !ok {
+		log.Printf("New %s MAC address seen on %s: %s", role, t.iface, e.MAC)
+	}
+}
+
+// refresh updates the last-seen time of mac if it is already known
+func (t *EndpointTracker) refresh(mac []byte) {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, role := range []string{RoleHost, RoleAC} {
+		if e, ok := t.endpoints[role+string(mac)]; ok {
+			e.LastSeen = now
+			e.lastSeen.Set(float64(now.Unix()))
+		}
+	}
+}
+
+// List returns a copy of all endpoints seen
+func (t *EndpointTracker) List() []EndpointInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]EndpointInfo, 0, len(t.endpoints))
+	for _, e := range t.endpoints {
+		res = append(res, e.EndpointInfo)
+	}
+	return res
+}
+
+// latest returns the endpoint of a role seen last, or nil if none was
+func (t *EndpointTracker) latest(role string) net.HardwareAddr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res *endpoint
+	for _, e := range t.endpoints {
+		if e.Role == role && (res == nil || e.LastSeen.After(res.LastSeen)) {
+			res = e
+		}
+	}
+	if res == nil {
+		return nil
+	}
+	return res.MAC
+}
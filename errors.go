@@ -0,0 +1,71 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// persistentInjectFailures is the number of consecutive injection failures
+// after which the interface is reported as failing
+const persistentInjectFailures = 10
+
+// Error describes a failure reported to the ErrorFunc of a proxy
+type Error struct {
+	Kind string // One of the Error* kinds
+	Peer string // Address of the tunnel peer or admin client involved, if any
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Peer != "" {
+		return fmt.Sprintf("%s (%s): %v", e.Kind, e.Peer, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorFunc receives the errors of a proxy and its packet handlers: a packet
+// loop failing repeatedly on a raw socket error (ErrorRecv), frames repeatedly failing
+// to be injected (ErrorInject), tunnel read and write errors and rejected
+// clients (ErrorAuth). It is called from the goroutine that hit the error and
+// must not block.
+type ErrorFunc func(err *Error)
+
+// SetErrorFunc sets the function receiving the errors of the proxy. Errors are
+// logged and counted in the errors metric whether a function is set or not.
+func (p *Proxy) SetErrorFunc(f ErrorFunc) {
+	p.errorFunc.Store(&f)
+}
+
+// reportError counts an error in the errors metric and passes it to the error
+// function
+func (p *Proxy) reportError(kind, peer string, err error) {
+	errorsTotal.With(kind).Inc()
+	p.notifyError(&Error{Kind: kind, Peer: peer, Err: err})
+}
+
+// notifyError passes an error to the error function, if one is set
+func (p *Proxy) notifyError(err *Error) {
+	if f := p.errorFunc.Load(); f != nil && *f != nil {
+		(*f)(err)
+	}
+}
+
+// injectFailures tracks consecutive injection failures of a packet handler
+type injectFailures struct {
+	count atomic.Int32
+}
+
+// failed records a failure and returns true when the failures have become
+// persistent, once per run of failures
+func (f *injectFailures) failed() bool {
+	return f.count.Add(1) == persistentInjectFailures
+}
+
+// succeeded ends a run of failures
+func (f *injectFailures) succeeded() {
+	f.count.Store(0)
+}
@@ -0,0 +1,110 @@
+package pppoeproxy
+
+import (
+	"os"
+	"sync"
+)
+
+// fakeQueueSize is the number of frames a fake socket holds before dropping
+// new ones, like a full socket buffer
+const fakeQueueSize = 256
+
+// FakeSegment is an in-memory Ethernet segment. Frames sent by one of its
+// sockets are received by every other socket of the segment bound to the
+// frame's ethertype, so handlers and whole proxies can be run without root or
+// real interfaces.
+type FakeSegment struct {
+	mu      sync.Mutex
+	sockets []*fakeSocket
+}
+
+// NewFakeSegment creates an empty segment
+func NewFakeSegment() *FakeSegment {
+	return &FakeSegment{}
+}
+
+// Open returns a new socket on the segment receiving the frames of the given
+// ethertype. Its signature matches OpenRawSocket, the interface name is
+// ignored.
+func (seg *FakeSegment) Open(interfaceName string, ethertype uint16) (RawSocket, error) {
+	s := &fakeSocket{
+		segment:   seg,
+		ethertype: ethertype,
+		queue:     make(chan []byte, fakeQueueSize),
+		closed:    make(chan struct{}),
+	}
+	seg.mu.Lock()
+	seg.sockets = append(seg.sockets, s)
+	seg.mu.Unlock()
+	return s, nil
+}
+
+// deliver queues a copy of frame on every socket of the segment other than
+// the sender
+func (seg *FakeSegment) deliver(from *fakeSocket, frame []byte) {
+	if len(frame) < ethernetHeaderSize {
+		return
+	}
+	ethertype, _ := framePayload(frame)
+
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	for _, s := range seg.sockets {
+		if s == from || s.ethertype != ethertype {
+			continue
+		}
+		select {
+		case s.queue <- append([]byte(nil), frame...):
+		default:
+			// Receiver is not keeping up, the frame is lost
+		}
+	}
+}
+
+// remove detaches a closed socket from the segment
+func (seg *FakeSegment) remove(s *fakeSocket) {
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	for i, other := range seg.sockets {
+		if other == s {
+			seg.sockets = append(seg.sockets[:i], seg.sockets[i+1:]...)
+			return
+		}
+	}
+}
+
+// fakeSocket is a RawSocket attached to a FakeSegment
+type fakeSocket struct {
+	segment   *FakeSegment
+	ethertype uint16
+	queue     chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *fakeSocket) Recv(buf []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, os.ErrClosed
+	case frame := <-s.queue:
+		return copy(buf, frame), nil
+	}
+}
+
+func (s *fakeSocket) Send(frame []byte) error {
+	select {
+	case <-s.closed:
+		return os.ErrClosed
+	default:
+	}
+	s.segment.deliver(s, frame)
+	return nil
+}
+
+func (s *fakeSocket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.segment.remove(s)
+	})
+	return nil
+}
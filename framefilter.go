@@ -0,0 +1,249 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FrameFilter selects frames with a display-filter style expression on their
+// headers, such as "session == 0x1234 && (code == PADT || ppp == LCP)".
+//
+// Comparisons are "<field> == <value>" and "<field> != <value>" (also eq and
+// ne), on the fields:
+//
+//	code              PPPoE code, by name (PADI, PADO, PADR, PADS, PADT, SESSION) or number
+//	session           PPPoE session ID
+//	mac, eth.addr     source or destination MAC address
+//	eth.src, eth.dst  source or destination MAC address
+//	ppp               PPP protocol, by name (LCP, PAP, CHAP, IPCP, IPv4...) or number
+//	vlan              ID of any VLAN tag
+//
+// They are combined with && (and), || (or), ! (not) and parentheses. A
+// comparison on a header the frame does not have is false, with == as with
+// !=: "ppp != LCP" only matches session frames.
+type FrameFilter struct {
+	expr string
+	root filterNode
+}
+
+// filterNode is a node of a compiled filter expression
+type filterNode interface {
+	match(info *frameInfo) bool
+}
+
+type filterAnd struct{ a, b filterNode }
+type filterOr struct{ a, b filterNode }
+type filterNot struct{ a filterNode }
+
+func (n filterAnd) match(info *frameInfo) bool { return n.a.match(info) && n.b.match(info) }
+func (n filterOr) match(info *frameInfo) bool  { return n.a.match(info) || n.b.match(info) }
+func (n filterNot) match(info *frameInfo) bool { return !n.a.match(info) }
+
+// filterCompare compares a header field with a value
+type filterCompare struct {
+	eq    func(info *frameInfo) (bool, bool) // Whether the frame has the field, and whether it has the value
+	equal bool                               // == rather than !=
+}
+
+func (n filterCompare) match(info *frameInfo) bool {
+	has, eq := n.eq(info)
+	return has && eq == n.equal
+}
+
+// ParseFrameFilter compiles a filter expression
+func ParseFrameFilter(expr string) (*FrameFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", expr, err)
+	}
+	return &FrameFilter{expr: expr, root: root}, nil
+}
+
+// Match reports whether a frame (including the Ethernet header) matches the
+// filter. A nil filter matches every frame.
+func (f *FrameFilter) Match(packet []byte) bool {
+	if f == nil {
+		return true
+	}
+	info := decodeFrame(packet)
+	return f.root.match(&info)
+}
+
+// String returns the expression of the filter
+func (f *FrameFilter) String() string {
+	return f.expr
+}
+
+// tokenizeFilter splits an expression into operators, parentheses and words
+func tokenizeFilter(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||") ||
+			strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case c == '!':
+			tokens = append(tokens, "!")
+			i++
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t()&|=!", rune(expr[j])) {
+				j++
+			}
+			if j == i {
+				// A lone & | or =
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// filterParser is a recursive descent parser of filter expressions
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+// peek returns the next token, lowercased, or "" at the end
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+// next consumes and returns the next token
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	n, err := p.parseAnd()
+	for err == nil && (p.peek() == "||" || p.peek() == "or") {
+		p.pos++
+		var b filterNode
+		if b, err = p.parseAnd(); err == nil {
+			n = filterOr{n, b}
+		}
+	}
+	return n, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	n, err := p.parseUnary()
+	for err == nil && (p.peek() == "&&" || p.peek() == "and") {
+		p.pos++
+		var b filterNode
+		if b, err = p.parseUnary(); err == nil {
+			n = filterAnd{n, b}
+		}
+	}
+	return n, err
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch p.peek() {
+	case "!", "not":
+		p.pos++
+		n, err := p.parseUnary()
+		return filterNot{n}, err
+	case "(":
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return n, nil
+	}
+	return p.parseCompare()
+}
+
+// parseCompare parses a "<field> <operator> <value>" comparison
+func (p *filterParser) parseCompare() (filterNode, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	var n filterCompare
+	switch op := p.peek(); op {
+	case "==", "eq":
+		n.equal = true
+	case "!=", "ne":
+	default:
+		return nil, fmt.Errorf("expected == or != after %q", field)
+	}
+	p.pos++
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if n.eq, err = filterField(strings.ToLower(field), value); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// filterField returns the function checking whether a frame has a field, and
+// whether the field has a value
+func filterField(field, value string) (func(info *frameInfo) (bool, bool), error) {
+	switch field {
+	case "code", "pppoe.code":
+		code, err := parsePPPoECode(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(info *frameInfo) (bool, bool) { return info.HasPPPoE, info.Code == code }, nil
+	case "session", "pppoe.session":
+		v, err := strconv.ParseUint(value, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session ID %q", value)
+		}
+		return func(info *frameInfo) (bool, bool) { return info.HasPPPoE, info.Session == uint16(v) }, nil
+	case "mac", "eth.addr", "eth.src", "eth.dst":
+		mac, err := net.ParseMAC(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q", value)
+		}
+		src, dst := field != "eth.dst", field != "eth.src"
+		return func(info *frameInfo) (bool, bool) {
+			return info.HasEther, src && bytes.Equal(info.Src, mac) || dst && bytes.Equal(info.Dst, mac)
+		}, nil
+	case "ppp", "ppp.protocol":
+		proto, err := parsePPPProtocol(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(info *frameInfo) (bool, bool) { return info.HasPPP, info.Protocol == proto }, nil
+	case "vlan", "vlan.id":
+		v, err := strconv.ParseUint(value, 0, 12)
+		if err != nil {
+			return nil, fmt.Errorf("invalid VLAN ID %q", value)
+		}
+		return func(info *frameInfo) (bool, bool) { return len(info.VLANs) > 0, slices.Contains(info.VLANs, uint16(v)) }, nil
+	}
+	return nil, fmt.Errorf("unknown field %q", field)
+}
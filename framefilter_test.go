@@ -0,0 +1,94 @@
+package pppoeproxy
+
+import "testing"
+
+func TestFrameFilterMatch(t *testing.T) {
+	// PADI from 02:00:00:00:00:01, and an LCP frame of session 0x1234 on
+	// VLAN 5 from the same host
+	padi := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x88, 0x63,
+		0x11, PADI, 0x00, 0x00, 0x00, 0x04, 0x01, 0x01, 0x00, 0x00,
+	}
+	lcp := []byte{
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x81, 0x00, 0x00, 0x05, 0x88, 0x64,
+		0x11, 0x00, 0x12, 0x34, 0x00, 0x06, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x04,
+	}
+
+	tests := []struct {
+		expr      string
+		padi, lcp bool
+	}{
+		{"code == PADI", true, false},
+		{"code != PADI", false, true},
+		{"session == 0x1234", false, true},
+		{"session != 0x1234", true, false},
+		{"mac == 02:00:00:00:00:01", true, true},
+		{"eth.dst == 02:00:00:00:00:01", false, false},
+		{"eth.dst != 02:00:00:00:00:01", true, true},
+		{"ppp == LCP", false, true},
+		{"ppp != LCP", false, false},
+		{"ppp != IPCP", false, true},
+		{"!(ppp == LCP)", true, false},
+		{"vlan == 5", false, true},
+		{"vlan != 5", false, false},
+		{"vlan != 6", false, true},
+		{"code == PADI || ppp == LCP && session == 0x1234", true, true},
+		{"(code == PADI || ppp == LCP) && session == 0x1234", false, true},
+		{"not code eq PADI and mac ne 02:00:00:00:00:03", false, true},
+	}
+	for _, tt := range tests {
+		f, err := ParseFrameFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseFrameFilter(%q): %v", tt.expr, err)
+		}
+		if got := f.Match(padi); got != tt.padi {
+			t.Errorf("%q on the PADI = %v, want %v", tt.expr, got, tt.padi)
+		}
+		if got := f.Match(lcp); got != tt.lcp {
+			t.Errorf("%q on the LCP frame = %v, want %v", tt.expr, got, tt.lcp)
+		}
+	}
+
+	var nilFilter *FrameFilter
+	if !nilFilter.Match(padi) {
+		t.Error("a nil filter does not match")
+	}
+}
+
+func TestParseFrameFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"", "code", "code ==", "code == PADX", "session == 0x10000", "mac == 1",
+		"vlan == 4096", "foo == 1", "(code == PADI", "code == PADI)", "code == PADI &&",
+		"code = PADI", "code == PADI & session == 1",
+	} {
+		if _, err := ParseFrameFilter(expr); err == nil {
+			t.Errorf("ParseFrameFilter(%q) succeeded", expr)
+		}
+	}
+}
+
+func FuzzParseFrameFilter(f *testing.F) {
+	for _, expr := range []string{
+		"session == 0x1234 && (code == PADT || ppp == LCP)",
+		"mac == 02:00:00:00:00:01 && (code != SESSION || ppp == LCP)",
+		"not (vlan eq 10 or eth.dst ne ff:ff:ff:ff:ff:ff) and !ppp == IPCP",
+		"((code==PADI))||!session!=1",
+	} {
+		f.Add(expr)
+	}
+	f.Fuzz(func(t *testing.T, expr string) {
+		filter, err := ParseFrameFilter(expr)
+		if err != nil {
+			return
+		}
+		if filter.String() != expr {
+			t.Fatalf("filter %q has expression %q", expr, filter.String())
+		}
+		for _, frame := range testFrames {
+			filter.Match(frame)
+			for n := range frame {
+				filter.Match(frame[:n])
+			}
+		}
+	})
+}
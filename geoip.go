@@ -0,0 +1,161 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIPFilter restricts the tunnel clients that may connect by country and
+// autonomous system, looked up in MaxMind DB files such as GeoLite2-Country
+// and GeoLite2-ASN
+type GeoIPFilter struct {
+	dbs   []*maxminddb.Reader
+	allow geoRules
+	deny  geoRules
+}
+
+// geoRules holds country codes and AS numbers
+type geoRules struct {
+	countries map[string]bool
+	asns      map[uint]bool
+}
+
+// geoRecord holds the fields used from the databases
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// parseGeoRules parses a comma separated list of ISO country codes (e.g. JP)
+// and AS numbers (e.g. AS2516)
+func parseGeoRules(s string) (geoRules, error) {
+	rules := geoRules{countries: make(map[string]bool), asns: make(map[uint]bool)}
+	for _, entry := range splitList(s) {
+		entry = strings.ToUpper(entry)
+		if num, ok := strings.CutPrefix(entry, "AS"); ok && num != "" {
+			n, err := strconv.ParseUint(num, 10, 32)
+			if err != nil {
+				return rules, fmt.Errorf("invalid AS number %q", entry)
+			}
+			rules.asns[uint(n)] = true
+			continue
+		}
+		if len(entry) != 2 {
+			return rules, fmt.Errorf("invalid country code %q", entry)
+		}
+		rules.countries[entry] = true
+	}
+	return rules, nil
+}
+
+// empty reports whether there are no rules
+func (r geoRules) empty() bool {
+	return len(r.countries) == 0 && len(r.asns) == 0
+}
+
+// match reports whether a record matches one of the rules
+func (r geoRules) match(rec geoRecord) bool {
+	return (rec.Country.ISOCode != "" && r.countries[rec.Country.ISOCode]) || (rec.ASN != 0 && r.asns[rec.ASN])
+}
+
+// NewGeoIPFilter opens the databases, comma separated, and parses the allow
+// and deny lists of country codes and AS numbers. When the allow list is not
+// empty, clients must match it.
+func NewGeoIPFilter(databases, allow, deny string) (*GeoIPFilter, error) {
+	f := &GeoIPFilter{}
+	var err error
+	if f.allow, err = parseGeoRules(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseGeoRules(deny); err != nil {
+		return nil, err
+	}
+	if f.allow.empty() && f.deny.empty() {
+		return nil, errors.New("GeoIP filtering requires allowed or denied countries or AS numbers")
+	}
+	for _, path := range splitList(databases) {
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open GeoIP database: %v", err)
+		}
+		f.dbs = append(f.dbs, db)
+	}
+	if len(f.dbs) == 0 {
+		return nil, errors.New("GeoIP filtering requires a database")
+	}
+	return f, nil
+}
+
+// Close closes the databases. A nil GeoIPFilter does nothing.
+func (f *GeoIPFilter) Close() error {
+	if f == nil {
+		return nil
+	}
+	var errs []error
+	for _, db := range f.dbs {
+		errs = append(errs, db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// lookup merges the records of ip found in the databases
+func (f *GeoIPFilter) lookup(ip netip.Addr) (geoRecord, error) {
+	var rec geoRecord
+	for _, db := range f.dbs {
+		var r geoRecord
+		if err := db.Lookup(ip.AsSlice(), &r); err != nil {
+			return rec, err
+		}
+		if r.Country.ISOCode != "" {
+			rec.Country = r.Country
+		}
+		if r.ASN != 0 {
+			rec.ASN = r.ASN
+		}
+	}
+	return rec, nil
+}
+
+// Check returns an error if ip may not connect. Private, loopback and other
+// non-global addresses are not in the databases and are left to the allow
+// list. A nil GeoIPFilter allows everything.
+func (f *GeoIPFilter) Check(ip netip.Addr) error {
+	if f == nil {
+		return nil
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return nil
+	}
+	rec, err := f.lookup(ip)
+	if err != nil {
+		return fmt.Errorf("GeoIP lookup failed: %v", err)
+	}
+	switch {
+	case f.deny.match(rec):
+		return fmt.Errorf("denied by GeoIP (%s)", rec)
+	case !f.allow.empty() && !f.allow.match(rec):
+		return fmt.Errorf("not allowed by GeoIP (%s)", rec)
+	}
+	return nil
+}
+
+// String describes the country and AS of a record, for log messages
+func (rec geoRecord) String() string {
+	country, asn := rec.Country.ISOCode, "unknown AS"
+	if country == "" {
+		country = "unknown country"
+	}
+	if rec.ASN != 0 {
+		asn = "AS" + strconv.FormatUint(uint64(rec.ASN), 10)
+	}
+	return country + ", " + asn
+}
@@ -5,7 +5,14 @@ go 1.23.1
 require (
 	github.com/KarpelesLab/goupd v0.4.5
 	github.com/KarpelesLab/shutdown v1.1.0
+	github.com/bufbuild/protocompile v0.14.1
+	github.com/google/gopacket v1.1.19
+	github.com/oschwald/maxminddb-golang v1.13.1
+	golang.org/x/crypto v0.32.0
+	golang.org/x/net v0.34.0
 	golang.org/x/sys v0.32.0
+	google.golang.org/grpc v1.71.1
+	google.golang.org/protobuf v1.36.4
 )
 
 require (
@@ -13,4 +20,7 @@ require (
 	github.com/KarpelesLab/pjson v0.1.7 // indirect
 	github.com/KarpelesLab/typutil v0.2.16 // indirect
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250115164207-1a7da9e5054f // indirect
 )
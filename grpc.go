@@ -0,0 +1,360 @@
+package pppoeproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer serves the control API described in pppoeproxy.proto
+type GRPCServer struct {
+	proxy    *Proxy
+	update   func(map[string]string) ([]string, error)
+	server   *grpc.Server
+	listener net.Listener
+}
+
+// GRPCConfig holds the settings of the gRPC control API
+type GRPCConfig struct {
+	Addr string        // Address to listen on
+	JWT  *JWTValidator // Require a bearer token issued by an OAuth/OIDC provider
+
+	// TLS, reloaded like the admin API certificate when the files change
+	CertFile     string // TLS certificate (empty serves plaintext)
+	KeyFile      string // TLS private key
+	ClientCAFile string // Require client certificates signed by this CA bundle (mTLS)
+}
+
+// NewGRPCServer listens on the configured address and serves the gRPC control
+// API. update is invoked by UpdateConfig with the settings to change and
+// returns the names of the settings that changed. Without JWT validation or
+// client certificates, the API is unauthenticated and only listens on a
+// loopback address. Bearer tokens are only accepted in plaintext on a loopback
+// address too.
+func NewGRPCServer(config GRPCConfig, proxy *Proxy, update func(map[string]string) ([]string, error)) (*GRPCServer, error) {
+	if config.JWT == nil && config.ClientCAFile == "" && !isLoopbackAddr(config.Addr) {
+		return nil, errors.New("the gRPC API requires JWT validation or a client CA unless it listens on a loopback address")
+	}
+	if config.JWT != nil && config.CertFile == "" && !isLoopbackAddr(config.Addr) {
+		return nil, errors.New("the gRPC API requires a TLS certificate for JWT validation unless it listens on a loopback address")
+	}
+
+	opts := []grpc.ServerOption{grpc.ForceServerCodec(grpcCodec{})}
+	if config.CertFile != "" {
+		tlsConfig, err := grpcTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	} else if config.ClientCAFile != "" {
+		return nil, errors.New("gRPC client certificates require a TLS certificate and key")
+	}
+	if config.JWT != nil {
+		opts = append(opts, grpcAuthInterceptors(proxy, config.JWT)...)
+	}
+
+	l, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for gRPC: %v", err)
+	}
+
+	s := &GRPCServer{
+		proxy:    proxy,
+		update:   update,
+		server:   grpc.NewServer(opts...),
+		listener: l,
+	}
+	s.server.RegisterService(&grpcServiceDesc, s)
+
+	go func() {
+		if err := s.server.Serve(l); err != nil {
+			log.Printf("gRPC server error: %v", err)
+		}
+	}()
+	log.Printf("gRPC API listening on %s", l.Addr())
+	return s, nil
+}
+
+// Close stops the gRPC server, ending active streams
+func (s *GRPCServer) Close() error {
+	s.server.Stop()
+	return nil
+}
+
+// isLoopbackAddr returns whether a listen address is on a loopback interface
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// grpcTLSConfig returns the TLS configuration of the gRPC API
+func grpcTLSConfig(config GRPCConfig) (*tls.Config, error) {
+	certs, err := newCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load gRPC API certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if config.ClientCAFile != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(config.ClientCAFile); err != nil {
+			return nil, fmt.Errorf("failed to read gRPC API client CA: %v", err)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// grpcAuthInterceptors returns the interceptors rejecting calls without a
+// valid bearer token in their "authorization" metadata
+func grpcAuthInterceptors(proxy *Proxy, v *JWTValidator) []grpc.ServerOption {
+	check := func(ctx context.Context, method string) error {
+		reason := "no credentials"
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+			token, ok := strings.CutPrefix(md.Get("authorization")[0], "Bearer ")
+			if !ok {
+				reason = "not a bearer token"
+			} else if _, err := v.Validate(ctx, token); err != nil {
+				reason = err.Error()
+			} else {
+				return nil
+			}
+		}
+		addr := "unknown"
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr.String()
+		}
+		proxy.reportError(ErrorAuth, addr, fmt.Errorf("unauthenticated gRPC call %s: %s", method, reason))
+		log.Printf("gRPC API: rejected unauthenticated call %s from %s: %s", method, addr, reason)
+		return status.Error(codes.Unauthenticated, "authentication required")
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := check(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := check(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// grpcServiceDesc describes the pppoeproxy.v1.Proxy service
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pppoeproxy.v1.Proxy",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		grpcUnary("GetStatus", (*GRPCServer).getStatus),
+		grpcUnary("ListSessions", (*GRPCServer).listSessions),
+		grpcUnary("ListClients", (*GRPCServer).listClients),
+		grpcUnary("GetCounters", (*GRPCServer).getCounters),
+		grpcUnary("UpdateConfig", (*GRPCServer).updateConfig),
+		grpcUnary("KickClient", (*GRPCServer).kickClient),
+		grpcUnary("TerminateSession", (*GRPCServer).terminateSession),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchSessions",
+			Handler:       grpcWatchSessions,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pppoeproxy.proto",
+}
+
+// grpcUnary builds the description of a unary method handled by fn
+func grpcUnary[Req any, PReq interface {
+	*Req
+	wireUnmarshaler
+}](name string, fn func(*GRPCServer, context.Context, PReq) (wireMarshaler, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := PReq(new(Req))
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			s := srv.(*GRPCServer)
+			if interceptor == nil {
+				return fn(s, ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/pppoeproxy.v1.Proxy/" + name}
+			return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+				return fn(s, ctx, req.(PReq))
+			})
+		},
+	}
+}
+
+func (s *GRPCServer) getStatus(ctx context.Context, req *emptyRequest) (wireMarshaler, error) {
+	st := s.proxy.Status()
+	return &pbStatus{
+		Mode:          st.Mode,
+		Interface:     st.Interface,
+		Address:       st.Address,
+		UptimeSeconds: st.Uptime.Seconds(),
+		Healthy:       st.Health == "",
+		HealthError:   st.Health,
+		TunnelUp:      st.TunnelUp,
+		Peers:         uint32(st.Peers),
+		Sessions:      uint32(st.Sessions),
+		Version:       st.Version,
+		Degraded:      st.Degraded,
+		ActiveSlave:   st.ActiveSlave,
+	}, nil
+}
+
+func (s *GRPCServer) listSessions(ctx context.Context, req *emptyRequest) (wireMarshaler, error) {
+	res := &pbListSessionsResponse{}
+	for _, ses := range s.proxy.Sessions() {
+		res.Sessions = append(res.Sessions, newPBSession(ses))
+	}
+	return res, nil
+}
+
+func (s *GRPCServer) listClients(ctx context.Context, req *emptyRequest) (wireMarshaler, error) {
+	res := &pbListClientsResponse{}
+	for _, c := range s.proxy.Peers() {
+		res.Clients = append(res.Clients, &pbClient{
+			Address:           c.Address,
+			ConnectedUnixNano: c.Connected.UnixNano(),
+			RTTSeconds:        c.RTT.Seconds(),
+			RTTAvgSeconds:     c.RTTAvg.Seconds(),
+			RTTMaxSeconds:     c.RTTMax.Seconds(),
+			Version:           c.Version,
+			Name:              c.Name,
+		})
+	}
+	return res, nil
+}
+
+func (s *GRPCServer) getCounters(ctx context.Context, req *emptyRequest) (wireMarshaler, error) {
+	res := &pbCounters{}
+	for _, typ := range []string{"discovery", "session"} {
+		for _, dir := range []string{DirectionRx, DirectionTx} {
+			res.Frames = append(res.Frames, &pbFrameCounter{
+				Type:      typ,
+				Direction: dir,
+				Frames:    framesTotal.With(typ, dir).Value(),
+				Bytes:     bytesTotal.With(typ, dir).Value(),
+			})
+		}
+	}
+	for _, kind := range errorKinds {
+		res.Errors = append(res.Errors, &pbErrorCounter{Kind: kind, Count: errorsTotal.With(kind).Value()})
+	}
+	return res, nil
+}
+
+func (s *GRPCServer) updateConfig(ctx context.Context, req *pbUpdateConfigRequest) (wireMarshaler, error) {
+	if s.update == nil {
+		return nil, status.Error(codes.Unimplemented, "configuration updates are not supported")
+	}
+	changed, err := s.update(req.Settings)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &pbUpdateConfigResponse{Changed: changed}, nil
+}
+
+func (s *GRPCServer) kickClient(ctx context.Context, req *pbKickClientRequest) (wireMarshaler, error) {
+	if err := s.proxy.KickClient(req.Address); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return emptyResponse{}, nil
+}
+
+func (s *GRPCServer) terminateSession(ctx context.Context, req *pbTerminateSessionRequest) (wireMarshaler, error) {
+	if req.ID > 0xffff {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid session ID %d", req.ID)
+	}
+	var ac net.HardwareAddr
+	if req.ACMAC != "" {
+		var err error
+		if ac, err = net.ParseMAC(req.ACMAC); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid MAC address %q", req.ACMAC)
+		}
+	}
+	if req.HostMAC != "" {
+		host, err := net.ParseMAC(req.HostMAC)
+		if err != nil || ac == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid host MAC address %q, or no AC MAC address", req.HostMAC)
+		}
+		if err := s.proxy.KillSessionByMAC(uint16(req.ID), host, ac); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return emptyResponse{}, nil
+	}
+	if err := s.proxy.KillSession(uint16(req.ID), ac); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return emptyResponse{}, nil
+}
+
+// grpcWatchSessions streams session events until the client goes away
+func grpcWatchSessions(srv any, stream grpc.ServerStream) error {
+	s := srv.(*GRPCServer)
+	req := &pbWatchSessionsRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+
+	// Subscribe before listing so no session falls in between
+	events, cancel := s.proxy.sessions.Subscribe()
+	defer cancel()
+
+	if req.Initial {
+		for _, ses := range s.proxy.sessions.List() {
+			if err := stream.SendMsg(&pbSessionEvent{Type: pbSessionEventStart, Session: newPBSession(ses)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-events:
+			msg := &pbSessionEvent{Type: pbSessionEventStart, Session: newPBSession(ev.Session), Reason: ev.Reason}
+			switch ev.Type {
+			case SessionEventEnd:
+				msg.Type = pbSessionEventEnd
+			case SessionEventIP:
+				msg.Type = pbSessionEventIP
+			case SessionEventAuth:
+				msg.Type = pbSessionEventAuth
+			case SessionEventRenegotiated:
+				msg.Type = pbSessionEventRenegotiated
+			}
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
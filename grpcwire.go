@@ -0,0 +1,405 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of pppoeproxy.proto are encoded by hand with protowire, which
+// keeps the build free of generated code while remaining wire compatible with
+// clients generated from the .proto file.
+
+// wireMarshaler is implemented by messages sent by the gRPC server
+type wireMarshaler interface {
+	marshal(b []byte) []byte
+}
+
+// wireUnmarshaler is implemented by messages received by the gRPC server
+type wireUnmarshaler interface {
+	unmarshal(field protowire.Number, typ protowire.Type, v uint64, data []byte) error
+}
+
+// grpcCodec encodes the hand-written messages for the gRPC server
+type grpcCodec struct{}
+
+func (grpcCodec) Name() string { return "proto" }
+
+func (grpcCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return m.marshal(nil), nil
+}
+
+func (grpcCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	return decodeFields(data, m.unmarshal)
+}
+
+// decodeFields calls fn for each field of an encoded message. Varint and
+// fixed-width values are passed in v, length-delimited ones in data.
+func decodeFields(b []byte, fn func(field protowire.Number, typ protowire.Type, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(b)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Field encoding helpers; like proto3, zero values are omitted
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendUint(b, num, 1)
+}
+
+func appendDouble(b []byte, num protowire.Number, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(v))
+}
+
+func appendMessage(b []byte, num protowire.Number, m wireMarshaler) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal(nil))
+}
+
+// emptyRequest is used for requests without fields; unknown fields are ignored
+type emptyRequest struct{}
+
+func (*emptyRequest) unmarshal(protowire.Number, protowire.Type, uint64, []byte) error {
+	return nil
+}
+
+// emptyResponse is used for responses without fields
+type emptyResponse struct{}
+
+func (emptyResponse) marshal(b []byte) []byte { return b }
+
+type pbStatus struct {
+	Mode, Interface, Address string
+	UptimeSeconds            float64
+	Healthy                  bool
+	HealthError              string
+	TunnelUp                 bool
+	Peers, Sessions          uint32
+	Version                  string
+	Degraded                 string
+	ActiveSlave              string
+}
+
+func (m *pbStatus) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Mode)
+	b = appendString(b, 2, m.Interface)
+	b = appendString(b, 3, m.Address)
+	b = appendDouble(b, 4, m.UptimeSeconds)
+	b = appendBool(b, 5, m.Healthy)
+	b = appendString(b, 6, m.HealthError)
+	b = appendBool(b, 7, m.TunnelUp)
+	b = appendUint(b, 8, uint64(m.Peers))
+	b = appendUint(b, 9, uint64(m.Sessions))
+	b = appendString(b, 10, m.Version)
+	b = appendString(b, 11, m.Degraded)
+	b = appendString(b, 12, m.ActiveSlave)
+	return b
+}
+
+type pbSession struct {
+	ID                                   uint32
+	HostMAC, ACMAC, Owner                string
+	StartedUnixNano                      int64
+	FramesRx, FramesTx, BytesRx, BytesTx uint64
+	IP                                   string
+	AuthProtocol                         string
+	AuthSuccess                          bool
+	AuthFailures                         uint64
+	LastSeenUnixNano                     int64
+	Renegotiations                       uint64
+}
+
+// newPBSession converts a tracked session to its API representation
+func newPBSession(s SessionInfo) *pbSession {
+	m := &pbSession{
+		ID:              uint32(s.ID),
+		HostMAC:         s.HostMAC.String(),
+		ACMAC:           s.ACMAC.String(),
+		Owner:           s.Owner,
+		StartedUnixNano: s.Started.UnixNano(),
+		FramesRx:        s.FramesRx,
+		FramesTx:        s.FramesTx,
+		BytesRx:         s.BytesRx,
+		BytesTx:         s.BytesTx,
+		AuthProtocol:    s.AuthProtocol,
+		AuthSuccess:     s.AuthSuccess,
+		AuthFailures:    s.AuthFailures,
+
+		LastSeenUnixNano: s.LastSeen.UnixNano(),
+		Renegotiations:   s.Renegotiations,
+	}
+	if s.IP.IsValid() {
+		m.IP = s.IP.String()
+	}
+	return m
+}
+
+func (m *pbSession) marshal(b []byte) []byte {
+	b = appendUint(b, 1, uint64(m.ID))
+	b = appendString(b, 2, m.HostMAC)
+	b = appendString(b, 3, m.ACMAC)
+	b = appendString(b, 4, m.Owner)
+	b = appendUint(b, 5, uint64(m.StartedUnixNano))
+	b = appendUint(b, 6, m.FramesRx)
+	b = appendUint(b, 7, m.FramesTx)
+	b = appendUint(b, 8, m.BytesRx)
+	b = appendUint(b, 9, m.BytesTx)
+	b = appendString(b, 10, m.IP)
+	b = appendString(b, 11, m.AuthProtocol)
+	b = appendBool(b, 12, m.AuthSuccess)
+	b = appendUint(b, 13, m.AuthFailures)
+	b = appendUint(b, 14, uint64(m.LastSeenUnixNano))
+	b = appendUint(b, 15, m.Renegotiations)
+	return b
+}
+
+type pbListSessionsResponse struct {
+	Sessions []*pbSession
+}
+
+func (m *pbListSessionsResponse) marshal(b []byte) []byte {
+	for _, s := range m.Sessions {
+		b = appendMessage(b, 1, s)
+	}
+	return b
+}
+
+type pbWatchSessionsRequest struct {
+	Initial bool
+}
+
+func (m *pbWatchSessionsRequest) unmarshal(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+	if num == 1 && typ == protowire.VarintType {
+		m.Initial = v != 0
+	}
+	return nil
+}
+
+// SessionEvent.Type values
+const (
+	pbSessionEventStart = 1
+	pbSessionEventEnd   = 2
+	pbSessionEventIP    = 3
+	pbSessionEventAuth  = 4
+
+	pbSessionEventRenegotiated = 5
+)
+
+type pbSessionEvent struct {
+	Type    uint64
+	Session *pbSession
+	Reason  string
+}
+
+func (m *pbSessionEvent) marshal(b []byte) []byte {
+	b = appendUint(b, 1, m.Type)
+	if m.Session != nil {
+		b = appendMessage(b, 2, m.Session)
+	}
+	b = appendString(b, 3, m.Reason)
+	return b
+}
+
+type pbClient struct {
+	Address                                  string
+	ConnectedUnixNano                        int64
+	RTTSeconds, RTTAvgSeconds, RTTMaxSeconds float64
+	Version                                  string
+	Name                                     string
+}
+
+func (m *pbClient) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Address)
+	b = appendUint(b, 2, uint64(m.ConnectedUnixNano))
+	b = appendDouble(b, 3, m.RTTSeconds)
+	b = appendDouble(b, 4, m.RTTAvgSeconds)
+	b = appendDouble(b, 5, m.RTTMaxSeconds)
+	b = appendString(b, 6, m.Version)
+	b = appendString(b, 7, m.Name)
+	return b
+}
+
+type pbListClientsResponse struct {
+	Clients []*pbClient
+}
+
+func (m *pbListClientsResponse) marshal(b []byte) []byte {
+	for _, c := range m.Clients {
+		b = appendMessage(b, 1, c)
+	}
+	return b
+}
+
+type pbFrameCounter struct {
+	Type, Direction string
+	Frames, Bytes   uint64
+}
+
+func (m *pbFrameCounter) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Type)
+	b = appendString(b, 2, m.Direction)
+	b = appendUint(b, 3, m.Frames)
+	b = appendUint(b, 4, m.Bytes)
+	return b
+}
+
+type pbErrorCounter struct {
+	Kind  string
+	Count uint64
+}
+
+func (m *pbErrorCounter) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Kind)
+	b = appendUint(b, 2, m.Count)
+	return b
+}
+
+type pbCounters struct {
+	Frames []*pbFrameCounter
+	Errors []*pbErrorCounter
+}
+
+func (m *pbCounters) marshal(b []byte) []byte {
+	for _, f := range m.Frames {
+		b = appendMessage(b, 1, f)
+	}
+	for _, e := range m.Errors {
+		b = appendMessage(b, 2, e)
+	}
+	return b
+}
+
+type pbUpdateConfigRequest struct {
+	Settings map[string]string
+}
+
+func (m *pbUpdateConfigRequest) unmarshal(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+	if num != 1 || typ != protowire.BytesType {
+		return nil
+	}
+
+	// Map entries are messages with the key in field 1 and the value in field 2
+	var key, value string
+	err := decodeFields(data, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		if typ == protowire.BytesType {
+			switch num {
+			case 1:
+				key = string(data)
+			case 2:
+				value = string(data)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if m.Settings == nil {
+		m.Settings = make(map[string]string)
+	}
+	m.Settings[key] = value
+	return nil
+}
+
+type pbUpdateConfigResponse struct {
+	Changed []string
+}
+
+func (m *pbUpdateConfigResponse) marshal(b []byte) []byte {
+	for _, name := range m.Changed {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, name)
+	}
+	return b
+}
+
+type pbKickClientRequest struct {
+	Address string
+}
+
+func (m *pbKickClientRequest) unmarshal(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+	if num == 1 && typ == protowire.BytesType {
+		m.Address = string(data)
+	}
+	return nil
+}
+
+type pbTerminateSessionRequest struct {
+	ID      uint32
+	ACMAC   string
+	HostMAC string
+}
+
+func (m *pbTerminateSessionRequest) unmarshal(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+	switch {
+	case num == 1 && typ == protowire.VarintType:
+		m.ID = uint32(v)
+	case num == 2 && typ == protowire.BytesType:
+		m.ACMAC = string(data)
+	case num == 3 && typ == protowire.BytesType:
+		m.HostMAC = string(data)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package pppoeproxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoFile compiles pppoeproxy.proto, so the hand-written encoding is
+// checked against the message types clients generate from it
+func protoFile(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	compiler := protocompile.Compiler{
+		Resolver: &protocompile.SourceResolver{ImportPaths: []string{"."}},
+	}
+	files, err := compiler.Compile(context.Background(), "pppoeproxy.proto")
+	if err != nil {
+		t.Fatalf("failed to compile pppoeproxy.proto: %v", err)
+	}
+	return files[0]
+}
+
+// protoMessage returns a message of the .proto type name set from its JSON
+// representation
+func protoMessage(t *testing.T, fd protoreflect.FileDescriptor, name, js string) *dynamicpb.Message {
+	t.Helper()
+	desc := fd.Messages().ByName(protoreflect.Name(name))
+	if desc == nil {
+		t.Fatalf("no message %s in pppoeproxy.proto", name)
+	}
+	m := dynamicpb.NewMessage(desc)
+	if err := protojson.Unmarshal([]byte(js), m); err != nil {
+		t.Fatalf("invalid %s %s: %v", name, js, err)
+	}
+	return m
+}
+
+func TestGRPCWireMarshal(t *testing.T) {
+	fd := protoFile(t)
+	session := &pbSession{
+		ID: 0x1234, HostMAC: "02:00:00:00:00:01", ACMAC: "02:00:00:00:00:02", Owner: "10.0.0.2:9000",
+		StartedUnixNano: -1, FramesRx: 1, FramesTx: 2, BytesRx: 1 << 40, BytesTx: 4,
+		IP: "100.64.0.1", AuthProtocol: "CHAP", AuthSuccess: true, AuthFailures: 3,
+	}
+	sessionJSON := `{"id": 4660, "hostMac": "02:00:00:00:00:01", "acMac": "02:00:00:00:00:02", "owner": "10.0.0.2:9000",
+		"startedUnixNano": "-1", "framesRx": "1", "framesTx": "2", "bytesRx": "1099511627776", "bytesTx": "4",
+		"ip": "100.64.0.1", "authProtocol": "CHAP", "authSuccess": true, "authFailures": "3"}`
+
+	tests := []struct {
+		name string // Message type in the .proto
+		msg  wireMarshaler
+		want string // JSON representation
+	}{
+		{"Status", &pbStatus{}, `{}`},
+		{"Status", &pbStatus{
+			Mode: "server", Interface: "eth0", Address: ":9000", UptimeSeconds: 12.5, Healthy: true,
+			HealthError: "x", TunnelUp: true, Peers: 2, Sessions: 70000, Version: "v1",
+			Degraded: "link down", ActiveSlave: "eth1",
+		}, `{"mode": "server", "interface": "eth0", "address": ":9000", "uptimeSeconds": 12.5, "healthy": true,
+			"healthError": "x", "tunnelUp": true, "peers": 2, "sessions": 70000, "version": "v1",
+			"degraded": "link down", "activeSlave": "eth1"}`},
+		{"Session", session, sessionJSON},
+		{"ListSessionsResponse", &pbListSessionsResponse{Sessions: []*pbSession{session, {}}},
+			`{"sessions": [` + sessionJSON + `, {}]}`},
+		{"SessionEvent", &pbSessionEvent{Type: pbSessionEventStart, Session: session},
+			`{"type": "START", "session": ` + sessionJSON + `}`},
+		{"SessionEvent", &pbSessionEvent{Type: pbSessionEventEnd, Reason: "PADT"},
+			`{"type": "END", "reason": "PADT"}`},
+		{"SessionEvent", &pbSessionEvent{Type: pbSessionEventIP}, `{"type": "IP"}`},
+		{"SessionEvent", &pbSessionEvent{Type: pbSessionEventAuth}, `{"type": "AUTH"}`},
+		{"ListClientsResponse", &pbListClientsResponse{Clients: []*pbClient{{
+			Address: "10.0.0.2:9000", ConnectedUnixNano: 1700000000000000000, RTTSeconds: 0.001,
+			RTTAvgSeconds: 0.002, RTTMaxSeconds: 0.5, Version: "v2", Name: "site-a",
+		}}}, `{"clients": [{"address": "10.0.0.2:9000", "connectedUnixNano": "1700000000000000000", "rttSeconds": 0.001,
+			"rttAvgSeconds": 0.002, "rttMaxSeconds": 0.5, "version": "v2", "name": "site-a"}]}`},
+		{"Counters", &pbCounters{
+			Frames: []*pbFrameCounter{{Type: "session", Direction: "rx", Frames: 5, Bytes: 500}},
+			Errors: []*pbErrorCounter{{Kind: "auth", Count: 1}, {Kind: "tunnel"}},
+		}, `{"frames": [{"type": "session", "direction": "rx", "frames": "5", "bytes": "500"}],
+			"errors": [{"kind": "auth", "count": "1"}, {"kind": "tunnel"}]}`},
+		{"UpdateConfigResponse", &pbUpdateConfigResponse{Changed: []string{"allow", "rtt-warn"}},
+			`{"changed": ["allow", "rtt-warn"]}`},
+		{"GetStatusRequest", emptyResponse{}, `{}`},
+	}
+	for _, tt := range tests {
+		data, err := grpcCodec{}.Marshal(tt.msg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := protoMessage(t, fd, tt.name, tt.want)
+		got := dynamicpb.NewMessage(want.Descriptor())
+		if err := proto.Unmarshal(data, got); err != nil {
+			t.Errorf("%s: generated type cannot decode %x: %v", tt.name, data, err)
+			continue
+		}
+		if !proto.Equal(got, want) {
+			t.Errorf("%s: decoded as %v, want %v", tt.name, got, want)
+		}
+		if unknown := got.GetUnknown(); len(unknown) > 0 {
+			t.Errorf("%s: unknown fields %x", tt.name, unknown)
+		}
+	}
+}
+
+func TestGRPCWireUnmarshal(t *testing.T) {
+	fd := protoFile(t)
+	tests := []struct {
+		name string // Message type in the .proto
+		js   string // JSON representation
+		want wireUnmarshaler
+	}{
+		{"GetStatusRequest", `{}`, &emptyRequest{}},
+		{"WatchSessionsRequest", `{}`, &pbWatchSessionsRequest{}},
+		{"WatchSessionsRequest", `{"initial": true}`, &pbWatchSessionsRequest{Initial: true}},
+		{"UpdateConfigRequest", `{"settings": {"allow": "10.0.0.0/8", "rtt-warn": "", "": "x"}}`,
+			&pbUpdateConfigRequest{Settings: map[string]string{"allow": "10.0.0.0/8", "rtt-warn": "", "": "x"}}},
+		{"KickClientRequest", `{"address": "10.0.0.2:9000"}`, &pbKickClientRequest{Address: "10.0.0.2:9000"}},
+		{"TerminateSessionRequest", `{"id": 4294967295, "acMac": "02:00:00:00:00:02", "hostMac": "02:00:00:00:00:01"}`,
+			&pbTerminateSessionRequest{ID: 0xffffffff, ACMAC: "02:00:00:00:00:02", HostMAC: "02:00:00:00:00:01"}},
+		// Fields a newer client may send are skipped
+		{"Session", `{"id": 1, "hostMac": "x", "startedUnixNano": "5", "authSuccess": true}`, &emptyRequest{}},
+		// Fields of the wrong type are skipped
+		{"Session", `{"id": 1, "owner": "x"}`, &pbKickClientRequest{}},
+	}
+	for _, tt := range tests {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(protoMessage(t, fd, tt.name, tt.js))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := reflect.New(reflect.TypeOf(tt.want).Elem()).Interface()
+		if err := (grpcCodec{}).Unmarshal(data, got); err != nil {
+			t.Errorf("%s %s: %v", tt.name, tt.js, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: decoded as %+v, want %+v", tt.name, tt.js, got, tt.want)
+		}
+	}
+}
+
+func TestGRPCServiceDesc(t *testing.T) {
+	svc := protoFile(t).Services().ByName("Proxy")
+	if svc == nil || string(svc.FullName()) != grpcServiceDesc.ServiceName {
+		t.Fatalf("service %s not in pppoeproxy.proto", grpcServiceDesc.ServiceName)
+	}
+	methods := make(map[string]bool) // Name to server streaming
+	for _, m := range grpcServiceDesc.Methods {
+		methods[m.MethodName] = false
+	}
+	for _, s := range grpcServiceDesc.Streams {
+		methods[s.StreamName] = s.ServerStreams
+	}
+	if len(methods) != svc.Methods().Len() {
+		t.Errorf("%d methods served, %d in pppoeproxy.proto", len(methods), svc.Methods().Len())
+	}
+	for i := 0; i < svc.Methods().Len(); i++ {
+		m := svc.Methods().Get(i)
+		streams, ok := methods[string(m.Name())]
+		if !ok {
+			t.Errorf("method %s not served", m.Name())
+		} else if streams != m.IsStreamingServer() || m.IsStreamingClient() {
+			t.Errorf("method %s served with the wrong streaming", m.Name())
+		}
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:9100": true,
+		"127.1.2.3:9100": true,
+		"[::1]:9100":     true,
+		"localhost:9100": true,
+		":9100":          false,
+		"0.0.0.0:9100":   false,
+		"[::]:9100":      false,
+		"10.0.0.1:9100":  false,
+		"example:9100":   false,
+		"127.0.0.1":      false,
+	} {
+		if got := isLoopbackAddr(addr); got != want {
+			t.Errorf("isLoopbackAddr(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestNewGRPCServerAuth(t *testing.T) {
+	jwt := &JWTValidator{}
+	for _, tt := range []struct {
+		config GRPCConfig
+		ok     bool
+	}{
+		{GRPCConfig{Addr: "127.0.0.1:0"}, true},
+		{GRPCConfig{Addr: "127.0.0.1:0", JWT: jwt}, true},
+		{GRPCConfig{Addr: "0.0.0.0:0"}, false},
+		{GRPCConfig{Addr: "0.0.0.0:0", JWT: jwt}, false}, // Bearer tokens in plaintext
+		{GRPCConfig{Addr: "0.0.0.0:0", ClientCAFile: "ca.pem"}, false},
+	} {
+		s, err := NewGRPCServer(tt.config, nil, nil)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewGRPCServer(%+v): %v", tt.config, err)
+		}
+		if s != nil {
+			s.Close()
+		}
+	}
+}
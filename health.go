@@ -0,0 +1,63 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// lockProbeTimeout is how long a health check waits for a lock before
+// considering the proxy wedged
+const lockProbeTimeout = 2 * time.Second
+
+// Healthy returns an error describing the first problem found if the packet
+// loops or the tunnel machinery are not working
+func (p *Proxy) Healthy() error {
+	if p.closed.Load() {
+		return errors.New("proxy is closed")
+	}
+	if !p.discoveryHandler.Running() {
+		return errors.New("discovery packet loop stopped")
+	}
+	if !p.sessionHandler.Running() {
+		return errors.New("session packet loop stopped")
+	}
+	if err := p.discoveryHandler.loop.health(); err != nil {
+		return err
+	}
+	if err := p.sessionHandler.loop.health(); err != nil {
+		return err
+	}
+
+	if p.isServer {
+		if int(p.accepting.Load()) < len(p.listeners) {
+			return errors.New("tunnel listener stopped")
+		}
+		if !probeLock(p.clientsMu.RLocker()) {
+			return errors.New("client list lock is stuck")
+		}
+	} else {
+		if !probeLock(&p.serverMu) {
+			return errors.New("server connection lock is stuck")
+		}
+	}
+
+	return nil
+}
+
+// probeLock reports whether l can be acquired within lockProbeTimeout
+func probeLock(l sync.Locker) bool {
+	done := make(chan struct{})
+	go func() {
+		l.Lock()
+		l.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(lockProbeTimeout):
+		return false
+	}
+}
@@ -0,0 +1,263 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// pppoeCodeNames maps PPPoE codes to their short names
+var pppoeCodeNames = map[uint8]string{
+	0x00: "SESSION",
+	PADI: "PADI",
+	PADO: "PADO",
+	PADR: "PADR",
+	PADS: "PADS",
+	PADT: "PADT",
+}
+
+// pppProtocolNames maps PPP protocol numbers to their short names
+var pppProtocolNames = map[uint16]string{
+	PPPProtoIP:     "IPv4",
+	PPPProtoIPv6:   "IPv6",
+	PPPProtoIPCP:   "IPCP",
+	PPPProtoIPv6CP: "IPv6CP",
+	PPPProtoCCP:    "CCP",
+	PPPProtoLCP:    "LCP",
+	PPPProtoPAP:    "PAP",
+	PPPProtoCHAP:   "CHAP",
+}
+
+// pppoeCodeName returns a printable name for a PPPoE code
+func pppoeCodeName(code uint8) string {
+	if name, ok := pppoeCodeNames[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
+
+// pppProtocolName returns a printable name for a PPP protocol number
+func pppProtocolName(proto uint16) string {
+	if name, ok := pppProtocolNames[proto]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", proto)
+}
+
+// DumpFilter selects which frames are hexdumped. Empty fields match everything.
+type DumpFilter struct {
+	Codes    map[uint8]bool
+	Sessions map[uint16]bool
+	MACs     []net.HardwareAddr
+	Expr     *FrameFilter // Also checked with the lists
+}
+
+// Match reports whether the frame (including the Ethernet header) matches the filter
+func (f *DumpFilter) Match(packet []byte) bool {
+	info := decodeFrame(packet)
+	if f.Expr != nil && !f.Expr.root.match(&info) {
+		return false
+	}
+	if !info.HasPPPoE {
+		// Too short to carry a PPPoE header, only match empty lists
+		return len(f.Codes) == 0 && len(f.Sessions) == 0 && len(f.MACs) == 0
+	}
+
+	if len(f.Codes) > 0 && !f.Codes[info.Code] {
+		return false
+	}
+	if len(f.Sessions) > 0 && !f.Sessions[info.Session] {
+		return false
+	}
+	if len(f.MACs) > 0 {
+		found := false
+		for _, mac := range f.MACs {
+			if bytes.Equal(info.Dst, mac) || bytes.Equal(info.Src, mac) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseDumpFilter builds a filter from comma separated lists of codes (names
+// such as PADI or numbers), session IDs and MAC addresses
+func ParseDumpFilter(codes, sessions, macs string) (*DumpFilter, error) {
+	f := &DumpFilter{}
+
+	for _, c := range splitList(codes) {
+		if f.Codes == nil {
+			f.Codes = make(map[uint8]bool)
+		}
+		code, err := parsePPPoECode(c)
+		if err != nil {
+			return nil, err
+		}
+		f.Codes[code] = true
+	}
+
+	for _, s := range splitList(sessions) {
+		if f.Sessions == nil {
+			f.Sessions = make(map[uint16]bool)
+		}
+		v, err := strconv.ParseUint(s, 0, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session ID %q", s)
+		}
+		f.Sessions[uint16(v)] = true
+	}
+
+	for _, m := range splitList(macs) {
+		mac, err := net.ParseMAC(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q", m)
+		}
+		f.MACs = append(f.MACs, mac)
+	}
+
+	return f, nil
+}
+
+// parsePPPoECode parses a PPPoE code name such as PADI, or number
+func parsePPPoECode(s string) (uint8, error) {
+	for code, name := range pppoeCodeNames {
+		if strings.EqualFold(s, name) {
+			return code, nil
+		}
+	}
+	v, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid packet code %q", s)
+	}
+	return uint8(v), nil
+}
+
+// splitList splits a comma separated list, ignoring empty entries
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Dumper logs decoded headers and hexdumps of selected frames
+type Dumper struct {
+	filter     *DumpFilter
+	limiter    *TokenBucket
+	suppressed atomic.Uint64
+}
+
+// NewDumper creates a dumper for frames matching filter, logging at most
+// rate frames per second (0 for unlimited)
+func NewDumper(filter *DumpFilter, rate float64) *Dumper {
+	d := &Dumper{filter: filter}
+	if rate > 0 {
+		d.limiter = NewTokenBucket(rate, rate)
+	}
+	return d
+}
+
+// Dump logs the frame if it matches the filter and the rate limit allows it
+func (d *Dumper) Dump(direction string, packet []byte) {
+	if d == nil || !d.filter.Match(packet) {
+		return
+	}
+
+	if d.limiter != nil && !d.limiter.Allow() {
+		d.suppressed.Add(1)
+		return
+	}
+
+	header := describeFrame(packet)
+	if n := d.suppressed.Swap(0); n > 0 {
+		header += fmt.Sprintf(" (%d frames suppressed by rate limit)", n)
+	}
+	log.Printf("[hexdump] %s %s\n%s", direction, header, hex.Dump(packet))
+}
+
+// frameInfo holds the decoded headers of a frame. Fields are only set when
+// the corresponding Has flag is.
+type frameInfo struct {
+	Length    int
+	HasEther  bool
+	Dst, Src  net.HardwareAddr
+	VLANs     []uint16 // VLAN IDs of the 802.1Q tags, outermost first
+	EtherType uint16   // Ethertype of the payload following any VLAN tags
+
+	HasPPPoE      bool
+	Version, Type uint8
+	Code          uint8
+	Session       uint16
+	PayloadLength uint16
+
+	HasPPP   bool
+	Protocol uint16
+
+	HasControl bool // Code/identifier/length header of a PPP control protocol
+	CtlCode    uint8
+	CtlID      uint8
+	CtlLength  uint16
+}
+
+// isControlProtocol reports whether a PPP protocol uses the
+// code/identifier/length layout of control protocols
+func isControlProtocol(proto uint16) bool {
+	switch proto {
+	case PPPProtoLCP, PPPProtoIPCP, PPPProtoIPv6CP, PPPProtoCCP, PPPProtoPAP, PPPProtoCHAP:
+		return true
+	}
+	return false
+}
+
+// describeFrame decodes the Ethernet, PPPoE and PPP headers of a frame
+func describeFrame(packet []byte) string {
+	info := decodeFrame(packet)
+	if !info.HasEther {
+		return fmt.Sprintf("truncated frame, %d bytes", len(packet))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s > %s type 0x%04x len %d", info.Src, info.Dst, info.EtherType, info.Length)
+	for _, vlan := range info.VLANs {
+		fmt.Fprintf(&b, " vlan %d", vlan)
+	}
+
+	if !info.HasPPPoE {
+		b.WriteString(", truncated PPPoE header")
+		return b.String()
+	}
+	fmt.Fprintf(&b, ", PPPoE ver %d type %d code %s session 0x%04x length %d",
+		info.Version, info.Type, pppoeCodeName(info.Code), info.Session, info.PayloadLength)
+
+	if !info.HasPPP {
+		return b.String()
+	}
+	fmt.Fprintf(&b, ", PPP %s", pppProtocolName(info.Protocol))
+
+	if info.HasControl {
+		fmt.Fprintf(&b, " code %d id %d length %d", info.CtlCode, info.CtlID, info.CtlLength)
+	}
+
+	return b.String()
+}
+
+// Middleware returns a middleware stage hexdumping the frames going through
+// it, to inspect them at a given point of the chain
+func (d *Dumper) Middleware() Middleware {
+	return func(direction string, packet []byte) ([]byte, bool) {
+		d.Dump(direction, packet)
+		return packet, true
+	}
+}
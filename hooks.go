@@ -0,0 +1,174 @@
+package pppoeproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hook events
+const (
+	HookSessionUp          = "SESSION_UP"
+	HookSessionDown        = "SESSION_DOWN"
+	HookTunnelUp           = "TUNNEL_UP"
+	HookTunnelDown         = "TUNNEL_DOWN"
+	HookClientConnected    = "CLIENT_CONNECTED"
+	HookClientDisconnected = "CLIENT_DISCONNECTED"
+	HookClientTimeout      = "CLIENT_TIMEOUT"
+	HookLinkUp             = "LINK_UP"
+	HookLinkDown           = "LINK_DOWN"
+	HookIPUp               = "IP_UP"
+	HookIPDown             = "IP_DOWN"
+	HookAuthSuccess        = "AUTH_SUCCESS"
+	HookAuthFailure        = "AUTH_FAILURE"
+	HookNoPADO             = "NO_PADO"
+	HookSessionConflict    = "SESSION_CONFLICT"
+)
+
+// hookQueueSize is the number of events that may wait for the hook command
+const hookQueueSize = 256
+
+// hooksFailed counts hook commands that failed or were dropped
+var hooksFailed = NewCounter("pppoeproxy_hook_failures_total", "Hook commands that failed, timed out or were dropped")
+
+// hookEvent is an event waiting to be passed to the hook command
+type hookEvent struct {
+	event string
+	env   []string
+}
+
+// HookRunner runs the configured hook command for lifecycle events. Events
+// are handled one at a time in the order they occurred, so a SESSION_DOWN is
+// never processed before the matching SESSION_UP.
+type HookRunner struct {
+	proxy *Proxy
+	queue chan hookEvent
+}
+
+// newHookRunner starts the hook runner of a proxy
+func newHookRunner(p *Proxy) *HookRunner {
+	h := &HookRunner{proxy: p, queue: make(chan hookEvent, hookQueueSize)}
+	p.spawn(h.loop)
+	return h
+}
+
+// Fire queues an event for the hook command. env holds KEY=value pairs
+// describing the event.
+func (h *HookRunner) Fire(event string, env ...string) {
+	if h.proxy.cfg().Hook == "" {
+		return
+	}
+	select {
+	case h.queue <- hookEvent{event: event, env: env}:
+	default:
+		hooksFailed.Inc()
+		log.Printf("Hook queue full, dropping %s event", event)
+	}
+}
+
+// loop runs queued events until the proxy is closed
+func (h *HookRunner) loop() {
+	for {
+		select {
+		case <-h.proxy.closedCh:
+			return
+		case ev := <-h.queue:
+			h.run(ev)
+		}
+	}
+}
+
+// run executes the hook command for an event
+func (h *HookRunner) run(ev hookEvent) {
+	cfg := h.proxy.cfg()
+	if cfg.Hook == "" {
+		return
+	}
+
+	mode := "client"
+	if cfg.IsServer {
+		mode = "server"
+	}
+
+	ctx := context.Background()
+	if cfg.HookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.HookTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, cfg.Hook, ev.event)
+	cmd.Env = append(os.Environ(), "EVENT="+ev.event, "INTERFACE="+cfg.Interface, "MODE="+mode)
+	cmd.Env = append(cmd.Env, ev.env...)
+	// Don't wait for children of a killed hook that keep the output open
+	cmd.WaitDelay = time.Second
+
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("Hook %s output: %s", ev.event, strings.TrimSpace(string(out)))
+	}
+	if err != nil {
+		hooksFailed.Inc()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		log.Printf("Hook %s for %s failed: %v", cfg.Hook, ev.event, err)
+	}
+}
+
+// watchSessions fires the SESSION_*, IP_* and AUTH_* hooks from the session
+// table
+func (h *HookRunner) watchSessions(t *SessionTable) {
+	events, cancel := t.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-h.proxy.closedCh:
+			return
+		case ev := <-events:
+			s := ev.Session
+			env := []string{
+				fmt.Sprintf("SESSION_ID=0x%04x", s.ID),
+				"HOST_MAC=" + s.HostMAC.String(),
+				"AC_MAC=" + s.ACMAC.String(),
+				"OWNER=" + s.Owner,
+			}
+			switch ev.Type {
+			case SessionEventStart:
+				h.Fire(HookSessionUp, env...)
+			case SessionEventIP:
+				if ev.OldIP.IsValid() {
+					h.Fire(HookIPDown, append(env, "IP="+ev.OldIP.String())...)
+				}
+				h.Fire(HookIPUp, append(env, "IP="+s.IP.String())...)
+			case SessionEventAuth:
+				env = append(env,
+					"AUTH_PROTOCOL="+s.AuthProtocol,
+					fmt.Sprintf("AUTH_FAILURES=%d", s.AuthFailures),
+					"AUTH_MESSAGE="+ev.Reason,
+				)
+				if s.AuthSuccess {
+					h.Fire(HookAuthSuccess, env...)
+				} else {
+					h.Fire(HookAuthFailure, env...)
+				}
+			case SessionEventEnd:
+				if s.IP.IsValid() {
+					h.Fire(HookIPDown, append(env, "IP="+s.IP.String())...)
+				}
+				env = append(env,
+					"REASON="+ev.Reason,
+					fmt.Sprintf("DURATION=%d", int(time.Since(s.Started).Seconds())),
+					fmt.Sprintf("BYTES_RX=%d", s.BytesRx),
+					fmt.Sprintf("BYTES_TX=%d", s.BytesTx),
+				)
+				h.Fire(HookSessionDown, env...)
+			}
+		}
+	}
+}
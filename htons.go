@@ -1,4 +1,4 @@
-package main
+package pppoeproxy
 
 import (
 	"encoding/binary"
@@ -0,0 +1,29 @@
+package pppoeproxy
+
+import "time"
+
+// sessionIdleCheckInterval is the interval between checks for idle sessions
+const sessionIdleCheckInterval = 10 * time.Second
+
+// expireIdle ends the sessions without any frame since before the given time.
+// Their PPP links are gone, most likely without a PADT the proxy saw.
+func (t *SessionTable) expireIdle(before time.Time) {
+	t.endMatching(ReasonIdleExpired, func(s *SessionInfo) bool { return s.LastSeen.Before(before) })
+}
+
+// expireIdleSessions ends the sessions idle for SessionIdleTimeout until the
+// proxy is closed
+func (p *Proxy) expireIdleSessions() {
+	ticker := time.NewTicker(sessionIdleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closedCh:
+			return
+		case now := <-ticker.C:
+			if timeout := p.cfg().SessionIdleTimeout; timeout > 0 {
+				p.sessions.expireIdle(now.Add(-timeout))
+			}
+		}
+	}
+}
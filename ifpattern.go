@@ -0,0 +1,351 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// patternScanInterval is how often the interfaces are listed to find new
+// interfaces matching a pattern, in addition to link change notifications
+const patternScanInterval = 10 * time.Second
+
+// maxLearnedMACs bounds the table of the interfaces MAC addresses were seen
+// on. It is cleared when full, frames to unknown addresses being flooded.
+const maxLearnedMACs = 4096
+
+// macTable maps the MAC addresses seen on the interfaces matching a pattern to
+// the interface they were seen on
+type macTable struct {
+	mu  sync.RWMutex
+	ifc map[[6]byte]string
+}
+
+// macTables holds the table of each pattern, shared by its discovery and
+// session sockets so session frames go where discovery saw the host
+var macTables sync.Map
+
+// patternMACs returns the table of a pattern
+func patternMACs(pattern string) *macTable {
+	t, _ := macTables.LoadOrStore(pattern, &macTable{ifc: make(map[[6]byte]string)})
+	return t.(*macTable)
+}
+
+// learn records the interface a source address was seen on
+func (t *macTable) learn(src []byte, name string) {
+	mac := [6]byte(src)
+	t.mu.RLock()
+	known := t.ifc[mac] == name
+	t.mu.RUnlock()
+	if known {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.ifc) >= maxLearnedMACs {
+		clear(t.ifc)
+	}
+	t.ifc[mac] = name
+}
+
+// lookup returns the interface a unicast address was seen on
+func (t *macTable) lookup(dst []byte) (string, bool) {
+	if dst[0]&1 != 0 {
+		return "", false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	name, ok := t.ifc[[6]byte(dst)]
+	return name, ok
+}
+
+// IsInterfacePattern reports whether name is a glob pattern such as "eth1.*"
+// matching several interfaces rather than an interface name
+func IsInterfacePattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// matchInterface reports whether the interface name matches pattern, which can
+// also be a plain interface name
+func matchInterface(pattern, name string) bool {
+	if !IsInterfacePattern(pattern) {
+		return pattern == name
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// FindInterfaces returns the interfaces matching pattern, which can also be a
+// plain interface name, or an error if none does
+func FindInterfaces(pattern string) ([]net.Interface, error) {
+	if !IsInterfacePattern(pattern) {
+		ifi, err := net.InterfaceByName(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Interface{*ifi}, nil
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var found []net.Interface
+	for _, ifi := range ifaces {
+		if matchInterface(pattern, ifi.Name) {
+			found = append(found, ifi)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no interface matches %s", pattern)
+	}
+	return found, nil
+}
+
+// patternMember is the socket opened on one interface matching the pattern
+type patternMember struct {
+	name  string
+	index int
+	sock  RawSocket
+}
+
+// capturedFrame is a frame received on one of the interfaces matching a
+// pattern, with its capture time
+type capturedFrame struct {
+	data     []byte
+	captured time.Time
+}
+
+// patternSocket is a raw socket on every up interface matching a glob
+// pattern. Interfaces appearing later are added, and interfaces going down or
+// removed are dropped. Like a bridge, it learns the interface each source
+// MAC address is seen on: frames sent to a known unicast address go out that
+// interface only, other frames are sent on all of them.
+type patternSocket struct {
+	pattern   string                 // Pattern, or description of the interfaces
+	match     func(name string) bool // Selects the interfaces
+	proto     uint16
+	frames    chan capturedFrame // Frames received on all interfaces
+	changed   chan struct{}      // Signaled when links changed
+	closed    chan struct{}
+	closeOnce sync.Once
+	stopWatch func()
+	learned   *macTable // Interfaces the MAC addresses were seen on
+
+	mu      sync.RWMutex
+	members map[string]*patternMember // By interface name
+}
+
+// openPatternSocket opens a raw socket on the interfaces matching pattern.
+// Matching interfaces may appear later.
+func openPatternSocket(pattern string, proto uint16) (RawSocket, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid interface pattern %q: %v", pattern, err)
+	}
+	return openMemberSocket(pattern, func(name string) bool { return matchInterface(pattern, name) }, proto), nil
+}
+
+// openMemberSocket opens a raw socket on the interfaces selected by match,
+// described by pattern in the log
+func openMemberSocket(pattern string, match func(name string) bool, proto uint16) *patternSocket {
+	s := &patternSocket{
+		pattern: pattern,
+		match:   match,
+		proto:   proto,
+		frames:  make(chan capturedFrame, fakeQueueSize),
+		changed: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		learned: patternMACs(pattern),
+		members: make(map[string]*patternMember),
+	}
+	s.scan()
+	if len(s.members) == 0 {
+		log.Printf("No interface matching %s is up yet", pattern)
+	}
+	s.stopWatch = watchLinks(func(index int, name string, removed bool) {
+		select {
+		case s.changed <- struct{}{}:
+		default:
+		}
+	})
+	go s.scanLoop()
+	return s
+}
+
+// scanLoop rescans the interfaces when links change and periodically
+func (s *patternSocket) scanLoop() {
+	ticker := time.NewTicker(patternScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-s.changed:
+		case <-ticker.C:
+		}
+		s.scan()
+	}
+}
+
+// scan opens a socket on the matching interfaces that are up and closes the
+// sockets of interfaces that went away
+func (s *patternSocket) scan() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	up := make(map[string]net.Interface)
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && s.match(ifi.Name) {
+			up[ifi.Name] = ifi
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed() {
+		return
+	}
+	for name, m := range s.members {
+		if ifi, ok := up[name]; !ok || ifi.Index != m.index {
+			s.removeLocked(m)
+			log.Printf("Released %04x socket on %s", s.proto, name)
+		}
+	}
+	for name, ifi := range up {
+		if _, ok := s.members[name]; ok {
+			continue
+		}
+		sock, err := openPacketSocket(name, s.proto)
+		if err != nil {
+			log.Printf("Failed to bind %04x socket to %s: %v", s.proto, name, err)
+			continue
+		}
+		m := &patternMember{name: name, index: ifi.Index, sock: sock}
+		s.members[name] = m
+		go s.receive(m)
+		log.Printf("Bound %04x socket to %s (matching %s)", s.proto, name, s.pattern)
+	}
+}
+
+// removeLocked closes the socket of an interface. s.mu must be held.
+func (s *patternSocket) removeLocked(m *patternMember) {
+	if s.members[m.name] != m {
+		return
+	}
+	delete(s.members, m.name)
+	m.sock.Close()
+}
+
+// receive queues the frames received on one interface until its socket is
+// closed or fails
+func (s *patternSocket) receive(m *patternMember) {
+	buf := make([]byte, 65536)
+	for {
+		n, captured, err := recvTimestamp(m.sock, buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Error receiving on %s, releasing socket: %v", m.name, err)
+				s.mu.Lock()
+				s.removeLocked(m)
+				s.mu.Unlock()
+			}
+			return
+		}
+		if n < ethernetHeaderSize {
+			continue
+		}
+		frame := append([]byte(nil), buf[:n]...)
+		s.learned.learn(frame[6:12], m.name)
+
+		select {
+		case s.frames <- capturedFrame{data: frame, captured: captured}:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Recv returns the next frame received on any of the interfaces
+func (s *patternSocket) Recv(buf []byte) (int, error) {
+	n, _, err := s.RecvTimestamp(buf)
+	return n, err
+}
+
+// RecvTimestamp is Recv also returning the capture time of the frame
+func (s *patternSocket) RecvTimestamp(buf []byte) (int, time.Time, error) {
+	select {
+	case <-s.closed:
+		return 0, time.Time{}, os.ErrClosed
+	case frame := <-s.frames:
+		return copy(buf, frame.data), frame.captured, nil
+	}
+}
+
+// Send transmits a frame on the interface its destination was seen on, or on
+// all the interfaces for broadcast, multicast and unknown destinations
+func (s *patternSocket) Send(frame []byte) error {
+	if len(frame) < ethernetHeaderSize {
+		return fmt.Errorf("frame too short: %d bytes", len(frame))
+	}
+
+	name, known := s.learned.lookup(frame[0:6])
+	s.mu.RLock()
+	var targets []*patternMember
+	if m, ok := s.members[name]; known && ok {
+		targets = append(targets, m)
+	} else {
+		for _, m := range s.members {
+			targets = append(targets, m)
+		}
+	}
+	s.mu.RUnlock()
+
+	if len(targets) == 0 {
+		return fmt.Errorf("no interface matching %s is up", s.pattern)
+	}
+	var err error
+	sent := false
+	for _, m := range targets {
+		if serr := m.sock.Send(frame); serr != nil {
+			err = fmt.Errorf("%s: %w", m.name, serr)
+		} else {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+// Close closes the sockets of all the interfaces
+func (s *patternSocket) Close() error {
+	s.closeOnce.Do(func() {
+		s.stopWatch()
+		s.mu.Lock()
+		close(s.closed)
+		for _, m := range s.members {
+			s.removeLocked(m)
+		}
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+// isClosed reports whether Close was called
+func (s *patternSocket) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
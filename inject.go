@@ -0,0 +1,97 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sides a diagnostic frame can be injected on
+const (
+	InjectInterface = "interface" // Sent on the PPPoE interface, as if received from the tunnel
+	InjectTunnel    = "tunnel"    // Sent to the tunnel peers, as if captured on the interface
+)
+
+// adminInjected counts the frames injected by administrators
+var adminInjected = NewCounterVec("pppoeproxy_admin_injected_total", "Diagnostic frames injected by administrators", "side")
+
+// validateFrame checks that frame is a well-formed PPPoE frame fitting the
+// interface, and returns the tunnel packet type carrying it
+func (p *Proxy) validateFrame(frame []byte) (uint16, error) {
+	ethertype, off := framePayload(frame)
+	if len(frame) < off+pppoeHeaderSize {
+		return 0, fmt.Errorf("frame too short: %d bytes", len(frame))
+	}
+	var packetType uint16
+	switch ethertype {
+	case PPPoEDiscovery:
+		packetType = PacketTypeDiscovery
+	case PPPoESession:
+		packetType = PacketTypeSession
+	default:
+		return 0, fmt.Errorf("not a PPPoE frame: ethertype 0x%04x", ethertype)
+	}
+	if frame[off] != 0x11 {
+		return 0, fmt.Errorf("unsupported PPPoE version and type 0x%02x", frame[off])
+	}
+	if length := int(binary.BigEndian.Uint16(frame[off+4 : off+6])); length > len(frame)-off-pppoeHeaderSize {
+		return 0, fmt.Errorf("PPPoE payload length %d exceeds the %d bytes of the frame", length, len(frame)-off-pppoeHeaderSize)
+	}
+	if max := p.maxFrameSize(); max > 0 && len(frame) > max {
+		return 0, fmt.Errorf("frame of %d bytes larger than the %d bytes the interface carries", len(frame), max)
+	}
+	if len(frame) > maxPacketSize {
+		return 0, fmt.Errorf("frame too large: %d bytes", len(frame))
+	}
+	return packetType, nil
+}
+
+// InjectFrame sends a PPPoE frame given by an administrator on side, for
+// diagnostics. Frames sent into the tunnel go to every peer, or only to the
+// peer with the remote address peer if not empty. Frames are validated but
+// bypass the filters and middleware. It returns the decoded headers of the
+// frame.
+func (p *Proxy) InjectFrame(side, peer string, frame []byte) (string, error) {
+	packetType, err := p.validateFrame(frame)
+	if err != nil {
+		return "", err
+	}
+	desc := describeFrame(frame)
+
+	switch side {
+	case InjectInterface:
+		if p.linkDown.Load() {
+			return "", errors.New("the PPPoE interface link is down")
+		}
+		if packetType == PacketTypeDiscovery {
+			err = p.discoveryHandler.InjectPacket(frame)
+		} else {
+			err = p.sessionHandler.InjectPacket(frame)
+		}
+		if err != nil {
+			return "", err
+		}
+	case InjectTunnel:
+		sent := 0
+		f := newTxFrame(packetType, frame, time.Time{})
+		for _, c := range p.peers() {
+			if peer != "" && c.remoteAddr != peer {
+				continue
+			}
+			p.queueFrame(c, f)
+			sent++
+		}
+		if sent == 0 {
+			if peer != "" {
+				return "", fmt.Errorf("no tunnel peer %s", peer)
+			}
+			return "", errors.New("no tunnel peer connected")
+		}
+	default:
+		return "", fmt.Errorf("invalid side %q, expected %s or %s", side, InjectInterface, InjectTunnel)
+	}
+
+	adminInjected.With(side).Inc()
+	return desc, nil
+}
@@ -0,0 +1,91 @@
+package pppoeproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ipMapping is an entry of the session address mapping file
+type ipMapping struct {
+	IP      string    `json:"ip"`
+	Session string    `json:"session"` // Session ID, e.g. 0x1234
+	HostMAC string    `json:"host_mac"`
+	ACMAC   string    `json:"ac_mac"`
+	Owner   string    `json:"owner,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// writeIPMap writes the addresses of the sessions to path, replacing the file
+// atomically so readers never see a partial mapping
+func (p *Proxy) writeIPMap(path string) error {
+	mappings := []ipMapping{}
+	for _, s := range p.sessions.List() {
+		if !s.IP.IsValid() {
+			continue
+		}
+		mappings = append(mappings, ipMapping{
+			IP:      s.IP.String(),
+			Session: fmt.Sprintf("0x%04x", s.ID),
+			HostMAC: s.HostMAC.String(),
+			ACMAC:   s.ACMAC.String(),
+			Owner:   s.Owner,
+			Started: s.Started,
+		})
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].IP < mappings[j].IP })
+	data, err := json.MarshalIndent(mappings, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// CreateTemp makes the file private, the mapping is meant for other tools
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// watchIPMap rewrites the address mapping file whenever a session starts,
+// ends or gets an address, until the proxy is closed
+func (p *Proxy) watchIPMap(path string) {
+	events, cancel := p.sessions.Subscribe()
+	defer cancel()
+
+	update := func() {
+		if err := p.writeIPMap(path); err != nil {
+			log.Printf("Error writing address mapping %s: %v", path, err)
+		}
+	}
+	update()
+	for {
+		select {
+		case <-p.closedCh:
+			return
+		case ev := <-events:
+			if ev.Type == SessionEventStart {
+				// New sessions have no address yet
+				continue
+			}
+			update()
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// journalFailures counts the session events that could not be journaled
+var journalFailures = NewCounter("pppoeproxy_journal_failures_total", "Session events that could not be written to the journal")
+
+// JournalEntry is a session event of the journal, stored as one JSON object
+// per line
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`   // One of the SessionEvent* types
+	Session  string    `json:"session"` // Session ID, e.g. 0x1234
+	HostMAC  string    `json:"host_mac"`
+	ACMAC    string    `json:"ac_mac"`
+	Owner    string    `json:"owner,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Reason   string    `json:"reason,omitempty"`   // Termination reason, or message of the AC for auth events
+	Auth     string    `json:"auth,omitempty"`     // Protocol and result of auth events, e.g. "CHAP failure"
+	Duration float64   `json:"duration,omitempty"` // Seconds, end events only
+	BytesRx  uint64    `json:"bytes_rx,omitempty"` // End events only
+	BytesTx  uint64    `json:"bytes_tx,omitempty"`
+}
+
+// journalEntry converts a session event to its journal entry
+func journalEntry(ev SessionEvent, now time.Time) JournalEntry {
+	s := &ev.Session
+	e := JournalEntry{
+		Time:    now,
+		Event:   ev.Type,
+		Session: fmt.Sprintf("0x%04x", s.ID),
+		HostMAC: s.HostMAC.String(),
+		ACMAC:   s.ACMAC.String(),
+		Owner:   s.Owner,
+		Reason:  ev.Reason,
+	}
+	if s.IP.IsValid() {
+		e.IP = s.IP.String()
+	}
+	switch ev.Type {
+	case SessionEventAuth:
+		e.Auth = s.AuthProtocol + " " + authResultName(s.AuthSuccess)
+	case SessionEventEnd:
+		e.Duration = now.Sub(s.Started).Round(time.Second).Seconds()
+		e.BytesRx = s.BytesRx
+		e.BytesTx = s.BytesTx
+	}
+	return e
+}
+
+// Journal size limits
+const (
+	journalMaxSize = 16 << 20 // Size at which the journal is rotated to <file>.1, replacing the previous one
+	journalSeekMin = 64 << 10 // Bisection of the journal stops at ranges of this size, read line by line
+)
+
+// watchJournal appends the session events to the journal at path until the
+// proxy is closed, rotating it once it reaches journalMaxSize
+func (p *Proxy) watchJournal(path string) {
+	events, cancel := p.sessions.Subscribe()
+	defer cancel()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("Not journaling session events: %v", err)
+		return
+	}
+	defer func() { f.Close() }()
+
+	failing := false
+	for {
+		select {
+		case <-p.closedCh:
+			return
+		case ev := <-events:
+			line, _ := json.Marshal(journalEntry(ev, time.Now()))
+			if _, err := f.Write(append(line, '\n')); err != nil {
+				journalFailures.Inc()
+				if !failing {
+					failing = true
+					log.Printf("Error writing session journal %s: %v", path, err)
+				}
+				continue
+			}
+			failing = false
+			if info, err := f.Stat(); err == nil && info.Size() >= journalMaxSize {
+				f = rotateJournal(path, f)
+			}
+		}
+	}
+}
+
+// rotateJournal renames the journal at path, open as f, to path.1 and returns
+// a new journal. f is kept if the journal cannot be rotated.
+func rotateJournal(path string, f *os.File) *os.File {
+	if err := os.Rename(path, path+".1"); err != nil {
+		log.Printf("Error rotating session journal %s: %v", path, err)
+		return f
+	}
+	next, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		// Keep appending to the rotated file rather than losing events
+		log.Printf("Error rotating session journal %s: %v", path, err)
+		return f
+	}
+	f.Close()
+	return next
+}
+
+// Journal returns the entries of the session journal between since and until,
+// oldest first. A zero time leaves that end of the range open. The entries of
+// the journal rotated last are included.
+func (p *Proxy) Journal(since, until time.Time) ([]JournalEntry, error) {
+	path := p.cfg().JournalFile
+	if path == "" {
+		return nil, errors.New("the session journal is not enabled")
+	}
+	res := []JournalEntry{}
+	for _, name := range []string{path + ".1", path} {
+		var err error
+		if res, err = readJournal(name, since, until, res); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// readJournal appends the entries of the journal file at path between since
+// and until to res. Entries are appended in time order, so the first entry at
+// or after since is found by bisection and reading stops after until: queries
+// for recent events do not read the whole file.
+func readJournal(path string, since, until time.Time, res []JournalEntry) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return res, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var offset int64
+	if !since.IsZero() {
+		offset = journalSeek(f, info.Size(), since)
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, offset, info.Size()-offset))
+	if offset > 0 {
+		// Skip the end of the line the offset falls into
+		if _, err := r.ReadSlice('\n'); err != nil && err != bufio.ErrBufferFull {
+			return res, nil
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A line cut short by a crash, or being written
+			continue
+		}
+		if !until.IsZero() && e.Time.After(until) {
+			break
+		}
+		if !since.IsZero() && e.Time.Before(since) {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res, scanner.Err()
+}
+
+// journalSeek returns an offset of the journal f, of the given size, from
+// which the first entry at or after since is found after skipping a line and
+// reading at most journalSeekMin bytes
+func journalSeek(f *os.File, size int64, since time.Time) int64 {
+	lo, hi := int64(0), size
+	for hi-lo > journalSeekMin {
+		mid := lo + (hi-lo)/2
+		if t, ok := journalTimeAt(f, mid); ok && t.Before(since) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// journalTimeAt returns the time of the first entry of the journal f starting
+// after offset
+func journalTimeAt(f *os.File, offset int64) (time.Time, bool) {
+	r := bufio.NewReader(io.NewSectionReader(f, offset, journalSeekMin))
+	if _, err := r.ReadSlice('\n'); err != nil {
+		return time.Time{}, false
+	}
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return time.Time{}, false
+	}
+	var e JournalEntry
+	if json.Unmarshal(line, &e) != nil {
+		return time.Time{}, false
+	}
+	return e.Time, true
+}
@@ -0,0 +1,87 @@
+package pppoeproxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestJournal writes n entries a second apart from start to path,
+// followed by a line cut short
+func writeTestJournal(t *testing.T, path string, start time.Time, n int) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < n; i++ {
+		line, _ := json.Marshal(JournalEntry{Time: start.Add(time.Duration(i) * time.Second), Event: SessionEventStart, Session: "0x1234"})
+		f.Write(append(line, '\n'))
+	}
+	f.WriteString(`{"time":"`)
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Several bisection ranges in each file
+	const n = 5000
+	writeTestJournal(t, path+".1", start, n)
+	writeTestJournal(t, path, start.Add(n*time.Second), n)
+	p := &Proxy{}
+	p.config.Store(&Config{JournalFile: path})
+
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+	for _, tt := range []struct {
+		since, until time.Time
+		first, count int
+	}{
+		{time.Time{}, time.Time{}, 0, 2 * n},
+		{at(10), at(19), 10, 10},
+		{at(n - 5), at(n + 4), n - 5, 10},
+		{at(2*n - 3), time.Time{}, 2*n - 3, 3},
+		{time.Time{}, at(0), 0, 1},
+		{at(3 * n), time.Time{}, 0, 0},
+		{at(4000).Add(time.Millisecond), at(4001), 4001, 1},
+	} {
+		entries, err := p.Journal(tt.since, tt.until)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tt.count || (tt.count > 0 && !entries[0].Time.Equal(at(tt.first))) {
+			t.Errorf("journal since %v until %v: %d entries, want %d from %v", tt.since, tt.until, len(entries), tt.count, at(tt.first))
+		}
+	}
+
+	// Recent entries are found without reading the file
+	f, err := os.Open(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	if offset := journalSeek(f, info.Size(), at(n-1)); info.Size()-offset > 2*journalSeekMin {
+		t.Errorf("reading %d bytes of %d for the last entry", info.Size()-offset, info.Size())
+	}
+}
+
+func TestRotateJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	writeTestJournal(t, path+".1", time.Now(), 1)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("current\n")
+	f = rotateJournal(path, f)
+	defer f.Close()
+	f.WriteString("next\n")
+
+	for name, want := range map[string]string{path + ".1": "current\n", path: "next\n"} {
+		if data, _ := os.ReadFile(name); string(data) != want {
+			t.Errorf("%s holds %q, want %q", name, data, want)
+		}
+	}
+}
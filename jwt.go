@@ -0,0 +1,313 @@
+package pppoeproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwksRefreshInterval = time.Hour        // Keys are fetched again after this time
+	jwksMinRefresh      = time.Minute      // Unknown key IDs trigger a fetch at most this often
+	jwtLeeway           = 60 * time.Second // Tolerated clock skew on exp and nbf
+)
+
+// JWTValidator validates the bearer tokens issued by an OAuth/OIDC provider:
+// signed JWTs (RS256/384/512 or ES256/384/512) from a given issuer and for a
+// given audience, verified with the keys published at a JWKS URL
+type JWTValidator struct {
+	issuer   string
+	audience string
+	jwksURL  string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // By key ID
+	fetched time.Time
+}
+
+// NewJWTValidator returns a validator for tokens from issuer for audience.
+// The keys are fetched from jwksURL when first needed.
+func NewJWTValidator(issuer, audience, jwksURL string) (*JWTValidator, error) {
+	if issuer == "" || audience == "" || jwksURL == "" {
+		return nil, errors.New("JWT validation requires an issuer, an audience and a JWKS URL")
+	}
+	return &JWTValidator{issuer: issuer, audience: audience, jwksURL: jwksURL}, nil
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims holds the registered claims checked by the validator
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"` // A string or an array of strings
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+// Validate checks the signature and claims of a token and returns its subject
+func (v *JWTValidator) Validate(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid token signature: %v", err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid token claims: %v", err)
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != v.issuer:
+		return "", fmt.Errorf("token issued by %q", claims.Issuer)
+	case !audienceContains(claims.Audience, v.audience):
+		return "", errors.New("token not issued for this audience")
+	case claims.ExpiresAt == nil:
+		return "", errors.New("token without expiration")
+	case now.After(unixTime(*claims.ExpiresAt).Add(jwtLeeway)):
+		return "", errors.New("token expired")
+	case claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)):
+		return "", errors.New("token not valid yet")
+	}
+	return claims.Subject, nil
+}
+
+// decodeJWTPart decodes the base64url JSON of a token part into v
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// unixTime converts a NumericDate claim
+func unixTime(t float64) time.Time {
+	return time.Unix(int64(t), 0)
+}
+
+// audienceContains reports whether the aud claim, a string or an array of
+// strings, contains audience
+func audienceContains(aud json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(aud, &list) != nil {
+		return false
+	}
+	for _, a := range list {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks the signature of signed with the algorithm of the
+// token header. The algorithm must match the key type, so an RSA key cannot
+// be used to verify e.g. an HMAC.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	var digest []byte
+	switch alg[2:] {
+	case "256":
+		sum := sha256.Sum256([]byte(signed))
+		hash, digest = crypto.SHA256, sum[:]
+	case "384":
+		sum := sha512.Sum384([]byte(signed))
+		hash, digest = crypto.SHA384, sum[:]
+	case "512":
+		sum := sha512.Sum512([]byte(signed))
+		hash, digest = crypto.SHA512, sum[:]
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			break
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, sig) != nil {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			break
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("token algorithm %q does not match the key", alg)
+}
+
+// key returns the verification key with the given ID, fetching the JWKS when
+// it is unknown or the keys are old. A token without key ID may be verified
+// with the only key of a single-key set.
+func (v *JWTValidator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.lookup(kid)
+	age := time.Since(v.fetched)
+	if (ok && age < jwksRefreshInterval) || (!ok && age < jwksMinRefresh) {
+		if !ok {
+			return nil, fmt.Errorf("unknown token key %q", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := fetchJWKS(ctx, v.jwksURL)
+	if err != nil {
+		if ok {
+			// Keep using the known keys while the provider is unreachable
+			log.Printf("Failed to refresh JWKS from %s: %v", v.jwksURL, err)
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+	if key, ok = v.lookup(kid); !ok {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+	return key, nil
+}
+
+// lookup returns a known key. Must be called with mu held.
+func (v *JWTValidator) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// jwk is a public key of a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`   // RSA modulus
+	E   string `json:"e"`   // RSA exponent
+	Crv string `json:"crv"` // EC curve
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS downloads the signature keys of a JWKS. Keys of unsupported types
+// are skipped.
+func fetchJWKS(ctx context.Context, url string) (map[string]crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA or EC key
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if n.Sign() == 0 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: b64(k.X), Y: b64(k.Y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,197 @@
+package pppoeproxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWKS serves the public keys of rsaKey and ecKey as "rsa" and "ec",
+// counting the fetches
+func testJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) (string, *atomic.Int32) {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string][]jwk{"keys": {
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X.Bytes()), Y: b64(ecKey.Y.Bytes())},
+		{Kty: "RSA", Kid: "enc", Use: "enc", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}}
+	fetches := new(atomic.Int32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, fetches
+}
+
+// signJWT returns a token with the given header and claims, signed with key
+// (an *rsa.PrivateKey, an *ecdsa.PrivateKey or HMAC key bytes), unsigned if
+// key is nil
+func signJWT(t *testing.T, header, claims map[string]any, key any) string {
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(header) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, _ := testJWKS(t, rsaKey, ecKey)
+	v, err := NewJWTValidator("https://issuer.example", "pppoeproxy", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"iss": "https://issuer.example", "aud": "pppoeproxy", "sub": "ops", "exp": now + 300}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	rs256 := map[string]any{"alg": "RS256", "kid": "rsa"}
+	es256 := map[string]any{"alg": "ES256", "kid": "ec"}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"RS256", signJWT(t, rs256, claims(nil), rsaKey), true},
+		{"ES256", signJWT(t, es256, claims(nil), ecKey), true},
+		{"audience list", signJWT(t, rs256, claims(map[string]any{"aud": []string{"other", "pppoeproxy"}}), rsaKey), true},
+		{"leeway", signJWT(t, rs256, claims(map[string]any{"exp": now - 30, "nbf": now + 30}), rsaKey), true},
+		{"alg none", signJWT(t, map[string]any{"alg": "none", "kid": "rsa"}, claims(nil), nil), false},
+		{"HS256 with the public key", signJWT(t, map[string]any{"alg": "HS256", "kid": "rsa"}, claims(nil), rsaKey.N.Bytes()), false},
+		{"RS256 with an EC key", signJWT(t, map[string]any{"alg": "RS256", "kid": "ec"}, claims(nil), ecKey), false},
+		{"ES256 with an RSA key", signJWT(t, map[string]any{"alg": "ES256", "kid": "rsa"}, claims(nil), rsaKey), false},
+		{"wrong key", signJWT(t, rs256, claims(nil), otherKey), false},
+		{"encryption key", signJWT(t, map[string]any{"alg": "RS256", "kid": "enc"}, claims(nil), rsaKey), false},
+		{"expired", signJWT(t, rs256, claims(map[string]any{"exp": now - 3600}), rsaKey), false},
+		{"no expiration", signJWT(t, rs256, claims(map[string]any{"exp": nil}), rsaKey), false},
+		{"not valid yet", signJWT(t, rs256, claims(map[string]any{"nbf": now + 3600}), rsaKey), false},
+		{"wrong issuer", signJWT(t, rs256, claims(map[string]any{"iss": "https://other.example"}), rsaKey), false},
+		{"wrong audience", signJWT(t, rs256, claims(map[string]any{"aud": "other"}), rsaKey), false},
+		{"wrong audience list", signJWT(t, rs256, claims(map[string]any{"aud": []string{"other"}}), rsaKey), false},
+		{"malformed", "header.claims", false},
+	}
+	for _, tt := range tests {
+		sub, err := v.Validate(context.Background(), tt.token)
+		if (err == nil) != tt.ok || (tt.ok && sub != "ops") {
+			t.Errorf("%s: subject %q, error %v", tt.name, sub, err)
+		}
+	}
+
+	// Claims changed after signing
+	token := signJWT(t, rs256, claims(nil), rsaKey)
+	forged := signJWT(t, rs256, claims(map[string]any{"sub": "admin"}), rsaKey)
+	parts, forgedParts := strings.Split(token, "."), strings.Split(forged, ".")
+	if _, err := v.Validate(context.Background(), parts[0]+"."+forgedParts[1]+"."+parts[2]); err == nil {
+		t.Error("token with altered claims accepted")
+	}
+}
+
+func TestJWTValidatorRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url, fetches := testJWKS(t, rsaKey, ecKey)
+	v, _ := NewJWTValidator("iss", "aud", url)
+	claims := map[string]any{"iss": "iss", "aud": "aud", "exp": time.Now().Unix() + 300}
+	valid := signJWT(t, map[string]any{"alg": "RS256", "kid": "rsa"}, claims, rsaKey)
+	unknown := signJWT(t, map[string]any{"alg": "RS256", "kid": "rotated"}, claims, rsaKey)
+
+	for i := 0; i < 3; i++ {
+		if _, err := v.Validate(context.Background(), valid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches for a known key", n)
+	}
+
+	// Unknown keys trigger a fetch at most every jwksMinRefresh
+	for i := 0; i < 3; i++ {
+		if _, err := v.Validate(context.Background(), unknown); err == nil {
+			t.Fatal("token with an unknown key accepted")
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches after unknown keys right after a fetch", n)
+	}
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-jwksMinRefresh)
+	v.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		v.Validate(context.Background(), unknown)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("%d fetches for unknown keys, want 2", n)
+	}
+
+	// Known keys are fetched again once old, and kept when the provider is
+	// unreachable
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-jwksRefreshInterval)
+	v.jwksURL = "http://127.0.0.1:1/jwks"
+	v.mu.Unlock()
+	if _, err := v.Validate(context.Background(), valid); err != nil {
+		t.Fatalf("known key dropped when the provider is unreachable: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// Keepalive metrics
+var (
+	keepaliveMissed = NewCounter("pppoeproxy_keepalive_missed_total", "Pings sent while the previous one was still unanswered")
+	deadPeers       = NewCounter("pppoeproxy_tunnel_dead_peers_total", "Tunnel connections closed because the peer stopped responding")
+	writeTimeouts   = NewCounter("pppoeproxy_tunnel_write_timeouts_total", "Tunnel writes that hit the write deadline")
+)
+
+// deadPeerTimeout returns how long a tunnel connection may stay silent before
+// the peer is considered dead, or 0 if dead-peer detection is disabled
+func (p *Proxy) deadPeerTimeout() time.Duration {
+	cfg := p.cfg()
+	if p.isServer && cfg.ClientTimeout > 0 {
+		return cfg.ClientTimeout
+	}
+	if cfg.KeepaliveInterval <= 0 || cfg.KeepaliveMisses <= 0 {
+		return 0
+	}
+	return cfg.KeepaliveInterval * time.Duration(cfg.KeepaliveMisses)
+}
+
+// armReadDeadline sets the read deadline of a tunnel connection for the next
+// packet. Any packet (including pings and pongs) pushes the deadline back.
+func (p *Proxy) armReadDeadline(client *Client) {
+	if timeout := p.deadPeerTimeout(); timeout > 0 {
+		client.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		client.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// isDeadPeer reports whether a tunnel read error was caused by the read
+// deadline, logging the dead peer if so
+func (p *Proxy) isDeadPeer(client *Client, err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	deadPeers.Inc()
+	timeout := p.deadPeerTimeout()
+	log.Printf("No data from %s for %s, closing dead tunnel connection", client.remoteAddr, timeout)
+	if p.isServer {
+		p.hooks.Fire(HookClientTimeout, "PEER="+client.remoteAddr, "CLIENT_NAME="+client.Name(), fmt.Sprintf("IDLE=%d", int(timeout.Seconds())))
+	}
+	return true
+}
+
+// resetPingTicker applies the configured keepalive interval to the ping ticker
+func (p *Proxy) resetPingTicker() {
+	if p.pingTicker == nil {
+		return
+	}
+	interval := p.cfg().KeepaliveInterval
+	if p.isServer {
+		interval = p.cfg().ClientPingInterval
+	}
+	if interval > 0 {
+		p.pingTicker.Reset(interval)
+	} else {
+		p.pingTicker.Stop()
+	}
+}
+
+// pingClients sends a ping to each client, so clients that stopped answering
+// are detected even when they do not send pings themselves
+func (p *Proxy) pingClients() {
+	clients := p.peers()
+	for _, client := range clients {
+		if n := client.pending.Add(1); n > 1 {
+			keepaliveMissed.Inc()
+			log.Printf("Client %s did not answer the last %d ping(s)", client.remoteAddr, n-1)
+		}
+		if err := client.WritePacket(PacketTypePing, pingPayload()); err != nil {
+			log.Printf("Error sending ping to %s: %v", client.remoteAddr, err)
+		}
+	}
+	if len(clients) > 0 {
+		log.Printf("Sent ping to %d client(s)", len(clients))
+	}
+}
+
+// setTCPKeepalive applies the configured TCP keepalive to a tunnel connection
+func (p *Proxy) setTCPKeepalive(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	cfg := p.cfg()
+	err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+		Enable:   cfg.TCPKeepaliveIdle >= 0,
+		Idle:     cfg.TCPKeepaliveIdle,
+		Interval: cfg.TCPKeepaliveInterval,
+		Count:    cfg.TCPKeepaliveCount,
+	})
+	if err != nil {
+		log.Printf("Error setting TCP keepalive on %s: %v", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,143 @@
+package pppoeproxy
+
+import (
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// rxDelayQueueSize is the number of frames read from a tunnel peer the
+// emulated latency holds back at once, beyond which they are dropped
+const rxDelayQueueSize = 16384
+
+// latencyDrops counts the frames dropped by the latency emulation
+var latencyDrops = NewCounter("pppoeproxy_emulated_latency_drops_total", "Frames read from the tunnel dropped because the emulated latency held back too many")
+
+// emulatedDelay returns delay varied randomly by up to jitter either way
+func emulatedDelay(delay, jitter time.Duration) time.Duration {
+	if jitter > 0 {
+		delay += time.Duration((2*rand.Float64() - 1) * float64(jitter))
+	}
+	return delay
+}
+
+// waitUntil waits until t, and returns false if closed is closed first
+func waitUntil(t time.Time, closed <-chan struct{}) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-closed:
+		return false
+	}
+}
+
+// rxDelayed is a frame read from a tunnel peer, held back until due
+type rxDelayed struct {
+	packetType uint16
+	data       []byte
+	due        time.Time
+}
+
+// rxDelayLine holds the frames read from a tunnel peer for the latency
+// emulated in the incoming direction. Once it was used, all the frames of the
+// peer go through it, so they are processed in order by a single goroutine.
+type rxDelayLine struct {
+	ready chan struct{} // Signaled when a frame was added
+
+	mu      sync.Mutex
+	started bool
+	frames  []rxDelayed
+}
+
+// newRxDelayLine returns an empty delay line
+func newRxDelayLine() *rxDelayLine {
+	return &rxDelayLine{ready: make(chan struct{}, 1)}
+}
+
+// receiveFrame processes a discovery, session, sequenced or timestamped
+// packet read from a tunnel peer, once the latency emulated in the incoming
+// direction elapsed
+func (p *Proxy) receiveFrame(client *Client, packetType uint16, data []byte) {
+	cfg := p.cfg()
+	delay := emulatedDelay(cfg.TunnelDelayIn, cfg.TunnelJitterIn)
+	line := client.rxDelay
+	line.mu.Lock()
+	if !line.started {
+		if delay <= 0 {
+			line.mu.Unlock()
+			p.handleFrame(client, packetType, data)
+			return
+		}
+		line.started = true
+		p.spawn(func() { p.processDelayed(client) })
+	}
+	if len(line.frames) >= rxDelayQueueSize {
+		line.mu.Unlock()
+		latencyDrops.Inc()
+		p.grantCredit(client, packetType, data)
+		return
+	}
+	// The payload is only valid until the next read
+	line.frames = append(line.frames, rxDelayed{packetType, append([]byte(nil), data...), time.Now().Add(delay)})
+	line.mu.Unlock()
+
+	select {
+	case line.ready <- struct{}{}:
+	default:
+	}
+}
+
+// processDelayed processes the frames of the delay line of a tunnel peer when
+// they are due, until the peer is closed
+func (p *Proxy) processDelayed(client *Client) {
+	line := client.rxDelay
+	for {
+		line.mu.Lock()
+		if len(line.frames) == 0 {
+			line.mu.Unlock()
+			select {
+			case <-client.tx.closed:
+				return
+			case <-line.ready:
+			}
+			continue
+		}
+		f := line.frames[0]
+		line.frames[0] = rxDelayed{}
+		line.frames = line.frames[1:]
+		line.mu.Unlock()
+
+		if !waitUntil(f.due, client.tx.closed) {
+			return
+		}
+		p.handleFrame(client, f.packetType, f.data)
+	}
+}
+
+// handleFrame injects a discovery, session, sequenced or timestamped packet
+// read from a tunnel peer, and grants the peer a new credit for it
+func (p *Proxy) handleFrame(client *Client, packetType uint16, data []byte) {
+	defer p.grantCredit(client, packetType, data)
+	switch packetType {
+	case PacketTypeDiscovery, PacketTypeSession:
+		p.injectFrame(client, packetType, data)
+
+	case PacketTypeSequenced:
+		packetType, frame, err := client.unwrapSequenced(data)
+		if err != nil {
+			log.Printf("Invalid packet from %s: %v", client.remoteAddr, err)
+			return
+		}
+		p.injectFrame(client, packetType, frame)
+
+	case PacketTypeTimestamped:
+		p.handleTimestamped(client, data)
+	}
+}
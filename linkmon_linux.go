@@ -0,0 +1,124 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// linkCallback is called with the index and name of an interface that was
+// added, removed or changed, or with index 0 when notifications were lost
+type linkCallback func(index int, name string, removed bool)
+
+// linkMonitor receives rtnetlink link notifications for the raw sockets. It
+// runs while at least one callback is registered.
+var linkMonitor struct {
+	mu        sync.Mutex
+	callbacks map[*linkCallback]struct{}
+	file      *os.File
+}
+
+// watchLinks registers f to be called on link changes and returns a function
+// unregistering it. Without a netlink socket, changes are only noticed when
+// receiving fails.
+func watchLinks(f linkCallback) func() {
+	linkMonitor.mu.Lock()
+	defer linkMonitor.mu.Unlock()
+
+	if linkMonitor.file == nil {
+		file, err := openLinkMonitor()
+		if err != nil {
+			log.Printf("Failed to monitor interfaces, changes are only handled on errors: %v", err)
+			return func() {}
+		}
+		linkMonitor.file = file
+		linkMonitor.callbacks = make(map[*linkCallback]struct{})
+		go readLinkEvents(file)
+	}
+	linkMonitor.callbacks[&f] = struct{}{}
+
+	return func() {
+		linkMonitor.mu.Lock()
+		defer linkMonitor.mu.Unlock()
+		delete(linkMonitor.callbacks, &f)
+		if len(linkMonitor.callbacks) == 0 && linkMonitor.file != nil {
+			linkMonitor.file.Close()
+			linkMonitor.file = nil
+		}
+	}
+}
+
+// openLinkMonitor opens a netlink socket subscribed to link notifications
+func openLinkMonitor() (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: unix.RTMGRP_LINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "netlink:link"), nil
+}
+
+// readLinkEvents dispatches link notifications until the socket is closed
+func readLinkEvents(file *os.File) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if errors.Is(err, unix.ENOBUFS) {
+				// Notifications were lost, let every socket check its
+				// interface
+				notifyLinks(0, "", false)
+				continue
+			}
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for i := range msgs {
+			m := &msgs[i]
+			if m.Header.Type != unix.RTM_NEWLINK && m.Header.Type != unix.RTM_DELLINK {
+				continue
+			}
+			if len(m.Data) < unix.SizeofIfInfomsg {
+				continue
+			}
+			info := (*unix.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+			attrs, err := syscall.ParseNetlinkRouteAttr(m)
+			if err != nil {
+				continue
+			}
+			var name string
+			for _, attr := range attrs {
+				if attr.Attr.Type == unix.IFLA_IFNAME {
+					name = unix.ByteSliceToString(attr.Value)
+				}
+			}
+			notifyLinks(int(info.Index), name, m.Header.Type == unix.RTM_DELLINK)
+		}
+	}
+}
+
+// notifyLinks calls the registered callbacks
+func notifyLinks(index int, name string, removed bool) {
+	linkMonitor.mu.Lock()
+	callbacks := make([]linkCallback, 0, len(linkMonitor.callbacks))
+	for f := range linkMonitor.callbacks {
+		callbacks = append(callbacks, *f)
+	}
+	linkMonitor.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(index, name, removed)
+	}
+}
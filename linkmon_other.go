@@ -0,0 +1,12 @@
+//go:build !linux
+
+package pppoeproxy
+
+// linkCallback is called with the index and name of an interface that was
+// added, removed or changed
+type linkCallback func(index int, name string, removed bool)
+
+// watchLinks does nothing: link changes are only noticed when receiving fails
+func watchLinks(f linkCallback) func() {
+	return func() {}
+}
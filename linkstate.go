@@ -0,0 +1,125 @@
+package pppoeproxy
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// linkPollInterval is how often the link state of the PPPoE interface is
+// checked, in addition to link change notifications
+const linkPollInterval = 5 * time.Second
+
+// Link states carried by PacketTypeLinkState
+const (
+	linkStateUp   = "up"
+	linkStateDown = "down"
+)
+
+// Link state metrics
+var (
+	linkUp        = NewGauge("pppoeproxy_link_up", "Whether the PPPoE interface link is up (1) or down (0)")
+	linkDownDrops = NewCounterVec("pppoeproxy_link_down_dropped_total", "Frames from the tunnel dropped while the PPPoE interface link was down", "type")
+)
+
+// interfaceLinkUp reports whether the interface, or one of the interfaces
+// matching the pattern, is up and has a carrier
+func interfaceLinkUp(name string) bool {
+	ifaces, err := FindInterfaces(name)
+	if err != nil {
+		return false
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&(net.FlagUp|net.FlagRunning) == net.FlagUp|net.FlagRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// watchLinkState follows the link state of the PPPoE interface, and the
+// failovers of a bond or team, until the proxy is closed. Interfaces unknown at startup, such as the in-memory
+// sockets of a FakeSegment, are not watched.
+func (p *Proxy) watchLinkState() {
+	name := p.cfg().Interface
+	if _, err := FindInterfaces(name); err != nil {
+		return
+	}
+
+	changed := make(chan struct{}, 1)
+	stop := watchLinks(func(index int, ifname string, removed bool) {
+		if index == 0 || matchInterface(name, ifname) {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer stop()
+
+	linkUp.Set(1)
+	bond := bondMonitor{name: name}
+	ticker := time.NewTicker(linkPollInterval)
+	defer ticker.Stop()
+	for {
+		p.updateLinkState(interfaceLinkUp(name))
+		bond.check()
+		select {
+		case <-p.closedCh:
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateLinkState pauses or resumes forwarding when the link state changed,
+// and tells the tunnel peers
+func (p *Proxy) updateLinkState(up bool) {
+	if p.linkDown.Swap(!up) == !up {
+		return
+	}
+
+	name := p.cfg().Interface
+	if up {
+		linkUp.Set(1)
+		log.Printf("Link of %s is up, resuming injection", name)
+		p.hooks.Fire(HookLinkUp)
+	} else {
+		linkUp.Set(0)
+		log.Printf("Link of %s is down, pausing injection", name)
+		p.hooks.Fire(HookLinkDown)
+	}
+	for _, peer := range p.peers() {
+		p.sendLinkState(peer)
+	}
+}
+
+// sendLinkState tells a tunnel peer whether our PPPoE link is up
+func (p *Proxy) sendLinkState(client *Client) {
+	state := linkStateUp
+	if p.linkDown.Load() {
+		state = linkStateDown
+	}
+	if err := client.WritePacket(PacketTypeLinkState, []byte(state)); err != nil {
+		log.Printf("Error sending link state to %s: %v", client.remoteAddr, err)
+	}
+}
+
+// handleLinkState records the link state announced by a tunnel peer
+func (p *Proxy) handleLinkState(client *Client, data []byte) {
+	down := string(data) == linkStateDown
+	if client.peerLinkDown.Swap(down) == down {
+		return
+	}
+	if down {
+		log.Printf("Tunnel peer %s reports its PPPoE link down", client.remoteAddr)
+	} else {
+		log.Printf("Tunnel peer %s reports its PPPoE link up", client.remoteAddr)
+	}
+}
+
+// PeerLinkDown reports whether the peer announced that its PPPoE link is down
+func (c *Client) PeerLinkDown() bool {
+	return c.peerLinkDown.Load()
+}
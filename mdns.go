@@ -0,0 +1,357 @@
+package pppoeproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsPrefix marks a server address discovered with multicast DNS
+const mdnsPrefix = "mdns:"
+
+// mDNS parameters. Only IPv4 multicast is used, which is what every
+// zeroconf implementation supports.
+const (
+	mdnsService = "_pppoeproxy._tcp.local." // Service type servers are advertised under
+	mdnsTTL     = 120                       // TTL of advertised records, in seconds
+	mdnsBrowse  = time.Second               // Time spent collecting answers when browsing
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// IsDiscoveryAddress reports whether a client address is looked up at
+// connection time rather than given as a host and port: a DNS SRV record name
+// ("srv:_pppoeproxy._tcp.example.com") or a server found with mDNS ("mdns:"
+// for any server, "mdns:name" for the server advertised as name)
+func IsDiscoveryAddress(address string) bool {
+	return strings.HasPrefix(address, srvPrefix) || strings.HasPrefix(address, mdnsPrefix)
+}
+
+// mdnsResponder answers mDNS queries for the tunnel listener, so clients on
+// the same network can find the server without a configured address
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	pc       *ipv4.PacketConn
+	service  dnsmessage.Name
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	addr     netip.Addr // Address the listener is bound to, invalid for all addresses
+}
+
+// advertise starts answering mDNS queries for the server under the given
+// instance name, on the tunnel interface when set, on every multicast
+// interface but the PPPoE one otherwise. The first
+// listener is advertised. It stops when the proxy is closed.
+func (p *Proxy) advertise(name string) error {
+	tcpAddr, ok := p.listeners[0].Addr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("mDNS advertisement requires a TCP listener")
+	}
+	if strings.Contains(name, ".") {
+		return fmt.Errorf("invalid mDNS name %q: must not contain dots", name)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+
+	r := &mdnsResponder{port: uint16(tcpAddr.Port)}
+	if ip, ok := netip.AddrFromSlice(tcpAddr.IP); ok && !ip.IsUnspecified() {
+		r.addr = ip.Unmap()
+	}
+	if r.service, err = dnsmessage.NewName(mdnsService); err != nil {
+		return err
+	}
+	if r.instance, err = dnsmessage.NewName(name + "." + mdnsService); err != nil {
+		return fmt.Errorf("invalid mDNS name %q: %v", name, err)
+	}
+	if r.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return fmt.Errorf("invalid host name %q: %v", hostname, err)
+	}
+
+	var tunnelIfi *net.Interface
+	if iface := p.cfg().TunnelInterface; iface != "" {
+		if tunnelIfi, err = net.InterfaceByName(iface); err != nil {
+			return err
+		}
+	}
+	r.conn, err = net.ListenMulticastUDP("udp4", tunnelIfi, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("failed to listen for mDNS queries: %v", err)
+	}
+	r.pc = ipv4.NewPacketConn(r.conn)
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || matchInterface(p.cfg().Interface, ifi.Name) || tunnelIfi != nil {
+			continue
+		}
+		// Fails harmlessly for the interface ListenMulticastUDP already joined
+		r.pc.JoinGroup(&ifi, mdnsGroup)
+	}
+	// Without the arrival interface, answers list the addresses of all interfaces
+	r.pc.SetControlMessage(ipv4.FlagInterface, true)
+
+	context.AfterFunc(p.ctx, func() { r.conn.Close() })
+	if !p.spawn(r.serve) {
+		r.conn.Close()
+		return nil
+	}
+	log.Printf("Advertising the server as %q over mDNS", name)
+	return nil
+}
+
+// serve answers queries until the connection is closed
+func (r *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, src, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error reading mDNS query: %v", err)
+			continue
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || msg.Header.Response {
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		r.answer(&msg, src.(*net.UDPAddr), ifIndex)
+	}
+}
+
+// answer replies to a query when it asks about our service, instance or host
+func (r *mdnsResponder) answer(query *dnsmessage.Message, src *net.UDPAddr, ifIndex int) {
+	var questions []dnsmessage.Question
+	for _, q := range query.Questions {
+		q.Class &^= 1 << 15 // Unicast-response bit
+		if q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY {
+			continue
+		}
+		if r.matches(q.Name, r.service) || r.matches(q.Name, r.instance) || r.matches(q.Name, r.host) {
+			questions = append(questions, q)
+		}
+	}
+	if len(questions) == 0 {
+		return
+	}
+
+	// Queries not sent from the mDNS port come from simple resolvers
+	// expecting a regular DNS answer (RFC 6762 section 6.7)
+	legacy := src.Port != mdnsGroup.Port
+	ttl := uint32(mdnsTTL)
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	if legacy {
+		msg.Header.ID = query.Header.ID
+		msg.Questions = questions
+		ttl = 10
+	}
+
+	hdr := func(name dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	msg.Answers = []dnsmessage.Resource{{Header: hdr(r.service, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: r.instance}}}
+	msg.Additionals = []dnsmessage.Resource{
+		{Header: hdr(r.instance, dnsmessage.TypeSRV), Body: &dnsmessage.SRVResource{Target: r.host, Port: r.port}},
+		{Header: hdr(r.instance, dnsmessage.TypeTXT), Body: &dnsmessage.TXTResource{TXT: []string{"version=" + Version()}}},
+	}
+	for _, ip := range r.addresses(ifIndex) {
+		msg.Additionals = append(msg.Additionals, dnsmessage.Resource{Header: hdr(r.host, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: ip.As4()}})
+	}
+
+	out, err := msg.Pack()
+	if err != nil {
+		log.Printf("Error building mDNS answer: %v", err)
+		return
+	}
+	dst := src
+	if !legacy {
+		dst = mdnsGroup
+		if ifi, err := net.InterfaceByIndex(ifIndex); err == nil {
+			r.pc.SetMulticastInterface(ifi)
+		}
+	}
+	if _, err := r.conn.WriteTo(out, dst); err != nil {
+		log.Printf("Error sending mDNS answer to %s: %v", dst, err)
+	}
+}
+
+// matches compares DNS names, which are case insensitive
+func (r *mdnsResponder) matches(a, b dnsmessage.Name) bool {
+	return strings.EqualFold(a.String(), b.String())
+}
+
+// addresses returns the IPv4 addresses clients can reach the listener on:
+// the address it is bound to, or the addresses of the interface the query
+// arrived on
+func (r *mdnsResponder) addresses(ifIndex int) []netip.Addr {
+	if r.addr.IsValid() {
+		if r.addr.Is4() {
+			return []netip.Addr{r.addr}
+		}
+		return nil
+	}
+
+	var ifaces []net.Interface
+	if ifi, err := net.InterfaceByIndex(ifIndex); ifIndex != 0 && err == nil {
+		ifaces = []net.Interface{*ifi}
+	} else {
+		ifaces, _ = net.Interfaces()
+	}
+	var res []netip.Addr
+	for _, ifi := range ifaces {
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip, ok := netip.AddrFromSlice(ipnet.IP); ok && ip.Unmap().Is4() && !ip.IsLoopback() {
+				res = append(res, ip.Unmap())
+			}
+		}
+	}
+	return res
+}
+
+// mdnsServer is a server found while browsing
+type mdnsServer struct {
+	target string // Host name from the SRV record
+	port   uint16
+}
+
+// browseMDNS queries the local network for advertised servers and returns
+// their addresses in the order they answered. The query socket gets the
+// dialer's socket options. With a non-empty instance, only
+// the server advertised under that name is returned.
+func browseMDNS(ctx context.Context, dialer *net.Dialer, instance string) ([]string, error) {
+	lc := net.ListenConfig{Control: dialer.Control}
+	conn, err := lc.ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	service, err := dnsmessage.NewName(mdnsService)
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32())},
+		Questions: []dnsmessage.Question{{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	out, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(out, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+
+	deadline := time.Now().Add(mdnsBrowse)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var order []string // Instances in the order they answered
+	servers := make(map[string]mdnsServer)
+	hosts := make(map[string][]netip.Addr)
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || !msg.Header.Response {
+			continue
+		}
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			name := strings.ToLower(rr.Header.Name.String())
+			switch body := rr.Body.(type) {
+			case *dnsmessage.SRVResource:
+				name, ok := strings.CutSuffix(name, "."+mdnsService)
+				if !ok {
+					continue
+				}
+				if _, seen := servers[name]; !seen {
+					order = append(order, name)
+				}
+				servers[name] = mdnsServer{target: strings.ToLower(body.Target.String()), port: body.Port}
+			case *dnsmessage.AResource:
+				ip := netip.AddrFrom4(body.A)
+				if !slices.Contains(hosts[name], ip) {
+					hosts[name] = append(hosts[name], ip)
+				}
+			}
+		}
+		if instance != "" {
+			if srv, ok := servers[strings.ToLower(instance)]; ok && len(hosts[srv.target]) > 0 {
+				break
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	var addrs []string
+	for _, name := range order {
+		if instance != "" && name != strings.ToLower(instance) {
+			continue
+		}
+		srv := servers[name]
+		for _, ip := range hosts[srv.target] {
+			addrs = append(addrs, netip.AddrPortFrom(ip, srv.port).String())
+		}
+	}
+	if len(addrs) == 0 {
+		if instance != "" {
+			return nil, fmt.Errorf("no server advertised as %q found with mDNS", instance)
+		}
+		return nil, errors.New("no server found with mDNS")
+	}
+	return addrs, nil
+}
+
+// dialMDNS browses for servers and connects to the first one that answers
+func dialMDNS(ctx context.Context, dialer *net.Dialer, instance string) (net.Conn, error) {
+	addrs, err := browseMDNS(ctx, dialer, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("Failed to connect to %s found with mDNS: %v", addr, err)
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,374 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing metric
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+func (c *Counter) value() float64 {
+	return float64(c.v.Load())
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add adds delta to the gauge
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		nv := math.Float64bits(math.Float64frombits(old) + delta)
+		if g.bits.CompareAndSwap(old, nv) {
+			return
+		}
+	}
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) value() float64 {
+	return g.Value()
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	bounds []float64       // Upper bounds of the buckets, ascending
+	counts []atomic.Uint64 // Observations per bucket, the last one above all bounds
+	sum    Gauge
+	count  atomic.Uint64
+}
+
+// Observe records an observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// value returns the number of observations, for SNMP
+func (h *Histogram) value() float64 {
+	return float64(h.count.Load())
+}
+
+// writeSamples writes the buckets, sum and count of the histogram
+func (h *Histogram) writeSamples(w io.Writer, name, labels string) error {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = fmt.Sprintf("%g", h.bounds[i])
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, le, cumulative); err != nil {
+			return err
+		}
+	}
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + labels + "}"
+	}
+	_, err := fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, suffix, h.sum.Value(), name, suffix, h.count.Load())
+	return err
+}
+
+// metricValue is implemented by all metric types
+type metricValue interface {
+	value() float64
+}
+
+// sampleWriter is implemented by the metrics exposing several samples per
+// series, such as histograms
+type sampleWriter interface {
+	writeSamples(w io.Writer, name, labels string) error
+}
+
+// metricFamily groups all series sharing a metric name
+type metricFamily struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mu     sync.Mutex
+	series map[string]metricValue
+}
+
+// get returns the series for the given label values, creating it if needed
+func (f *metricFamily) get(values []string, create func() metricValue) metricValue {
+	key := f.key(values)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.series[key]
+	if !ok {
+		m = create()
+		f.series[key] = m
+	}
+	return m
+}
+
+// delete removes the series for the given label values
+func (f *metricFamily) delete(values []string) {
+	key := f.key(values)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.series, key)
+}
+
+// key returns the series key for the given label values
+func (f *metricFamily) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	var key strings.Builder
+	for i, l := range f.labels {
+		if i > 0 {
+			key.WriteByte(',')
+		}
+		fmt.Fprintf(&key, "%s=%q", l, values[i])
+	}
+	return key.String()
+}
+
+// metricsRegistry holds all registered metric families
+var metricsRegistry = struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}{families: make(map[string]*metricFamily)}
+
+// registerFamily registers a metric family, returning the existing one if
+// the name is already known
+func registerFamily(name, help, typ string, labels []string) *metricFamily {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+
+	if f, ok := metricsRegistry.families[name]; ok {
+		return f
+	}
+	f := &metricFamily{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string]metricValue),
+	}
+	metricsRegistry.families[name] = f
+	return f
+}
+
+// NewCounter registers a counter without labels
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// NewGauge registers a gauge without labels
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	f *metricFamily
+}
+
+// NewCounterVec registers a counter family with the given label names
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: registerFamily(name, help, "counter", labels)}
+}
+
+// With returns the counter for the given label values
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.get(values, func() metricValue { return new(Counter) }).(*Counter)
+}
+
+// Total returns the sum of all counters in the set
+func (v *CounterVec) Total() uint64 {
+	v.f.mu.Lock()
+	defer v.f.mu.Unlock()
+	var total uint64
+	for _, m := range v.f.series {
+		total += m.(*Counter).Value()
+	}
+	return total
+}
+
+// GaugeVec is a set of gauges partitioned by label values
+type GaugeVec struct {
+	f *metricFamily
+}
+
+// NewGaugeVec registers a gauge family with the given label names
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: registerFamily(name, help, "gauge", labels)}
+}
+
+// With returns the gauge for the given label values
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.get(values, func() metricValue { return new(Gauge) }).(*Gauge)
+}
+
+// Delete removes the gauge for the given label values, for series that
+// describe something that went away
+func (v *GaugeVec) Delete(values ...string) {
+	v.f.delete(values)
+}
+
+// HistogramVec is a set of histograms partitioned by label values
+type HistogramVec struct {
+	f      *metricFamily
+	bounds []float64
+}
+
+// NewHistogramVec registers a histogram family with the given bucket upper
+// bounds, in ascending order, and label names
+func NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{f: registerFamily(name, help, "histogram", labels), bounds: bounds}
+}
+
+// With returns the histogram for the given label values
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.get(values, func() metricValue {
+		return &Histogram{bounds: v.bounds, counts: make([]atomic.Uint64, len(v.bounds)+1)}
+	}).(*Histogram)
+}
+
+// WriteMetrics writes all registered metrics in the Prometheus text format
+func WriteMetrics(w io.Writer) error {
+	metricsRegistry.mu.Lock()
+	families := make([]*metricFamily, 0, len(metricsRegistry.families))
+	for _, f := range metricsRegistry.families {
+		families = append(families, f)
+	}
+	metricsRegistry.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	for _, f := range families {
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ); err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		for _, k := range keys {
+			if sw, ok := f.series[k].(sampleWriter); ok {
+				if err := sw.writeSamples(w, f.name, k); err != nil {
+					f.mu.Unlock()
+					return err
+				}
+				continue
+			}
+			name := f.name
+			if k != "" {
+				name += "{" + k + "}"
+			}
+			if _, err := fmt.Fprintf(w, "%s %g\n", name, f.series[k].value()); err != nil {
+				f.mu.Unlock()
+				return err
+			}
+		}
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// snapshotMetrics returns the value of every series, keyed by its name and
+// labels as exposed to Prometheus. Histograms give their number of
+// observations.
+func snapshotMetrics() map[string]float64 {
+	metricsRegistry.mu.Lock()
+	families := make([]*metricFamily, 0, len(metricsRegistry.families))
+	for _, f := range metricsRegistry.families {
+		families = append(families, f)
+	}
+	metricsRegistry.mu.Unlock()
+
+	res := make(map[string]float64)
+	for _, f := range families {
+		f.mu.Lock()
+		for k, m := range f.series {
+			name := f.name
+			if k != "" {
+				name += "{" + k + "}"
+			}
+			res[name] = m.value()
+		}
+		f.mu.Unlock()
+	}
+	return res
+}
+
+// ServeMetrics starts an HTTP server exposing metrics on /metrics
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics server: %v", err)
+	}
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+	log.Printf("Metrics available on http://%s/metrics", ln.Addr())
+	return nil
+}
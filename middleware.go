@@ -0,0 +1,66 @@
+package pppoeproxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Middleware processes a frame, including its Ethernet header, before it is
+// forwarded into the tunnel (direction DirectionRx) or injected on the
+// interface (DirectionTx). It returns the frame to pass on, which may be
+// modified in place or replaced, and false to drop it. The frame is only
+// valid during the call.
+type Middleware func(direction string, packet []byte) ([]byte, bool)
+
+// middlewareDropped counts frames dropped by middleware
+var middlewareDropped = NewCounterVec("pppoeproxy_middleware_dropped_total", "Frames dropped by middleware", "direction")
+
+// middlewareChain is the ordered list of registered middleware. Frames are
+// processed concurrently, so the list is replaced rather than modified.
+type middlewareChain struct {
+	mu   sync.Mutex // Serializes additions
+	list atomic.Pointer[[]Middleware]
+}
+
+// add appends middleware to the chain
+func (c *middlewareChain) add(m []Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var list []Middleware
+	if old := c.list.Load(); old != nil {
+		list = append(list, *old...)
+	}
+	list = append(list, m...)
+	c.list.Store(&list)
+}
+
+// run passes a frame through the chain and returns the frame to use, or false
+// if it must be dropped
+func (c *middlewareChain) run(direction string, packet []byte) ([]byte, bool) {
+	list := c.list.Load()
+	if list == nil {
+		return packet, true
+	}
+	for _, m := range *list {
+		var ok bool
+		packet, ok = m(direction, packet)
+		if !ok {
+			middlewareDropped.With(direction).Inc()
+			return nil, false
+		}
+		if len(packet) < ethernetHeaderSize+pppoeHeaderSize {
+			// Too short to be forwarded, treat it as dropped
+			middlewareDropped.With(direction).Inc()
+			return nil, false
+		}
+	}
+	return packet, true
+}
+
+// Use appends middleware to the chain every forwarded and injected frame goes
+// through. Middleware runs in the order it was registered and may be added
+// while the proxy runs.
+func (p *Proxy) Use(m ...Middleware) {
+	p.middleware.add(m)
+}
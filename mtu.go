@@ -0,0 +1,66 @@
+package pppoeproxy
+
+import (
+	"log"
+	"strconv"
+)
+
+// tunnelFrameOverhead is the framing added to a frame in the tunnel: the
+// packet type and the length of frames up to 16383 bytes
+const tunnelFrameOverhead = 2 + 2
+
+// interfaceMTU returns the MTU of the PPPoE interface, the smallest one of the
+// interfaces matching a pattern, or 0 if unknown (e.g. with an in-memory
+// socket)
+func (p *Proxy) interfaceMTU() int {
+	ifaces, err := FindInterfaces(p.cfg().Interface)
+	if err != nil {
+		return 0
+	}
+	mtu := ifaces[0].MTU
+	for _, ifi := range ifaces[1:] {
+		mtu = min(mtu, ifi.MTU)
+	}
+	return mtu
+}
+
+// maxFrameSize returns the size of the largest frame captured on the PPPoE
+// interface, including its Ethernet header and a VLAN tag
+func (p *Proxy) maxFrameSize() int {
+	mtu := p.interfaceMTU()
+	if mtu <= 0 {
+		return 0
+	}
+	return mtu + ethernetHeaderSize + 4
+}
+
+// checkPathMTU logs when a full-size frame does not fit in one segment of
+// the new tunnel connection. Nothing is lost over TCP, but each such frame
+// costs two segments, which matters on paths with a reduced MTU (e.g. through
+// a VPN) where lowering the MTU of the PPPoE interfaces helps.
+func (p *Proxy) checkPathMTU(client *Client) {
+	frame := p.maxFrameSize()
+	if frame == 0 {
+		return
+	}
+	mss, err := tcpMSS(client.conn)
+	if err != nil || mss <= 0 {
+		return
+	}
+	if need := frame + tunnelFrameOverhead; need > mss {
+		log.Printf("Tunnel path to %s has an MSS of %d bytes, full-size frames from %s (%d bytes with framing) take two TCP segments", client.remoteAddr, mss, p.cfg().Interface, need)
+	}
+}
+
+// checkPeerMTU warns when the PPPoE interface of the tunnel peer has a larger
+// MTU than ours: full-size frames captured on its side cannot be injected
+// here and are dropped
+func (p *Proxy) checkPeerMTU(client *Client, value string) {
+	peerMTU, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	if mtu := p.interfaceMTU(); mtu > 0 && peerMTU > mtu {
+		log.Printf("Warning: tunnel peer %s has a PPPoE interface MTU of %d, larger than %d on %s; its full-size frames will be dropped here", client.remoteAddr, peerMTU, mtu, p.cfg().Interface)
+	}
+}
@@ -0,0 +1,29 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpMSS returns the maximum segment size of a TCP connection, which follows
+// the path MTU discovered by the system
+func tcpMSS(conn net.Conn) (int, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, errors.New("not a TCP connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var mss int
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		mss, serr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	}); err != nil {
+		return 0, err
+	}
+	return mss, serr
+}
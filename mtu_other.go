@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pppoeproxy
+
+import (
+	"errors"
+	"net"
+)
+
+// tcpMSS reports that the segment size is not available on this system
+func tcpMSS(conn net.Conn) (int, error) {
+	return 0, errors.New("TCP_MAXSEG not supported")
+}
@@ -0,0 +1,210 @@
+//go:build darwin || freebsd || openbsd
+
+package pppoeproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bpfBufferSize is the BPF buffer size requested, a read returns at most this
+// many bytes of frames
+const bpfBufferSize = 65536
+
+// packetSocket captures and injects frames of one ethertype through a BPF
+// device. The device is non-blocking and registered with the Go runtime
+// poller, so closing it wakes up a goroutine blocked in Recv.
+type packetSocket struct {
+	file *os.File
+	conn syscall.RawConn
+	buf  []byte // Frames returned by the last read
+	next int    // Offset of the next frame in buf
+}
+
+// openPacketSocket opens a BPF device attached to interfaceName, filtering the
+// frames of the given ethertype
+func openPacketSocket(interfaceName string, proto uint16) (RawSocket, error) {
+	if _, err := net.InterfaceByName(interfaceName); err != nil {
+		return nil, fmt.Errorf("interface not found: %v", err)
+	}
+
+	fd, err := openBPF()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+	size, err := setupBPF(fd, interfaceName, proto)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind socket: %v", err)
+	}
+
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("bpf:%s:%04x", interfaceName, proto))
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+	return &packetSocket{file: file, conn: conn, buf: make([]byte, size)}, nil
+}
+
+// openBPF opens the BPF cloning device, or the first free numbered device on
+// systems without one such as macOS
+func openBPF() (int, error) {
+	const flags = unix.O_RDWR | unix.O_NONBLOCK | unix.O_CLOEXEC
+	fd, err := unix.Open("/dev/bpf", flags, 0)
+	if err == nil || !errors.Is(err, unix.ENOENT) {
+		return fd, err
+	}
+	for i := 0; i < 256; i++ {
+		fd, err = unix.Open(fmt.Sprintf("/dev/bpf%d", i), flags, 0)
+		if !errors.Is(err, unix.EBUSY) {
+			return fd, err
+		}
+	}
+	return -1, err
+}
+
+// setupBPF attaches the device to the interface with a filter on the ethertype
+// and returns the buffer size reads must use
+func setupBPF(fd int, interfaceName string, proto uint16) (int, error) {
+	// The buffer size can only be changed before attaching the interface
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCSBLEN, bpfBufferSize); err != nil {
+		return 0, fmt.Errorf("BIOCSBLEN: %v", err)
+	}
+
+	var ifr [32]byte // struct ifreq, only the name is used
+	if len(interfaceName) >= unix.IFNAMSIZ {
+		return 0, fmt.Errorf("interface name too long: %s", interfaceName)
+	}
+	copy(ifr[:], interfaceName)
+	if err := bpfIoctl(fd, unix.BIOCSETIF, unsafe.Pointer(&ifr)); err != nil {
+		return 0, fmt.Errorf("BIOCSETIF: %v", err)
+	}
+
+	// Deliver frames as they arrive instead of when the buffer fills up
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCIMMEDIATE, 1); err != nil {
+		return 0, fmt.Errorf("BIOCIMMEDIATE: %v", err)
+	}
+	// Use the source address of injected frames as is
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCSHDRCMPLT, 1); err != nil {
+		return 0, fmt.Errorf("BIOCSHDRCMPLT: %v", err)
+	}
+	// Don't capture the frames we inject, they would be sent back into the tunnel
+	if err := bpfIgnoreSent(fd); err != nil {
+		return 0, err
+	}
+
+	// ldh [12]; jeq #proto, accept, drop
+	filter := []unix.BpfInsn{
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_ABS, K: 12},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: uint32(proto)},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0xffffffff},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+	}
+	prog := unix.BpfProgram{Len: uint32(len(filter)), Insns: &filter[0]}
+	if err := bpfIoctl(fd, unix.BIOCSETF, unsafe.Pointer(&prog)); err != nil {
+		return 0, fmt.Errorf("BIOCSETF: %v", err)
+	}
+
+	size, err := unix.IoctlGetInt(fd, unix.BIOCGBLEN)
+	if err != nil {
+		return 0, fmt.Errorf("BIOCGBLEN: %v", err)
+	}
+	return size, nil
+}
+
+// bpfIoctl issues an ioctl taking a pointer to a structure
+func bpfIoctl(fd int, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Recv returns the next captured frame
+func (s *packetSocket) Recv(buf []byte) (int, error) {
+	n, _, err := s.RecvTimestamp(buf)
+	return n, err
+}
+
+// RecvTimestamp returns the next captured frame and the time the kernel
+// captured it. A read returns all the frames buffered by the kernel, each
+// preceded by a bpf_hdr, so they are handed out one at a time.
+func (s *packetSocket) RecvTimestamp(buf []byte) (int, time.Time, error) {
+	for {
+		if s.next < len(s.buf) {
+			if n, captured, ok := s.nextFrame(buf); ok {
+				return n, captured, nil
+			}
+			continue
+		}
+
+		var n int
+		var rerr error
+		s.buf = s.buf[:cap(s.buf)]
+		err := s.conn.Read(func(fd uintptr) bool {
+			n, rerr = unix.Read(int(fd), s.buf)
+			return rerr != unix.EAGAIN && rerr != unix.EINTR
+		})
+		if err != nil {
+			// The poller only fails once the device is closed
+			return 0, time.Time{}, os.ErrClosed
+		}
+		if rerr != nil {
+			s.buf = s.buf[:0]
+			return 0, time.Time{}, rerr
+		}
+		s.buf = s.buf[:n]
+		s.next = 0
+	}
+}
+
+// nextFrame copies the frame at s.next into buf and advances to the next one,
+// returning its capture time. It returns false when the buffer holds no
+// complete frame.
+func (s *packetSocket) nextFrame(buf []byte) (int, time.Time, bool) {
+	rest := s.buf[s.next:]
+	if len(rest) < unix.SizeofBpfHdr {
+		s.next = len(s.buf)
+		return 0, time.Time{}, false
+	}
+	hdr := (*unix.BpfHdr)(unsafe.Pointer(&rest[0]))
+	start, end := int(hdr.Hdrlen), int(hdr.Hdrlen)+int(hdr.Caplen)
+	if end > len(rest) {
+		s.next = len(s.buf)
+		return 0, time.Time{}, false
+	}
+	s.next += bpfWordAlign(end)
+	captured := time.Unix(int64(hdr.Tstamp.Sec), int64(hdr.Tstamp.Usec)*int64(time.Microsecond))
+	return copy(buf, rest[start:end]), captured, true
+}
+
+// bpfWordAlign rounds n up to the alignment of frames in a BPF buffer
+func bpfWordAlign(n int) int {
+	return (n + bpfAlignment - 1) &^ (bpfAlignment - 1)
+}
+
+// Send injects a frame on the interface
+func (s *packetSocket) Send(packet []byte) error {
+	var werr error
+	err := s.conn.Write(func(fd uintptr) bool {
+		_, werr = unix.Write(int(fd), packet)
+		return werr != unix.EAGAIN && werr != unix.EINTR
+	})
+	if err != nil {
+		return os.ErrClosed
+	}
+	return werr
+}
+
+// Close closes the device, ending a pending Recv
+func (s *packetSocket) Close() error {
+	return s.file.Close()
+}
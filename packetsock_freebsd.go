@@ -0,0 +1,19 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bpfAlignment is BPF_ALIGNMENT, the alignment of frames in a BPF buffer
+const bpfAlignment = int(unsafe.Sizeof(uintptr(0)))
+
+// bpfIgnoreSent stops the device from capturing outgoing frames
+func bpfIgnoreSent(fd int) error {
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCSSEESENT, 0); err != nil {
+		return fmt.Errorf("BIOCSSEESENT: %v", err)
+	}
+	return nil
+}
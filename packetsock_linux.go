@@ -0,0 +1,204 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sizes of the control messages of received frames: PACKET_AUXDATA, and
+// SCM_TIMESTAMPING with the software, legacy and hardware timestamps
+const (
+	sizeofAuxdata      = int(unsafe.Sizeof(unix.TpacketAuxdata{}))
+	sizeofTimestamping = 3 * int(unsafe.Sizeof(unix.Timespec{}))
+)
+
+// rxTimestamping requests the receive timestamps of the kernel, and of the
+// NIC when hardware timestamping was enabled on it (e.g. by ptp4l)
+const rxTimestamping = unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE |
+	unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE
+
+// Ancillary data loaded by classic BPF from the socket buffer, at offsets
+// from SKF_AD_OFF (-0x1000)
+const (
+	skfAdOffset   = 0xfffff000
+	skfAdProtocol = 0
+	skfAdPktType  = 4
+)
+
+// packetSocket is a raw AF_PACKET socket bound to one interface and
+// ethertype. It is non-blocking and registered with the Go runtime poller, so
+// closing it wakes up a goroutine blocked in recv.
+type packetSocket struct {
+	file    *os.File
+	conn    syscall.RawConn
+	sa      unix.SockaddrLinklayer // Destination used for injected frames
+	oob     []byte                 // Control messages of the last frame received
+	ingress *atomic.Int32          // Slave the last frame was received on, for bond and team interfaces
+}
+
+// openPacketSocket opens a raw socket for the given ethertype on interfaceName
+func openPacketSocket(interfaceName string, proto uint16) (RawSocket, error) {
+	// Get interface index
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil, fmt.Errorf("interface not found: %v", err)
+	}
+
+	// The socket receives nothing until it is bound and filtered
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+
+	// Frames received on a VLAN without subinterface have their tag
+	// stripped and are only delivered to sockets bound to all protocols, so
+	// the ethertype is matched by a filter instead, after the tag was removed.
+	// Frames we send are ignored too.
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdOffset + skfAdPktType},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 3, Jf: 0, K: unix.PACKET_OUTGOING},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: skfAdOffset + skfAdProtocol},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: uint32(proto)},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0xffffffff},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to attach filter: %v", err)
+	}
+
+	// The auxiliary data gives back the stripped VLAN tag
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to enable auxiliary data: %v", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING, rxTimestamping); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to enable timestamping: %v", err)
+	}
+
+	// On a bond or team, the source address gives the slave a frame was
+	// received on rather than the master
+	var ingress *atomic.Int32
+	if isAggregate(interfaceName) {
+		if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_ORIGDEV, 1); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to enable original device reporting: %v", err)
+		}
+		ingress = bondIngressOf(interfaceName)
+	}
+
+	// Bind to the interface
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind socket: %v", err)
+	}
+	addr := unix.SockaddrLinklayer{
+		Protocol: htons(proto),
+		Ifindex:  iface.Index,
+	}
+
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("packet:%s:%04x", interfaceName, proto))
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+	oob := make([]byte, unix.CmsgSpace(sizeofAuxdata)+unix.CmsgSpace(sizeofTimestamping))
+	return &packetSocket{file: file, conn: conn, sa: addr, oob: oob, ingress: ingress}, nil
+}
+
+// Recv waits for the next frame and copies it into buf
+func (s *packetSocket) Recv(buf []byte) (int, error) {
+	n, _, err := s.RecvTimestamp(buf)
+	return n, err
+}
+
+// RecvTimestamp waits for the next frame and copies it into buf, putting back
+// the VLAN tag the kernel stripped, if any, so its VLAN ID and 802.1p
+// priority are kept when the frame is injected on the other end. It returns
+// the hardware timestamp of the frame when the NIC provides one, the time the
+// kernel received it otherwise.
+func (s *packetSocket) RecvTimestamp(buf []byte) (int, time.Time, error) {
+	var n, oobn int
+	var from unix.Sockaddr
+	var rerr error
+	err := s.conn.Read(func(fd uintptr) bool {
+		n, oobn, _, from, rerr = unix.Recvmsg(int(fd), buf, s.oob, 0)
+		return rerr != unix.EAGAIN && rerr != unix.EINTR
+	})
+	if err != nil {
+		// The poller only fails once the socket is closed
+		return 0, time.Time{}, os.ErrClosed
+	}
+	if rerr != nil {
+		return 0, time.Time{}, rerr
+	}
+
+	aux, captured := parseControl(s.oob[:oobn])
+	if aux != nil && aux.Status&unix.TP_STATUS_VLAN_VALID != 0 {
+		tpid := uint16(etherTypeVLAN)
+		if aux.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+			tpid = aux.Vlan_tpid
+		}
+		n = insertVLANTag(buf, n, tpid, aux.Vlan_tci)
+	}
+	if captured.IsZero() {
+		captured = time.Now()
+	}
+	if sll, ok := from.(*unix.SockaddrLinklayer); ok && s.ingress != nil && sll.Ifindex != s.sa.Ifindex {
+		s.ingress.Store(int32(sll.Ifindex))
+	}
+	return n, captured, nil
+}
+
+// parseControl returns the PACKET_AUXDATA control message of a received
+// frame, or nil, and its receive timestamp, or the zero time
+func parseControl(oob []byte) (*unix.TpacketAuxdata, time.Time) {
+	var aux *unix.TpacketAuxdata
+	var captured time.Time
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, captured
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_PACKET && m.Header.Type == unix.PACKET_AUXDATA && len(m.Data) >= sizeofAuxdata:
+			aux = (*unix.TpacketAuxdata)(unsafe.Pointer(&m.Data[0]))
+		case m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPING && len(m.Data) >= sizeofTimestamping:
+			ts := (*[3]unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+			if hw := ts[2]; hw.Sec != 0 || hw.Nsec != 0 {
+				captured = time.Unix(hw.Unix())
+			} else if sw := ts[0]; sw.Sec != 0 || sw.Nsec != 0 {
+				captured = time.Unix(sw.Unix())
+			}
+		}
+	}
+	return aux, captured
+}
+
+// Send injects a frame on the interface
+func (s *packetSocket) Send(packet []byte) error {
+	var serr error
+	err := s.conn.Write(func(fd uintptr) bool {
+		serr = unix.Sendto(int(fd), packet, 0, &s.sa)
+		return serr != unix.EAGAIN && serr != unix.EINTR
+	})
+	if err != nil {
+		return os.ErrClosed
+	}
+	return serr
+}
+
+// Close closes the socket, ending a pending Recv
+func (s *packetSocket) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,18 @@
+package pppoeproxy
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// bpfAlignment is BPF_ALIGNMENT, the alignment of frames in a BPF buffer
+const bpfAlignment = 4
+
+// bpfIgnoreSent stops the device from capturing outgoing frames
+func bpfIgnoreSent(fd int) error {
+	if err := unix.IoctlSetPointerInt(fd, unix.BIOCSDIRFILT, unix.BPF_DIRECTION_OUT); err != nil {
+		return fmt.Errorf("BIOCSDIRFILT: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !openbsd
+
+package pppoeproxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// openPacketSocket reports that raw sockets are not supported
+func openPacketSocket(interfaceName string, proto uint16) (RawSocket, error) {
+	return nil, fmt.Errorf("raw sockets are not supported on %s", runtime.GOOS)
+}
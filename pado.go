@@ -0,0 +1,117 @@
+package pppoeproxy
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Reasons a PADI went unanswered, from where the proxy stands
+const (
+	NoPADOACUnreachable = "ac-unreachable" // The PADI was injected, or the tunnel is healthy, but no AC answered
+	NoPADOTunnelBroken  = "tunnel-broken"  // The tunnel was down or not answering pings (client mode)
+)
+
+// PADO monitoring metrics
+var (
+	noPADOTotal = NewCounterVec("pppoeproxy_pado_timeouts_total", "PADIs that got no PADO in reply within the timeout", "reason")
+	padiWaiting = NewGauge("pppoeproxy_padi_waiting", "Hosts that sent a PADI and are waiting for a PADO")
+)
+
+func init() {
+	// Create both series so alerts can be defined before a PADI goes unanswered
+	noPADOTotal.With(NoPADOACUnreachable)
+	noPADOTotal.With(NoPADOTunnelBroken)
+}
+
+// padoWatch tracks the hosts waiting for a PADO in reply to their PADI
+type padoWatch struct {
+	mu      sync.Mutex
+	pending map[[6]byte]*time.Timer // By host MAC
+}
+
+// watchPADO follows the PADIs and PADOs of a discovery frame going through
+// the proxy in either direction. The first PADI of a host starts a timer,
+// stopped by a PADO sent to it; retransmitted PADIs do not restart it.
+func (p *Proxy) watchPADO(packet []byte) {
+	timeout := p.cfg().PADOTimeout
+	off := pppoeOffset(packet)
+	if len(packet) < off+pppoeHeaderSize {
+		return
+	}
+
+	var host [6]byte
+	switch packet[off+1] {
+	case PADI:
+		if timeout <= 0 {
+			return
+		}
+		copy(host[:], packet[6:12])
+		p.pado.mu.Lock()
+		defer p.pado.mu.Unlock()
+		if p.pado.pending == nil {
+			p.pado.pending = make(map[[6]byte]*time.Timer)
+		}
+		if _, ok := p.pado.pending[host]; ok {
+			return
+		}
+		p.pado.pending[host] = time.AfterFunc(timeout, func() { p.padoTimeout(host, timeout) })
+		padiWaiting.Set(float64(len(p.pado.pending)))
+	case PADO:
+		copy(host[:], packet[0:6])
+		p.pado.mu.Lock()
+		defer p.pado.mu.Unlock()
+		if t, ok := p.pado.pending[host]; ok {
+			t.Stop()
+			delete(p.pado.pending, host)
+			padiWaiting.Set(float64(len(p.pado.pending)))
+		}
+	}
+}
+
+// padoTimeout reports a host that got no PADO within timeout of its PADI.
+// The next PADI of the host starts a new wait.
+func (p *Proxy) padoTimeout(host [6]byte, timeout time.Duration) {
+	p.pado.mu.Lock()
+	_, ok := p.pado.pending[host]
+	delete(p.pado.pending, host)
+	padiWaiting.Set(float64(len(p.pado.pending)))
+	p.pado.mu.Unlock()
+	if !ok || p.closed.Load() {
+		return
+	}
+
+	reason := p.noPADOReason()
+	mac := net.HardwareAddr(host[:]).String()
+	noPADOTotal.With(reason).Inc()
+	log.Printf("No PADO received by host %s within %s of its PADI (%s)", mac, timeout, reason)
+	p.hooks.Fire(HookNoPADO, "HOST_MAC="+mac, "REASON="+reason)
+}
+
+// noPADOReason tells whether an unanswered PADI most likely did not make it
+// through the tunnel, or reached the segment of the ACs. The server injects
+// PADIs itself, and a client trusts a tunnel that answers its pings.
+func (p *Proxy) noPADOReason() string {
+	if p.isServer {
+		return NoPADOACUnreachable
+	}
+	p.serverMu.Lock()
+	server := p.server
+	p.serverMu.Unlock()
+	if server == nil || server.pending.Load() > 1 {
+		return NoPADOTunnelBroken
+	}
+	return NoPADOACUnreachable
+}
+
+// stopPADOWatch cancels the pending PADO timers
+func (p *Proxy) stopPADOWatch() {
+	p.pado.mu.Lock()
+	defer p.pado.mu.Unlock()
+	for host, t := range p.pado.pending {
+		t.Stop()
+		delete(p.pado.pending, host)
+	}
+	padiWaiting.Set(0)
+}
@@ -0,0 +1,379 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Capture file formats read by PcapReader
+const (
+	pcapMagic      = 0xa1b2c3d4 // Classic pcap, microsecond timestamps
+	pcapMagicNano  = 0xa1b23c4d // Classic pcap, nanosecond timestamps
+	pcapngSHB      = 0x0a0d0d0a // pcapng Section Header Block
+	pcapngIDB      = 0x00000001 // pcapng Interface Description Block
+	pcapngSPB      = 0x00000003 // pcapng Simple Packet Block
+	pcapngEPB      = 0x00000006 // pcapng Enhanced Packet Block
+	pcapngBOM      = 0x1a2b3c4d // pcapng byte-order magic
+	linkTypeEther  = 1
+	pcapngMaxBlock = 16 << 20
+)
+
+// PcapReader reads the Ethernet frames of a capture file in the pcap or
+// pcapng format, as written by tcpdump or Wireshark
+type PcapReader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+	nano  bool // Classic pcap with nanosecond timestamps
+	link  int  // Link type of a classic pcap file
+	ifs   []pcapngInterface
+	last  time.Time // Time of the last frame, for pcapng blocks without one
+}
+
+// pcapngInterface is an interface described in a pcapng section
+type pcapngInterface struct {
+	link  int
+	units float64 // Timestamp units per second
+}
+
+// NewPcapReader checks the header of a capture file and returns a reader for
+// its frames
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	pr := &PcapReader{r: bufio.NewReader(r)}
+	magic, err := pr.r.Peek(4)
+	if err != nil {
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	if binary.BigEndian.Uint32(magic) == pcapngSHB {
+		pr.ng = true
+		if _, err := pr.nextBlock(); err != nil {
+			return nil, err
+		}
+		return pr, nil
+	}
+
+	var hdr [24]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case pcapMagic:
+			pr.order = order
+		case pcapMagicNano:
+			pr.order, pr.nano = order, true
+		}
+	}
+	if pr.order == nil {
+		return nil, errors.New("not a pcap or pcapng file")
+	}
+	pr.link = int(pr.order.Uint32(hdr[20:24]) & 0xffff)
+	if pr.link != linkTypeEther {
+		return nil, fmt.Errorf("unsupported link type %d, only Ethernet captures can be read", pr.link)
+	}
+	return pr, nil
+}
+
+// Next returns the next Ethernet frame and its capture time, or io.EOF at
+// the end of the file. Frames of pcapng interfaces that are not Ethernet are
+// skipped.
+func (pr *PcapReader) Next() (time.Time, []byte, error) {
+	if !pr.ng {
+		return pr.nextPcap()
+	}
+	for {
+		frame, err := pr.nextBlock()
+		if err != nil || frame != nil {
+			return pr.last, frame, err
+		}
+	}
+}
+
+// nextPcap reads a record of a classic pcap file
+func (pr *PcapReader) nextPcap() (time.Time, []byte, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// The capture was cut while a header was being written
+			return time.Time{}, nil, io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+	sec, frac := int64(pr.order.Uint32(hdr[0:4])), int64(pr.order.Uint32(hdr[4:8]))
+	if !pr.nano {
+		frac *= 1000
+	}
+	length := pr.order.Uint32(hdr[8:12])
+	if length > maxPacketSize {
+		return time.Time{}, nil, fmt.Errorf("corrupt capture: %d bytes frame", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(pr.r, frame); err != nil {
+		return time.Time{}, nil, io.EOF
+	}
+	pr.last = time.Unix(sec, frac)
+	return pr.last, frame, nil
+}
+
+// nextBlock reads a pcapng block and returns the Ethernet frame it holds,
+// nil for the other blocks
+func (pr *PcapReader) nextBlock() ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(pr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(hdr[0:4]) == pcapngSHB {
+		// Each section sets its byte order and interfaces
+		bom, err := pr.r.Peek(4)
+		if err != nil {
+			return nil, io.EOF
+		}
+		switch {
+		case binary.LittleEndian.Uint32(bom) == pcapngBOM:
+			pr.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(bom) == pcapngBOM:
+			pr.order = binary.BigEndian
+		default:
+			return nil, errors.New("corrupt capture: invalid pcapng byte-order magic")
+		}
+		pr.ifs = nil
+	}
+
+	blockType, length := pr.order.Uint32(hdr[0:4]), pr.order.Uint32(hdr[4:8])
+	if length < 12 || length%4 != 0 || length > pcapngMaxBlock {
+		return nil, fmt.Errorf("corrupt capture: %d bytes pcapng block", length)
+	}
+	body := make([]byte, length-8)
+	if _, err := io.ReadFull(pr.r, body); err != nil {
+		return nil, io.EOF
+	}
+	body = body[:len(body)-4] // Trailing copy of the length
+
+	switch blockType {
+	case pcapngIDB:
+		if len(body) < 8 {
+			return nil, errors.New("corrupt capture: short pcapng interface block")
+		}
+		pr.ifs = append(pr.ifs, pcapngInterface{
+			link:  int(pr.order.Uint16(body[0:2])),
+			units: pcapngTimestampUnits(pr.order, body[8:]),
+		})
+	case pcapngEPB:
+		if len(body) < 20 {
+			return nil, errors.New("corrupt capture: short pcapng packet block")
+		}
+		id := int(pr.order.Uint32(body[0:4]))
+		if id >= len(pr.ifs) {
+			return nil, fmt.Errorf("corrupt capture: packet of undescribed interface %d", id)
+		}
+		ts := uint64(pr.order.Uint32(body[4:8]))<<32 | uint64(pr.order.Uint32(body[8:12]))
+		captured := int(pr.order.Uint32(body[12:16]))
+		if captured > len(body)-20 {
+			return nil, errors.New("corrupt capture: pcapng packet larger than its block")
+		}
+		sec, frac := math.Modf(float64(ts) / pr.ifs[id].units)
+		pr.last = time.Unix(int64(sec), int64(frac*1e9))
+		if pr.ifs[id].link == linkTypeEther {
+			return body[20 : 20+captured], nil
+		}
+	case pcapngSPB:
+		// No timestamp, the frame is given the time of the previous one
+		if len(body) < 4 || len(pr.ifs) == 0 {
+			return nil, errors.New("corrupt capture: invalid pcapng simple packet block")
+		}
+		captured := min(int(pr.order.Uint32(body[0:4])), len(body)-4)
+		if pr.ifs[0].link == linkTypeEther {
+			return body[4 : 4+captured], nil
+		}
+	}
+	return nil, nil
+}
+
+// pcapngTimestampUnits returns the timestamp units per second given by the
+// if_tsresol option of an interface, microseconds by default
+func pcapngTimestampUnits(order binary.ByteOrder, options []byte) float64 {
+	for len(options) >= 4 {
+		code, length := order.Uint16(options[0:2]), int(order.Uint16(options[2:4]))
+		if code == 0 || 4+length > len(options) {
+			break
+		}
+		if code == 9 && length == 1 {
+			res := options[4]
+			if res&0x80 != 0 {
+				return math.Pow(2, float64(res&0x7f))
+			}
+			return math.Pow(10, float64(res))
+		}
+		options = options[4+(length+3)&^3:]
+	}
+	return 1e6
+}
+
+// PcapReplay feeds the frames of a capture file to the packet handlers, as
+// if they were received on the interface, to reproduce a problem seen in the
+// field
+type PcapReplay struct {
+	Path   string
+	Speed  float64       // Playback speed relative to the capture, 0 for as fast as possible
+	MaxGap time.Duration // Longest wait between two frames, shortening idle periods (0 for no limit)
+}
+
+// Open returns a socket receiving the frames of the given ethertype from the
+// capture file, replayed from now on, along with those received by live.
+// Frames sent go to live, or are discarded when live is nil, to replay a
+// capture without any interface.
+func (pr PcapReplay) Open(ethertype uint16, live RawSocket) (RawSocket, error) {
+	f, err := os.Open(pr.Path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewPcapReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", pr.Path, err)
+	}
+	s := &pcapSocket{
+		live:   live,
+		frames: make(chan pcapRecv),
+		closed: make(chan struct{}),
+	}
+	go s.replay(pr, ethertype, f, r)
+	if live != nil {
+		go s.receive()
+	}
+	return s, nil
+}
+
+// pcapRecv is a frame, or receive error of the live socket, waiting for Recv
+type pcapRecv struct {
+	frame []byte
+	at    time.Time
+	err   error
+}
+
+// pcapSocket is a RawSocket replaying a capture file, see PcapReplay
+type pcapSocket struct {
+	live      RawSocket // nil when only replaying
+	frames    chan pcapRecv
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// replay passes the frames of the capture file to Recv at their time
+// relative to the first frame of the file, so the sockets of both ethertypes
+// stay in step
+func (s *pcapSocket) replay(pr PcapReplay, ethertype uint16, f *os.File, r *PcapReader) {
+	defer f.Close()
+	start := time.Now()
+	var first, prev time.Time
+	var offset time.Duration // Capture time elapsed, once idle periods are shortened
+	replayed := 0
+	for {
+		t, frame, err := r.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error reading capture %s: %v", pr.Path, err)
+			}
+			break
+		}
+		if first.IsZero() {
+			first, prev = t, t
+		}
+		gap := t.Sub(prev)
+		if pr.MaxGap > 0 && gap > pr.MaxGap {
+			gap = pr.MaxGap
+		}
+		offset += max(gap, 0)
+		prev = t
+
+		if len(frame) < ethernetHeaderSize {
+			continue
+		}
+		if et, _ := framePayload(frame); et != ethertype {
+			continue
+		}
+		if pr.Speed > 0 {
+			timer := time.NewTimer(time.Until(start.Add(time.Duration(float64(offset) / pr.Speed))))
+			select {
+			case <-timer.C:
+			case <-s.closed:
+				timer.Stop()
+				return
+			}
+		}
+		select {
+		case s.frames <- pcapRecv{frame: frame, at: time.Now()}:
+			replayed++
+		case <-s.closed:
+			return
+		}
+	}
+	log.Printf("Replayed %d frames of ethertype 0x%04x from %s", replayed, ethertype, pr.Path)
+}
+
+// receive passes the frames of the live socket to Recv. A receive error is
+// passed too and waits for the next Recv, so the packet loop paces retries
+// as it does with the live socket alone.
+func (s *pcapSocket) receive() {
+	for {
+		buf := make([]byte, maxPacketSize)
+		n, at, err := recvTimestamp(s.live, buf)
+		select {
+		case s.frames <- pcapRecv{frame: buf[:n], at: at, err: err}:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *pcapSocket) Recv(buf []byte) (int, error) {
+	n, _, err := s.RecvTimestamp(buf)
+	return n, err
+}
+
+func (s *pcapSocket) RecvTimestamp(buf []byte) (int, time.Time, error) {
+	select {
+	case <-s.closed:
+		return 0, time.Time{}, os.ErrClosed
+	case f := <-s.frames:
+		if f.err != nil {
+			return 0, time.Time{}, f.err
+		}
+		return copy(buf, f.frame), f.at, nil
+	}
+}
+
+func (s *pcapSocket) Send(frame []byte) error {
+	if s.live == nil {
+		select {
+		case <-s.closed:
+			return os.ErrClosed
+		default:
+			return nil
+		}
+	}
+	return s.live.Send(frame)
+}
+
+func (s *pcapSocket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.live != nil {
+			err = s.live.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,111 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// testPcap returns a classic pcap file holding frames
+func testPcap(order binary.AppendByteOrder, magic uint32, frames ...[]byte) []byte {
+	b := order.AppendUint32(nil, magic)
+	b = order.AppendUint16(b, 2)
+	b = order.AppendUint16(b, 4)
+	b = append(b, make([]byte, 8)...)
+	b = order.AppendUint32(b, 65535)
+	b = order.AppendUint32(b, linkTypeEther)
+	for i, frame := range frames {
+		b = order.AppendUint32(b, 1700000000)
+		b = order.AppendUint32(b, uint32(i))
+		b = order.AppendUint32(b, uint32(len(frame)))
+		b = order.AppendUint32(b, uint32(len(frame)))
+		b = append(b, frame...)
+	}
+	return b
+}
+
+// pcapngBlock returns a little-endian pcapng block
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	b := binary.LittleEndian.AppendUint32(nil, blockType)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(body)+12))
+	b = append(b, body...)
+	return binary.LittleEndian.AppendUint32(b, uint32(len(body)+12))
+}
+
+// testPcapng returns a pcapng file with an Ethernet interface with nanosecond
+// timestamps holding frames, the last one in a simple packet block
+func testPcapng(frames ...[]byte) []byte {
+	shb := binary.LittleEndian.AppendUint32(nil, pcapngBOM)
+	shb = append(shb, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	b := pcapngBlock(pcapngSHB, shb)
+	idb := []byte{linkTypeEther, 0, 0, 0, 0, 0, 0, 0, 9, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0}
+	b = append(b, pcapngBlock(pcapngIDB, idb)...)
+	for i, frame := range frames {
+		if i == len(frames)-1 {
+			spb := binary.LittleEndian.AppendUint32(nil, uint32(len(frame)))
+			b = append(b, pcapngBlock(pcapngSPB, append(spb, frame...))...)
+			break
+		}
+		epb := binary.LittleEndian.AppendUint32(nil, 0)
+		epb = binary.LittleEndian.AppendUint32(epb, 0x17a)
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(i))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+		epb = binary.LittleEndian.AppendUint32(epb, uint32(len(frame)))
+		b = append(b, pcapngBlock(pcapngEPB, append(epb, frame...))...)
+	}
+	return b
+}
+
+func TestPcapReader(t *testing.T) {
+	for name, file := range map[string][]byte{
+		"pcap":      testPcap(binary.LittleEndian, pcapMagic, testFrames...),
+		"pcap-nano": testPcap(binary.BigEndian, pcapMagicNano, testFrames...),
+		"pcapng":    testPcapng(testFrames...),
+	} {
+		pr, err := NewPcapReader(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i, want := range testFrames {
+			_, frame, err := pr.Next()
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", name, i, err)
+			}
+			if !bytes.Equal(frame, want) {
+				t.Fatalf("%s: frame %d is %x, want %x", name, i, frame, want)
+			}
+		}
+		if _, _, err := pr.Next(); err != io.EOF {
+			t.Fatalf("%s: %v at the end of the file", name, err)
+		}
+	}
+}
+
+func FuzzPcapReader(f *testing.F) {
+	f.Add(testPcap(binary.LittleEndian, pcapMagic, testFrames...))
+	f.Add(testPcap(binary.BigEndian, pcapMagicNano, testFrames[0]))
+	f.Add(testPcapng(testFrames...))
+	f.Add(testPcapng(testFrames[1]))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pr, err := NewPcapReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// Each frame takes at least a header, so there cannot be more
+		// frames than bytes
+		for i := 0; i <= len(data); i++ {
+			_, frame, err := pr.Next()
+			if err != nil {
+				return
+			}
+			if len(frame) > len(data) {
+				t.Fatalf("frame of %d bytes in a %d bytes file", len(frame), len(data))
+			}
+		}
+		t.Fatalf("more than %d frames in a %d bytes file", len(data), len(data))
+	})
+}
@@ -0,0 +1,105 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PPP protocol filter metrics
+var pppFiltered = NewCounterVec("pppoeproxy_ppp_filtered_total", "Session frames dropped by the PPP protocol filter", "direction", "protocol")
+
+// PPPFilter selects the session frames proxied by PPP protocol, separately
+// for each direction. Frames of a denied protocol are dropped, and when
+// protocols are allowed in a direction, the frames of other protocols are
+// dropped too.
+type PPPFilter struct {
+	allow map[string]map[uint16]bool // By direction
+	deny  map[string]map[uint16]bool
+}
+
+// ParsePPPFilter builds a filter from comma separated allow and deny lists of
+// PPP protocols, given by name as in the hexdumps (e.g. LCP, IPv6CP) or
+// number (e.g. 0x0057). Entries prefixed with "rx:" only apply to the frames
+// captured on the interface, and "tx:" to the frames received from the
+// tunnel; others apply to both.
+func ParsePPPFilter(allow, deny string) (*PPPFilter, error) {
+	f := &PPPFilter{allow: make(map[string]map[uint16]bool), deny: make(map[string]map[uint16]bool)}
+	if err := parsePPPList(allow, f.allow); err != nil {
+		return nil, err
+	}
+	if err := parsePPPList(deny, f.deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parsePPPList adds the protocols of a filter list to set, by direction
+func parsePPPList(list string, set map[string]map[uint16]bool) error {
+	for _, entry := range splitList(list) {
+		directions := []string{DirectionRx, DirectionTx}
+		if dir, name, ok := strings.Cut(entry, ":"); ok {
+			if dir != DirectionRx && dir != DirectionTx {
+				return fmt.Errorf("invalid direction %q (rx or tx)", dir)
+			}
+			directions = []string{dir}
+			entry = name
+		}
+		proto, err := parsePPPProtocol(entry)
+		if err != nil {
+			return err
+		}
+		for _, dir := range directions {
+			if set[dir] == nil {
+				set[dir] = make(map[uint16]bool)
+			}
+			set[dir][proto] = true
+		}
+	}
+	return nil
+}
+
+// parsePPPProtocol parses a PPP protocol name or number
+func parsePPPProtocol(s string) (uint16, error) {
+	if strings.EqualFold(s, "IP") {
+		return PPPProtoIP, nil
+	}
+	for proto, name := range pppProtocolNames {
+		if strings.EqualFold(s, name) {
+			return proto, nil
+		}
+	}
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PPP protocol %q", s)
+	}
+	return uint16(v), nil
+}
+
+// Allow reports whether a session frame going in direction is proxied.
+// Frames without a PPP header are. A nil filter allows all the frames.
+func (f *PPPFilter) Allow(direction string, packet []byte) bool {
+	if f == nil {
+		return true
+	}
+	info := decodeFrame(packet)
+	if !info.HasPPP {
+		return true
+	}
+	if f.deny[direction][info.Protocol] {
+		return false
+	}
+	allow := f.allow[direction]
+	return len(allow) == 0 || allow[info.Protocol]
+}
+
+// filterPPP reports whether a session frame passes the PPP protocol filter,
+// counting it if not
+func (p *Proxy) filterPPP(direction string, packet []byte) bool {
+	f := p.cfg().PPPFilter
+	if f.Allow(direction, packet) {
+		return true
+	}
+	pppFiltered.With(direction, pppProtocolName(decodeFrame(packet).Protocol)).Inc()
+	return false
+}
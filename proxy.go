@@ -1,112 +1,462 @@
-package main
+package pppoeproxy
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"strings"
+	"net/netip"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Maximum payload sizes accepted from a tunnel peer
+const (
+	maxPacketSize = 65536   // Largest discovery/session/ping payload
+	maxSkipSize   = 1048576 // Largest unknown payload we are willing to skip
+)
+
 // Client represents a network connection with synchronized access
 type Client struct {
-	conn       net.Conn
-	writeMu    sync.Mutex // Mutex for connection writes
-	remoteAddr string
+	conn           net.Conn
+	reader         *bufio.Reader
+	readBuf        []byte
+	writeMu        sync.Mutex // Mutex for connection writes
+	writeBuf       []byte
+	writeTimeout   atomic.Int64 // Write deadline in nanoseconds (0 disables)
+	maxStalls      atomic.Int32 // Consecutive write timeouts before the connection is closed
+	stalls         int32        // Consecutive write timeouts so far
+	remoteAddr     string
+	connected      time.Time
+	rtt            rttStats
+	pending        atomic.Int32 // Pings sent and not answered yet
+	peerVersion    atomic.Pointer[string]
+	peerSequence   atomic.Bool // Peer announced it understands sequenced frames
+	peerTimestamps atomic.Bool // Peer announced it understands timestamped frames
+	peerLinkDown   atomic.Bool // Peer announced its PPPoE link is down
+	txSeq          uint32      // Sequence number of the next sequenced frame, protected by writeMu
+	rxSeq          seqTracker
+	policy         atomic.Pointer[clientPolicyState] // Policy applied to the client (server mode), nil without one
+	authPolicy     *ClientPolicy                     // Policy given by the authorization endpoint, replacing ClientPolicies
+	tx             *txQueue                          // Captured frames waiting to be sent
+	rxDelay        *rxDelayLine                      // Frames read held back by the emulated latency
+	rxCredits      rxCredits                         // Frames read to grant new credits for
 }
 
 // NewClient creates a new Client instance
 func NewClient(conn net.Conn) *Client {
 	return &Client{
 		conn:       conn,
+		reader:     bufio.NewReader(conn),
+		readBuf:    make([]byte, 4096),
 		remoteAddr: conn.RemoteAddr().String(),
+		connected:  time.Now(),
+		tx:         newTxQueue(),
+		rxDelay:    newRxDelayLine(),
 	}
 }
 
 // Close closes the client connection
 func (c *Client) Close() error {
+	c.tx.close()
 	return c.conn.Close()
 }
 
-// WritePacket writes a complete packet atomically
+// SetWriteTimeout sets the deadline applied to each write and the number of
+// consecutive timeouts after which the peer is considered stalled
+func (c *Client) SetWriteTimeout(timeout time.Duration, maxStalls int) {
+	c.writeTimeout.Store(int64(timeout))
+	c.maxStalls.Store(int32(maxStalls))
+}
+
+// WritePacket writes a complete packet atomically. If the peer stops reading
+// and the write deadline expires before anything was sent, the packet is
+// dropped; the connection is closed once too many writes in a row time out,
+// or if a packet was only partially written.
 func (c *Client) WritePacket(packetType uint16, data []byte) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
+	return c.write(packetType, nil, data)
+}
 
-	// Write packet type
-	if err := binary.Write(c.conn, binary.BigEndian, packetType); err != nil {
-		return fmt.Errorf("error writing packet type: %v", err)
+// write sends a packet made of a payload header and data. The caller holds
+// writeMu.
+func (c *Client) write(packetType uint16, hdr, data []byte) error {
+	// Build the whole frame (type, varint length, data) so it is sent with a
+	// single write
+	buf := binary.BigEndian.AppendUint16(c.writeBuf[:0], packetType)
+	buf = binary.AppendUvarint(buf, uint64(len(hdr)+len(data)))
+	buf = append(buf, hdr...)
+	buf = append(buf, data...)
+	c.writeBuf = buf
+
+	if timeout := time.Duration(c.writeTimeout.Load()); timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	} else {
+		c.conn.SetWriteDeadline(time.Time{})
 	}
 
-	// Write length as varint
-	length := len(data)
-	for length >= 0x80 {
-		if _, err := c.conn.Write([]byte{byte(length) | 0x80}); err != nil {
-			return fmt.Errorf("error writing length: %v", err)
-		}
-		length >>= 7
+	n, err := c.conn.Write(buf)
+	if err == nil {
+		c.stalls = 0
+		return nil
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("error writing packet: %v", err)
 	}
-	if _, err := c.conn.Write([]byte{byte(length)}); err != nil {
-		return fmt.Errorf("error writing length: %v", err)
+
+	writeTimeouts.Inc()
+	c.stalls++
+	if n > 0 {
+		// The stream is out of sync, it cannot be used anymore
+		c.conn.Close()
+		return fmt.Errorf("write to %s timed out after a partial packet, connection closed", c.remoteAddr)
+	}
+	if max := c.maxStalls.Load(); max > 0 && c.stalls >= max {
+		deadPeers.Inc()
+		c.conn.Close()
+		return fmt.Errorf("peer %s stalled for %d writes, connection closed", c.remoteAddr, c.stalls)
+	}
+	return fmt.Errorf("write to %s timed out, packet dropped", c.remoteAddr)
+}
+
+// ReadPacket reads a complete packet and returns its type and payload. The
+// payload is only valid until the next call to ReadPacket. Payloads of unknown
+// packet types are discarded and returned as nil.
+func (c *Client) ReadPacket() (uint16, []byte, error) {
+	// Read packet type (uint16)
+	var packetType uint16
+	if err := binary.Read(c.reader, binary.BigEndian, &packetType); err != nil {
+		return 0, nil, err
+	}
+
+	// Read length (varint)
+	length, err := binary.ReadUvarint(c.reader)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error reading length: %v", err)
 	}
 
-	// Write data
-	if len(data) > 0 {
-		if _, err := c.conn.Write(data); err != nil {
-			return fmt.Errorf("error writing data: %v", err)
+	switch packetType {
+	case PacketTypePing, PacketTypePong, PacketTypeDiscovery, PacketTypeSession, PacketTypeGoodbye, PacketTypeHello, PacketTypeSequenced, PacketTypeSessions, PacketTypeLinkState, PacketTypeTimestamped, PacketTypeChallenge, PacketTypeCredit:
+	default:
+		// Skip any data associated with an unknown packet type
+		if length > maxSkipSize {
+			return 0, nil, fmt.Errorf("unknown packet too large to skip: %d bytes", length)
 		}
+		if _, err := io.CopyN(io.Discard, c.reader, int64(length)); err != nil {
+			return 0, nil, fmt.Errorf("error skipping unknown packet data: %v", err)
+		}
+		return packetType, nil, nil
 	}
 
-	return nil
+	if length > maxPacketSize {
+		return 0, nil, fmt.Errorf("packet too large: %d bytes", length)
+	}
+
+	// Resize buffer if needed
+	if length > uint64(len(c.readBuf)) {
+		c.readBuf = make([]byte, length)
+	}
+
+	data := c.readBuf[:length]
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return 0, nil, fmt.Errorf("error reading packet data: %v", err)
+	}
+
+	return packetType, data, nil
+}
+
+// Config holds the settings of a Proxy
+type Config struct {
+	Interface   string         // Name of the interface PPPoE frames are proxied on
+	IsServer    bool           // Run as server (accept tunnel clients) instead of client
+	Address     string         // Address to connect to (client), or comma separated addresses to listen on (server)
+	AllowedIP   string         // Addresses and CIDR prefixes allowed to connect, comma separated (server mode only)
+	Listeners   []net.Listener // Already open tunnel listeners, by position in Address; nil entries are opened (server mode, optional)
+	RTTWarn     time.Duration  // Log a warning when the tunnel RTT exceeds this value (0 disables)
+	Dumper      *Dumper        // Hexdump selected frames for debugging (nil disables)
+	LogFilter   *FrameFilter   // Only log the frames received and injected matching this expression (nil logs all)
+	Recorder    *Recorder      // Record tunnel frames to a file (nil disables)
+	Tracer      *Tracer        // Keep the last frames in memory for the admin API (nil disables)
+	Sampler     *Sampler       // Export flow records of sampled frames (nil disables)
+	Advertise   string         // Name the server is advertised under with mDNS (server mode, empty disables)
+	StateFile   string         // File the session table is saved to and restored from across restarts (empty disables)
+	IPMapFile   string         // JSON file kept up to date with the address of each session, for external tools (empty disables)
+	JournalFile string         // File the session events are appended to, for later analysis (empty disables)
+	GeoIP       *GeoIPFilter   // Country and AS restrictions applied after AllowedIP (server mode, nil disables)
+
+	// Sessions without any frame for this long are ended as idle-expired,
+	// so those that ended without a PADT seen are not tracked forever (0
+	// disables)
+	SessionIdleTimeout time.Duration
+
+	// PPPoE sessions and hosts proxied, frames of the others are ignored in
+	// both directions (nil for all)
+	SessionFilter *SessionFilter
+
+	// PPP protocols of the session frames proxied in each direction (nil
+	// for all)
+	PPPFilter *PPPFilter
+
+	// Changes made to the tags of the discovery frames proxied in each
+	// direction (nil for none)
+	TagRules *TagRules
+
+	// Replace the AC-Cookie of the PADOs proxied with one signed by the
+	// proxy, and drop the PADRs not returning it, so hosts that did not get
+	// a PADO through the proxy cannot reach the AC
+	ACCookies bool
+
+	// Answer the PADIs and PADRs the proxy does not forward, for lack of a
+	// tunnel or because of a client policy, with a PADO or PADS carrying a
+	// Generic-Error tag giving the reason, rather than dropping them silently
+	DiscoveryErrors bool
+
+	// Identity and limits of known tunnel clients, the first matching policy
+	// applies (server mode)
+	ClientPolicies []ClientPolicy
+
+	// External authorization of tunnel clients (server mode)
+	AuthURL     string        // HTTP endpoint each client that passed AllowedIP is posted to (empty disables)
+	AuthTimeout time.Duration // Timeout of authorization requests, and of the hello the client sends first (0 for 5s)
+	AuthToken   string        // Key of the answer to the challenge of a server, which forwards it to its AuthURL (client mode)
+
+	// Tunnel sockets
+	TunnelInterface string // Interface the tunnel connections are bound to, so they never use another one (empty for any)
+	BindAddress     string // Source address and/or port of the connection to the server (client mode, empty for any)
+	TunnelMark      uint32 // Firewall mark of the connections to the server, for policy routing (client mode, Linux, 0 disables)
+	DSCP            int    // DSCP the tunnel packets are marked with, so QoS policies can prioritize them (0 for the system default)
+
+	// Keepalive and dead-peer detection
+	KeepaliveInterval time.Duration // Interval between pings (client mode, 0 disables)
+	KeepaliveMisses   int           // Intervals without data before the peer is considered dead (0 disables)
+	WriteTimeout      time.Duration // Deadline for each tunnel write (0 disables)
+	WriteStalls       int           // Consecutive write timeouts before the peer is considered dead (0 disables)
+
+	// Stale client reaping (server mode)
+	ClientPingInterval time.Duration // Interval between pings sent to each client (0 disables)
+	ClientTimeout      time.Duration // Time without data after which a client is dropped (0 for KeepaliveInterval x KeepaliveMisses)
+
+	// TCP keepalive of tunnel connections, detecting half-open connections
+	// even without pings
+	TCPKeepaliveIdle     time.Duration // Idle time before the first probe (0 for 15s, negative disables TCP keepalive)
+	TCPKeepaliveInterval time.Duration // Interval between probes (0 for 15s)
+	TCPKeepaliveCount    int           // Unanswered probes before the connection is dropped (0 for 9)
+
+	// Reconnection backoff (client mode)
+	ReconnectMin    time.Duration // Delay before the first reconnection attempt
+	ReconnectMax    time.Duration // Maximum delay between attempts
+	ReconnectFactor float64       // Multiplier applied to the delay after each failure
+	ReconnectJitter float64       // Fraction of the delay randomized to avoid synchronized retries
+	ReconnectRotate bool          // Start each attempt with the next address the server name resolves to
+
+	// Frames captured while reconnecting, sent once connected (client mode)
+	ReconnectQueue     int // Discovery and PPP control frames kept (0 disables)
+	ReconnectQueueData int // Other session frames kept (0 disables)
+
+	// Number the frames sent into the tunnel so the peer counts lost and
+	// reordered frames (with peers announcing support for it)
+	SequenceFrames bool
+
+	// Token bucket shaping of the session frames injected for each PPPoE
+	// session, overridden by the client policies setting it (server mode)
+	SessionRate  float64 // Bits per second (0 disables)
+	SessionBurst int     // Bytes injected at once beyond the rate (0 for a tenth of a second at the rate)
+
+	// Token bucket cap of the tunnel throughput in each direction, for all
+	// the peers together. Frames beyond the outgoing rate wait in the send
+	// queues of the peers, and reading slows down beyond the incoming rate.
+	TunnelRateOut float64 // Bits per second of frames sent into the tunnel (0 disables)
+	TunnelRateIn  float64 // Bits per second read from the tunnel (0 disables)
+	TunnelBurst   int     // Bytes beyond the rates (0 for a tenth of a second at the rate)
+
+	// Frames of each kind, control and data, a tunnel peer may send ahead of
+	// their injection, announced in the hello and granted again as the frames
+	// are injected (0 disables). A peer announcing credits limits what is
+	// sent to it whatever this setting.
+	TunnelCredits int
+
+	// Frame dropped when a bounded queue is full
+	TunnelQueueDrop  DropPolicy // Send queues of each tunnel peer ("" for DropKeepControl)
+	SessionQueueDrop DropPolicy // Frames of a session waiting for its shaping rate ("" for DropTail)
+
+	// Send the capture time of the frames into the tunnel so the peer
+	// measures the one-way forwarding latency (with peers announcing support
+	// for it). The clocks of both ends must be synchronized.
+	TimestampFrames bool
+
+	// Report the hosts that got no PADO in reply to their PADI within this
+	// time, the most common reason a PPPoE client cannot connect (0 disables)
+	PADOTimeout time.Duration
+
+	// Check every header of the frames in both directions against RFC 2516
+	// and the PPP encapsulation, dropping malformed frames before anything
+	// else reads them
+	StrictParsing bool
+
+	// Latency emulated on the tunnel, to preview how a slower WAN would
+	// affect the PPP sessions. Frames sent into the tunnel wait in the send
+	// queues, and frames read from it before being injected, for the delay
+	// varied randomly by up to the jitter either way. They stay in order.
+	TunnelDelayOut  time.Duration // Added to the frames sent into the tunnel (0 disables)
+	TunnelJitterOut time.Duration
+	TunnelDelayIn   time.Duration // Added to the frames read from the tunnel (0 disables)
+	TunnelJitterIn  time.Duration
+
+	// Faults injected in the tunnel for testing (nil disables)
+	Chaos *Chaos
+
+	// Lifecycle event hooks
+	Hook        string        // Command run for lifecycle events (empty disables)
+	HookTimeout time.Duration // Maximum run time of the hook command (0 for no limit)
+}
+
+// applyDefaults fills in the settings left to their zero value that have no
+// sensible zero behavior, using the defaults of the command line tool
+func (c *Config) applyDefaults() {
+	if c.ReconnectMin <= 0 {
+		c.ReconnectMin = 2 * time.Second
+	}
+	if c.ReconnectMax <= 0 {
+		c.ReconnectMax = 60 * time.Second
+	}
+	if c.ReconnectFactor < 1 {
+		c.ReconnectFactor = 2
+	}
+	if c.AuthTimeout <= 0 {
+		c.AuthTimeout = 5 * time.Second
+	}
 }
 
 // Proxy handles the client-server communication
 type Proxy struct {
+	config           atomic.Pointer[Config]
 	isServer         bool
 	address          string
-	allowedIP        string
 	discoveryHandler *DiscoveryHandler
 	sessionHandler   *SessionHandler
-	listener         net.Listener
+	sessions         *SessionTable
+	endpoints        *EndpointTracker
+	hooks            *HookRunner
+	pado             padoWatch     // Hosts waiting for a PADO
+	cookies          *cookieSigner // Signs the AC-Cookies of the PADOs with ACCookies
+	refusals         *TokenBucket  // Limits the discovery requests refused with DiscoveryErrors
+	stray            strayTracker  // Frames of unknown sessions reported
+	middleware       middlewareChain
+	reconnectQueue   reconnectQueue                // Frames captured while not connected to the server
+	tunnelOut        atomic.Pointer[tunnelLimiter] // Cap of the frames sent into the tunnel, nil without one
+	tunnelIn         atomic.Pointer[tunnelLimiter] // Cap of the data read from the tunnel, nil without one
+	errorFunc        atomic.Pointer[ErrorFunc]
+	listeners        []net.Listener
+	accepting        atomic.Int32 // Number of accept loops running
 	server           *Client
 	clientsMu        sync.RWMutex
 	clients          map[string]*Client
-	closed           bool
+	ctx              context.Context    // Cancelled when the proxy is closed
+	cancel           context.CancelFunc // Cancels ctx
+	lifeMu           sync.Mutex         // Orders goroutine starts with Close
+	wg               sync.WaitGroup     // Goroutines waited for by Wait
+	closed           atomic.Bool
 	closedCh         chan struct{}
-	serverMu         sync.Mutex   // Mutex for server connection access
-	reconnectTimer   *time.Timer  // Timer for reconnection attempts
-	pingTicker       *time.Ticker // Ticker for sending pings
+	draining         atomic.Bool   // Set while shutting down gracefully
+	connections      atomic.Uint64 // Tunnel connections made or accepted, for the report
+	peaks            peakRates
+	linkDown         atomic.Bool   // Set while the PPPoE interface link is down
+	serverDone       chan struct{} // Closed when the current server connection handler exits
+	serverMu         sync.Mutex    // Mutex for server connection access
+	reconnectMu      sync.Mutex    // Mutex for reconnection state
+	reconnectTimer   *time.Timer   // Timer for reconnection attempts
+	backoff          Backoff       // Delay computation for reconnection attempts
+	dialRotation     atomic.Uint32 // Index of the resolved address tried first, with ReconnectRotate
+	localAddr        *net.TCPAddr  // Source address of the connection to the server (nil for any)
+	pingTicker       *time.Ticker  // Ticker for sending pings to the server or the clients
 }
 
-// NewProxy creates a new proxy instance
-func NewProxy(isServer bool, address, allowedIP string, discoveryHandler *DiscoveryHandler, sessionHandler *SessionHandler) (*Proxy, error) {
+// NewProxy creates a new proxy instance. The proxy is closed when ctx is
+// cancelled.
+func NewProxy(ctx context.Context, config Config, discoveryHandler *DiscoveryHandler, sessionHandler *SessionHandler) (*Proxy, error) {
+	config.applyDefaults()
+	if config.TunnelInterface != "" && matchInterface(config.Interface, config.TunnelInterface) {
+		return nil, errors.New("the tunnel cannot use the PPPoE interface")
+	}
+	var localAddr *net.TCPAddr
+	if config.BindAddress != "" && !config.IsServer {
+		var err error
+		if localAddr, err = ParseBindAddress(config.BindAddress); err != nil {
+			return nil, err
+		}
+	}
+	cookies, err := newCookieSigner()
+	if err != nil {
+		return nil, err
+	}
 	p := &Proxy{
-		isServer:         isServer,
-		address:          address,
-		allowedIP:        allowedIP,
+		isServer:         config.IsServer,
+		address:          config.Address,
+		localAddr:        localAddr,
+		cookies:          cookies,
+		refusals:         NewTokenBucket(refusalRate, refusalRate),
 		discoveryHandler: discoveryHandler,
 		sessionHandler:   sessionHandler,
+		sessions:         NewSessionTable(),
+		endpoints:        NewEndpointTracker(config.Interface),
 		clients:          make(map[string]*Client),
 		closedCh:         make(chan struct{}),
 	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	context.AfterFunc(p.ctx, func() { p.Close() })
+	p.config.Store(&config)
+	p.setTunnelLimits(&config)
+	if config.StateFile != "" {
+		if err := p.loadState(config.StateFile); err != nil {
+			log.Printf("Not restoring sessions: %v", err)
+		}
+		p.spawn(p.saveStateLoop)
+	}
+	p.spawn(p.trackPeaks)
+	p.spawn(p.expireIdleSessions)
+	p.hooks = newHookRunner(p)
+	p.spawn(func() { p.hooks.watchSessions(p.sessions) })
+	if config.IPMapFile != "" {
+		p.spawn(func() { p.watchIPMap(config.IPMapFile) })
+	}
+	if config.JournalFile != "" {
+		p.spawn(func() { p.watchJournal(config.JournalFile) })
+	}
+	if config.Chaos != nil {
+		log.Printf("Chaos mode enabled, degrading the tunnel: %s", config.Chaos)
+		if config.Chaos.Disconnect > 0 {
+			p.spawn(func() { p.chaosDisconnects(config.Chaos) })
+		}
+	}
 
 	// Set the packet handlers
 	discoveryHandler.SetForwardFunc(p.handleDiscoveryPacket)
 	sessionHandler.SetForwardFunc(p.handleSessionPacket)
+	discoveryHandler.SetErrorFunc(p.notifyError)
+	sessionHandler.SetErrorFunc(p.notifyError)
+	discoveryHandler.SetLogFilter(config.LogFilter)
+	sessionHandler.SetLogFilter(config.LogFilter)
+
+	p.pingTicker = time.NewTicker(time.Hour)
+	p.resetPingTicker()
+	p.spawn(p.pingLoop)
+	p.spawn(p.watchLinkState)
 
 	// Start server or connect to server
-	if isServer {
+	if p.isServer {
 		if err := p.startServer(); err != nil {
+			p.Close()
 			return nil, err
 		}
 	} else {
-		// In client mode, set up ping ticker and connect
-		p.pingTicker = time.NewTicker(60 * time.Second)
-		go p.pingLoop()
-
 		if err := p.connectToServer(); err != nil {
 			log.Printf("Initial connection failed: %v", err)
 			// Start reconnection attempts
@@ -117,14 +467,132 @@ func NewProxy(isServer bool, address, allowedIP string, discoveryHandler *Discov
 	return p, nil
 }
 
-// Close shuts down the proxy
+// cfg returns the configuration currently in effect
+func (p *Proxy) cfg() *Config {
+	return p.config.Load()
+}
+
+// Config returns a copy of the configuration currently in effect
+func (p *Proxy) Config() Config {
+	return *p.cfg()
+}
+
+// UpdateConfig applies the runtime-tunable settings of config to a running
+// proxy. Settings that require a restart (mode, address, listener, interface,
+// recording, frame trace, sampling, mDNS advertisement, tunnel interface, source address,
+// state file, address mapping file, session journal, GeoIP filter, chaos
+// mode) are kept.
+func (p *Proxy) UpdateConfig(config Config) {
+	old := p.cfg()
+	config.Interface = old.Interface
+	config.IsServer = old.IsServer
+	config.Address = old.Address
+	config.Listeners = old.Listeners
+	config.Recorder = old.Recorder
+	config.Tracer = old.Tracer
+	config.Sampler = old.Sampler
+	config.Advertise = old.Advertise
+	config.StateFile = old.StateFile
+	config.IPMapFile = old.IPMapFile
+	config.JournalFile = old.JournalFile
+	config.GeoIP = old.GeoIP
+	config.Chaos = old.Chaos
+	config.TunnelInterface = old.TunnelInterface
+	config.BindAddress = old.BindAddress
+	config.TunnelMark = old.TunnelMark
+	config.applyDefaults()
+	p.config.Store(&config)
+	p.setTunnelLimits(&config)
+	p.discoveryHandler.SetLogFilter(config.LogFilter)
+	p.sessionHandler.SetLogFilter(config.LogFilter)
+
+	if config.KeepaliveInterval != old.KeepaliveInterval || config.ClientPingInterval != old.ClientPingInterval {
+		p.resetPingTicker()
+	}
+	if config.WriteTimeout != old.WriteTimeout || config.WriteStalls != old.WriteStalls {
+		for _, peer := range p.peers() {
+			peer.SetWriteTimeout(config.WriteTimeout, config.WriteStalls)
+		}
+	}
+	if p.isServer {
+		for _, peer := range p.peers() {
+			p.applyClientPolicy(peer)
+		}
+	}
+	if config.TCPKeepaliveIdle != old.TCPKeepaliveIdle || config.TCPKeepaliveInterval != old.TCPKeepaliveInterval || config.TCPKeepaliveCount != old.TCPKeepaliveCount {
+		for _, peer := range p.peers() {
+			p.setTCPKeepalive(peer.conn)
+		}
+	}
+	if config.DSCP != old.DSCP {
+		for _, peer := range p.peers() {
+			setDSCP(peer.conn, config.DSCP)
+		}
+	}
+}
+
+// startClient applies the configured write timeout, TCP keepalive and DSCP to
+// a tunnel connection, sends our hello with the extra fields given, checks
+// that full-size frames fit the tunnel path and starts sending the frames
+// queued for it
+func (p *Proxy) startClient(client *Client, extra ...string) {
+	conn := client.conn
+	p.connections.Add(1)
+	cfg := p.cfg()
+	client.SetWriteTimeout(cfg.WriteTimeout, cfg.WriteStalls)
+	p.setTCPKeepalive(conn)
+	if cfg.DSCP != 0 {
+		setDSCP(conn, cfg.DSCP)
+	}
+	// Sequenced and timestamped frames, session lists and credits are
+	// understood whether or not we send them
+	fields := []string{"seq=1", "sessions=1", "ts=1"}
+	if mtu := p.interfaceMTU(); mtu > 0 {
+		fields = append(fields, "mtu="+strconv.Itoa(mtu))
+	}
+	fields = append(fields, p.creditHelloField(client))
+	fields = append(fields, extra...)
+	if err := client.SendHello(fields...); err != nil {
+		log.Printf("Error sending hello to %s: %v", client.remoteAddr, err)
+	}
+	if p.linkDown.Load() {
+		p.sendLinkState(client)
+	}
+	p.checkPathMTU(client)
+	p.spawn(func() { p.sendQueued(client) })
+}
+
+// spawn runs fn in a goroutine that Wait waits for. It returns false without
+// running fn once the proxy is closed.
+func (p *Proxy) spawn(fn func()) bool {
+	p.lifeMu.Lock()
+	defer p.lifeMu.Unlock()
+	if p.closed.Load() {
+		return false
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		fn()
+	}()
+	return true
+}
+
+// Close shuts down the proxy. It may be called more than once.
 func (p *Proxy) Close() error {
-	p.closed = true
+	p.lifeMu.Lock()
+	if p.closed.Load() {
+		p.lifeMu.Unlock()
+		return nil
+	}
+	p.closed.Store(true)
+	p.lifeMu.Unlock()
+
+	// Abort a pending connection attempt before taking the server lock
+	p.cancel()
 	close(p.closedCh)
 
-	if p.listener != nil {
-		p.listener.Close()
-	}
+	p.closeListeners()
 
 	p.serverMu.Lock()
 	if p.server != nil {
@@ -139,10 +607,14 @@ func (p *Proxy) Close() error {
 	}
 	p.clientsMu.Unlock()
 
+	// Sessions not terminated with a PADT are still alive for the endpoints,
+	// the next run restores them
+	p.saveState()
+	p.sessions.EndAll(ReasonShutdown)
+
 	// Stop timers and tickers
-	if p.reconnectTimer != nil {
-		p.reconnectTimer.Stop()
-	}
+	p.stopReconnect()
+	p.stopPADOWatch()
 
 	if p.pingTicker != nil {
 		p.pingTicker.Stop()
@@ -151,7 +623,43 @@ func (p *Proxy) Close() error {
 	return nil
 }
 
-// pingLoop sends periodic pings to the server
+// Wait blocks until the proxy is closed, by Close or by cancellation of the
+// context given to NewProxy, and all its goroutines have exited. The packet
+// handlers belong to the caller and have their own Wait.
+func (p *Proxy) Wait() {
+	<-p.closedCh
+	p.wg.Wait()
+}
+
+// Run proxies PPPoE frames on config.Interface until ctx is cancelled, then
+// closes the proxy and its packet handlers and waits for them to stop. It
+// returns early if the proxy cannot be started. Use NewProxy and Drain for a
+// graceful shutdown.
+func Run(ctx context.Context, config Config) error {
+	discovery, err := NewDiscoveryHandler(ctx, config.Interface, config.IsServer)
+	if err != nil {
+		return fmt.Errorf("failed to initialize discovery handler: %v", err)
+	}
+	defer discovery.Wait()
+	defer discovery.Close()
+
+	session, err := NewSessionHandler(ctx, config.Interface, config.IsServer)
+	if err != nil {
+		return fmt.Errorf("failed to initialize session handler: %v", err)
+	}
+	defer session.Wait()
+	defer session.Close()
+
+	proxy, err := NewProxy(ctx, config, discovery, session)
+	if err != nil {
+		return fmt.Errorf("failed to initialize proxy: %v", err)
+	}
+	proxy.Wait()
+	return nil
+}
+
+// pingLoop sends periodic pings to the server, or to the clients in server
+// mode
 func (p *Proxy) pingLoop() {
 	for {
 		select {
@@ -163,9 +671,13 @@ func (p *Proxy) pingLoop() {
 	}
 }
 
-// sendPing sends a ping packet to the server
+// sendPing sends a ping packet to the server, or to each client in server mode
 func (p *Proxy) sendPing() {
-	if p.closed {
+	if p.closed.Load() {
+		return
+	}
+	if p.isServer {
+		p.pingClients()
 		return
 	}
 
@@ -177,8 +689,13 @@ func (p *Proxy) sendPing() {
 		return
 	}
 
-	// Send ping packet (type 0, empty data)
-	if err := server.WritePacket(PacketTypePing, []byte{}); err != nil {
+	if server.pending.Add(1) > 1 {
+		keepaliveMissed.Inc()
+		log.Printf("Server did not answer the last %d ping(s)", server.pending.Load()-1)
+	}
+
+	// Send ping packet (type 0, carrying the send timestamp)
+	if err := server.WritePacket(PacketTypePing, pingPayload()); err != nil {
 		log.Printf("Error sending ping: %v", err)
 		return
 	}
@@ -188,24 +705,37 @@ func (p *Proxy) sendPing() {
 
 // scheduleReconnect schedules a reconnection attempt
 func (p *Proxy) scheduleReconnect() {
-	if p.closed {
+	if p.closed.Load() || p.draining.Load() {
 		return
 	}
 
+	p.reconnectMu.Lock()
+	defer p.reconnectMu.Unlock()
+
 	// Stop any existing timer
 	if p.reconnectTimer != nil {
 		p.reconnectTimer.Stop()
 	}
 
-	// Reconnect after 5 seconds
-	p.reconnectTimer = time.AfterFunc(5*time.Second, func() {
-		if p.closed {
+	cfg := p.cfg()
+	p.backoff.Min = cfg.ReconnectMin
+	p.backoff.Max = cfg.ReconnectMax
+	p.backoff.Factor = cfg.ReconnectFactor
+	p.backoff.Jitter = cfg.ReconnectJitter
+	delay := p.backoff.Next()
+	reconnectDelay.Set(delay.Seconds())
+	log.Printf("Reconnecting to server in %s", delay.Round(time.Millisecond))
+
+	p.reconnectTimer = time.AfterFunc(delay, func() {
+		if p.closed.Load() || p.draining.Load() {
 			return
 		}
 
 		log.Printf("Attempting to reconnect to server...")
+		reconnectAttempts.Inc()
 		err := p.connectToServer()
 		if err != nil {
+			reconnectFailures.Inc()
 			log.Printf("Reconnection failed: %v", err)
 			p.scheduleReconnect()
 		} else {
@@ -214,58 +744,168 @@ func (p *Proxy) scheduleReconnect() {
 	})
 }
 
-// startServer starts a TCP server to accept client connections
+// stopReconnect cancels any pending reconnection attempt
+func (p *Proxy) stopReconnect() {
+	p.reconnectMu.Lock()
+	defer p.reconnectMu.Unlock()
+	if p.reconnectTimer != nil {
+		p.reconnectTimer.Stop()
+	}
+}
+
+// startServer starts a TCP server to accept client connections on each
+// listen address. All listeners feed the same client pool.
 func (p *Proxy) startServer() error {
-	var err error
-	p.listener, err = net.Listen("tcp", p.address)
-	if err != nil {
-		return fmt.Errorf("failed to start server: %v", err)
+	inherited := p.cfg().Listeners
+	for i, addr := range ListenAddresses(p.address) {
+		var l net.Listener
+		if i < len(inherited) {
+			l = inherited[i]
+		}
+		if l == nil {
+			var err error
+			l, err = p.listen(addr)
+			if err != nil {
+				p.closeListeners()
+				return fmt.Errorf("failed to start server on %s: %v", addr, err)
+			}
+		}
+		p.listeners = append(p.listeners, l)
 	}
 
-	go p.acceptClients()
-	log.Printf("Server listening on %s", p.address)
+	for _, l := range p.listeners {
+		p.accepting.Add(1)
+		p.spawn(func() { p.acceptClients(l) })
+		log.Printf("Server listening on %s", l.Addr())
+	}
+
+	if name := p.cfg().Advertise; name != "" {
+		if err := p.advertise(name); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// acceptClients accepts and handles client connections
-func (p *Proxy) acceptClients() {
+// ListenAddresses splits the comma separated listen addresses of a server
+func ListenAddresses(address string) []string {
+	return splitList(address)
+}
+
+// closeListeners closes the tunnel listeners, stopping the accept loops
+func (p *Proxy) closeListeners() {
+	for _, l := range p.listeners {
+		l.Close()
+	}
+}
+
+// acceptClients accepts and handles client connections from a listener
+func (p *Proxy) acceptClients(l net.Listener) {
+	defer p.accepting.Add(-1)
+
 	for {
-		conn, err := p.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			if p.closed {
+			if p.closed.Load() || p.draining.Load() {
 				return
 			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
 
-		clientIP := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		ip, _ := remoteIP(conn.RemoteAddr())
+		clientIP := ip.String()
 
 		// Check if client IP is allowed
-		if !p.isClientAllowed(clientIP) {
+		if !p.isClientAllowed(ip) {
+			p.reportError(ErrorAuth, clientIP, errors.New("tunnel client not allowed"))
 			log.Printf("Rejected connection from unauthorized client: %s", clientIP)
 			conn.Close()
 			continue
 		}
+		if err := p.cfg().GeoIP.Check(ip); err != nil {
+			p.reportError(ErrorAuth, clientIP, err)
+			log.Printf("Rejected connection from %s: %v", clientIP, err)
+			conn.Close()
+			continue
+		}
 
-		client := NewClient(conn)
-		log.Printf("Accepted connection from %s", clientIP)
-		p.clientsMu.Lock()
-		p.clients[client.remoteAddr] = client
-		p.clientsMu.Unlock()
+		if p.cfg().AuthURL == "" {
+			if !p.admitClient(NewClient(conn), nil, nil) {
+				return
+			}
+			continue
+		}
 
-		go p.handleClient(client)
+		// The authorization endpoint may be slow, do not hold up other clients
+		if !p.spawn(func() { p.authorizeAndAdmit(conn, ip) }) {
+			conn.Close()
+			return
+		}
 	}
 }
 
-// isClientAllowed checks if the client IP is allowed to connect
-func (p *Proxy) isClientAllowed(clientIP string) bool {
-	// Extract the IP part without the port
-	ipParts := strings.Split(clientIP, ":")
-	ip := ipParts[0]
+// authorizeAndAdmit challenges a client, reads its hello, which carries the
+// answer, and admits the client once the authorization endpoint allowed it
+func (p *Proxy) authorizeAndAdmit(conn net.Conn, ip netip.Addr) {
+	client := NewClient(conn)
+	challenge, err := challengeClient(client)
+	var hello []byte
+	if err == nil {
+		hello, err = p.readHello(client)
+	}
+	var policy *ClientPolicy
+	if err == nil {
+		policy, err = p.authorizeClient(conn, ip, challenge, parseHello(hello)["auth"])
+	}
+	if err != nil {
+		p.reportError(ErrorAuth, ip.String(), err)
+		log.Printf("Rejected connection from %s: %v", ip, err)
+		conn.Close()
+		return
+	}
+	p.admitClient(client, policy, hello)
+}
 
-	// Check if it matches the allowed IP
-	return ip == p.allowedIP
+// admitClient starts handling an accepted client connection. authPolicy is
+// the policy given by the authorization endpoint, if any, and hello the hello
+// already read from the client. It returns false if the proxy was closed
+// meanwhile.
+func (p *Proxy) admitClient(client *Client, authPolicy *ClientPolicy, hello []byte) bool {
+	p.startClient(client)
+	client.authPolicy = authPolicy
+	p.applyClientPolicy(client)
+	if hello != nil {
+		p.handleHello(client, hello)
+	}
+	ip, _ := remoteIP(client.conn.RemoteAddr())
+	if name := client.Name(); name != "" {
+		log.Printf("Accepted connection from %s (%s)", ip, name)
+	} else {
+		log.Printf("Accepted connection from %s", ip)
+	}
+	p.clientsMu.Lock()
+	p.clients[client.remoteAddr] = client
+	tunnelPeers.Set(float64(len(p.clients)))
+	p.clientsMu.Unlock()
+
+	p.hooks.Fire(HookClientConnected, "PEER="+client.remoteAddr, "CLIENT_NAME="+client.Name())
+	if !p.spawn(func() { p.handleClient(client) }) {
+		// Closed meanwhile, the client list was already cleaned up
+		client.Close()
+		return false
+	}
+	return true
+}
+
+// isClientAllowed checks if the client IP matches the allow list
+func (p *Proxy) isClientAllowed(ip netip.Addr) bool {
+	list, err := ParseAllowList(p.cfg().AllowedIP)
+	if err != nil {
+		log.Printf("Invalid allow list, rejecting all clients: %v", err)
+		return false
+	}
+	return allowed(list, ip)
 }
 
 // handleClient processes packets from a connected client
@@ -274,107 +914,64 @@ func (p *Proxy) handleClient(client *Client) {
 		client.Close()
 		p.clientsMu.Lock()
 		delete(p.clients, client.remoteAddr)
+		tunnelPeers.Set(float64(len(p.clients)))
 		p.clientsMu.Unlock()
-		log.Printf("Client %s disconnected", client.remoteAddr)
+		p.sessions.EndOwner(client.remoteAddr, ReasonTunnelClosed)
+		forgetPeerVersion(client)
+		forgetClientPolicy(client)
+		log.Printf("Client %s disconnected", client.label())
+		p.hooks.Fire(HookClientDisconnected, "PEER="+client.remoteAddr, "CLIENT_NAME="+client.Name())
 	}()
 
-	buffer := make([]byte, 4096)
 	for {
-		// Read packet type (uint16)
-		var packetType uint16
-		if err := binary.Read(client.conn, binary.BigEndian, &packetType); err != nil {
-			if err == io.EOF {
+		p.armReadDeadline(client)
+		packetType, data, err := client.ReadPacket()
+		if err != nil {
+			if err == io.EOF || p.closed.Load() || p.isDeadPeer(client, err) {
 				return
 			}
-			log.Printf("Error reading packet type: %v", err)
+			p.reportError(ErrorTunnelRead, client.remoteAddr, err)
+			log.Printf("Error reading packet from client %s: %v", client.remoteAddr, err)
 			return
 		}
-
-		// Read length (varint)
-		var length uint64
-		var shift uint
-		for {
-			if len(buffer) == 0 {
-				log.Printf("Buffer too small for varint")
-				return
-			}
-
-			_, err := client.conn.Read(buffer[:1])
-			if err != nil {
-				log.Printf("Error reading varint: %v", err)
-				return
-			}
-
-			b := buffer[0]
-			length |= uint64(b&0x7f) << shift
-			shift += 7
-
-			if b&0x80 == 0 {
-				break
-			}
-
-			if shift > 63 {
-				log.Printf("Varint too large")
-				return
-			}
+		if !p.waitTunnelIn(len(data)) {
+			return
 		}
 
 		// Process packet based on type
 		switch packetType {
 		case PacketTypePing:
-			// Respond with pong
-			if err := client.WritePacket(PacketTypePong, []byte{}); err != nil {
+			// Respond with pong, echoing the ping payload
+			if err := client.WritePacket(PacketTypePong, data); err != nil {
 				log.Printf("Error sending pong: %v", err)
 				return
 			}
 			log.Printf("Received ping from client %s, sent pong", client.remoteAddr)
 
 		case PacketTypePong:
-			// Just log receipt of pong
-			log.Printf("Received pong from client %s", client.remoteAddr)
-
-		case PacketTypeDiscovery, PacketTypeSession:
-			// Resize buffer if needed
-			if length > uint64(len(buffer)) {
-				newSize := length
-				if newSize > 65536 {
-					log.Printf("Packet too large: %d bytes", length)
-					return
-				}
-				buffer = make([]byte, newSize)
-			}
+			p.handlePong(client, data)
 
-			// Read packet data for non-zero length packets
-			if length > 0 {
-				if _, err := io.ReadFull(client.conn, buffer[:length]); err != nil {
-					log.Printf("Error reading packet data: %v", err)
-					return
-				}
-			}
+		case PacketTypeDiscovery, PacketTypeSession, PacketTypeSequenced, PacketTypeTimestamped:
+			p.receiveFrame(client, packetType, data)
 
-			// Process packet based on type
-			if packetType == PacketTypeDiscovery {
-				// Inject the packet into the interface
-				p.discoveryHandler.InjectPacket(buffer[:length])
-			} else {
-				// Inject the packet into the interface
-				p.sessionHandler.InjectPacket(buffer[:length])
-			}
+		case PacketTypeGoodbye:
+			log.Printf("Client %s closed the tunnel", client.remoteAddr)
+			return
+
+		case PacketTypeHello:
+			p.handleHello(client, data)
+
+		case PacketTypeSessions:
+			p.handleSessions(client, data)
+
+		case PacketTypeLinkState:
+			p.handleLinkState(client, data)
+
+		case PacketTypeCredit:
+			p.handleCredit(client, data)
 
 		default:
 			log.Printf("Unknown packet type from client %s: %d", client.remoteAddr, packetType)
-			// Skip any data associated with an unknown packet type
-			if length > 0 {
-				if length > 1048576 { // 1MB limit for skipping
-					log.Printf("Unknown packet too large to skip: %d bytes", length)
-					return
-				}
-
-				if _, err := io.CopyN(io.Discard, client.conn, int64(length)); err != nil {
-					log.Printf("Error skipping unknown packet data: %v", err)
-					return
-				}
-			}
 		}
 	}
 }
@@ -390,142 +987,230 @@ func (p *Proxy) connectToServer() error {
 		p.server = nil
 	}
 
-	conn, err := net.Dial("tcp", p.address)
+	conn, err := p.dialServer(p.ctx)
 	if err != nil {
 		return fmt.Errorf("failed to connect to server: %v", err)
 	}
 
-	p.server = NewClient(conn)
-	log.Printf("Connected to server at %s", p.address)
-	go p.handleServerConnection(p.server)
+	client := NewClient(conn)
+	var fields []string
+	var hello []byte
+	if token := p.cfg().AuthToken; token != "" {
+		fields, hello = p.answerChallenge(client, token)
+	}
+	p.startClient(client, fields...)
+	if hello != nil {
+		p.handleHello(client, hello)
+	}
+	done := make(chan struct{})
+	if !p.spawn(func() { p.handleServerConnection(client, done) }) {
+		client.Close()
+		return errors.New("proxy is closed")
+	}
+	p.server = client
+	p.serverDone = done
+	p.flushReconnectQueue(client)
+	p.reconnectMu.Lock()
+	p.backoff.Reset()
+	reconnectDelay.Set(0)
+	p.reconnectMu.Unlock()
+	tunnelUp.Set(1)
+	tunnelPeers.Set(1)
+	log.Printf("Connected to server at %s (%s)", p.address, conn.RemoteAddr())
+	p.hooks.Fire(HookTunnelUp, "PEER="+p.server.remoteAddr)
 	return nil
 }
 
 // handleServerConnection processes packets from the server
-func (p *Proxy) handleServerConnection(client *Client) {
+func (p *Proxy) handleServerConnection(client *Client, done chan struct{}) {
+	defer close(done)
 	defer func() {
 		p.serverMu.Lock()
 		if p.server == client {
 			p.server = nil
+			tunnelUp.Set(0)
+			tunnelPeers.Set(0)
 		}
 		p.serverMu.Unlock()
 
 		client.Close()
+		forgetPeerVersion(client)
 		log.Printf("Disconnected from server")
+		p.hooks.Fire(HookTunnelDown, "PEER="+client.remoteAddr)
 
 		// Schedule reconnection if we're not closing
-		if !p.closed {
+		if !p.closed.Load() {
 			p.scheduleReconnect()
 		}
 	}()
 
-	buffer := make([]byte, 4096)
 	for {
-		// Read packet type (uint16)
-		var packetType uint16
-		if err := binary.Read(client.conn, binary.BigEndian, &packetType); err != nil {
-			if err == io.EOF || p.closed {
+		p.armReadDeadline(client)
+		packetType, data, err := client.ReadPacket()
+		if err != nil {
+			if err == io.EOF || p.closed.Load() || p.isDeadPeer(client, err) {
 				return
 			}
-			log.Printf("Error reading packet type from server: %v", err)
+			p.reportError(ErrorTunnelRead, client.remoteAddr, err)
+			log.Printf("Error reading packet from server: %v", err)
 			return
 		}
-
-		// Read length (varint)
-		var length uint64
-		var shift uint
-		for {
-			if len(buffer) == 0 {
-				log.Printf("Buffer too small for varint")
-				return
-			}
-
-			_, err := client.conn.Read(buffer[:1])
-			if err != nil {
-				log.Printf("Error reading varint from server: %v", err)
-				return
-			}
-
-			b := buffer[0]
-			length |= uint64(b&0x7f) << shift
-			shift += 7
-
-			if b&0x80 == 0 {
-				break
-			}
-
-			if shift > 63 {
-				log.Printf("Varint too large")
-				return
-			}
+		if !p.waitTunnelIn(len(data)) {
+			return
 		}
 
 		// Process packet based on type
 		switch packetType {
 		case PacketTypePing:
-			// Respond with pong
-			if err := client.WritePacket(PacketTypePong, []byte{}); err != nil {
+			// Respond with pong, echoing the ping payload
+			if err := client.WritePacket(PacketTypePong, data); err != nil {
 				log.Printf("Error sending pong: %v", err)
 				return
 			}
 			log.Printf("Received ping, sent pong")
 
 		case PacketTypePong:
-			// Just log receipt of pong
-			log.Printf("Received pong from server")
-
-		case PacketTypeDiscovery, PacketTypeSession:
-			// Resize buffer if needed
-			if length > uint64(len(buffer)) {
-				newSize := length
-				if newSize > 65536 {
-					log.Printf("Packet from server too large: %d bytes", length)
-					return
-				}
-				buffer = make([]byte, newSize)
-			}
+			p.handlePong(client, data)
 
-			// Read packet data for non-zero length packets
-			if length > 0 {
-				if _, err := io.ReadFull(client.conn, buffer[:length]); err != nil {
-					log.Printf("Error reading packet data from server: %v", err)
-					return
-				}
-			}
+		case PacketTypeDiscovery, PacketTypeSession, PacketTypeSequenced, PacketTypeTimestamped:
+			p.receiveFrame(client, packetType, data)
 
-			// Process packet based on type
-			if packetType == PacketTypeDiscovery {
-				// Inject the packet into the interface
-				p.discoveryHandler.InjectPacket(buffer[:length])
-			} else {
-				// Inject the packet into the interface
-				p.sessionHandler.InjectPacket(buffer[:length])
-			}
+		case PacketTypeGoodbye:
+			log.Printf("Server closed the tunnel")
+			return
+
+		case PacketTypeHello:
+			p.handleHello(client, data)
+
+		case PacketTypeSessions:
+			p.handleSessions(client, data)
+
+		case PacketTypeLinkState:
+			p.handleLinkState(client, data)
+
+		case PacketTypeChallenge:
+			// Only answered with -auth-token, before the hello
+
+		case PacketTypeCredit:
+			p.handleCredit(client, data)
 
 		default:
 			log.Printf("Unknown packet type from server: %d", packetType)
-			// Skip any data associated with an unknown packet type
-			if length > 0 {
-				if length > 1048576 { // 1MB limit for skipping
-					log.Printf("Unknown packet too large to skip: %d bytes", length)
-					return
-				}
-
-				if _, err := io.CopyN(io.Discard, client.conn, int64(length)); err != nil {
-					log.Printf("Error skipping unknown packet data: %v", err)
-					return
-				}
-			}
 		}
 	}
 }
 
+// injectFrame injects a discovery or session frame received from the tunnel,
+// and reports whether it was injected, or queued by the shaper of its session
+func (p *Proxy) injectFrame(from *Client, packetType uint16, data []byte) bool {
+	if !p.checkStrict(DirectionTx, data) {
+		return false
+	}
+	if p.isServer && !p.allowedByPolicy(from, packetType, data) {
+		return false
+	}
+	if !p.filterSession(DirectionTx, data) {
+		return false
+	}
+	if packetType == PacketTypeSession && !p.filterPPP(DirectionTx, data) {
+		return false
+	}
+	if p.linkDown.Load() {
+		// Injection would fail, and a PPPoE client or server is not
+		// reachable anyway
+		if packetType == PacketTypeDiscovery {
+			linkDownDrops.With("discovery").Inc()
+		} else {
+			linkDownDrops.With("session").Inc()
+		}
+		return false
+	}
+
+	if packetType == PacketTypeDiscovery {
+		return p.injectDiscovery(from, data)
+	}
+	return p.shapeSession(from, data, p.injectSession)
+}
+
+// injectDiscovery injects a discovery frame received from a tunnel client
+func (p *Proxy) injectDiscovery(from *Client, data []byte) bool {
+	data, ok := p.middleware.run(DirectionTx, data)
+	if !ok {
+		return false
+	}
+
+	if data, ok = p.guardCookie(DirectionTx, data); !ok {
+		return false
+	}
+
+	cfg := p.cfg()
+	data = cfg.TagRules.Apply(DirectionTx, data)
+	cfg.Dumper.Dump(DirectionTx, data)
+	cfg.Recorder.Record(DirectionTx, PacketTypeDiscovery, data)
+	cfg.Tracer.Trace(DirectionTx, data)
+	cfg.Sampler.Sample(DirectionTx, data)
+
+	owner := ""
+	if p.isServer {
+		owner = from.remoteAddr
+	}
+	p.checkPADS(data)
+	p.sessions.ObserveDiscovery(data, owner)
+	p.endpoints.ObserveDiscovery(data)
+	p.watchPADO(data)
+	return p.discoveryHandler.InjectPacket(data) == nil
+}
+
+// injectSession injects a session frame received from the tunnel
+func (p *Proxy) injectSession(data []byte) bool {
+	data, ok := p.middleware.run(DirectionTx, data)
+	if !ok {
+		return false
+	}
+
+	cfg := p.cfg()
+	cfg.Dumper.Dump(DirectionTx, data)
+	cfg.Recorder.Record(DirectionTx, PacketTypeSession, data)
+	cfg.Tracer.Trace(DirectionTx, data)
+	cfg.Sampler.Sample(DirectionTx, data)
+
+	if !p.sessions.ObserveSession(data, DirectionTx) {
+		p.checkStray(DirectionTx, data)
+	}
+	p.endpoints.ObserveSession(data)
+	return p.sessionHandler.InjectPacket(data) == nil
+}
+
 // handleDiscoveryPacket sends a discovery packet to the server or clients
 func (p *Proxy) handleDiscoveryPacket(packet []byte) {
-	if p.closed {
+	if p.closed.Load() || !p.checkStrict(DirectionRx, packet) {
+		return
+	}
+
+	packet, ok := p.middleware.run(DirectionRx, packet)
+	if !ok || !p.filterSession(DirectionRx, packet) {
+		return
+	}
+
+	if packet, ok = p.guardCookie(DirectionRx, packet); !ok {
 		return
 	}
 
+	cfg := p.cfg()
+	packet = cfg.TagRules.Apply(DirectionRx, packet)
+	cfg.Dumper.Dump(DirectionRx, packet)
+	cfg.Recorder.Record(DirectionRx, PacketTypeDiscovery, packet)
+	cfg.Tracer.Trace(DirectionRx, packet)
+	cfg.Sampler.Sample(DirectionRx, packet)
+	var captured time.Time // Sent to peers with TimestampFrames only
+	if cfg.TimestampFrames {
+		captured = p.discoveryHandler.captured
+	}
+	p.checkPADS(packet)
+	p.sessions.ObserveDiscovery(packet, "")
+	p.endpoints.ObserveDiscovery(packet)
+	p.watchPADO(packet)
+
 	if p.isServer {
 		// In server mode, broadcast to all clients
 		p.clientsMu.RLock()
@@ -536,34 +1221,60 @@ func (p *Proxy) handleDiscoveryPacket(packet []byte) {
 		}
 
 		// Broadcast to all clients
+		f := newTxFrame(PacketTypeDiscovery, packet, captured)
 		for _, client := range p.clients {
-			if err := client.WritePacket(PacketTypeDiscovery, packet); err != nil {
-				log.Printf("Error sending discovery packet to client %s: %v", client.remoteAddr, err)
+			if client.sendsFrame(packet) {
+				p.queueFrame(client, f)
 			}
 		}
 	} else {
-		// In client mode, send to server
+		// In client mode, send to server, or keep the frame until the
+		// connection is back
 		p.serverMu.Lock()
 		server := p.server
+		queued := server == nil && !p.draining.Load() && cfg.ReconnectQueue > 0
+		if queued {
+			p.queueForReconnect(PacketTypeDiscovery, packet)
+		}
 		p.serverMu.Unlock()
 
 		if server == nil {
+			if !queued {
+				p.refuseDiscovery(nil, packet, RefuseNoTunnel, "pppoeproxy: no tunnel to the access concentrator")
+			}
 			return
 		}
 
 		// Send to server
-		if err := server.WritePacket(PacketTypeDiscovery, packet); err != nil {
-			log.Printf("Error sending discovery packet to server: %v", err)
-		}
+		p.queueFrame(server, newTxFrame(PacketTypeDiscovery, packet, captured))
 	}
 }
 
 // handleSessionPacket sends a session packet to the server or clients
 func (p *Proxy) handleSessionPacket(packet []byte) {
-	if p.closed {
+	if p.closed.Load() || !p.checkStrict(DirectionRx, packet) {
 		return
 	}
 
+	packet, ok := p.middleware.run(DirectionRx, packet)
+	if !ok || !p.filterSession(DirectionRx, packet) || !p.filterPPP(DirectionRx, packet) {
+		return
+	}
+
+	cfg := p.cfg()
+	cfg.Dumper.Dump(DirectionRx, packet)
+	cfg.Recorder.Record(DirectionRx, PacketTypeSession, packet)
+	cfg.Tracer.Trace(DirectionRx, packet)
+	cfg.Sampler.Sample(DirectionRx, packet)
+	var captured time.Time // Sent to peers with TimestampFrames only
+	if cfg.TimestampFrames {
+		captured = p.sessionHandler.captured
+	}
+	if !p.sessions.ObserveSession(packet, DirectionRx) {
+		p.checkStray(DirectionRx, packet)
+	}
+	p.endpoints.ObserveSession(packet)
+
 	if p.isServer {
 		// In server mode, broadcast to all clients
 		p.clientsMu.RLock()
@@ -574,15 +1285,20 @@ func (p *Proxy) handleSessionPacket(packet []byte) {
 		}
 
 		// Broadcast to all clients
+		f := newTxFrame(PacketTypeSession, packet, captured)
 		for _, client := range p.clients {
-			if err := client.WritePacket(PacketTypeSession, packet); err != nil {
-				log.Printf("Error sending session packet to client %s: %v", client.remoteAddr, err)
+			if client.sendsFrame(packet) {
+				p.queueFrame(client, f)
 			}
 		}
 	} else {
-		// In client mode, send to server
+		// In client mode, send to server, or keep the frame until the
+		// connection is back
 		p.serverMu.Lock()
 		server := p.server
+		if server == nil && !p.draining.Load() {
+			p.queueForReconnect(PacketTypeSession, packet)
+		}
 		p.serverMu.Unlock()
 
 		if server == nil {
@@ -590,8 +1306,6 @@ func (p *Proxy) handleSessionPacket(packet []byte) {
 		}
 
 		// Send to server
-		if err := server.WritePacket(PacketTypeSession, packet); err != nil {
-			log.Printf("Error sending session packet to server: %v", err)
-		}
+		p.queueFrame(server, newTxFrame(PacketTypeSession, packet, captured))
 	}
 }
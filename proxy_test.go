@@ -0,0 +1,369 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// Addresses and session ID of the test endpoints
+var (
+	testHostMAC   = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x5e, 0x01}
+	testACMAC     = net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x5e, 0x02}
+	testBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+const testSession = 0x1234
+
+// testFrame builds a PPPoE frame from src to dst, with the VLAN tags given
+func testFrame(dst, src net.HardwareAddr, ethertype uint16, code uint8, session uint16, payload []byte, vlans ...uint16) []byte {
+	frame := append(append([]byte(nil), dst...), src...)
+	for _, id := range vlans {
+		frame = binary.BigEndian.AppendUint16(frame, etherTypeVLAN)
+		frame = binary.BigEndian.AppendUint16(frame, id)
+	}
+	frame = binary.BigEndian.AppendUint16(frame, ethertype)
+	frame = append(frame, 0x11, code)
+	frame = binary.BigEndian.AppendUint16(frame, session)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+// testTag encodes a discovery tag
+func testTag(tag uint16, value string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, tag)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// testEndpoint is a synthetic host or AC on a FakeSegment
+type testEndpoint struct {
+	t         *testing.T
+	discovery RawSocket
+	session   RawSocket
+	frames    chan []byte // Frames received on both sockets
+}
+
+// newTestEndpoint opens the sockets of an endpoint on seg
+func newTestEndpoint(t *testing.T, seg *FakeSegment) *testEndpoint {
+	e := &testEndpoint{t: t, frames: make(chan []byte, 64)}
+	e.discovery, _ = seg.Open("test", PPPoEDiscovery)
+	e.session, _ = seg.Open("test", PPPoESession)
+	for _, sock := range []RawSocket{e.discovery, e.session} {
+		t.Cleanup(func() { sock.Close() })
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				n, err := sock.Recv(buf)
+				if err != nil {
+					return
+				}
+				e.frames <- append([]byte(nil), buf[:n]...)
+			}
+		}()
+	}
+	return e
+}
+
+// send transmits a frame on the socket of its ethertype
+func (e *testEndpoint) send(frame []byte) {
+	sock := e.discovery
+	if ethertype, _ := framePayload(frame); ethertype == PPPoESession {
+		sock = e.session
+	}
+	if err := sock.Send(frame); err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+// next returns the next frame received, or nil after a second
+func (e *testEndpoint) next() []byte {
+	select {
+	case frame := <-e.frames:
+		return frame
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// expect fails the test unless the next frame received is want
+func (e *testEndpoint) expect(what string, want []byte) {
+	e.t.Helper()
+	if got := e.next(); !bytes.Equal(got, want) {
+		e.t.Fatalf("%s: received %x, want %x", what, got, want)
+	}
+}
+
+// expectNone fails the test if a frame is received within 100ms
+func (e *testEndpoint) expectNone(what string) {
+	e.t.Helper()
+	select {
+	case frame := <-e.frames:
+		e.t.Fatalf("%s: received %x", what, frame)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// startTestProxy starts a proxy on seg, closed at the end of the test
+func startTestProxy(t *testing.T, seg *FakeSegment, config Config) *Proxy {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	discoverySock, _ := seg.Open(config.Interface, PPPoEDiscovery)
+	sessionSock, _ := seg.Open(config.Interface, PPPoESession)
+	discovery := NewDiscoveryHandlerWithSocket(ctx, discoverySock, config.IsServer)
+	session := NewSessionHandlerWithSocket(ctx, sessionSock, config.IsServer)
+	p, err := NewProxy(ctx, config, discovery, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// startTestProxies starts a server proxy with config on an AC segment and a
+// client proxy on a host segment, connected over the loopback interface, and
+// returns the host and AC endpoints once the tunnel is up
+func startTestProxies(t *testing.T, config Config) (server *Proxy, host, ac *testEndpoint) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSeg, acSeg := NewFakeSegment(), NewFakeSegment()
+	config.Interface, config.IsServer = "test-ac", true
+	config.Address, config.Listeners, config.AllowedIP = l.Addr().String(), []net.Listener{l}, "127.0.0.1"
+	server = startTestProxy(t, acSeg, config)
+	startTestProxy(t, hostSeg, Config{Interface: "test-host", Address: l.Addr().String()})
+
+	// Frames from the AC side are only forwarded once the server admitted
+	// the client
+	for start := time.Now(); len(server.Peers()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the client did not connect")
+		}
+	}
+	return server, newTestEndpoint(t, hostSeg), newTestEndpoint(t, acSeg)
+}
+
+func TestDiscoveryHandler(t *testing.T) {
+	seg := NewFakeSegment()
+	sock, _ := seg.Open("test", PPPoEDiscovery)
+	h := NewDiscoveryHandlerWithSocket(context.Background(), sock, true)
+	defer h.Close()
+	forwarded := make(chan []byte, 1)
+	h.SetForwardFunc(func(packet []byte) { forwarded <- append([]byte(nil), packet...) })
+	host := newTestEndpoint(t, seg)
+
+	padi := testFrame(testBroadcast, testHostMAC, PPPoEDiscovery, PADI, 0, testTag(TagServiceName, ""))
+	host.send(padi)
+	select {
+	case got := <-forwarded:
+		if !bytes.Equal(got, padi) {
+			t.Fatalf("forwarded %x, want %x", got, padi)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("PADI not forwarded")
+	}
+
+	pado := testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADO, 0, testTag(TagACName, "ac"))
+	if err := h.InjectPacket(pado); err != nil {
+		t.Fatal(err)
+	}
+	host.expect("injected PADO", pado)
+}
+
+func TestProxyForwarding(t *testing.T) {
+	server, host, ac := startTestProxies(t, Config{})
+
+	serviceName := testTag(TagServiceName, "")
+	lcpRequest := []byte{0xc0, 0x21, 0x01, 0x01, 0x00, 0x0e, 0x01, 0x04, 0x05, 0xd4, 0x05, 0x06, 0x12, 0x34, 0x56, 0x78}
+	lcpAck := append([]byte{0xc0, 0x21, 0x02}, lcpRequest[3:]...)
+	steps := []struct {
+		name     string
+		fromHost bool
+		frame    []byte
+	}{
+		{"PADI", true, testFrame(testBroadcast, testHostMAC, PPPoEDiscovery, PADI, 0, serviceName)},
+		{"PADO", false, testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADO, 0, append(testTag(TagACName, "ac"), serviceName...))},
+		{"PADR", true, testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADR, 0, serviceName)},
+		{"PADS", false, testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADS, testSession, serviceName)},
+		{"LCP Configure-Request", true, testFrame(testACMAC, testHostMAC, PPPoESession, 0, testSession, lcpRequest)},
+		{"LCP Configure-Ack", false, testFrame(testHostMAC, testACMAC, PPPoESession, 0, testSession, lcpAck)},
+	}
+	for _, step := range steps {
+		from, to := ac, host
+		if step.fromHost {
+			from, to = host, ac
+		}
+		from.send(step.frame)
+		to.expect(step.name, step.frame)
+	}
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].ID != testSession || !bytes.Equal(sessions[0].HostMAC, testHostMAC) {
+		t.Fatalf("server tracks %+v", sessions)
+	}
+
+	padt := testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADT, testSession, nil)
+	host.send(padt)
+	ac.expect("PADT", padt)
+}
+
+func TestProxyCredits(t *testing.T) {
+	server, host, ac := startTestProxies(t, Config{TunnelCredits: 4})
+
+	// Far more frames than the credits announced by the server, which
+	// grants more as it injects them
+	for i := 0; i < 40; i++ {
+		frame := testFrame(testACMAC, testHostMAC, PPPoESession, 0, testSession, []byte{0x00, 0x21, 0x45, 0x00, 0x00, byte(i)})
+		host.send(frame)
+		ac.expect(fmt.Sprintf("frame %d", i), frame)
+	}
+
+	// The hello of the client preceded its frames
+	server.clientsMu.RLock()
+	defer server.clientsMu.RUnlock()
+	for _, client := range server.clients {
+		client.rxCredits.mu.Lock()
+		if client.rxCredits.window != 4 || !client.rxCredits.peer {
+			t.Errorf("server grants %d credits, client understands them %v", client.rxCredits.window, client.rxCredits.peer)
+		}
+		client.rxCredits.mu.Unlock()
+	}
+}
+
+func TestProxyClientPolicyVLAN(t *testing.T) {
+	_, host, ac := startTestProxies(t, Config{
+		ClientPolicies: []ClientPolicy{{Name: "site", Prefixes: mustAllowList(t, "127.0.0.1"), VLANs: []uint16{10}}},
+	})
+
+	serviceName := testTag(TagServiceName, "")
+	host.send(testFrame(testBroadcast, testHostMAC, PPPoEDiscovery, PADI, 0, serviceName))
+	host.send(testFrame(testBroadcast, testHostMAC, PPPoEDiscovery, PADI, 0, serviceName, 20))
+	padi := testFrame(testBroadcast, testHostMAC, PPPoEDiscovery, PADI, 0, serviceName, 10)
+	host.send(padi)
+	ac.expect("PADI on VLAN 10", padi)
+	ac.expectNone("PADIs on other VLANs")
+
+	ac.send(testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADO, 0, serviceName, 20))
+	pado := testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADO, 0, serviceName, 10)
+	ac.send(pado)
+	host.expect("PADO on VLAN 10", pado)
+	host.expectNone("PADO on VLAN 20")
+}
+
+func TestProxyACCookies(t *testing.T) {
+	_, host, ac := startTestProxies(t, Config{ACCookies: true})
+
+	cookie := testTag(TagACCookie, "ac cookie")
+	ac.send(testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADO, 0, append(testTag(TagACName, "ac"), cookie...)))
+	pado, err := parsePPPoE(host.next())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed []byte
+	for _, tag := range pado.Tags {
+		if tag.Type == TagACCookie {
+			signed = tag.Value
+		}
+	}
+	if len(signed) != cookieHeaderSize+len("ac cookie") {
+		t.Fatalf("PADO cookie %x not signed", signed)
+	}
+
+	// A PADR with a forged cookie is dropped, the signed one is replaced by
+	// the cookie of the AC
+	host.send(testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADR, 0, cookie))
+	ac.expectNone("PADR with a forged cookie")
+	host.send(testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADR, 0, testTag(TagACCookie, string(signed))))
+	ac.expect("PADR", testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADR, 0, cookie))
+}
+
+func TestProxyRefusal(t *testing.T) {
+	// The client cannot reach its server
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	seg := NewFakeSegment()
+	startTestProxy(t, seg, Config{Interface: "test-host", Address: addr, DiscoveryErrors: true})
+	host := newTestEndpoint(t, seg)
+
+	host.send(testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADR, 0, testTag(TagHostUniq, "1")))
+	pads, err := parsePPPoE(host.next())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pads.Code != PADS || pads.Session != 0 || !bytes.Equal(pads.Dst, testHostMAC) || !bytes.Equal(pads.Src, testACMAC) {
+		t.Fatalf("refused with %+v", pads)
+	}
+	if len(pads.Tags) != 2 || pads.Tags[0].Type != TagHostUniq || pads.Tags[1].Type != TagGenericError {
+		t.Fatalf("refused with tags %+v", pads.Tags)
+	}
+}
+
+func TestProxyAuthToken(t *testing.T) {
+	// The endpoint knows the token of the client as "secret", and checks the
+	// response to the challenge with it
+	answers := make(chan bool, 2)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req authRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		challenge, err := hex.DecodeString(req.Challenge)
+		valid := err == nil && len(challenge) == authChallengeSize && req.Response == challengeResponse("secret", challenge)
+		select {
+		case answers <- valid:
+		default: // The rejected client reconnecting
+		}
+		json.NewEncoder(w).Encode(authResponse{Allow: valid, Name: "site"})
+	}))
+	defer endpoint.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startTestProxy(t, NewFakeSegment(), Config{
+		Interface: "test-ac", IsServer: true, Address: l.Addr().String(), Listeners: []net.Listener{l},
+		AllowedIP: "127.0.0.1", AuthURL: endpoint.URL,
+	})
+
+	for _, token := range []string{"wrong", "secret"} {
+		startTestProxy(t, NewFakeSegment(), Config{Interface: "test-host", Address: l.Addr().String(), AuthToken: token})
+		select {
+		case valid := <-answers:
+			if valid != (token == "secret") {
+				t.Fatalf("response of a client with token %q valid %v", token, valid)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("endpoint not called")
+		}
+	}
+	for start := time.Now(); len(server.Peers()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the client was not admitted")
+		}
+	}
+	// The hello read for the response is handled once the client is admitted
+	if peers := server.Peers(); len(peers) != 1 || peers[0].Name != "site" || peers[0].Version != Version() {
+		t.Fatalf("server peers %+v", peers)
+	}
+}
+
+// mustAllowList parses an allow list
+func mustAllowList(t *testing.T, list string) []netip.Prefix {
+	prefixes, err := ParseAllowList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefixes
+}
@@ -0,0 +1,66 @@
+package pppoeproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is a simple token bucket rate limiter
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum number of tokens
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket refilled at rate tokens per second
+func NewTokenBucket(rate, burst float64) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens accumulated since the last call
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// AllowN reports whether n tokens are available, consuming them if so
+func (b *TokenBucket) AllowN(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// delayN returns zero and consumes n tokens if they are available, or how
+// long until they are
+func (b *TokenBucket) delayN(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Allow reports whether a single token is available, consuming it if so
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
@@ -0,0 +1,33 @@
+package pppoeproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(1000, 100)
+	if !b.AllowN(100) {
+		t.Fatal("the initial burst is not available")
+	}
+	if b.Allow() {
+		t.Fatal("token available beyond the burst")
+	}
+	if d := b.delayN(50); d < 40*time.Millisecond || d > 50*time.Millisecond {
+		t.Fatalf("50 tokens at 1000/s available in %v", d)
+	}
+
+	// Tokens accumulate up to the burst
+	b.mu.Lock()
+	b.last = b.last.Add(-time.Second)
+	b.mu.Unlock()
+	if b.AllowN(101) {
+		t.Fatal("more tokens than the burst")
+	}
+	if d := b.delayN(100); d != 0 {
+		t.Fatalf("a full bucket delays by %v", d)
+	}
+	if b.AllowN(10) {
+		t.Fatal("tokens left after delayN consumed them")
+	}
+}
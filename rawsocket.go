@@ -0,0 +1,51 @@
+package pppoeproxy
+
+import "time"
+
+// RawSocket sends and receives the Ethernet frames of one ethertype on a
+// network interface. The packet handlers only use this interface, so they can
+// run on something else than a real interface, such as a FakeSegment.
+type RawSocket interface {
+	// Recv waits for the next frame and copies it, including its Ethernet
+	// header, into buf. It returns os.ErrClosed once the socket is closed.
+	Recv(buf []byte) (int, error)
+	// Send transmits a frame, including its Ethernet header
+	Send(frame []byte) error
+	// Close closes the socket, ending a pending Recv
+	Close() error
+}
+
+// timestampSocket is implemented by the raw sockets that know when a frame
+// was captured, from the kernel or the NIC, which is more accurate than when
+// Recv returned it
+type timestampSocket interface {
+	// RecvTimestamp is Recv also returning the capture time of the frame
+	RecvTimestamp(buf []byte) (int, time.Time, error)
+}
+
+// recvTimestamp receives a frame and its capture time, which is the current
+// time if the socket does not timestamp frames
+func recvTimestamp(sock RawSocket, buf []byte) (int, time.Time, error) {
+	if ts, ok := sock.(timestampSocket); ok {
+		return ts.RecvTimestamp(buf)
+	}
+	n, err := sock.Recv(buf)
+	return n, time.Now(), err
+}
+
+// OpenRawSocket opens a raw socket bound to interfaceName receiving the
+// frames of the given ethertype. The socket follows the interface: it is
+// re-bound when the interface comes back up after receiving failed, or when
+// the name is given to another interface (re-created or renamed), which Linux
+// reports with rtnetlink.
+//
+// interfaceName can also be a glob pattern such as "eth1.*": the socket then
+// receives the frames of every matching interface, including the interfaces
+// appearing later, and sends a frame on the interface its destination was
+// seen on, or on all of them.
+func OpenRawSocket(interfaceName string, ethertype uint16) (RawSocket, error) {
+	if IsInterfacePattern(interfaceName) {
+		return openPatternSocket(interfaceName, ethertype)
+	}
+	return openRebindingSocket(interfaceName, ethertype)
+}
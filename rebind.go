@@ -0,0 +1,216 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// interfaceRebinds counts the raw sockets re-bound after their interface
+// changed
+var interfaceRebinds = NewCounterVec("pppoeproxy_interface_rebinds_total", "Raw sockets re-bound after their interface went down, was re-created or renamed", "interface")
+
+// boundSocket is a raw socket with the index of the interface it is bound to
+type boundSocket struct {
+	RawSocket
+	index int
+}
+
+// rebindingSocket is a raw socket following the interface carrying a name.
+// When receiving fails, for example because the interface went down or was
+// removed, or when another interface takes the name, the socket is re-created
+// once the interface is up again, so forwarding resumes without a restart.
+type rebindingSocket struct {
+	name      string
+	proto     uint16
+	sock      atomic.Pointer[boundSocket]
+	received  atomic.Bool   // Set when a frame was received since the last rebind
+	changed   chan struct{} // Signaled when the link of the interface changed
+	closed    chan struct{}
+	closeOnce sync.Once
+	stopWatch func()
+
+	rebindMu   sync.Mutex // Serializes rebinds, protects the fields below
+	backoff    Backoff
+	lastRebind time.Time
+}
+
+// openBoundSocket opens a raw socket on the interface currently carrying name
+func openBoundSocket(name string, proto uint16) (*boundSocket, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("interface not found: %v", err)
+	}
+	sock, err := openPacketSocket(name, proto)
+	if err != nil {
+		return nil, err
+	}
+	return &boundSocket{RawSocket: sock, index: iface.Index}, nil
+}
+
+// openRebindingSocket opens a raw socket on interfaceName that is re-bound when
+// the interface changes
+func openRebindingSocket(interfaceName string, proto uint16) (RawSocket, error) {
+	sock, err := openBoundSocket(interfaceName, proto)
+	if err != nil {
+		return nil, err
+	}
+	s := &rebindingSocket{
+		name:    interfaceName,
+		proto:   proto,
+		changed: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+		backoff: Backoff{Min: 100 * time.Millisecond, Max: 10 * time.Second, Factor: 2, Jitter: 0.1},
+	}
+	s.sock.Store(sock)
+	s.stopWatch = watchLinks(s.linkChanged)
+	return s, nil
+}
+
+// Recv waits for the next frame, re-binding the socket when receiving fails
+func (s *rebindingSocket) Recv(buf []byte) (int, error) {
+	n, _, err := s.RecvTimestamp(buf)
+	return n, err
+}
+
+// RecvTimestamp is Recv also returning the capture time of the frame
+func (s *rebindingSocket) RecvTimestamp(buf []byte) (int, time.Time, error) {
+	for {
+		sock := s.sock.Load()
+		n, captured, err := recvTimestamp(sock.RawSocket, buf)
+		if err == nil {
+			s.received.Store(true)
+			return n, captured, nil
+		}
+		if s.isClosed() {
+			return 0, time.Time{}, os.ErrClosed
+		}
+		if !errors.Is(err, os.ErrClosed) {
+			// An os.ErrClosed socket was replaced by a rebind
+			log.Printf("Error receiving on %s, re-binding socket: %v", s.name, err)
+		}
+		if !s.rebind(sock) {
+			return 0, time.Time{}, os.ErrClosed
+		}
+	}
+}
+
+// Send injects a frame through the current socket
+func (s *rebindingSocket) Send(frame []byte) error {
+	return s.sock.Load().Send(frame)
+}
+
+// Close closes the socket, ending a pending Recv and any rebind in progress
+func (s *rebindingSocket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.stopWatch()
+		err = s.sock.Load().Close()
+	})
+	return err
+}
+
+// isClosed reports whether Close was called
+func (s *rebindingSocket) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// linkChanged is called by the link monitor when an interface is added,
+// removed or changes, or with index 0 when changes may have been missed. A
+// different interface now carrying our name, because ours was re-created or
+// renamed, is bound right away. Other changes wake up a rebind waiting for the
+// interface to come back.
+func (s *rebindingSocket) linkChanged(index int, name string, removed bool) {
+	sock := s.sock.Load()
+	if index == 0 {
+		iface, err := net.InterfaceByName(s.name)
+		if err != nil {
+			return
+		}
+		index, name = iface.Index, iface.Name
+	}
+	if name != s.name && index != sock.index {
+		return
+	}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	if name == s.name && index != sock.index && !removed {
+		go s.rebind(sock)
+	}
+}
+
+// rebind replaces old by a new socket once the interface is up, unless it was
+// already replaced. It returns false if the socket was closed meanwhile.
+func (s *rebindingSocket) rebind(old *boundSocket) bool {
+	s.rebindMu.Lock()
+	defer s.rebindMu.Unlock()
+	if s.sock.Load() != old {
+		return !s.isClosed()
+	}
+
+	// A socket failing again right away, without receiving anything, must
+	// not be re-created in a tight loop
+	if s.received.Swap(false) || time.Since(s.lastRebind) > s.backoff.Max {
+		s.backoff.Reset()
+	} else if !s.wait(s.backoff.Next()) {
+		return false
+	}
+
+	logged := false
+	for {
+		iface, err := net.InterfaceByName(s.name)
+		if err == nil && iface.Flags&net.FlagUp == 0 {
+			err = errors.New("interface is down")
+		}
+		if err == nil {
+			var sock *boundSocket
+			if sock, err = openBoundSocket(s.name, s.proto); err == nil {
+				s.sock.Store(sock)
+				old.Close()
+				if s.isClosed() {
+					// Close may have missed the new socket
+					sock.Close()
+					return false
+				}
+				s.lastRebind = time.Now()
+				interfaceRebinds.With(s.name).Inc()
+				log.Printf("Re-bound %04x socket to %s (index %d)", s.proto, s.name, sock.index)
+				return true
+			}
+		}
+		if !logged {
+			log.Printf("Waiting for %s to re-bind %04x socket: %v", s.name, s.proto, err)
+			logged = true
+		}
+		if !s.wait(s.backoff.Next()) {
+			return false
+		}
+	}
+}
+
+// wait waits for d or a link change, and returns false if the socket is
+// closed meanwhile
+func (s *rebindingSocket) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.closed:
+		return false
+	case <-s.changed:
+	case <-timer.C:
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package pppoeproxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// reconnectQueueMaxAge bounds how long a frame is kept while reconnecting:
+// PPPoE and PPP endpoints retransmit on their own after that
+const reconnectQueueMaxAge = 10 * time.Second
+
+// Reconnection queue metrics
+var (
+	reconnectQueued  = NewCounter("pppoeproxy_reconnect_queued_total", "Frames kept while reconnecting to the server")
+	reconnectFlushed = NewCounter("pppoeproxy_reconnect_flushed_total", "Frames kept while reconnecting and sent once reconnected")
+	reconnectDropped = NewCounter("pppoeproxy_reconnect_queue_dropped_total", "Frames kept while reconnecting and dropped because the queue was full or they expired")
+)
+
+// queuedFrame is a frame waiting for the tunnel to come back
+type queuedFrame struct {
+	packetType uint16
+	data       []byte
+	at         time.Time
+	control    bool // Discovery or PPP control frame
+}
+
+// reconnectQueue keeps the frames captured while the client is not connected
+// to the server, so a PADI or LCP request sent during a blip is not lost and
+// the endpoints do not wait for their retry timers
+type reconnectQueue struct {
+	mu      sync.Mutex
+	frames  []queuedFrame
+	control int // Number of control frames in frames
+}
+
+// push queues a copy of a frame. When the queue already holds max frames of
+// the same kind, the oldest is dropped to keep the latest retransmissions.
+func (q *reconnectQueue) push(packetType uint16, data []byte, control bool, max int) {
+	if max <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	count := q.control
+	if !control {
+		count = len(q.frames) - q.control
+	}
+	if count >= max {
+		for i, f := range q.frames {
+			if f.control == control {
+				q.frames = append(q.frames[:i], q.frames[i+1:]...)
+				reconnectDropped.Inc()
+				break
+			}
+		}
+	} else if control {
+		q.control++
+	}
+	q.frames = append(q.frames, queuedFrame{packetType: packetType, data: append([]byte(nil), data...), at: time.Now(), control: control})
+	reconnectQueued.Inc()
+}
+
+// len returns the number of frames waiting for the connection
+func (q *reconnectQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
+
+// take empties the queue and returns the frames that did not expire
+func (q *reconnectQueue) take() []queuedFrame {
+	q.mu.Lock()
+	frames := q.frames
+	q.frames, q.control = nil, 0
+	q.mu.Unlock()
+
+	var res []queuedFrame
+	for _, f := range frames {
+		if time.Since(f.at) > reconnectQueueMaxAge {
+			reconnectDropped.Inc()
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+// queueForReconnect keeps a frame captured while there is no server
+// connection. The caller holds serverMu, so the frame cannot miss the flush
+// of a connection being established.
+func (p *Proxy) queueForReconnect(packetType uint16, packet []byte) {
+	cfg := p.cfg()
+	if packetType == PacketTypeDiscovery {
+		p.reconnectQueue.push(packetType, packet, true, cfg.ReconnectQueue)
+		return
+	}
+	if info := decodeFrame(packet); info.HasPPP && isControlProtocol(info.Protocol) {
+		p.reconnectQueue.push(packetType, packet, true, cfg.ReconnectQueue)
+	} else {
+		p.reconnectQueue.push(packetType, packet, false, cfg.ReconnectQueueData)
+	}
+}
+
+// flushReconnectQueue sends the frames kept while reconnecting to the new
+// server connection. The caller holds serverMu.
+func (p *Proxy) flushReconnectQueue(server *Client) {
+	frames := p.reconnectQueue.take()
+	if len(frames) == 0 {
+		return
+	}
+	for _, f := range frames {
+		p.queueFrame(server, txFrame{packetType: f.packetType, data: f.data, control: f.control})
+		reconnectFlushed.Inc()
+	}
+	log.Printf("Sent %d frame(s) captured while reconnecting", len(frames))
+}
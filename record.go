@@ -0,0 +1,235 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recording file format: the 8-byte magic below followed by one record per
+// frame made of the capture time in nanoseconds since the Unix epoch
+// (uint64), the direction (uint8, 0 for rx and 1 for tx), the tunnel packet
+// type (uint16), the frame length (uint32) and the frame itself. All integers
+// are big endian.
+const recordMagic = "PPPOREC1"
+
+// recordHeaderSize is the size of the fixed part of a record
+const recordHeaderSize = 8 + 1 + 2 + 4
+
+// recordFlushInterval bounds how many recorded frames are lost on a crash
+const recordFlushInterval = time.Second
+
+// Recorder writes the frames going through the tunnel to a file, so they can
+// be replayed later with "pppoeproxy replay"
+type Recorder struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	err    error // First write error, recording stops after it
+	done   chan struct{}
+	frames uint64
+}
+
+// NewRecorder opens the recording file. Frames are appended to an existing
+// recording, so restarts (e.g. after an update) continue the same recording.
+func NewRecorder(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %v", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open recording: %v", err)
+	}
+	r := &Recorder{
+		f:    f,
+		w:    bufio.NewWriterSize(f, 65536),
+		done: make(chan struct{}),
+	}
+	if st.Size() == 0 {
+		if _, err := r.w.WriteString(recordMagic); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to write recording: %v", err)
+		}
+	} else if err := repairRecording(f, st.Size()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	go r.flushLoop()
+	return r, nil
+}
+
+// repairRecording checks the header of an existing recording and truncates a
+// record left incomplete by a crash, so new records are not misaligned
+func repairRecording(f *os.File, size int64) error {
+	if _, err := NewRecordingReader(io.NewSectionReader(f, 0, int64(len(recordMagic)))); err != nil {
+		return err
+	}
+
+	var hdr [recordHeaderSize]byte
+	off := int64(len(recordMagic))
+	for off+recordHeaderSize <= size {
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			return err
+		}
+		next := off + recordHeaderSize + int64(binary.BigEndian.Uint32(hdr[11:15]))
+		if next > size {
+			break
+		}
+		off = next
+	}
+	if off < size {
+		log.Printf("Discarding %d bytes of incomplete record at the end of %s", size-off, f.Name())
+		return f.Truncate(off)
+	}
+	return nil
+}
+
+// Record appends a frame to the recording. direction is DirectionRx for
+// frames captured on the interface and sent into the tunnel, DirectionTx for
+// frames received from the tunnel and injected. A nil Recorder does nothing.
+func (r *Recorder) Record(direction string, packetType uint16, frame []byte) {
+	if r == nil {
+		return
+	}
+
+	var hdr [recordHeaderSize]byte
+	binary.BigEndian.PutUint64(hdr[0:8], uint64(time.Now().UnixNano()))
+	if direction == DirectionTx {
+		hdr[8] = 1
+	}
+	binary.BigEndian.PutUint16(hdr[9:11], packetType)
+	binary.BigEndian.PutUint32(hdr[11:15], uint32(len(frame)))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.w.Write(hdr[:])
+	if _, err := r.w.Write(frame); err != nil {
+		r.err = err
+		log.Printf("Error writing recording, recording stopped: %v", err)
+		return
+	}
+	r.frames++
+}
+
+// Middleware returns a middleware stage recording the frames going through
+// it, to capture them at a given point of the chain
+func (r *Recorder) Middleware() Middleware {
+	return func(direction string, packet []byte) ([]byte, bool) {
+		packetType := uint16(PacketTypeSession)
+		if ethertype, _ := framePayload(packet); ethertype == PPPoEDiscovery {
+			packetType = PacketTypeDiscovery
+		}
+		r.Record(direction, packetType, packet)
+		return packet, true
+	}
+}
+
+// flushLoop periodically writes buffered frames to the file
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(recordFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if r.err == nil {
+				if err := r.w.Flush(); err != nil {
+					r.err = err
+					log.Printf("Error writing recording, recording stopped: %v", err)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// Close flushes and closes the recording. Frames recorded afterwards are
+// ignored.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == os.ErrClosed {
+		return nil
+	}
+	close(r.done)
+	err := r.err
+	if err == nil {
+		err = r.w.Flush()
+	}
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.err = os.ErrClosed
+	log.Printf("Recorded %d frames to %s", r.frames, r.f.Name())
+	return err
+}
+
+// RecordedFrame is a frame read back from a recording
+type RecordedFrame struct {
+	Time      time.Time // Capture time
+	Direction string    // DirectionRx or DirectionTx
+	Type      uint16    // Tunnel packet type
+	Data      []byte    // Ethernet frame
+}
+
+// RecordingReader reads the frames of a recording in order
+type RecordingReader struct {
+	r *bufio.Reader
+}
+
+// NewRecordingReader checks the recording header and returns a reader for its frames
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordMagic {
+		return nil, errors.New("not a pppoeproxy recording")
+	}
+	return &RecordingReader{r: br}, nil
+}
+
+// Next returns the next frame, or io.EOF at the end of the recording
+func (rr *RecordingReader) Next() (RecordedFrame, error) {
+	var hdr [recordHeaderSize]byte
+	if _, err := io.ReadFull(rr.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// The recording was cut while a header was being written
+			return RecordedFrame{}, io.EOF
+		}
+		return RecordedFrame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(hdr[11:15])
+	if length > maxPacketSize {
+		return RecordedFrame{}, fmt.Errorf("corrupt recording: %d bytes frame", length)
+	}
+	frame := RecordedFrame{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:8]))),
+		Direction: DirectionRx,
+		Type:      binary.BigEndian.Uint16(hdr[9:11]),
+		Data:      make([]byte, length),
+	}
+	if hdr[8] == 1 {
+		frame.Direction = DirectionTx
+	}
+	if _, err := io.ReadFull(rr.r, frame.Data); err != nil {
+		return RecordedFrame{}, io.EOF
+	}
+	return frame, nil
+}
@@ -0,0 +1,99 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+)
+
+// Reasons the proxy refuses discovery requests
+const (
+	RefuseNoTunnel    = "no-tunnel"    // No tunnel to the AC, and the request is not kept until there is one
+	RefuseMaxSessions = "max-sessions" // The tunnel client reached the number of sessions of its policy
+)
+
+const (
+	// refusalRate is the number of refusals sent per second at most, so
+	// a flood of requests is not answered in kind
+	refusalRate = 10
+
+	// refusalACName is the AC-Name of the PADOs refusing a PADI
+	refusalACName = "pppoeproxy"
+)
+
+// discoveryRefused counts the discovery requests answered with a Generic-Error
+var discoveryRefused = NewCounterVec("pppoeproxy_discovery_refused_total", "Discovery requests the proxy answered with a Generic-Error tag instead of forwarding them", "reason")
+
+// buildRefusal builds the answer to a PADI or PADR the proxy refuses: a PADO
+// from src, or a PADS with session ID 0 from the AC the PADR was sent to,
+// with the Service-Name, Host-Uniq and Relay-Session-Id tags of the request
+// and message in a Generic-Error tag. It returns nil for other frames, and
+// for a PADI without src.
+func buildRefusal(request []byte, src net.HardwareAddr, message string) []byte {
+	f, err := parsePPPoE(request)
+	if err != nil || f.EtherType != PPPoEDiscovery || f.Code != PADI && f.Code != PADR || f.Code == PADI && len(src) != 6 {
+		return nil
+	}
+
+	var tags []pppoeTag
+	for _, tag := range f.Tags {
+		switch tag.Type {
+		case TagServiceName, TagHostUniq, TagRelaySessionID:
+			tags = append(tags, tag)
+		}
+	}
+	_, off := framePayload(request)
+	resp := append([]byte(nil), request[:off+pppoeHeaderSize]...)
+	copy(resp[0:6], f.Src)
+	if f.Code == PADI {
+		copy(resp[6:12], src)
+		resp[off+1] = PADO
+		tags = append(tags, pppoeTag{TagACName, []byte(refusalACName)})
+	} else {
+		copy(resp[6:12], f.Dst)
+		resp[off+1] = PADS
+	}
+	binary.BigEndian.PutUint16(resp[off+2:off+4], 0)
+	tags = append(tags, pppoeTag{TagGenericError, []byte(message)})
+	return rebuildDiscovery(resp, tags)
+}
+
+// refuseDiscovery answers a PADI or PADR the proxy does not forward with a
+// Generic-Error tag giving the reason, so the host logs why it gets no
+// session. The answer is sent to the tunnel client the request came from, or
+// injected on the interface if from is nil. Nothing is sent without
+// DiscoveryErrors, or beyond refusalRate.
+func (p *Proxy) refuseDiscovery(from *Client, request []byte, reason, message string) {
+	if !p.cfg().DiscoveryErrors || !p.refusals.Allow() {
+		return
+	}
+	var src net.HardwareAddr // Only needed for a PADO
+	if off := pppoeOffset(request); len(request) > off+1 && request[off+1] == PADI {
+		src = p.refusalSource()
+	}
+	resp := buildRefusal(request, src, message)
+	if resp == nil {
+		return
+	}
+	discoveryRefused.With(reason).Inc()
+	if from != nil {
+		p.queueFrame(from, newTxFrame(PacketTypeDiscovery, resp, time.Time{}))
+		return
+	}
+	p.discoveryHandler.InjectPacket(resp)
+}
+
+// refusalSource returns the source address of the PADOs refusing a PADI: the
+// last AC seen, or the address of the interface before any was
+func (p *Proxy) refusalSource() net.HardwareAddr {
+	if mac := p.endpoints.latest(RoleAC); mac != nil {
+		return mac
+	}
+	ifi, err := net.InterfaceByName(p.cfg().Interface)
+	if err != nil {
+		log.Printf("Cannot get the address of %s for refusals: %v", p.cfg().Interface, err)
+		return nil
+	}
+	return ifi.HardwareAddr
+}
@@ -0,0 +1,175 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// peakInterval is the interval the peak rates are measured over
+const peakInterval = time.Second
+
+// reportTypes lists the frame types of the report, with their direction
+var reportTypes = [][2]string{
+	{"discovery", DirectionRx}, {"discovery", DirectionTx},
+	{"session", DirectionRx}, {"session", DirectionTx},
+}
+
+// peakRates tracks the highest frame and byte rates of each frame type and
+// direction
+type peakRates struct {
+	mu                    sync.Mutex
+	frames, bytes         [4]uint64 // Highest per peakInterval, in the order of reportTypes
+	lastFrames, lastBytes [4]uint64
+}
+
+// sample accounts for the counters at the end of an interval
+func (r *peakRates) sample() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, t := range reportTypes {
+		frames, bytes := framesTotal.With(t[0], t[1]).Value(), bytesTotal.With(t[0], t[1]).Value()
+		r.frames[i] = max(r.frames[i], frames-r.lastFrames[i])
+		r.bytes[i] = max(r.bytes[i], bytes-r.lastBytes[i])
+		r.lastFrames[i], r.lastBytes[i] = frames, bytes
+	}
+}
+
+// trackPeaks samples the peak rates until the proxy is closed
+func (p *Proxy) trackPeaks() {
+	p.peaks.sample()
+	// Traffic before the first sample does not fit an interval
+	p.peaks.mu.Lock()
+	p.peaks.frames, p.peaks.bytes = [4]uint64{}, [4]uint64{}
+	p.peaks.mu.Unlock()
+
+	ticker := time.NewTicker(peakInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closedCh:
+			return
+		case <-ticker.C:
+			p.peaks.sample()
+		}
+	}
+}
+
+// reportDrops lists the counters of dropped frames in the report, by source
+var reportDrops = []struct {
+	name string
+	vec  *CounterVec
+}{
+	{"strict parser", framesRejected},
+	{"session filter", sessionFiltered},
+	{"PPP filter", pppFiltered},
+	{"AC-Cookie", cookiesRejected},
+	{"middleware", middlewareDropped},
+	{"client policy", clientLimited},
+	{"link down", linkDownDrops},
+	{"full queue", queueDrops},
+	{"session shaping", sessionShaped},
+	{"chaos", chaosFaults},
+}
+
+// WriteReport writes a human-readable summary of the activity of the proxy
+// since it started: frames and bytes forwarded with their peak rates, frames
+// dropped by reason, sessions and their durations, tunnel connections and
+// errors. Counters are shared by the proxies of a process.
+func (p *Proxy) WriteReport(w io.Writer) error {
+	st := p.Status()
+	fmt.Fprintf(w, "Statistics of %s in %s mode on %s\n\n", st.Uptime.Round(time.Second), st.Mode, st.Interface)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "TYPE\tDIRECTION\tFRAMES\tBYTES\tPEAK FRAMES/S\tPEAK BIT/S\n")
+	p.peaks.mu.Lock()
+	for i, t := range reportTypes {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%s\n", t[0], t[1], framesTotal.With(t[0], t[1]).Value(), bytesTotal.With(t[0], t[1]).Value(),
+			p.peaks.frames[i], formatBitRate(float64(p.peaks.bytes[i]*8)/peakInterval.Seconds()))
+	}
+	p.peaks.mu.Unlock()
+
+	fmt.Fprintf(tw, "\nDROPPED\tREASON\tFRAMES\n")
+	drops := 0
+	for _, d := range reportDrops {
+		for _, v := range d.vec.values() {
+			if d.vec == chaosFaults && v.labels != "fault=drop" || d.vec == sessionShaped && v.labels != "result=dropped" {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\n", d.name, v.labels, v.value)
+			drops++
+		}
+	}
+	for _, d := range []struct {
+		name string
+		c    *Counter
+	}{{"reconnect queue", reconnectDropped}, {"latency emulation", latencyDrops}} {
+		if n := d.c.Value(); n > 0 {
+			fmt.Fprintf(tw, "%s\t-\t%d\n", d.name, n)
+			drops++
+		}
+	}
+	if drops == 0 {
+		fmt.Fprintf(tw, "none\n")
+	}
+
+	ss := p.sessions.stats()
+	fmt.Fprintf(tw, "\nsessions established:\t%d\n", ss.established)
+	fmt.Fprintf(tw, "sessions active:\t%d\n", st.Sessions)
+	if ss.ended > 0 {
+		fmt.Fprintf(tw, "sessions ended:\t%d, lasting min %s, avg %s, max %s\n", ss.ended,
+			ss.min.Round(time.Second), (ss.total / time.Duration(ss.ended)).Round(time.Second), ss.max.Round(time.Second))
+	} else {
+		fmt.Fprintf(tw, "sessions ended:\t0\n")
+	}
+	fmt.Fprintf(tw, "tunnel connections:\t%d\n", p.connections.Load())
+	if !p.isServer {
+		fmt.Fprintf(tw, "reconnect attempts:\t%d (%d failed)\n", reconnectAttempts.Value(), reconnectFailures.Value())
+	}
+	fmt.Fprintf(tw, "dead peers:\t%d\n", deadPeers.Value())
+	fmt.Fprintf(tw, "write timeouts:\t%d\n", writeTimeouts.Value())
+	errs := make([]string, 0, len(errorKinds))
+	for _, kind := range errorKinds {
+		errs = append(errs, fmt.Sprintf("%s=%d", kind, errorsTotal.With(kind).Value()))
+	}
+	fmt.Fprintf(tw, "errors:\t%s\n", strings.Join(errs, " "))
+	return tw.Flush()
+}
+
+// formatBitRate formats a rate in bits per second with the suffixes of
+// ParseBitRate
+func formatBitRate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.1fG", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.1fM", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.1fk", bps/1e3)
+	}
+	return fmt.Sprintf("%.0f", bps)
+}
+
+// counterValue is a counter of a set, with its labels as "name=value" pairs
+type counterValue struct {
+	labels string
+	value  uint64
+}
+
+// values returns the nonzero counters of the set, sorted by labels
+func (v *CounterVec) values() []counterValue {
+	v.f.mu.Lock()
+	var res []counterValue
+	for key, m := range v.f.series {
+		if n := m.(*Counter).Value(); n > 0 {
+			res = append(res, counterValue{strings.ReplaceAll(strings.ReplaceAll(key, `"`, ""), ",", " "), n})
+		}
+	}
+	v.f.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].labels < res[j].labels })
+	return res
+}
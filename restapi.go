@@ -0,0 +1,481 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminAPIConfig holds the settings of the REST admin API
+type AdminAPIConfig struct {
+	Addr         string // Address to listen on
+	CertFile     string // TLS certificate
+	KeyFile      string // TLS private key
+	ClientCAFile string // CA bundle used to authenticate client certificates (mTLS)
+	TokenFile    string // File with one accepted bearer token per line
+
+	// Validates bearer tokens issued by an OAuth/OIDC provider, accepted in
+	// addition to TokenFile (nil disables)
+	JWT *JWTValidator
+
+	// Reject connections without a certificate signed by ClientCAFile, so
+	// tokens alone do not give access
+	RequireClientCert bool
+
+	// Automatic certificate (ACME) instead of CertFile and KeyFile
+	ACMEDomain    string // Domain to obtain the certificate for (empty disables)
+	ACMEEmail     string // Contact address registered with the certificate authority (optional)
+	ACMECache     string // Directory the ACME account key and certificates are kept in
+	ACMEDirectory string // Directory URL of the certificate authority (empty for Let's Encrypt)
+}
+
+// AdminAPI serves management operations over HTTPS. Every request must be
+// authenticated with a bearer token or, when a client CA is configured, a
+// client certificate.
+type AdminAPI struct {
+	proxy  *Proxy
+	reload func()
+	update func(map[string]string) ([]string, error)
+	tokens [][]byte
+	jwt    *JWTValidator
+	mtls   bool
+	server *http.Server
+}
+
+// NewAdminAPI starts the REST admin API. reload is invoked to reload the
+// configuration file and update to change runtime-tunable settings.
+func NewAdminAPI(config AdminAPIConfig, proxy *Proxy, reload func(), update func(map[string]string) ([]string, error)) (*AdminAPI, error) {
+	if config.ACMEDomain == "" && (config.CertFile == "" || config.KeyFile == "") {
+		return nil, errors.New("the admin API requires a TLS certificate and key")
+	}
+	if config.ClientCAFile == "" && config.TokenFile == "" && config.JWT == nil {
+		return nil, errors.New("the admin API requires a token file, JWT validation or a client CA")
+	}
+	if config.RequireClientCert && config.ClientCAFile == "" {
+		return nil, errors.New("requiring admin API client certificates needs a client CA")
+	}
+
+	a := &AdminAPI{proxy: proxy, reload: reload, update: update, jwt: config.JWT}
+
+	var tlsConfig *tls.Config
+	var err error
+	if config.ACMEDomain != "" {
+		if tlsConfig, err = acmeTLSConfig(config); err != nil {
+			return nil, err
+		}
+	} else {
+		certs, err := newCertReloader(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load admin API certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	if config.ClientCAFile != "" {
+		pool, err := loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin API client CA: %v", err)
+		}
+		tlsConfig.ClientCAs = pool
+		// Token authentication remains possible, so certificates are only
+		// verified when presented
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		a.mtls = true
+	}
+	if config.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		if config.ACMEDomain != "" {
+			allowACMEChallenge(tlsConfig)
+		}
+	}
+
+	if config.TokenFile != "" {
+		if a.tokens, err = loadTokens(config.TokenFile); err != nil {
+			return nil, err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/status", a.handleStatus)
+	mux.HandleFunc("GET /api/v1/dump", a.handleDump)
+	mux.HandleFunc("GET /api/v1/report", a.handleReport)
+	mux.HandleFunc("GET /api/v1/trace", a.handleTrace)
+	mux.HandleFunc("GET /api/v1/sessions", a.handleSessions)
+	mux.HandleFunc("DELETE /api/v1/sessions/{id}", a.handleTerminate)
+	mux.HandleFunc("GET /api/v1/journal", a.handleJournal)
+	mux.HandleFunc("POST /api/v1/inject", a.handleInject)
+	mux.HandleFunc("GET /api/v1/clients", a.handleClients)
+	mux.HandleFunc("DELETE /api/v1/clients/{addr}", a.handleKick)
+	mux.HandleFunc("GET /api/v1/acl", a.handleGetACL)
+	mux.HandleFunc("PUT /api/v1/acl", a.handleSetACL)
+	mux.HandleFunc("PATCH /api/v1/config", a.handleConfig)
+	mux.HandleFunc("POST /api/v1/reload", a.handleReload)
+
+	l, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for admin API: %v", err)
+	}
+
+	a.server = &http.Server{
+		Handler:           a.authenticate(mux),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.Default(),
+	}
+	go func() {
+		if err := a.server.ServeTLS(l, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin API server error: %v", err)
+		}
+	}()
+	log.Printf("Admin API listening on https://%s", l.Addr())
+	return a, nil
+}
+
+// Close stops the admin API
+func (a *AdminAPI) Close() error {
+	return a.server.Close()
+}
+
+// loadTokens reads the accepted bearer tokens, one per line. Empty lines and
+// lines starting with # are ignored.
+func loadTokens(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open admin API token file: %v", err)
+	}
+	defer f.Close()
+
+	var tokens [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, []byte(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read admin API token file: %v", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", path)
+	}
+	return tokens, nil
+}
+
+// authenticate rejects requests without a verified client certificate or a
+// valid bearer token
+func (a *AdminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.mtls && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reason := "no credentials"
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			for _, t := range a.tokens {
+				if subtle.ConstantTimeCompare([]byte(token), t) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			reason = "unknown token"
+			if a.jwt != nil {
+				_, err := a.jwt.Validate(r.Context(), token)
+				if err == nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+				reason = err.Error()
+			}
+		}
+
+		a.proxy.reportError(ErrorAuth, r.RemoteAddr, fmt.Errorf("unauthenticated admin API request %s %s: %s", r.Method, r.URL.Path, reason))
+		log.Printf("Admin API: rejected unauthenticated %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, reason)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pppoeproxy"`)
+		writeJSONError(w, http.StatusUnauthorized, errors.New("authentication required"))
+	})
+}
+
+// writeJSON sends v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError sends an error response
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *AdminAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.proxy.Status())
+}
+
+func (a *AdminAPI) handleDump(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.proxy.Dump())
+}
+
+func (a *AdminAPI) handleReport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	a.proxy.WriteReport(w)
+}
+
+func (a *AdminAPI) handleTrace(w http.ResponseWriter, r *http.Request) {
+	cfg := a.proxy.cfg()
+	if cfg.Tracer == nil {
+		writeJSONError(w, http.StatusNotFound, errors.New("the frame trace is not enabled"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Content-Disposition", `attachment; filename="pppoeproxy-trace.pcapng"`)
+	cfg.Tracer.WritePcapng(w, cfg.Interface)
+}
+
+// apiSession is the JSON representation of a session
+type apiSession struct {
+	ID       uint16    `json:"id"`
+	HostMAC  string    `json:"host_mac"`
+	ACMAC    string    `json:"ac_mac"`
+	Owner    string    `json:"owner,omitempty"`
+	Started  time.Time `json:"started"`
+	LastSeen time.Time `json:"last_seen"`
+	IP       string    `json:"ip,omitempty"` // Assigned to the host by IPCP
+	FramesRx uint64    `json:"frames_rx"`
+	FramesTx uint64    `json:"frames_tx"`
+	BytesRx  uint64    `json:"bytes_rx"`
+	BytesTx  uint64    `json:"bytes_tx"`
+
+	AuthProtocol string `json:"auth_protocol,omitempty"` // PAP or CHAP, once the AC sent a result
+	AuthSuccess  bool   `json:"auth_success"`
+	AuthFailures uint64 `json:"auth_failures"`
+
+	Renegotiations uint64 `json:"renegotiations"` // LCP or IPCP negotiations after the session came up
+}
+
+// newAPISession returns the JSON representation of a session
+func newAPISession(s SessionInfo) apiSession {
+	ses := apiSession{
+		ID:       s.ID,
+		HostMAC:  s.HostMAC.String(),
+		ACMAC:    s.ACMAC.String(),
+		Owner:    s.Owner,
+		Started:  s.Started,
+		LastSeen: s.LastSeen,
+		FramesRx: s.FramesRx,
+		FramesTx: s.FramesTx,
+		BytesRx:  s.BytesRx,
+		BytesTx:  s.BytesTx,
+
+		AuthProtocol: s.AuthProtocol,
+		AuthSuccess:  s.AuthSuccess,
+		AuthFailures: s.AuthFailures,
+
+		Renegotiations: s.Renegotiations,
+	}
+	if s.IP.IsValid() {
+		ses.IP = s.IP.String()
+	}
+	return ses
+}
+
+func (a *AdminAPI) handleSessions(w http.ResponseWriter, r *http.Request) {
+	res := []apiSession{}
+	for _, s := range a.proxy.Sessions() {
+		res = append(res, newAPISession(s))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// handleTerminate ends the session given in the path; the "ac" query
+// parameter selects the access concentrator when the ID is ambiguous, and
+// along with "host" allows terminating an untracked session
+func (a *AdminAPI) handleTerminate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 0, 16)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid session ID %q", r.PathValue("id")))
+		return
+	}
+	var ac net.HardwareAddr
+	if v := r.URL.Query().Get("ac"); v != "" {
+		if ac, err = net.ParseMAC(v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid MAC address %q", v))
+			return
+		}
+	}
+
+	if v := r.URL.Query().Get("host"); v != "" {
+		host, err := net.ParseMAC(v)
+		if err != nil || ac == nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid host MAC address %q, or no AC MAC address", v))
+			return
+		}
+		if err := a.proxy.KillSessionByMAC(uint16(id), host, ac); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := a.proxy.KillSession(uint16(id), ac); err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleJournal returns the session events of the journal, optionally
+// between the RFC 3339 times given by the "since" and "until" query parameters
+func (a *AdminAPI) handleJournal(w http.ResponseWriter, r *http.Request) {
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *t, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid %s time %q", name, v))
+			return
+		}
+	}
+
+	if a.proxy.cfg().JournalFile == "" {
+		writeJSONError(w, http.StatusNotFound, errors.New("the session journal is not enabled"))
+		return
+	}
+	entries, err := a.proxy.Journal(since, until)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// apiInject is the JSON request injecting a diagnostic frame
+type apiInject struct {
+	Frame    string `json:"frame"`              // Ethernet frame, starting with the destination MAC address
+	Encoding string `json:"encoding,omitempty"` // "hex" (default, spaces and colons allowed) or "base64"
+	Side     string `json:"side"`               // InjectInterface or InjectTunnel
+	Peer     string `json:"peer,omitempty"`     // Tunnel peer address (tunnel side, empty for all)
+}
+
+// handleInject injects the diagnostic frame of the request. Every attempt is
+// logged for auditing.
+func (a *AdminAPI) handleInject(w http.ResponseWriter, r *http.Request) {
+	var req apiInject
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+
+	var frame []byte
+	var err error
+	switch req.Encoding {
+	case "", "hex":
+		frame, err = hex.DecodeString(strings.NewReplacer(" ", "", ":", "", "\n", "").Replace(req.Frame))
+	case "base64":
+		frame, err = base64.StdEncoding.DecodeString(req.Frame)
+	default:
+		err = fmt.Errorf("unknown encoding %q", req.Encoding)
+	}
+	if err != nil {
+		log.Printf("Audit: admin API client %s failed to inject a frame on the %s: %v", requestIdentity(r), req.Side, err)
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid frame: %v", err))
+		return
+	}
+
+	desc, err := a.proxy.InjectFrame(req.Side, req.Peer, frame)
+	if err != nil {
+		log.Printf("Audit: admin API client %s failed to inject a frame on the %s: %v (frame %x)", requestIdentity(r), req.Side, err, frame)
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	log.Printf("Audit: admin API client %s injected a %d byte frame on the %s: %s (frame %x)", requestIdentity(r), len(frame), req.Side, desc, frame)
+	writeJSON(w, http.StatusOK, map[string]string{"injected": desc})
+}
+
+// requestIdentity describes the client of an admin API request for audit
+// logs: its address and the subject of its certificate, if any
+func requestIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return fmt.Sprintf("%s (%s)", r.RemoteAddr, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	return r.RemoteAddr
+}
+
+func (a *AdminAPI) handleClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.proxy.Peers())
+}
+
+func (a *AdminAPI) handleKick(w http.ResponseWriter, r *http.Request) {
+	if err := a.proxy.KickClient(r.PathValue("addr")); err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiACL is the JSON representation of the tunnel access list
+type apiACL struct {
+	Allow string `json:"allow"`
+}
+
+func (a *AdminAPI) handleGetACL(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, apiACL{Allow: a.proxy.cfg().AllowedIP})
+}
+
+func (a *AdminAPI) handleSetACL(w http.ResponseWriter, r *http.Request) {
+	var acl apiACL
+	if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	if _, err := a.update(map[string]string{"allow": acl.Allow}); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiACL{Allow: a.proxy.cfg().AllowedIP})
+}
+
+// handleConfig changes runtime-tunable settings given as a JSON object
+// mapping option names to values
+func (a *AdminAPI) handleConfig(w http.ResponseWriter, r *http.Request) {
+	var settings map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	changed, err := a.update(settings)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if changed == nil {
+		changed = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"changed": changed})
+}
+
+func (a *AdminAPI) handleReload(w http.ResponseWriter, r *http.Request) {
+	a.reload()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+)
+
+// pingEpoch is the reference point for ping timestamps. Timestamps are only
+// interpreted by the side that sent them, so a monotonic offset is enough.
+var pingEpoch = time.Now()
+
+// Tunnel RTT metrics
+var (
+	rttCurrent = NewGauge("pppoeproxy_tunnel_rtt_seconds", "Most recent tunnel round-trip time")
+	rttAverage = NewGauge("pppoeproxy_tunnel_rtt_avg_seconds", "Moving average of the tunnel round-trip time")
+	rttMaximum = NewGauge("pppoeproxy_tunnel_rtt_max_seconds", "Maximum tunnel round-trip time observed")
+)
+
+// rttStats tracks round-trip times measured on a tunnel connection
+type rttStats struct {
+	mu      sync.Mutex
+	current time.Duration
+	avg     time.Duration
+	max     time.Duration
+	samples uint64
+}
+
+// update records a new RTT sample
+func (s *rttStats) update(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.current = rtt
+	if s.samples == 0 {
+		s.avg = rtt
+	} else {
+		// Exponentially weighted moving average, alpha = 1/8 (as in TCP SRTT)
+		s.avg += (rtt - s.avg) / 8
+	}
+	if rtt > s.max {
+		s.max = rtt
+	}
+	s.samples++
+}
+
+// get returns the current, average and maximum RTT
+func (s *rttStats) get() (current, avg, max time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current, s.avg, s.max
+}
+
+// pingPayload builds the payload of a ping packet carrying the send timestamp
+func pingPayload() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(time.Since(pingEpoch)))
+	return buf
+}
+
+// handlePong computes the RTT from the timestamp echoed in a pong packet
+func (p *Proxy) handlePong(client *Client, data []byte) {
+	client.pending.Store(0)
+
+	if len(data) != 8 {
+		// Peer did not echo a timestamp
+		log.Printf("Received pong from %s", client.remoteAddr)
+		return
+	}
+
+	sent := time.Duration(binary.BigEndian.Uint64(data))
+	rtt := time.Since(pingEpoch) - sent
+	if rtt < 0 {
+		return
+	}
+
+	client.rtt.update(rtt)
+	current, avg, max := client.rtt.get()
+	rttCurrent.Set(current.Seconds())
+	rttAverage.Set(avg.Seconds())
+	rttMaximum.Set(max.Seconds())
+
+	if warn := p.cfg().RTTWarn; warn > 0 && rtt > warn {
+		log.Printf("Warning: tunnel RTT to %s is %s (threshold %s, avg %s)", client.remoteAddr, rtt, warn, avg)
+	} else {
+		log.Printf("Received pong from %s, RTT %s", client.remoteAddr, rtt)
+	}
+}
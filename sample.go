@@ -0,0 +1,125 @@
+package pppoeproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sampling metrics
+var (
+	samplesExported = NewCounter("pppoeproxy_samples_exported_total", "Flow records of sampled frames exported")
+	samplesFailed   = NewCounter("pppoeproxy_samples_failed_total", "Flow records of sampled frames that could not be exported")
+)
+
+// SampleRecord is the flow record exported for a sampled frame, as one JSON
+// object per line (or per datagram for a UDP collector)
+type SampleRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`          // DirectionRx or DirectionTx
+	Type      string    `json:"type"`               // "discovery" or "session"
+	Code      string    `json:"code"`               // PPPoE code, SESSION for session frames
+	Session   uint16    `json:"session"`            // PPPoE session ID
+	Protocol  string    `json:"protocol,omitempty"` // PPP protocol of session frames
+	Size      int       `json:"size"`               // Frame length including the Ethernet header
+	Rate      int       `json:"rate"`               // One in Rate frames is sampled
+}
+
+// Sampler exports a flow record for one in every N frames going through the
+// proxy, giving an idea of the traffic without the cost of recording it all
+type Sampler struct {
+	rate    uint64
+	count   atomic.Uint64
+	mu      sync.Mutex
+	w       io.WriteCloser
+	dest    string
+	failing bool // Set after a write error, until a write succeeds
+}
+
+// NewSampler creates a sampler exporting the records of one in rate frames to
+// dest: a file the records are appended to, or "udp:host:port" for a
+// collector receiving one record per datagram
+func NewSampler(rate int, dest string) (*Sampler, error) {
+	if rate <= 0 {
+		return nil, errors.New("the sampling rate must be positive")
+	}
+	s := &Sampler{rate: uint64(rate), dest: dest}
+	if addr, ok := strings.CutPrefix(dest, "udp:"); ok {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open sample collector: %v", err)
+		}
+		s.w = conn
+		return s, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sample file: %v", err)
+	}
+	s.w = f
+	return s, nil
+}
+
+// Sample exports the record of a frame going in direction if it is one of
+// the sampled frames. A nil Sampler does nothing.
+func (s *Sampler) Sample(direction string, packet []byte) {
+	if s == nil || s.count.Add(1)%s.rate != 0 {
+		return
+	}
+
+	info := decodeFrame(packet)
+	rec := SampleRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Type:      "session",
+		Code:      pppoeCodeName(info.Code),
+		Session:   info.Session,
+		Size:      len(packet),
+		Rate:      int(s.rate),
+	}
+	if info.EtherType == PPPoEDiscovery {
+		rec.Type = "discovery"
+	}
+	if info.HasPPP {
+		rec.Protocol = pppProtocolName(info.Protocol)
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(line); err != nil {
+		samplesFailed.Inc()
+		if !s.failing {
+			s.failing = true
+			log.Printf("Error exporting sampled frames to %s: %v", s.dest, err)
+		}
+		return
+	}
+	if s.failing {
+		s.failing = false
+		log.Printf("Exporting sampled frames to %s again", s.dest)
+	}
+	samplesExported.Inc()
+}
+
+// Close closes the file or collector connection. A nil Sampler does nothing.
+func (s *Sampler) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
@@ -0,0 +1,98 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// sequenceHeaderSize is the size of the header of a PacketTypeSequenced
+// payload: the sequence number (uint32) and the packet type of the frame
+// (uint16), both big endian
+const sequenceHeaderSize = 4 + 2
+
+// Sequence number metrics, counted by the receiver of sequenced frames
+var (
+	seqMissing   = NewCounter("pppoeproxy_tunnel_seq_missing_total", "Sequenced frames from tunnel peers skipped in the sequence (lost, or late and then also counted as reordered)")
+	seqReordered = NewCounter("pppoeproxy_tunnel_seq_reordered_total", "Sequenced frames from tunnel peers received after a later frame")
+)
+
+// seqTracker follows the sequence numbers received on a tunnel connection.
+// It is only used by the goroutine reading the connection.
+type seqTracker struct {
+	started bool
+	next    uint32 // Sequence number expected next
+}
+
+// observe accounts for a received sequence number
+func (t *seqTracker) observe(seq uint32) {
+	if !t.started {
+		t.started = true
+		t.next = seq + 1
+		return
+	}
+	// Signed difference, so the comparison survives wrapping
+	switch diff := int32(seq - t.next); {
+	case diff == 0:
+		t.next++
+	case diff > 0:
+		seqMissing.Add(uint64(diff))
+		t.next = seq + 1
+	default:
+		seqReordered.Inc()
+	}
+}
+
+// WriteFrame writes a discovery or session frame. With sequence, and if the
+// peer announced it understands them, the frame is sent with the next
+// sequence number of the connection so the peer can count lost and reordered
+// frames.
+func (c *Client) WriteFrame(packetType uint16, frame []byte, sequence bool) error {
+	return c.WriteFrameAt(packetType, frame, sequence, time.Time{})
+}
+
+// WriteFrameAt is WriteFrame also sending the time the frame was captured,
+// unless it is zero or the peer did not announce it understands timestamped
+// frames, so the peer measures the forwarding latency
+func (c *Client) WriteFrameAt(packetType uint16, frame []byte, sequence bool, captured time.Time) error {
+	sequence = sequence && c.peerSequence.Load()
+	timestamp := !captured.IsZero() && c.peerTimestamps.Load()
+	if !sequence && !timestamp {
+		return c.WritePacket(packetType, frame)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var buf [timestampHeaderSize + sequenceHeaderSize]byte
+	hdr := buf[:0]
+	outer := packetType
+	if sequence {
+		outer = PacketTypeSequenced
+	}
+	if timestamp {
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(captured.UnixNano()))
+		hdr = binary.BigEndian.AppendUint16(hdr, outer)
+		outer = PacketTypeTimestamped
+	}
+	if sequence {
+		hdr = binary.BigEndian.AppendUint32(hdr, c.txSeq)
+		hdr = binary.BigEndian.AppendUint16(hdr, packetType)
+		// A frame dropped on a write timeout keeps its number, the peer sees the gap
+		c.txSeq++
+	}
+	return c.write(outer, hdr, frame)
+}
+
+// unwrapSequenced returns the packet type and frame of a sequenced payload,
+// accounting for its sequence number
+func (c *Client) unwrapSequenced(data []byte) (uint16, []byte, error) {
+	if len(data) < sequenceHeaderSize {
+		return 0, nil, fmt.Errorf("sequenced packet too short: %d bytes", len(data))
+	}
+	packetType := binary.BigEndian.Uint16(data[4:6])
+	if packetType != PacketTypeDiscovery && packetType != PacketTypeSession {
+		return 0, nil, fmt.Errorf("invalid sequenced packet type %d", packetType)
+	}
+	c.rxSeq.observe(binary.BigEndian.Uint32(data[0:4]))
+	return packetType, data[sequenceHeaderSize:], nil
+}
@@ -1,92 +1,158 @@
-package main
+package pppoeproxy
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
-	"net"
+	"net/netip"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// LCP and IPCP codes, and the IPCP option carrying the negotiated address
+// (RFC 1661, RFC 1332)
+const (
+	lcpConfigureRequest = 1
+	ipcpConfigureAck    = 2
+	ipcpOptionIPAddress = 3
+)
 
-	"golang.org/x/sys/unix"
+// Codes of the authentication results sent by the authenticator (RFC 1334,
+// RFC 1994)
+const (
+	papAuthAck  = 2
+	papAuthNak  = 3
+	chapSuccess = 3
+	chapFailure = 4
 )
 
+// authMaxMsgLen is the length of the authenticator messages kept
+const authMaxMsgLen = 128
+
+// authResult is the outcome of a PAP or CHAP authentication
+type authResult struct {
+	Protocol uint16 // PPPProtoPAP or PPPProtoCHAP
+	Success  bool
+	Message  string // Message of the authenticator, made printable
+}
+
 // SessionHandler handles PPPoE session packets
 type SessionHandler struct {
-	fd           int
-	isServer     bool
-	interfaceIdx int
-	forwardFunc  ForwardFunc
-	mu           sync.Mutex
+	sock        RawSocket
+	isServer    bool
+	forwardFunc ForwardFunc
+	errorFunc   ErrorFunc
+	logFilter   atomic.Pointer[FrameFilter] // Selects the frames logged, nil logging all
+	injectFails injectFailures
+	mu          sync.Mutex
+	loop        *loopSupervisor
+	captured    time.Time     // Capture time of the frame being forwarded, only used by the receive loop and the forward function
+	running     atomic.Bool   // Set while the receive loop is running
+	done        chan struct{} // Closed when the receive loop exits
+	closeOnce   sync.Once
+	stop        func() bool // Unregisters the context cancellation hook
 }
 
-// NewSessionHandler creates a new handler for PPPoE session packets
-func NewSessionHandler(interfaceName string, isServer bool) (*SessionHandler, error) {
-	// Get interface index
-	iface, err := net.InterfaceByName(interfaceName)
-	if err != nil {
-		return nil, fmt.Errorf("interface not found: %v", err)
-	}
-
-	// Create raw socket for PPPoE session packets
-	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(PPPoESession)))
+// NewSessionHandler creates a new handler for PPPoE session packets. The handler
+// is closed when ctx is cancelled.
+func NewSessionHandler(ctx context.Context, interfaceName string, isServer bool) (*SessionHandler, error) {
+	sock, err := OpenRawSocket(interfaceName, PPPoESession)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create socket: %v", err)
-	}
-
-	// Bind to the interface
-	addr := unix.SockaddrLinklayer{
-		Protocol: htons(PPPoESession),
-		Ifindex:  iface.Index,
-	}
-
-	if err := unix.Bind(fd, &addr); err != nil {
-		unix.Close(fd)
-		return nil, fmt.Errorf("failed to bind socket: %v", err)
+		return nil, err
 	}
+	return NewSessionHandlerWithSocket(ctx, sock, isServer), nil
+}
 
+// NewSessionHandlerWithSocket creates a handler for PPPoE session packets
+// using an already opened socket, such as a FakeSegment socket in tests. The
+// handler owns the socket and closes it.
+func NewSessionHandlerWithSocket(ctx context.Context, sock RawSocket, isServer bool) *SessionHandler {
 	handler := &SessionHandler{
-		fd:           fd,
-		isServer:     isServer,
-		interfaceIdx: iface.Index,
+		sock:     sock,
+		isServer: isServer,
+		loop:     newLoopSupervisor("session"),
+		done:     make(chan struct{}),
 	}
 
 	// Start packet processing
+	handler.running.Store(true)
 	go handler.processPackets()
+	handler.stop = context.AfterFunc(ctx, func() { handler.Close() })
 
-	return handler, nil
+	return handler
 }
 
-// Close closes the socket
+// Close closes the socket and stops the receive loop. It may be called more
+// than once.
 func (h *SessionHandler) Close() error {
-	return unix.Close(h.fd)
+	var err error
+	h.closeOnce.Do(func() {
+		h.stop()
+		h.loop.close()
+		err = h.sock.Close()
+	})
+	return err
+}
+
+// Running reports whether the receive loop is still running
+func (h *SessionHandler) Running() bool {
+	return h.running.Load()
+}
+
+// Wait blocks until the receive loop has exited after Close
+func (h *SessionHandler) Wait() {
+	<-h.done
 }
 
 // processPackets receives and processes PPPoE session packets
 func (h *SessionHandler) processPackets() {
+	defer close(h.done)
+	defer h.running.Store(false)
+
 	buf := make([]byte, 2048)
 	for {
-		n, _, err := unix.Recvfrom(h.fd, buf, 0)
+		n, captured, err := recvTimestamp(h.sock, buf)
 		if err != nil {
-			if err == unix.EINTR {
-				continue
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			errorsTotal.With(ErrorRecv).Inc()
+			delay, persistent := h.loop.failed(err)
+			log.Printf("Error receiving session packet, restarting the packet loop in %s: %v", delay.Round(time.Millisecond), err)
+			if persistent != nil {
+				h.reportError(ErrorRecv, persistent)
 			}
-			log.Printf("Error receiving packet: %v", err)
-			return
+			if !h.loop.restart(delay) {
+				return
+			}
+			continue
 		}
+		h.loop.received.Store(true)
 
 		if n < 20 { // Ethernet header (14) + minimum PPPoE header (6)
 			continue
 		}
 
 		packet := buf[:n]
+		h.captured = captured
 		h.handlePacket(packet)
 	}
 }
 
 // handlePacket processes a PPPoE session packet
 func (h *SessionHandler) handlePacket(packet []byte) {
-	// Skip the Ethernet header (14 bytes)
-	pppoeHeader := packet[14:]
+	// Skip the Ethernet header and any VLAN tag
+	off := pppoeOffset(packet)
+	if len(packet) < off+pppoeHeaderSize {
+		return
+	}
+	pppoeHeader := packet[off:]
 
 	// Check if this is a PPPoE Session packet
 	if pppoeHeader[0] != 0x11 { // PPPoE version 1, type 1
@@ -97,7 +163,7 @@ func (h *SessionHandler) handlePacket(packet []byte) {
 	sessionID := binary.BigEndian.Uint16(pppoeHeader[2:4])
 
 	// Check if this is a session establishment or termination
-	if len(pppoeHeader) >= 8 { // PPPoE header (6) + at least protocol (2)
+	if len(pppoeHeader) >= 8 && h.logFilter.Load().Match(packet) { // PPPoE header (6) + at least protocol (2)
 		// Get the PPP protocol type
 		protocol := binary.BigEndian.Uint16(pppoeHeader[6:8])
 
@@ -124,6 +190,7 @@ func (h *SessionHandler) handlePacket(packet []byte) {
 	}
 
 	// Forward the packet to the appropriate endpoint
+	countFrame("session", DirectionRx, len(packet))
 	h.forwardPacket(packet)
 }
 
@@ -146,30 +213,58 @@ func (h *SessionHandler) SetForwardFunc(f ForwardFunc) {
 	h.forwardFunc = f
 }
 
+// SetLogFilter sets the expression selecting the frames logged as they are
+// received or injected, nil logging all
+func (h *SessionHandler) SetLogFilter(f *FrameFilter) {
+	h.logFilter.Store(f)
+}
+
+// SetErrorFunc sets the function called when the receive loop fails or frames
+// persistently fail to be injected
+func (h *SessionHandler) SetErrorFunc(f ErrorFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errorFunc = f
+}
+
+// reportError passes an error to the error function, if one is set
+func (h *SessionHandler) reportError(kind string, err error) {
+	h.mu.Lock()
+	errorFunc := h.errorFunc
+	h.mu.Unlock()
+
+	if errorFunc != nil {
+		errorFunc(&Error{Kind: kind, Err: err})
+	}
+}
+
+// injectFailed records an injection error, reporting it once injection has
+// failed persistently
+func (h *SessionHandler) injectFailed(err error) {
+	errorsTotal.With(ErrorInject).Inc()
+	if h.injectFails.failed() {
+		h.reportError(ErrorInject, fmt.Errorf("%d consecutive session frames could not be injected: %w", persistentInjectFailures, err))
+	}
+}
+
 // InjectPacket injects a packet into the interface
-func (h *SessionHandler) InjectPacket(packet []byte) {
+func (h *SessionHandler) InjectPacket(packet []byte) error {
 	if len(packet) < 14 {
 		log.Printf("Packet too short to inject: %d bytes", len(packet))
-		return
-	}
-
-	// Prepare sockaddr for packet injection
-	sa := unix.SockaddrLinklayer{
-		Protocol: htons(PPPoESession),
-		Ifindex:  h.interfaceIdx,
+		return fmt.Errorf("packet too short to inject: %d bytes", len(packet))
 	}
 
 	// Extract session information for logging
-	if len(packet) >= 20 { // 14 + 6 (Ethernet + PPPoE headers)
+	if pppoe := packet[pppoeOffset(packet):]; len(pppoe) >= pppoeHeaderSize && h.logFilter.Load().Match(packet) {
 		// Get session ID
-		sessionID := binary.BigEndian.Uint16(packet[16:18])
+		sessionID := binary.BigEndian.Uint16(pppoe[2:4])
 
 		// Check for LCP packets (session establishment/termination)
-		if len(packet) >= 22 { // + 2 for protocol
-			protocol := binary.BigEndian.Uint16(packet[20:22])
+		if len(pppoe) >= 8 { // + 2 for protocol
+			protocol := binary.BigEndian.Uint16(pppoe[6:8])
 
-			if protocol == 0xc021 && len(packet) >= 23 { // LCP protocol
-				lcpCode := packet[22]
+			if protocol == 0xc021 && len(pppoe) >= 9 { // LCP protocol
+				lcpCode := pppoe[8]
 				if lcpCode == 1 { // Configure-Request
 					log.Printf("Injecting PPPoE Session establishment request, ID: 0x%04x", sessionID)
 				} else if lcpCode == 5 { // Terminate-Request
@@ -180,7 +275,85 @@ func (h *SessionHandler) InjectPacket(packet []byte) {
 	}
 
 	// Send packet to interface (don't log regular data packets)
-	if err := unix.Sendto(h.fd, packet, 0, &sa); err != nil {
+	if err := h.sock.Send(packet); err != nil {
+		h.injectFailed(err)
 		log.Printf("Error injecting session packet: %v", err)
+		return err
+	}
+	h.injectFails.succeeded()
+	countFrame("session", DirectionTx, len(packet))
+	return nil
+}
+
+// ipcpAckAddress returns the IP-Address option of an IPCP Configure-Ack
+// session frame (including the Ethernet header). A Configure-Ack repeats the
+// options its receiver requested, so this is the address of the receiver of
+// the frame.
+func ipcpAckAddress(packet []byte) (netip.Addr, bool) {
+	off := pppoeOffset(packet)
+	ppp := packet[min(off+pppoeHeaderSize, len(packet)):]
+	if len(ppp) < 6 || binary.BigEndian.Uint16(ppp[0:2]) != PPPProtoIPCP || ppp[2] != ipcpConfigureAck {
+		return netip.Addr{}, false
+	}
+
+	// The options end with the IPCP packet, which may be followed by padding
+	length := int(binary.BigEndian.Uint16(ppp[4:6]))
+	if length < 4 || 2+length > len(ppp) {
+		return netip.Addr{}, false
+	}
+	opts := ppp[6 : 2+length]
+	for len(opts) >= 2 {
+		optLen := int(opts[1])
+		if optLen < 2 || optLen > len(opts) {
+			return netip.Addr{}, false
+		}
+		if opts[0] == ipcpOptionIPAddress && optLen == 6 {
+			return netip.AddrFrom4([4]byte(opts[2:6])), true
+		}
+		opts = opts[optLen:]
+	}
+	return netip.Addr{}, false
+}
+
+// pppAuthResult returns the outcome carried by a PAP Authenticate-Ack or -Nak,
+// or a CHAP Success or Failure session frame (including the Ethernet header)
+func pppAuthResult(packet []byte) (authResult, bool) {
+	off := pppoeOffset(packet)
+	ppp := packet[min(off+pppoeHeaderSize, len(packet)):]
+	if len(ppp) < 6 {
+		return authResult{}, false
+	}
+	res := authResult{Protocol: binary.BigEndian.Uint16(ppp[0:2])}
+	length := int(binary.BigEndian.Uint16(ppp[4:6]))
+	if length < 4 || 2+length > len(ppp) {
+		return authResult{}, false
 	}
+	msg := ppp[6 : 2+length]
+
+	switch res.Protocol {
+	case PPPProtoPAP:
+		if ppp[2] != papAuthAck && ppp[2] != papAuthNak {
+			return authResult{}, false
+		}
+		res.Success = ppp[2] == papAuthAck
+		// The message is preceded by its length
+		if len(msg) > 0 {
+			msg = msg[1:min(1+int(msg[0]), len(msg))]
+		}
+	case PPPProtoCHAP:
+		if ppp[2] != chapSuccess && ppp[2] != chapFailure {
+			return authResult{}, false
+		}
+		res.Success = ppp[2] == chapSuccess
+	default:
+		return authResult{}, false
+	}
+
+	res.Message = strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, string(msg[:min(len(msg), authMaxMsgLen)]))
+	return res, true
 }
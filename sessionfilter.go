@@ -0,0 +1,124 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Session filter metrics
+var sessionFiltered = NewCounterVec("pppoeproxy_session_filtered_total", "Frames ignored by the session allow and deny lists", "direction")
+
+// sessionMatch is an entry of a session filter list: a session ID, a MAC
+// address, or a pair of MAC addresses
+type sessionMatch struct {
+	session   uint16
+	mac, mac2 net.HardwareAddr // mac alone matches frames from or to it, both match frames between them and their broadcasts
+}
+
+// match reports whether a frame matches the entry. Session IDs only match
+// frames of an established session, not the discovery frames setting it up.
+func (m *sessionMatch) match(info *frameInfo) bool {
+	switch {
+	case m.mac == nil:
+		return info.Session != 0 && info.Session == m.session
+	case m.mac2 == nil:
+		return bytes.Equal(info.Src, m.mac) || bytes.Equal(info.Dst, m.mac)
+	default:
+		// Including the broadcast PADI of the host
+		broadcast := info.Dst[0]&1 != 0
+		return bytes.Equal(info.Src, m.mac) && (broadcast || bytes.Equal(info.Dst, m.mac2)) ||
+			bytes.Equal(info.Src, m.mac2) && (broadcast || bytes.Equal(info.Dst, m.mac))
+	}
+}
+
+// SessionFilter selects the PPPoE sessions that are proxied, so the proxy can
+// share its interface with sessions terminated locally. Frames matching a
+// deny entry are ignored, and when there are allow entries, frames must
+// match one of them. Discovery frames not carrying a session ID yet are only
+// checked against the MAC address entries.
+type SessionFilter struct {
+	allow, deny []sessionMatch
+}
+
+// ParseSessionFilter builds a filter from comma separated allow and deny
+// lists of session IDs (e.g. 0x1234), MAC addresses and pairs of MAC
+// addresses separated by a slash, a host and its access concentrator
+func ParseSessionFilter(allow, deny string) (*SessionFilter, error) {
+	f := &SessionFilter{}
+	var err error
+	if f.allow, err = parseSessionMatches(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseSessionMatches(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseSessionMatches parses a session filter list
+func parseSessionMatches(list string) ([]sessionMatch, error) {
+	var res []sessionMatch
+	for _, entry := range splitList(list) {
+		var m sessionMatch
+		first, second, pair := strings.Cut(entry, "/")
+		if mac, err := net.ParseMAC(first); err == nil {
+			m.mac = mac
+			if pair {
+				if m.mac2, err = net.ParseMAC(second); err != nil {
+					return nil, fmt.Errorf("invalid MAC address %q", second)
+				}
+			}
+		} else {
+			v, err := strconv.ParseUint(entry, 0, 16)
+			if err != nil || v == 0 {
+				return nil, fmt.Errorf("invalid session ID or MAC address %q", entry)
+			}
+			m.session = uint16(v)
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// Allow reports whether a frame (including the Ethernet header) is proxied.
+// A nil filter allows all the frames.
+func (f *SessionFilter) Allow(packet []byte) bool {
+	if f == nil {
+		return true
+	}
+	info := decodeFrame(packet)
+	if !info.HasEther {
+		return false
+	}
+	for i := range f.deny {
+		if f.deny[i].match(&info) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	checked := false
+	for i := range f.allow {
+		m := &f.allow[i]
+		if m.match(&info) {
+			return true
+		}
+		checked = checked || m.mac != nil || info.Session != 0
+	}
+	// Session IDs do not apply to discovery frames before PADS
+	return !checked
+}
+
+// filterSession reports whether a frame passes the session filter, counting
+// it if not
+func (p *Proxy) filterSession(direction string, packet []byte) bool {
+	if p.cfg().SessionFilter.Allow(packet) {
+		return true
+	}
+	sessionFiltered.With(direction).Inc()
+	return false
+}
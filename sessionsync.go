@@ -0,0 +1,117 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// syncedSessionSize is the size of a session in a PacketTypeSessions
+// payload: the session ID (uint16, big endian), the host MAC and the AC MAC
+const syncedSessionSize = 2 + 6 + 6
+
+// encodeSessions builds the PacketTypeSessions payloads describing sessions,
+// split so each fits in a tunnel packet
+func encodeSessions(sessions []SessionInfo) [][]byte {
+	const perPacket = maxPacketSize / syncedSessionSize
+	var payloads [][]byte
+	for len(sessions) > 0 {
+		n := min(len(sessions), perPacket)
+		b := make([]byte, 0, n*syncedSessionSize)
+		for _, s := range sessions[:n] {
+			b = binary.BigEndian.AppendUint16(b, s.ID)
+			b = append(b, s.HostMAC...)
+			b = append(b, s.ACMAC...)
+		}
+		payloads = append(payloads, b)
+		sessions = sessions[n:]
+	}
+	return payloads
+}
+
+// decodeSessions parses a PacketTypeSessions payload
+func decodeSessions(data []byte) ([]SessionInfo, error) {
+	if len(data)%syncedSessionSize != 0 {
+		return nil, fmt.Errorf("invalid session list length %d", len(data))
+	}
+	sessions := make([]SessionInfo, 0, len(data)/syncedSessionSize)
+	for ; len(data) > 0; data = data[syncedSessionSize:] {
+		sessions = append(sessions, SessionInfo{
+			ID:      binary.BigEndian.Uint16(data[0:2]),
+			HostMAC: net.HardwareAddr(append([]byte(nil), data[2:8]...)),
+			ACMAC:   net.HardwareAddr(append([]byte(nil), data[8:14]...)),
+		})
+	}
+	return sessions, nil
+}
+
+// adopt adds the sessions known to a tunnel peer that are missing from the
+// table, such as after a restart of this proxy, and takes ownership of
+// sessions announced by owner. New sessions are not reported as started: they
+// were established before. It returns the number of sessions added.
+func (t *SessionTable) adopt(sessions []SessionInfo, owner string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	added := 0
+	for _, s := range sessions {
+		if s.ID == 0 {
+			continue
+		}
+		key := sessionKey{ID: s.ID}
+		copy(key.AC[:], s.ACMAC)
+		if owner != "" {
+			t.owners[string(s.HostMAC)] = owner
+		}
+		if cur, ok := t.sessions[key]; ok {
+			if owner != "" {
+				cur.Owner = owner
+			}
+			continue
+		}
+		s.Owner = owner
+		s.Started = time.Now()
+		s.LastSeen = s.Started
+		t.sessions[key] = &s
+		added++
+	}
+	sessionsActive.Set(float64(len(t.sessions)))
+	return added
+}
+
+// sendSessions sends the tunnel peer the sessions it takes part in, once it
+// announced it understands session lists: all sessions in client mode, the
+// sessions negotiated through that client in server mode
+func (p *Proxy) sendSessions(client *Client) {
+	var sessions []SessionInfo
+	for _, s := range p.sessions.List() {
+		if !p.isServer || s.Owner == client.remoteAddr {
+			sessions = append(sessions, s)
+		}
+	}
+	for _, payload := range encodeSessions(sessions) {
+		if err := client.WritePacket(PacketTypeSessions, payload); err != nil {
+			log.Printf("Error sending session list to %s: %v", client.remoteAddr, err)
+			return
+		}
+	}
+}
+
+// handleSessions merges the session list of a tunnel peer into the table, so
+// both ends agree on the active sessions after either one restarted or the
+// tunnel reconnected
+func (p *Proxy) handleSessions(client *Client, data []byte) {
+	sessions, err := decodeSessions(data)
+	if err != nil {
+		log.Printf("Invalid session list from %s: %v", client.remoteAddr, err)
+		return
+	}
+	owner := ""
+	if p.isServer {
+		owner = client.remoteAddr
+	}
+	if n := p.sessions.adopt(sessions, owner); n > 0 {
+		log.Printf("Resumed %d session(s) known to tunnel peer %s", n, client.remoteAddr)
+	}
+}
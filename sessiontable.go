@@ -0,0 +1,513 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Session table metrics
+var (
+	sessionsActive = NewGauge("pppoeproxy_sessions_active", "Number of active PPPoE sessions")
+	sessionIPInfo  = NewGaugeVec("pppoeproxy_session_ip_info", "IPv4 address assigned to each PPPoE session by IPCP", "session", "host_mac", "ac_mac", "ip")
+	pppAuthTotal   = NewCounterVec("pppoeproxy_ppp_auth_total", "PPP authentication results sent by the access concentrators", "protocol", "result")
+)
+
+// Session termination reasons
+const (
+	ReasonPADTHost     = "padt-host"     // Host sent a PADT
+	ReasonPADTAC       = "padt-ac"       // Access concentrator sent a PADT
+	ReasonReplaced     = "replaced"      // A new PADS reused the same session ID
+	ReasonTunnelClosed = "tunnel-closed" // The tunnel client owning the session disconnected
+	ReasonShutdown     = "shutdown"      // The proxy is shutting down
+	ReasonAdmin        = "admin"         // Terminated by an administrator
+	ReasonIdleExpired  = "idle-expired"  // No frame of the session for SessionIdleTimeout
+)
+
+// pppRetransmitWindow is the time during which the access concentrator may
+// repeat an IPCP Configure-Ack for a retransmitted request: the default
+// restart timer of 3s times Max-Configure (RFC 1661)
+const pppRetransmitWindow = 30 * time.Second
+
+// sessionKey identifies a PPPoE session; session IDs are only unique per AC
+type sessionKey struct {
+	ID uint16
+	AC [6]byte
+}
+
+// SessionInfo describes a PPPoE session established through the proxy
+type SessionInfo struct {
+	ID       uint16
+	HostMAC  net.HardwareAddr
+	ACMAC    net.HardwareAddr
+	Owner    string // Tunnel client the session was negotiated through (server mode)
+	Started  time.Time
+	LastSeen time.Time  // Last frame of the session, in either direction
+	IP       netip.Addr // IPv4 address of the host, learned from IPCP (invalid until negotiated)
+	FramesRx uint64     // Frames captured on the interface
+	FramesTx uint64     // Frames injected on the interface
+	BytesRx  uint64
+	BytesTx  uint64
+
+	// PPP authentication of the host, from the results sent by the AC
+	AuthProtocol string // PAP or CHAP, empty until a result was seen
+	AuthSuccess  bool   // Outcome of the last attempt
+	AuthFailures uint64 // Failed attempts
+
+	// LCP or IPCP negotiations after the session came up
+	Renegotiations uint64
+	negotiated     time.Time // Last IPCP Configure-Ack of the AC, zero until the session came up
+	renegotiating  bool      // LCP started again, until IPCP completes
+}
+
+// Session event types
+const (
+	SessionEventStart = "start"
+	SessionEventEnd   = "end"
+	SessionEventIP    = "ip"   // The address of the host was learned or changed
+	SessionEventAuth  = "auth" // The AC sent the result of a PAP or CHAP authentication
+
+	// LCP or IPCP was negotiated again on a live session
+	SessionEventRenegotiated = "renegotiated"
+)
+
+// SessionEvent reports the start or end of a session, the address assigned to
+// its host, the result of its authentication or its renegotiation to
+// subscribers
+type SessionEvent struct {
+	Type    string
+	Session SessionInfo
+	Reason  string     // Termination reason (end events), message of the AC (auth events), LCP or IPCP (renegotiated events)
+	OldIP   netip.Addr // Address replaced by the new one (ip events only, invalid if none)
+}
+
+// SessionTable tracks PPPoE sessions from PADS to PADT
+type SessionTable struct {
+	mu          sync.Mutex
+	sessions    map[sessionKey]*SessionInfo
+	owners      map[string]string // Host MAC to the tunnel client that sent its discovery
+	shapers     map[sessionKey]*sessionShaper
+	summary     sessionStats
+	subMu       sync.Mutex
+	subscribers map[chan SessionEvent]bool
+}
+
+// sessionStats counts the sessions seen by a table
+type sessionStats struct {
+	established, ended uint64
+	total, min, max    time.Duration // Durations of the ended sessions
+}
+
+// NewSessionTable creates an empty session table
+func NewSessionTable() *SessionTable {
+	return &SessionTable{
+		sessions:    make(map[sessionKey]*SessionInfo),
+		owners:      make(map[string]string),
+		shapers:     make(map[sessionKey]*sessionShaper),
+		subscribers: make(map[chan SessionEvent]bool),
+	}
+}
+
+// Subscribe returns a channel receiving session events, and a
+// function to call once the subscriber is done. Events are dropped when the
+// subscriber does not keep up.
+func (t *SessionTable) Subscribe() (<-chan SessionEvent, func()) {
+	ch := make(chan SessionEvent, 64)
+	t.subMu.Lock()
+	t.subscribers[ch] = true
+	t.subMu.Unlock()
+
+	return ch, func() {
+		t.subMu.Lock()
+		delete(t.subscribers, ch)
+		t.subMu.Unlock()
+	}
+}
+
+// publish sends an event to all subscribers without blocking
+func (t *SessionTable) publish(ev SessionEvent) {
+	t.subMu.Lock()
+	defer t.subMu.Unlock()
+	for ch := range t.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// ObserveDiscovery updates the table from a discovery packet (including the
+// Ethernet header), regardless of the direction it is travelling in. owner is
+// the tunnel client the packet came from, if any.
+func (t *SessionTable) ObserveDiscovery(packet []byte, owner string) {
+	off := pppoeOffset(packet)
+	if len(packet) < off+pppoeHeaderSize || packet[off] != 0x11 {
+		return
+	}
+
+	code := packet[off+1]
+	sessionID := binary.BigEndian.Uint16(packet[off+2 : off+4])
+
+	var dst, src [6]byte
+	copy(dst[:], packet[0:6])
+	copy(src[:], packet[6:12])
+
+	switch code {
+	case PADI, PADR:
+		// Remember which tunnel client the host is reachable through
+		if owner != "" {
+			t.mu.Lock()
+			t.owners[string(src[:])] = owner
+			t.mu.Unlock()
+		}
+	case PADS:
+		if sessionID == 0 {
+			// PADS with a zero session ID is an error reply
+			return
+		}
+		// PADS is sent by the AC to the host
+		now := time.Now()
+		t.add(&SessionInfo{
+			ID:       sessionID,
+			HostMAC:  net.HardwareAddr(dst[:]),
+			ACMAC:    net.HardwareAddr(src[:]),
+			Started:  now,
+			LastSeen: now,
+		})
+	case PADT:
+		// PADT may be sent by either end
+		if !t.end(sessionKey{ID: sessionID, AC: src}, ReasonPADTAC) {
+			t.end(sessionKey{ID: sessionID, AC: dst}, ReasonPADTHost)
+		}
+	}
+}
+
+// ObserveSession accounts a session packet (including the Ethernet header)
+// travelling in the given direction. The address of the host is learned from
+// the IPCP Configure-Ack sent by the AC, the outcome of its authentication
+// from the PAP or CHAP result, and renegotiations from LCP and IPCP once the
+// session is up. It reports whether the packet belongs to a tracked session.
+func (t *SessionTable) ObserveSession(packet []byte, direction string) bool {
+	now := time.Now()
+	t.mu.Lock()
+	_, s := t.lookupLocked(packet)
+	if s == nil {
+		t.mu.Unlock()
+		return false
+	}
+
+	s.LastSeen = now
+	if direction == DirectionRx {
+		s.FramesRx++
+		s.BytesRx += uint64(len(packet))
+	} else {
+		s.FramesTx++
+		s.BytesTx += uint64(len(packet))
+	}
+
+	var events []SessionEvent
+	fromAC := bytes.Equal(packet[6:12], s.ACMAC)
+	if protocol := renegotiation(s, packet, fromAC, now); protocol != "" {
+		s.Renegotiations++
+		events = append(events, SessionEvent{Type: SessionEventRenegotiated, Reason: protocol})
+	}
+	// Only the AC sends the address of the host and authentication results
+	if ip, ok := ipcpAckAddress(packet); fromAC && ok && ip != s.IP {
+		forgetSessionIP(s)
+		events = append(events, SessionEvent{Type: SessionEventIP, OldIP: s.IP})
+		s.IP = ip
+		sessionIPInfo.With(sessionIPLabels(s)...).Set(1)
+	} else if res, ok := pppAuthResult(packet); fromAC && ok {
+		events = append(events, SessionEvent{Type: SessionEventAuth, Reason: res.Message})
+		s.AuthProtocol = pppProtocolName(res.Protocol)
+		s.AuthSuccess = res.Success
+		if !res.Success {
+			s.AuthFailures++
+		}
+	}
+	for i := range events {
+		events[i].Session = *s
+	}
+	t.mu.Unlock()
+
+	for _, ev := range events {
+		s := &ev.Session
+		switch ev.Type {
+		case SessionEventRenegotiated:
+			log.Printf("session-renegotiated id=0x%04x host=%s ac=%s protocol=%s renegotiations=%d", s.ID, s.HostMAC, s.ACMAC, ev.Reason, s.Renegotiations)
+		case SessionEventIP:
+			log.Printf("session-ip id=0x%04x host=%s ac=%s ip=%s", s.ID, s.HostMAC, s.ACMAC, s.IP)
+		case SessionEventAuth:
+			pppAuthTotal.With(s.AuthProtocol, authResultName(s.AuthSuccess)).Inc()
+			log.Printf("session-auth id=0x%04x host=%s ac=%s protocol=%s result=%s failures=%d message=%q",
+				s.ID, s.HostMAC, s.ACMAC, s.AuthProtocol, authResultName(s.AuthSuccess), s.AuthFailures, ev.Reason)
+		}
+		t.publish(ev)
+	}
+	return true
+}
+
+// renegotiation updates the negotiation state of a session from a session
+// packet, and returns the protocol negotiated again once the session was up:
+// "LCP" for a Configure-Request from either end, "IPCP" for a Configure-Ack of
+// the AC outside of an LCP renegotiation, or "" if none. The table of s must be locked.
+func renegotiation(s *SessionInfo, packet []byte, fromAC bool, now time.Time) string {
+	ppp := packet[min(pppoeOffset(packet)+pppoeHeaderSize, len(packet)):]
+	if len(ppp) < 3 {
+		return ""
+	}
+	switch protocol, code := binary.BigEndian.Uint16(ppp[0:2]), ppp[2]; {
+	case protocol == PPPProtoLCP && code == lcpConfigureRequest:
+		if s.negotiated.IsZero() || s.renegotiating {
+			return ""
+		}
+		s.renegotiating = true
+		return "LCP"
+	case protocol == PPPProtoIPCP && code == ipcpConfigureAck && fromAC:
+		// Acks repeated for retransmitted requests are not renegotiations
+		again := !s.negotiated.IsZero() && !s.renegotiating && now.Sub(s.negotiated) > pppRetransmitWindow
+		s.negotiated = now
+		s.renegotiating = false
+		if again {
+			return "IPCP"
+		}
+	}
+	return ""
+}
+
+// authResultName returns the name of an authentication outcome
+func authResultName(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+// conflicting returns a tracked session using the same session ID as the
+// session between host and ac, with a different pair of MAC addresses
+func (t *SessionTable) conflicting(id uint16, host, ac net.HardwareAddr) (SessionInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, s := range t.sessions {
+		if key.ID == id && (!bytes.Equal(s.HostMAC, host) || !bytes.Equal(s.ACMAC, ac)) {
+			return *s, true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// lookupLocked returns the session a session packet belongs to, or nil. t.mu
+// must be held.
+func (t *SessionTable) lookupLocked(packet []byte) (sessionKey, *SessionInfo) {
+	off := pppoeOffset(packet)
+	if len(packet) < off+pppoeHeaderSize {
+		return sessionKey{}, nil
+	}
+	key := sessionKey{ID: binary.BigEndian.Uint16(packet[off+2 : off+4])}
+
+	// The AC is either the source or the destination of the frame
+	copy(key.AC[:], packet[6:12])
+	if s, ok := t.sessions[key]; ok {
+		return key, s
+	}
+	copy(key.AC[:], packet[0:6])
+	if s, ok := t.sessions[key]; ok {
+		return key, s
+	}
+	return sessionKey{}, nil
+}
+
+// shaper returns the shaper of the session a session packet belongs to, set
+// to update(current shaper) which may replace it, or nil if the session is
+// not tracked. The shaper is dropped when the session ends.
+func (t *SessionTable) shaper(packet []byte, update func(old *sessionShaper) *sessionShaper) *sessionShaper {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key, s := t.lookupLocked(packet)
+	if s == nil {
+		return nil
+	}
+	old := t.shapers[key]
+	shaper := update(old)
+	if shaper != old {
+		t.shapers[key] = shaper
+	}
+	return shaper
+}
+
+// forgetLocked drops the state kept for a session that ended. t.mu must be
+// held.
+func (t *SessionTable) forgetLocked(key sessionKey) {
+	if shaper, ok := t.shapers[key]; ok {
+		shaper.close()
+		delete(t.shapers, key)
+	}
+}
+
+// add registers a session, replacing any previous session with the same key
+func (t *SessionTable) add(s *SessionInfo) {
+	var key sessionKey
+	key.ID = s.ID
+	copy(key.AC[:], s.ACMAC)
+
+	t.mu.Lock()
+	s.Owner = t.owners[string(s.HostMAC)]
+	old, replaced := t.sessions[key]
+	t.forgetLocked(key)
+	t.sessions[key] = s
+	t.summary.established++
+	snapshot := *s
+	sessionsActive.Set(float64(len(t.sessions)))
+	t.mu.Unlock()
+
+	if replaced {
+		t.ended(old, ReasonReplaced)
+	}
+	logSessionStart(s)
+	t.publish(SessionEvent{Type: SessionEventStart, Session: snapshot})
+}
+
+// end removes a session, logs its lifecycle record and reports whether it existed
+func (t *SessionTable) end(key sessionKey, reason string) bool {
+	t.mu.Lock()
+	s, ok := t.sessions[key]
+	if ok {
+		delete(t.sessions, key)
+		t.forgetLocked(key)
+		sessionsActive.Set(float64(len(t.sessions)))
+	}
+	t.mu.Unlock()
+
+	if ok {
+		t.ended(s, reason)
+	}
+	return ok
+}
+
+// EndOwner ends all sessions negotiated through the given tunnel client
+func (t *SessionTable) EndOwner(owner, reason string) {
+	t.endMatching(reason, func(s *SessionInfo) bool { return s.Owner == owner })
+
+	t.mu.Lock()
+	for mac, o := range t.owners {
+		if o == owner {
+			delete(t.owners, mac)
+		}
+	}
+	t.mu.Unlock()
+}
+
+// countOwner returns the number of sessions negotiated through the given
+// tunnel client
+func (t *SessionTable) countOwner(owner string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, s := range t.sessions {
+		if s.Owner == owner {
+			n++
+		}
+	}
+	return n
+}
+
+// EndAll ends all tracked sessions
+func (t *SessionTable) EndAll(reason string) {
+	t.endMatching(reason, func(s *SessionInfo) bool { return true })
+}
+
+// endMatching ends all sessions for which match returns true
+func (t *SessionTable) endMatching(reason string, match func(s *SessionInfo) bool) {
+	var ended []*SessionInfo
+
+	t.mu.Lock()
+	for key, s := range t.sessions {
+		if match(s) {
+			delete(t.sessions, key)
+			t.forgetLocked(key)
+			ended = append(ended, s)
+		}
+	}
+	sessionsActive.Set(float64(len(t.sessions)))
+	t.mu.Unlock()
+
+	for _, s := range ended {
+		t.ended(s, reason)
+	}
+}
+
+// ended logs and publishes the end of a session removed from the table
+func (t *SessionTable) ended(s *SessionInfo, reason string) {
+	d := time.Since(s.Started)
+	t.mu.Lock()
+	if t.summary.ended == 0 || d < t.summary.min {
+		t.summary.min = d
+	}
+	t.summary.max = max(t.summary.max, d)
+	t.summary.total += d
+	t.summary.ended++
+	t.mu.Unlock()
+
+	forgetSessionIP(s)
+	logSessionEnd(s, reason)
+	t.publish(SessionEvent{Type: SessionEventEnd, Session: *s, Reason: reason})
+}
+
+// stats returns the number of sessions established and ended, and the
+// durations of the ended ones
+func (t *SessionTable) stats() sessionStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.summary
+}
+
+// Len returns the number of tracked sessions
+func (t *SessionTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions)
+}
+
+// List returns a copy of all tracked sessions
+func (t *SessionTable) List() []SessionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make([]SessionInfo, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		res = append(res, *s)
+	}
+	return res
+}
+
+// sessionIPLabels returns the labels of the address metric of a session
+func sessionIPLabels(s *SessionInfo) []string {
+	return []string{fmt.Sprintf("0x%04x", s.ID), s.HostMAC.String(), s.ACMAC.String(), s.IP.String()}
+}
+
+// forgetSessionIP removes the address metric of a session, if it had one
+func forgetSessionIP(s *SessionInfo) {
+	if s.IP.IsValid() {
+		sessionIPInfo.Delete(sessionIPLabels(s)...)
+	}
+}
+
+// logSessionStart logs the establishment of a session
+func logSessionStart(s *SessionInfo) {
+	log.Printf("session-start id=0x%04x host=%s ac=%s owner=%q", s.ID, s.HostMAC, s.ACMAC, s.Owner)
+}
+
+// logSessionEnd logs the lifecycle record of a terminated session
+func logSessionEnd(s *SessionInfo, reason string) {
+	ip := "-"
+	if s.IP.IsValid() {
+		ip = s.IP.String()
+	}
+	log.Printf("session-end id=0x%04x host=%s ac=%s owner=%q ip=%s duration=%s frames_rx=%d frames_tx=%d bytes_rx=%d bytes_tx=%d reason=%s",
+		s.ID, s.HostMAC, s.ACMAC, s.Owner, ip, time.Since(s.Started).Round(time.Second),
+		s.FramesRx, s.FramesTx, s.BytesRx, s.BytesTx, reason)
+}
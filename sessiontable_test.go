@@ -0,0 +1,176 @@
+package pppoeproxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testPPP builds a session frame carrying a PPP packet of the given protocol,
+// code and data, sent from src to dst
+func testPPP(dst, src net.HardwareAddr, protocol uint16, code uint8, data []byte) []byte {
+	ppp := []byte{byte(protocol >> 8), byte(protocol), code, 1, byte((4 + len(data)) >> 8), byte(4 + len(data))}
+	return testFrame(dst, src, PPPoESession, 0, testSession, append(ppp, data...))
+}
+
+// nextEvent returns the next session event, failing the test after a second
+func nextEvent(t *testing.T, events <-chan SessionEvent) SessionEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no session event")
+		return SessionEvent{}
+	}
+}
+
+func TestSessionTableSnooping(t *testing.T) {
+	table := NewSessionTable()
+	events, unsubscribe := table.Subscribe()
+	defer unsubscribe()
+
+	table.ObserveDiscovery(testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADR, 0, nil), "client")
+	table.ObserveDiscovery(testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADS, testSession, nil), "")
+	if ev := nextEvent(t, events); ev.Type != SessionEventStart || ev.Session.Owner != "client" {
+		t.Fatalf("event %+v, want the start of a session owned by the client", ev)
+	}
+
+	ipOption := []byte{ipcpOptionIPAddress, 6, 203, 0, 113, 5}
+	steps := []struct {
+		name  string
+		frame []byte
+		event string // Empty if none
+	}{
+		// The host acknowledging the address of the AC is not the
+		// address of the host
+		{"IPCP Configure-Ack from the host", testPPP(testACMAC, testHostMAC, PPPProtoIPCP, ipcpConfigureAck, []byte{ipcpOptionIPAddress, 6, 203, 0, 113, 1}), ""},
+		{"IPCP Configure-Request from the AC", testPPP(testHostMAC, testACMAC, PPPProtoIPCP, 1, ipOption), ""},
+		{"IPCP Configure-Ack from the AC", testPPP(testHostMAC, testACMAC, PPPProtoIPCP, ipcpConfigureAck, ipOption), SessionEventIP},
+		{"PAP Authenticate-Nak", testPPP(testHostMAC, testACMAC, PPPProtoPAP, papAuthNak, []byte{3, 'b', 'a', 'd'}), SessionEventAuth},
+		{"PAP Authenticate-Ack", testPPP(testHostMAC, testACMAC, PPPProtoPAP, papAuthAck, []byte{0}), SessionEventAuth},
+		{"CHAP Failure", testPPP(testHostMAC, testACMAC, PPPProtoCHAP, chapFailure, []byte("E=691")), SessionEventAuth},
+	}
+	for _, step := range steps {
+		if !table.ObserveSession(step.frame, DirectionTx) {
+			t.Fatalf("%s: session not tracked", step.name)
+		}
+		if step.event == "" {
+			continue
+		}
+		if ev := nextEvent(t, events); ev.Type != step.event {
+			t.Fatalf("%s: %s event, want %s", step.name, ev.Type, step.event)
+		}
+	}
+
+	s := table.List()[0]
+	if s.IP != netip.MustParseAddr("203.0.113.5") || s.AuthProtocol != "CHAP" || s.AuthSuccess || s.AuthFailures != 2 || s.FramesTx != uint64(len(steps)) {
+		t.Fatalf("session %+v", s)
+	}
+
+	table.ObserveDiscovery(testFrame(testACMAC, testHostMAC, PPPoEDiscovery, PADT, testSession, nil), "")
+	if ev := nextEvent(t, events); ev.Type != SessionEventEnd || ev.Reason != ReasonPADTHost {
+		t.Fatalf("event %+v, want the end of the session by the host", ev)
+	}
+	if table.ObserveSession(steps[0].frame, DirectionTx) {
+		t.Fatal("ended session still tracked")
+	}
+}
+
+func TestSessionTableRenegotiation(t *testing.T) {
+	table := NewSessionTable()
+	events, unsubscribe := table.Subscribe()
+	defer unsubscribe()
+	table.ObserveDiscovery(testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADS, testSession, nil), "")
+	nextEvent(t, events)
+
+	ipOption := []byte{ipcpOptionIPAddress, 6, 203, 0, 113, 5}
+	lcpFromHost := testPPP(testACMAC, testHostMAC, PPPProtoLCP, lcpConfigureRequest, nil)
+	lcpFromAC := testPPP(testHostMAC, testACMAC, PPPProtoLCP, lcpConfigureRequest, nil)
+	ipcpAck := testPPP(testHostMAC, testACMAC, PPPProtoIPCP, ipcpConfigureAck, ipOption)
+	steps := []struct {
+		name   string
+		frame  []byte
+		events []string
+		reason string // Of the renegotiated event
+	}{
+		{"LCP Configure-Request from the host", lcpFromHost, nil, ""},
+		{"LCP Configure-Request from the AC", lcpFromAC, nil, ""},
+		{"IPCP Configure-Ack", ipcpAck, []string{SessionEventIP}, ""},
+		{"IPCP Configure-Ack for a retransmitted request", ipcpAck, nil, ""},
+		{"LCP Configure-Request once up", lcpFromHost, []string{SessionEventRenegotiated}, "LCP"},
+		{"LCP Configure-Request of the same renegotiation", lcpFromAC, nil, ""},
+		{"IPCP Configure-Ack ending the renegotiation", ipcpAck, nil, ""},
+		{"LCP Configure-Request once up again", lcpFromAC, []string{SessionEventRenegotiated}, "LCP"},
+		{"IPCP Configure-Ack ending the renegotiation", ipcpAck, nil, ""},
+		{"IPCP Configure-Ack later", testPPP(testHostMAC, testACMAC, PPPProtoIPCP, ipcpConfigureAck, []byte{ipcpOptionIPAddress, 6, 203, 0, 113, 6}),
+			[]string{SessionEventRenegotiated, SessionEventIP}, "IPCP"},
+	}
+	for i, step := range steps {
+		if i == len(steps)-1 {
+			// Past the retransmissions of the last negotiation
+			table.mu.Lock()
+			for _, s := range table.sessions {
+				s.negotiated = s.negotiated.Add(-pppRetransmitWindow - time.Second)
+			}
+			table.mu.Unlock()
+		}
+		table.ObserveSession(step.frame, DirectionTx)
+		for _, want := range step.events {
+			ev := nextEvent(t, events)
+			if ev.Type != want || (want == SessionEventRenegotiated && ev.Reason != step.reason) {
+				t.Fatalf("%s: %s event (%s), want %s", step.name, ev.Type, ev.Reason, want)
+			}
+		}
+		select {
+		case ev := <-events:
+			t.Fatalf("%s: unexpected %s event", step.name, ev.Type)
+		default:
+		}
+	}
+	if s := table.List()[0]; s.Renegotiations != 3 || s.IP != netip.MustParseAddr("203.0.113.6") {
+		t.Fatalf("session %+v", s)
+	}
+}
+
+func TestSessionTableExpireIdle(t *testing.T) {
+	table := NewSessionTable()
+	otherHost := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x99}
+	table.ObserveDiscovery(testFrame(testHostMAC, testACMAC, PPPoEDiscovery, PADS, testSession, nil), "")
+	table.ObserveDiscovery(testFrame(otherHost, testACMAC, PPPoEDiscovery, PADS, testSession+1, nil), "")
+	events, unsubscribe := table.Subscribe()
+	defer unsubscribe()
+
+	// Only the first session sees traffic
+	table.expireIdle(time.Now().Add(-time.Minute))
+	start := time.Now()
+	table.ObserveSession(testPPP(testACMAC, testHostMAC, PPPProtoLCP, 9, nil), DirectionRx)
+	table.expireIdle(start)
+	ev := nextEvent(t, events)
+	if ev.Type != SessionEventEnd || ev.Reason != ReasonIdleExpired || ev.Session.ID != testSession+1 {
+		t.Fatalf("event %+v, want the second session idle-expired", ev)
+	}
+	if sessions := table.List(); len(sessions) != 1 || sessions[0].ID != testSession || sessions[0].LastSeen.Before(start) {
+		t.Fatalf("sessions %+v", sessions)
+	}
+
+	// Sessions restored from a state without last-seen times are idle
+	// since the state was saved
+	st := table.snapshot()
+	st.Saved = time.Now().Add(-time.Hour)
+	st.Sessions[0].LastSeen = time.Time{}
+	restored := NewSessionTable()
+	restored.restore(st)
+	restored.expireIdle(time.Now().Add(-time.Minute))
+	if n := restored.Len(); n != 0 {
+		t.Fatalf("%d stale restored sessions kept", n)
+	}
+
+	// Sessions adopted from a tunnel peer were just seen alive
+	restored.adopt(table.List(), "")
+	restored.expireIdle(time.Now().Add(-time.Minute))
+	if n := restored.Len(); n != 1 {
+		t.Fatalf("%d adopted sessions kept", n)
+	}
+}
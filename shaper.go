@@ -0,0 +1,181 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session shaping metrics
+var sessionShaped = NewCounterVec("pppoeproxy_session_shaped_total", "Session frames delayed or dropped to keep PPPoE sessions within their rate", "result")
+
+// shaperQueueSize is the number of frames of a session waiting to be
+// injected beyond which frames are dropped
+const shaperQueueSize = 128
+
+// minShaperBurst is the smallest burst of a shaper, two full-size frames, so
+// every frame eventually fits
+const minShaperBurst = 2 * 1522
+
+// ParseBitRate parses a rate in bits per second, with an optional k, M or G
+// suffix (powers of 1000), e.g. "20M"
+func ParseBitRate(s string) (float64, error) {
+	mult := 1.0
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1e3
+	case strings.HasSuffix(s, "M"):
+		mult = 1e6
+	case strings.HasSuffix(s, "G"):
+		mult = 1e9
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate * mult, nil
+}
+
+// sessionShaper delays the frames injected for a PPPoE session so they stay
+// within its rate. Frames within the rate are injected right away, the other
+// ones are queued and injected by a goroutine running while the queue is not
+// empty.
+type sessionShaper struct {
+	rate   float64 // Bits per second
+	burst  int     // Bytes
+	bucket *TokenBucket
+	inject func(frame []byte)
+	done   <-chan struct{} // Closed when the proxy is closed
+	stop   chan struct{}   // Closed when the session ended
+
+	mu       sync.Mutex
+	queue    []txFrame
+	draining bool
+	stopOnce sync.Once
+}
+
+// newSessionShaper returns a shaper injecting frames with inject at rate bits
+// per second, with a burst of burst bytes (0 for a tenth of a second at the
+// rate)
+func newSessionShaper(rate float64, burst int, done <-chan struct{}, inject func(frame []byte)) *sessionShaper {
+	size := float64(burst)
+	if size <= 0 {
+		size = rate / 8 / 10
+	}
+	size = max(size, minShaperBurst)
+	return &sessionShaper{
+		rate:   rate,
+		burst:  burst,
+		bucket: NewTokenBucket(rate/8, size),
+		inject: inject,
+		done:   done,
+		stop:   make(chan struct{}),
+	}
+}
+
+// submit injects a frame now or queues it, and reports false if the frame
+// was dropped because the queue is full. A queued frame may be dropped
+// instead, according to policy.
+func (s *sessionShaper) submit(frame []byte, policy DropPolicy) bool {
+	s.mu.Lock()
+	if !s.draining && s.bucket.AllowN(float64(len(frame))) {
+		s.mu.Unlock()
+		s.inject(frame)
+		return true
+	}
+	// The frame is in the reader's buffer
+	f := newTxFrame(PacketTypeSession, frame, time.Time{})
+	if len(s.queue) >= shaperQueueSize {
+		sessionShaped.With("dropped").Inc()
+		i := policy.dropIndex(s.queue, f)
+		if i < 0 {
+			s.mu.Unlock()
+			policy.countDrop("session", f)
+			return false
+		}
+		policy.countDrop("session", s.queue[i])
+		s.queue = append(s.queue[:i], s.queue[i+1:]...)
+	}
+	s.queue = append(s.queue, f)
+	start := !s.draining
+	s.draining = true
+	s.mu.Unlock()
+
+	if start {
+		go s.drain()
+	}
+	return true
+}
+
+// drain injects the queued frames as tokens become available, until the
+// queue is empty
+func (s *sessionShaper) drain() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.draining = false
+			s.mu.Unlock()
+			return
+		}
+		frame := shift(&s.queue).data
+		s.mu.Unlock()
+
+		for delay := s.bucket.delayN(float64(len(frame))); delay > 0; delay = s.bucket.delayN(float64(len(frame))) {
+			timer.Reset(delay)
+			select {
+			case <-s.done:
+				return
+			case <-s.stop:
+				return
+			case <-timer.C:
+			}
+		}
+		s.inject(frame)
+		sessionShaped.With("delayed").Inc()
+	}
+}
+
+// close drops the queued frames once the session ended
+func (s *sessionShaper) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// sessionShaping returns the rate and burst applied to the sessions of a
+// client: those of its policy if it sets them, the global ones otherwise
+func (p *Proxy) sessionShaping(from *Client) (float64, int) {
+	cfg := p.cfg()
+	if p.isServer && from != nil {
+		if st := from.policy.Load(); st != nil && st.SessionRate > 0 {
+			return st.SessionRate, st.SessionBurst
+		}
+	}
+	return cfg.SessionRate, cfg.SessionBurst
+}
+
+// shapeSession injects a session frame received from a client through the
+// shaper of its session, and reports whether it was injected or queued.
+// Frames of untracked sessions are not shaped.
+func (p *Proxy) shapeSession(from *Client, frame []byte, inject func(frame []byte) bool) bool {
+	rate, burst := p.sessionShaping(from)
+	if rate <= 0 {
+		return inject(frame)
+	}
+	shaper := p.sessions.shaper(frame, func(old *sessionShaper) *sessionShaper {
+		if old != nil && old.rate == rate && old.burst == burst {
+			return old
+		}
+		// A replaced shaper injects its queued frames and stops
+		return newSessionShaper(rate, burst, p.closedCh, func(frame []byte) { inject(frame) })
+	})
+	if shaper == nil {
+		return inject(frame)
+	}
+	return shaper.submit(frame, p.cfg().SessionQueueDrop.or(DropTail))
+}
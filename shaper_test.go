@@ -0,0 +1,76 @@
+package pppoeproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBitRate(t *testing.T) {
+	for s, want := range map[string]float64{"0": 0, "5000": 5000, "1.5k": 1500, "20M": 20e6, "1G": 1e9} {
+		if got, err := ParseBitRate(s); err != nil || got != want {
+			t.Errorf("ParseBitRate(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "M", "-1", "10m", "fast"} {
+		if _, err := ParseBitRate(s); err == nil {
+			t.Errorf("ParseBitRate(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSessionShaper(t *testing.T) {
+	injected := make(chan []byte, 8)
+	done := make(chan struct{})
+	defer close(done)
+	// 10000 bytes per second with a burst of two full-size frames
+	s := newSessionShaper(80000, 0, done, func(frame []byte) { injected <- frame })
+	defer s.close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !s.submit(append(make([]byte, 1499), byte(i)), DropTail) {
+			t.Fatalf("frame %d dropped", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case frame := <-injected:
+			if frame[1499] != byte(i) {
+				t.Fatalf("frame %d injected instead of %d", frame[1499], i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("frame %d not injected", i)
+		}
+		if d := time.Since(start); i == 2 && d < 100*time.Millisecond {
+			t.Fatalf("frame beyond the burst injected after %v", d)
+		}
+	}
+}
+
+func TestSessionShaperQueue(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	// One byte per second, the frames beyond the burst stay queued
+	s := newSessionShaper(8, 0, done, func(frame []byte) {})
+	defer s.close()
+
+	lcp := testFrame(testHostMAC, testACMAC, PPPoESession, 0, testSession, []byte{0xc0, 0x21, 0x09, 0x01, 0x00, 0x08, 0, 0, 0, 0})
+	ipv4 := testFrame(testHostMAC, testACMAC, PPPoESession, 0, testSession, append([]byte{0x00, 0x21}, make([]byte, 1400)...))
+	for i := 0; i < 2+shaperQueueSize; i++ {
+		if !s.submit(ipv4, DropTail) {
+			t.Fatalf("frame %d dropped", i)
+		}
+	}
+	if s.submit(ipv4, DropTail) {
+		t.Fatal("frame queued beyond the queue size")
+	}
+	if !s.submit(lcp, DropKeepControl) {
+		t.Fatal("control frame dropped with keep-control")
+	}
+	s.mu.Lock()
+	n, last := len(s.queue), s.queue[len(s.queue)-1]
+	s.mu.Unlock()
+	if n != shaperQueueSize || !last.control {
+		t.Fatalf("%d frames queued, last control %v", n, last.control)
+	}
+}
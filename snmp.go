@@ -0,0 +1,474 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BER/SNMP tags
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	snmpTimeTicks  = 0x43
+	snmpGauge32    = 0x42
+	snmpCounter64  = 0x46
+	snmpNoSuchObj  = 0x80
+	snmpEndOfMib   = 0x82
+	snmpGetRequest = 0xa0
+	snmpGetNext    = 0xa1
+	snmpResponse   = 0xa2
+	snmpGetBulk    = 0xa5
+)
+
+// snmpVersion2c is the version number carried in SNMPv2c messages
+const snmpVersion2c = 1
+
+// snmpTooBig is the error-status of a response that would not fit in a message
+const snmpTooBig = 1
+
+// snmpMaxResponse is the size of the largest response, the payload of a UDP
+// datagram
+const snmpMaxResponse = 65507
+
+// DefaultSNMPBaseOID is in the NET-SNMP "playpen" subtree reserved for
+// experimentation; deployments with their own enterprise number can override it
+const DefaultSNMPBaseOID = "1.3.6.1.4.1.8072.9999.7"
+
+// snmpValue is a typed SNMP value, already BER encoded
+type snmpValue []byte
+
+// snmpObject is a single scalar exposed by the agent
+type snmpObject struct {
+	oid   []uint32
+	value func() snmpValue
+}
+
+// SNMPAgent is a minimal read-only SNMPv2c responder
+type SNMPAgent struct {
+	conn      net.PacketConn
+	community string
+	objects   []snmpObject
+}
+
+// NewSNMPAgent starts an SNMPv2c responder on the given UDP address, exposing
+// the proxy counters below baseOID
+func NewSNMPAgent(addr, community, baseOID string) (*SNMPAgent, error) {
+	base, err := parseOID(baseOID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNMP base OID: %v", err)
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start SNMP agent: %v", err)
+	}
+
+	a := &SNMPAgent{
+		conn:      conn,
+		community: community,
+	}
+	a.registerObjects(base)
+
+	go a.serve()
+	log.Printf("SNMP agent listening on %s (base OID %s)", conn.LocalAddr(), baseOID)
+	return a, nil
+}
+
+// Close stops the agent
+func (a *SNMPAgent) Close() error {
+	return a.conn.Close()
+}
+
+// registerObjects builds the sorted object table
+func (a *SNMPAgent) registerObjects(base []uint32) {
+	sub := func(ids ...uint32) []uint32 {
+		return append(append([]uint32{}, base...), ids...)
+	}
+	counter := func(f func() uint64) func() snmpValue {
+		return func() snmpValue { return encodeUnsigned(snmpCounter64, f()) }
+	}
+	gauge := func(g *Gauge) func() snmpValue {
+		return func() snmpValue { return encodeUnsigned(snmpGauge32, uint64(g.Value())) }
+	}
+
+	a.objects = []snmpObject{
+		// SNMPv2-MIB::sysDescr.0 and sysUpTime.0
+		{oid: []uint32{1, 3, 6, 1, 2, 1, 1, 1, 0}, value: func() snmpValue { return encodeTLV(berOctetString, []byte("pppoeproxy")) }},
+		{oid: []uint32{1, 3, 6, 1, 2, 1, 1, 3, 0}, value: func() snmpValue {
+			return encodeUnsigned(snmpTimeTicks, uint64(time.Since(startTime)/(10*time.Millisecond)))
+		}},
+		{oid: sub(1, 0), value: gauge(sessionsActive)},
+		{oid: sub(2, 0), value: func() snmpValue {
+			// 1 = up, 2 = down, following the IF-MIB ifOperStatus convention
+			if tunnelPeers.Value() > 0 {
+				return encodeInt(berInteger, 1)
+			}
+			return encodeInt(berInteger, 2)
+		}},
+		{oid: sub(3, 0), value: gauge(tunnelPeers)},
+		{oid: sub(4, 0), value: counter(framesTotal.With("discovery", DirectionRx).Value)},
+		{oid: sub(5, 0), value: counter(framesTotal.With("discovery", DirectionTx).Value)},
+		{oid: sub(6, 0), value: counter(framesTotal.With("session", DirectionRx).Value)},
+		{oid: sub(7, 0), value: counter(framesTotal.With("session", DirectionTx).Value)},
+		{oid: sub(8, 0), value: counter(errorsTotal.Total)},
+	}
+
+	sort.Slice(a.objects, func(i, j int) bool { return compareOID(a.objects[i].oid, a.objects[j].oid) < 0 })
+}
+
+// serve answers incoming SNMP requests
+func (a *SNMPAgent) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("SNMP read error: %v", err)
+			continue
+		}
+
+		resp, err := a.handleMessage(buf[:n])
+		if err != nil {
+			log.Printf("Invalid SNMP request from %s: %v", addr, err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+
+		if _, err := a.conn.WriteTo(resp, addr); err != nil {
+			log.Printf("SNMP write error: %v", err)
+		}
+	}
+}
+
+// handleMessage decodes a request message and builds the response
+func (a *SNMPAgent) handleMessage(msg []byte) ([]byte, error) {
+	tag, body, _, err := decodeTLV(msg)
+	if err != nil || tag != berSequence {
+		return nil, errors.New("malformed message")
+	}
+
+	tag, v, body, err := decodeTLV(body)
+	if err != nil || tag != berInteger {
+		return nil, errors.New("malformed version")
+	}
+	if decodeInt(v) != snmpVersion2c {
+		// Only SNMPv2c is supported, other versions are silently ignored
+		return nil, nil
+	}
+
+	tag, community, body, err := decodeTLV(body)
+	if err != nil || tag != berOctetString {
+		return nil, errors.New("malformed community")
+	}
+	if string(community) != a.community {
+		// RFC 3416 - requests with an unknown community are dropped
+		return nil, nil
+	}
+
+	pduType, pdu, _, err := decodeTLV(body)
+	if err != nil {
+		return nil, errors.New("malformed PDU")
+	}
+
+	// request-id, error-status/non-repeaters, error-index/max-repetitions
+	var fields [3]int64
+	var raw [3][]byte
+	for i := range fields {
+		tag, v, pdu, err = decodeTLV(pdu)
+		if err != nil || tag != berInteger {
+			return nil, errors.New("malformed PDU header")
+		}
+		fields[i] = decodeInt(v)
+		raw[i] = v
+	}
+
+	tag, vbList, _, err := decodeTLV(pdu)
+	if err != nil || tag != berSequence {
+		return nil, errors.New("malformed varbind list")
+	}
+
+	var oids [][]uint32
+	for len(vbList) > 0 {
+		var vb []byte
+		tag, vb, vbList, err = decodeTLV(vbList)
+		if err != nil || tag != berSequence {
+			return nil, errors.New("malformed varbind")
+		}
+		tag, v, _, err = decodeTLV(vb)
+		if err != nil || tag != berOID {
+			return nil, errors.New("malformed varbind OID")
+		}
+		oid, err := decodeOID(v)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+
+	// Room left for the varbinds by the headers of the response
+	room := snmpMaxResponse - len(community) - len(raw[0]) - 32
+
+	var varbinds []byte
+	var errorStatus int64
+	switch pduType {
+	case snmpGetRequest:
+		for _, oid := range oids {
+			varbinds = append(varbinds, a.get(oid)...)
+		}
+	case snmpGetNext:
+		for _, oid := range oids {
+			varbinds = append(varbinds, a.getNext(oid)...)
+		}
+	case snmpGetBulk:
+		// Responses too large to fit carry fewer varbinds (RFC 3416)
+		nonRepeaters := int(max(fields[1], 0))
+		maxRepetitions := int(min(max(fields[2], 0), 64))
+	bulk:
+		for i, oid := range oids {
+			if i < nonRepeaters {
+				vb := a.getNext(oid)
+				if len(varbinds)+len(vb) > room {
+					break bulk
+				}
+				varbinds = append(varbinds, vb...)
+				continue
+			}
+			cur := oid
+			for r := 0; r < maxRepetitions; r++ {
+				vb, next := a.next(cur)
+				if len(varbinds)+len(vb) > room {
+					break bulk
+				}
+				varbinds = append(varbinds, vb...)
+				if next == nil {
+					break
+				}
+				cur = next
+			}
+		}
+	default:
+		// Set and other PDUs are not supported by this read-only agent
+		return nil, fmt.Errorf("unsupported PDU type 0x%02x", pduType)
+	}
+	if len(varbinds) > room {
+		errorStatus, varbinds = snmpTooBig, nil
+	}
+
+	resp := encodeTLV(berInteger, raw[0])
+	resp = append(resp, encodeInt(berInteger, errorStatus)...) // error-status
+	resp = append(resp, encodeInt(berInteger, 0)...)           // error-index
+	resp = append(resp, encodeTLV(berSequence, varbinds)...)
+
+	out := encodeInt(berInteger, snmpVersion2c)
+	out = append(out, encodeTLV(berOctetString, community)...)
+	out = append(out, encodeTLV(snmpResponse, resp)...)
+	return encodeTLV(berSequence, out), nil
+}
+
+// get returns the varbind for an exact OID
+func (a *SNMPAgent) get(oid []uint32) []byte {
+	for _, obj := range a.objects {
+		if compareOID(obj.oid, oid) == 0 {
+			return encodeVarbind(oid, obj.value())
+		}
+	}
+	return encodeVarbind(oid, encodeTLV(snmpNoSuchObj, nil))
+}
+
+// getNext returns the varbind of the object following oid
+func (a *SNMPAgent) getNext(oid []uint32) []byte {
+	vb, _ := a.next(oid)
+	return vb
+}
+
+// next returns the varbind of the object following oid and its OID, or an
+// endOfMibView varbind and nil if there is none
+func (a *SNMPAgent) next(oid []uint32) ([]byte, []uint32) {
+	for _, obj := range a.objects {
+		if compareOID(obj.oid, oid) > 0 {
+			return encodeVarbind(obj.oid, obj.value()), obj.oid
+		}
+	}
+	return encodeVarbind(oid, encodeTLV(snmpEndOfMib, nil)), nil
+}
+
+// encodeVarbind encodes an OID/value pair
+func encodeVarbind(oid []uint32, value snmpValue) []byte {
+	return encodeTLV(berSequence, append(encodeTLV(berOID, encodeOID(oid)), value...))
+}
+
+// encodeTLV encodes a BER tag-length-value triplet
+func encodeTLV(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	switch l := len(value); {
+	case l < 0x80:
+		out = append(out, byte(l))
+	case l < 0x100:
+		out = append(out, 0x81, byte(l))
+	default:
+		out = append(out, 0x82, byte(l>>8), byte(l))
+	}
+	return append(out, value...)
+}
+
+// decodeTLV decodes a BER tag-length-value triplet, returning the remaining bytes
+func decodeTLV(buf []byte) (byte, []byte, []byte, error) {
+	if len(buf) < 2 {
+		return 0, nil, nil, errors.New("truncated TLV")
+	}
+	tag := buf[0]
+	length := int(buf[1])
+	buf = buf[2:]
+
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 2 || len(buf) < n {
+			return 0, nil, nil, errors.New("unsupported TLV length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			length = length<<8 | int(buf[i])
+		}
+		buf = buf[n:]
+	}
+
+	if len(buf) < length {
+		return 0, nil, nil, errors.New("truncated TLV value")
+	}
+	return tag, buf[:length], buf[length:], nil
+}
+
+// encodeInt encodes a signed integer with the given tag
+func encodeInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if (v < 0x80 && v >= -0x80) || len(b) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return encodeTLV(tag, b)
+}
+
+// encodeUnsigned encodes an unsigned integer with the given tag
+func encodeUnsigned(tag byte, v uint64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		// Prevent the value from being interpreted as negative
+		b = append([]byte{0}, b...)
+	}
+	return encodeTLV(tag, b)
+}
+
+// decodeInt decodes a BER signed integer
+func decodeInt(b []byte) int64 {
+	if len(b) == 0 || len(b) > 8 {
+		return 0
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+// encodeOID encodes an object identifier body
+func encodeOID(oid []uint32) []byte {
+	if len(oid) < 2 {
+		return []byte{0}
+	}
+	out := encodeBase128(nil, oid[0]*40+oid[1])
+	for _, id := range oid[2:] {
+		out = encodeBase128(out, id)
+	}
+	return out
+}
+
+// encodeBase128 appends a base-128 encoded sub-identifier
+func encodeBase128(out []byte, v uint32) []byte {
+	var tmp [5]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7f) | 0x80
+	}
+	return append(out, tmp[i:]...)
+}
+
+// decodeOID decodes an object identifier body
+func decodeOID(b []byte) ([]uint32, error) {
+	var ids []uint32
+	var v uint32
+	for i, c := range b {
+		if v > 0x1ffffff {
+			return nil, errors.New("OID sub-identifier overflow")
+		}
+		v = v<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return nil, errors.New("truncated OID")
+			}
+			continue
+		}
+		if len(ids) == 0 {
+			first := min(v/40, 2)
+			ids = append(ids, first, v-first*40)
+		} else {
+			ids = append(ids, v)
+		}
+		v = 0
+	}
+	return ids, nil
+}
+
+// parseOID parses a dotted OID string
+func parseOID(s string) ([]uint32, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("OID %q is too short", s)
+	}
+	oid := make([]uint32, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q: %v", s, err)
+		}
+		oid[i] = uint32(v)
+	}
+	return oid, nil
+}
+
+// compareOID compares two OIDs in lexicographic order
+func compareOID(a, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
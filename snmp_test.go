@@ -0,0 +1,95 @@
+package pppoeproxy
+
+import (
+	"testing"
+)
+
+// snmpRequest encodes an SNMPv2c request of the given PDU type
+func snmpRequest(community string, pduType byte, nonRepeaters, maxRepetitions int64, oids ...[]uint32) []byte {
+	var varbinds []byte
+	for _, oid := range oids {
+		varbinds = append(varbinds, encodeVarbind(oid, encodeTLV(berNull, nil))...)
+	}
+	pdu := encodeInt(berInteger, 42)
+	pdu = append(pdu, encodeInt(berInteger, nonRepeaters)...)
+	pdu = append(pdu, encodeInt(berInteger, maxRepetitions)...)
+	pdu = append(pdu, encodeTLV(berSequence, varbinds)...)
+
+	msg := encodeInt(berInteger, snmpVersion2c)
+	msg = append(msg, encodeTLV(berOctetString, []byte(community))...)
+	msg = append(msg, encodeTLV(pduType, pdu)...)
+	return encodeTLV(berSequence, msg)
+}
+
+// testSNMPAgent returns an agent that is not listening
+func testSNMPAgent(t testing.TB) *SNMPAgent {
+	base, err := parseOID(DefaultSNMPBaseOID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &SNMPAgent{community: "public"}
+	a.registerObjects(base)
+	return a
+}
+
+func TestSNMPResponseSize(t *testing.T) {
+	a := testSNMPAgent(t)
+	var oids [][]uint32
+	for i := 0; i < 6000; i++ {
+		oids = append(oids, []uint32{1, 3})
+	}
+	for _, tt := range []struct {
+		pduType     byte
+		errorStatus int64
+	}{
+		{snmpGetNext, snmpTooBig},
+		{snmpGetBulk, 0},
+	} {
+		resp, err := a.handleMessage(snmpRequest("public", tt.pduType, 10, 64, oids...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp) > snmpMaxResponse {
+			t.Errorf("PDU 0x%02x: response of %d bytes", tt.pduType, len(resp))
+		}
+		_, msg, rest, err := decodeTLV(resp)
+		if err != nil || len(rest) > 0 {
+			t.Fatalf("PDU 0x%02x: malformed response", tt.pduType)
+		}
+		_, _, msg, _ = decodeTLV(msg) // version
+		_, _, msg, _ = decodeTLV(msg) // community
+		_, pdu, _, _ := decodeTLV(msg)
+		_, _, pdu, _ = decodeTLV(pdu) // request-id
+		_, status, pdu, _ := decodeTLV(pdu)
+		_, _, pdu, _ = decodeTLV(pdu) // error-index
+		_, varbinds, _, _ := decodeTLV(pdu)
+		if decodeInt(status) != tt.errorStatus || tt.errorStatus == 0 && len(varbinds) == 0 {
+			t.Errorf("PDU 0x%02x: error-status %d with %d bytes of varbinds", tt.pduType, decodeInt(status), len(varbinds))
+		}
+	}
+}
+
+func FuzzSNMPMessage(f *testing.F) {
+	base, _ := parseOID(DefaultSNMPBaseOID)
+	f.Add(snmpRequest("public", snmpGetRequest, 0, 0, []uint32{1, 3, 6, 1, 2, 1, 1, 1, 0}, append(base, 1, 0)))
+	f.Add(snmpRequest("public", snmpGetNext, 0, 0, []uint32{1, 3}))
+	f.Add(snmpRequest("public", snmpGetBulk, 1, 10, []uint32{1, 3, 6, 1, 2, 1, 1, 3, 0}, base))
+	f.Add(snmpRequest("private", snmpGetRequest, 0, 0, base))
+	a := testSNMPAgent(f)
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		resp, err := a.handleMessage(msg)
+		if err != nil || resp == nil {
+			return
+		}
+		// The response is a single well formed message
+		tag, body, rest, err := decodeTLV(resp)
+		if err != nil || tag != berSequence || len(rest) > 0 {
+			t.Fatalf("malformed response %x to %x", resp, msg)
+		}
+		for len(body) > 0 {
+			if _, _, body, err = decodeTLV(body); err != nil {
+				t.Fatalf("malformed response %x to %x: %v", resp, msg, err)
+			}
+		}
+	})
+}
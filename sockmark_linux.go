@@ -0,0 +1,16 @@
+package pppoeproxy
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// setMark sets the firewall mark of a socket with SO_MARK, used by policy
+// routing rules (ip rule add fwmark)
+func setMark(fd uintptr, mark uint32) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(mark)); err != nil {
+		return fmt.Errorf("failed to set firewall mark 0x%x: %v", mark, err)
+	}
+	return nil
+}
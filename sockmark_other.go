@@ -0,0 +1,13 @@
+//go:build !linux
+
+package pppoeproxy
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// setMark reports that sockets cannot be given a firewall mark
+func setMark(fd uintptr, mark uint32) error {
+	return fmt.Errorf("firewall marks are not supported on %s", runtime.GOOS)
+}
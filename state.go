@@ -0,0 +1,205 @@
+package pppoeproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State persistence settings
+const (
+	stateSaveInterval = 10 * time.Second // Interval between saves of the session table
+	stateMaxAge       = 5 * time.Minute  // Older states are ignored, their PPP sessions have timed out
+)
+
+// savedState is the content of the state file
+type savedState struct {
+	Saved    time.Time         `json:"saved"`
+	Sessions []savedSession    `json:"sessions"`
+	Owners   map[string]string `json:"owners,omitempty"` // Host MAC to tunnel client
+}
+
+// savedSession is a session of the state file
+type savedSession struct {
+	ID       uint16    `json:"id"`
+	HostMAC  string    `json:"host_mac"`
+	ACMAC    string    `json:"ac_mac"`
+	Owner    string    `json:"owner,omitempty"`
+	Started  time.Time `json:"started"`
+	LastSeen time.Time `json:"last_seen"`
+	IP       string    `json:"ip,omitempty"`
+	FramesRx uint64    `json:"frames_rx"`
+	FramesTx uint64    `json:"frames_tx"`
+	BytesRx  uint64    `json:"bytes_rx"`
+	BytesTx  uint64    `json:"bytes_tx"`
+
+	AuthProtocol string `json:"auth_protocol,omitempty"`
+	AuthSuccess  bool   `json:"auth_success,omitempty"`
+	AuthFailures uint64 `json:"auth_failures,omitempty"`
+
+	Renegotiations uint64    `json:"renegotiations,omitempty"`
+	Negotiated     time.Time `json:"negotiated"`
+}
+
+// snapshot returns the sessions and discovery owners of the table
+func (t *SessionTable) snapshot() savedState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := savedState{Owners: make(map[string]string, len(t.owners))}
+	for mac, owner := range t.owners {
+		st.Owners[net.HardwareAddr(mac).String()] = owner
+	}
+	for _, s := range t.sessions {
+		saved := savedSession{
+			ID:       s.ID,
+			HostMAC:  s.HostMAC.String(),
+			ACMAC:    s.ACMAC.String(),
+			Owner:    s.Owner,
+			Started:  s.Started,
+			LastSeen: s.LastSeen,
+			FramesRx: s.FramesRx,
+			FramesTx: s.FramesTx,
+			BytesRx:  s.BytesRx,
+			BytesTx:  s.BytesTx,
+
+			AuthProtocol: s.AuthProtocol,
+			AuthSuccess:  s.AuthSuccess,
+			AuthFailures: s.AuthFailures,
+
+			Renegotiations: s.Renegotiations,
+			Negotiated:     s.negotiated,
+		}
+		if s.IP.IsValid() {
+			saved.IP = s.IP.String()
+		}
+		st.Sessions = append(st.Sessions, saved)
+	}
+	return st
+}
+
+// restore adds saved sessions to the table without reporting them as new
+// sessions, and returns how many were restored
+func (t *SessionTable) restore(st savedState) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for mac, owner := range st.Owners {
+		if hw, err := net.ParseMAC(mac); err == nil {
+			t.owners[string(hw)] = owner
+		}
+	}
+	n := 0
+	for _, saved := range st.Sessions {
+		host, err1 := net.ParseMAC(saved.HostMAC)
+		ac, err2 := net.ParseMAC(saved.ACMAC)
+		if err1 != nil || err2 != nil || len(ac) != 6 {
+			continue
+		}
+		s := &SessionInfo{
+			ID:       saved.ID,
+			HostMAC:  host,
+			ACMAC:    ac,
+			Owner:    saved.Owner,
+			Started:  saved.Started,
+			LastSeen: saved.LastSeen,
+			FramesRx: saved.FramesRx,
+			FramesTx: saved.FramesTx,
+			BytesRx:  saved.BytesRx,
+			BytesTx:  saved.BytesTx,
+
+			AuthProtocol: saved.AuthProtocol,
+			AuthSuccess:  saved.AuthSuccess,
+			AuthFailures: saved.AuthFailures,
+
+			Renegotiations: saved.Renegotiations,
+			negotiated:     saved.Negotiated,
+		}
+		if s.LastSeen.IsZero() {
+			// Saved by a version that did not record it
+			s.LastSeen = st.Saved
+		}
+		if ip, err := netip.ParseAddr(saved.IP); err == nil {
+			s.IP = ip
+			sessionIPInfo.With(sessionIPLabels(s)...).Set(1)
+		}
+		key := sessionKey{ID: s.ID}
+		copy(key.AC[:], ac)
+		t.sessions[key] = s
+		n++
+	}
+	sessionsActive.Set(float64(len(t.sessions)))
+	return n
+}
+
+// loadState restores the session table saved by a previous run
+func (p *Proxy) loadState(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var st savedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	if age := time.Since(st.Saved); age > stateMaxAge {
+		log.Printf("Ignoring the sessions saved in %s %s ago", path, age.Round(time.Second))
+		return nil
+	}
+	if n := p.sessions.restore(st); n > 0 {
+		log.Printf("Restored %d session(s) from %s", n, path)
+	}
+	return nil
+}
+
+// saveState writes the session table to the state file, replacing it
+// atomically so a crash never leaves a truncated file
+func (p *Proxy) saveState() {
+	path := p.cfg().StateFile
+	if path == "" {
+		return
+	}
+	st := p.sessions.snapshot()
+	st.Saved = time.Now()
+	data, err := json.Marshal(st)
+	if err != nil {
+		log.Printf("Error saving state: %v", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		log.Printf("Error saving state: %v", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Error saving state: %v", err)
+	}
+}
+
+// saveStateLoop periodically saves the session table until the proxy is closed
+func (p *Proxy) saveStateLoop() {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closedCh:
+			return
+		case <-ticker.C:
+			p.saveState()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package pppoeproxy
+
+import "time"
+
+// Frame directions used in metric labels
+const (
+	DirectionRx = "rx" // Captured on the interface and sent into the tunnel
+	DirectionTx = "tx" // Received from the tunnel and injected on the interface
+)
+
+// startTime is used to report the process uptime
+var startTime = time.Now()
+
+// Core forwarding metrics
+var (
+	framesTotal = NewCounterVec("pppoeproxy_frames_total", "PPPoE frames forwarded", "type", "direction")
+	bytesTotal  = NewCounterVec("pppoeproxy_bytes_total", "PPPoE bytes forwarded", "type", "direction")
+	errorsTotal = NewCounterVec("pppoeproxy_errors_total", "Errors encountered while forwarding", "kind")
+	tunnelUp    = NewGauge("pppoeproxy_tunnel_up", "Whether the tunnel to the server is connected (client mode)")
+	tunnelPeers = NewGauge("pppoeproxy_tunnel_peers", "Number of connected tunnel peers")
+)
+
+// Error kinds used in the errors metric and in Error
+const (
+	ErrorRecv        = "recv"         // Error receiving from a raw socket
+	ErrorInject      = "inject"       // Error injecting a frame on the interface
+	ErrorTunnelRead  = "tunnel_read"  // Error reading from a tunnel connection
+	ErrorTunnelWrite = "tunnel_write" // Error writing to a tunnel connection
+	ErrorAuth        = "auth"         // Tunnel client or admin request rejected
+)
+
+// errorKinds lists the error kinds in display order
+var errorKinds = []string{ErrorRecv, ErrorInject, ErrorTunnelRead, ErrorTunnelWrite, ErrorAuth}
+
+func init() {
+	// Create the common series so they are reported before any traffic is seen
+	for _, typ := range []string{"discovery", "session"} {
+		for _, dir := range []string{DirectionRx, DirectionTx} {
+			framesTotal.With(typ, dir)
+			bytesTotal.With(typ, dir)
+		}
+	}
+	for _, kind := range errorKinds {
+		errorsTotal.With(kind)
+	}
+}
+
+// countFrame records a forwarded frame
+func countFrame(typ, direction string, size int) {
+	framesTotal.With(typ, direction).Inc()
+	bytesTotal.With(typ, direction).Add(uint64(size))
+}
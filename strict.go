@@ -0,0 +1,215 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Reasons the strict parser rejects a frame
+const (
+	RejectTruncated = "truncated"  // Shorter than its Ethernet, VLAN or PPPoE headers
+	RejectEthertype = "ethertype"  // Not a PPPoE ethertype
+	RejectAddress   = "address"    // Multicast source, or destination not valid for the code
+	RejectVersion   = "version"    // PPPoE version and type other than 1
+	RejectCode      = "code"       // Code not valid for the stage
+	RejectSessionID = "session-id" // Session ID not valid for the code
+	RejectLength    = "length"     // PPPoE payload length beyond the end of the frame
+	RejectTag       = "tag"        // Discovery tag extending beyond the payload
+	RejectPPP       = "ppp"        // Invalid PPP protocol, or control packet length inconsistent with the payload
+)
+
+// framesRejected counts the frames rejected by the strict parser
+var framesRejected = NewCounterVec("pppoeproxy_frames_rejected_total", "Malformed frames rejected by the strict parser", "direction", "reason")
+
+// ParseError describes why the strict parser rejected a frame
+type ParseError struct {
+	Reason string // One of the Reject* reasons
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return e.Msg
+}
+
+// rejectFrame returns a ParseError
+func rejectFrame(reason, format string, args ...any) *ParseError {
+	return &ParseError{Reason: reason, Msg: fmt.Sprintf(format, args...)}
+}
+
+// pppoeTag is a discovery tag
+type pppoeTag struct {
+	Type  uint16
+	Value []byte
+}
+
+// pppoeFrame is a PPPoE frame checked by parsePPPoE. Its slices point into
+// the frame.
+type pppoeFrame struct {
+	Dst, Src  net.HardwareAddr
+	EtherType uint16
+	Code      uint8
+	Session   uint16
+	Payload   []byte     // PPPoE payload, as long as its length field says
+	Tags      []pppoeTag // Tags of discovery frames, up to End-Of-List
+	Protocol  uint16     // PPP protocol of session frames
+}
+
+// parsePPPoE checks every header of a PPPoE frame against RFC 2516 and the
+// PPP encapsulation, and returns its fields. Nothing is read before the
+// length it depends on is checked, so any input is safe, and the fixed
+// offsets the rest of the proxy reads are within a frame it accepted.
+func parsePPPoE(frame []byte) (pppoeFrame, error) {
+	var f pppoeFrame
+	if len(frame) < ethernetHeaderSize {
+		return f, rejectFrame(RejectTruncated, "frame of %d bytes shorter than an Ethernet header", len(frame))
+	}
+	f.Dst, f.Src = net.HardwareAddr(frame[0:6]), net.HardwareAddr(frame[6:12])
+	if f.Src[0]&1 != 0 {
+		return f, rejectFrame(RejectAddress, "multicast source address %s", f.Src)
+	}
+
+	var off int
+	f.EtherType, off = framePayload(frame)
+	switch f.EtherType {
+	case PPPoEDiscovery, PPPoESession:
+	case etherTypeVLAN, etherTypeQinQ:
+		return f, rejectFrame(RejectTruncated, "frame of %d bytes ending in a VLAN tag", len(frame))
+	default:
+		return f, rejectFrame(RejectEthertype, "ethertype 0x%04x is not PPPoE", f.EtherType)
+	}
+	if len(frame) < off+pppoeHeaderSize {
+		return f, rejectFrame(RejectTruncated, "frame of %d bytes shorter than its PPPoE header", len(frame))
+	}
+	hdr := frame[off : off+pppoeHeaderSize]
+	if hdr[0] != 0x11 {
+		return f, rejectFrame(RejectVersion, "PPPoE version and type 0x%02x", hdr[0])
+	}
+	f.Code = hdr[1]
+	f.Session = binary.BigEndian.Uint16(hdr[2:4])
+	length := int(binary.BigEndian.Uint16(hdr[4:6]))
+	if rest := len(frame) - off - pppoeHeaderSize; length > rest {
+		return f, rejectFrame(RejectLength, "PPPoE payload length %d exceeds the %d bytes of the frame", length, rest)
+	}
+	// Bytes beyond the length are Ethernet padding
+	f.Payload = frame[off+pppoeHeaderSize : off+pppoeHeaderSize+length]
+
+	if f.EtherType == PPPoEDiscovery {
+		return f, f.parseDiscovery()
+	}
+	return f, f.parseSession()
+}
+
+// parseDiscovery checks the code, addresses, session ID and tags of a
+// discovery frame
+func (f *pppoeFrame) parseDiscovery() error {
+	switch f.Code {
+	case PADI:
+		if !isBroadcast(f.Dst) {
+			return rejectFrame(RejectAddress, "PADI to %s instead of the broadcast address", f.Dst)
+		}
+	case PADO, PADR, PADS, PADT:
+		if f.Dst[0]&1 != 0 {
+			return rejectFrame(RejectAddress, "%s to multicast address %s", pppoeCodeName(f.Code), f.Dst)
+		}
+	default:
+		return rejectFrame(RejectCode, "unknown discovery code 0x%02x", f.Code)
+	}
+
+	payload := f.Payload
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return rejectFrame(RejectTag, "%d trailing bytes after the last tag", len(payload))
+		}
+		tag := pppoeTag{Type: binary.BigEndian.Uint16(payload[0:2])}
+		length := int(binary.BigEndian.Uint16(payload[2:4]))
+		if length > len(payload)-4 {
+			return rejectFrame(RejectTag, "tag 0x%04x of %d bytes exceeds the %d bytes left", tag.Type, length, len(payload)-4)
+		}
+		if tag.Type == TagEndOfList {
+			break
+		}
+		tag.Value = payload[4 : 4+length]
+		f.Tags = append(f.Tags, tag)
+		payload = payload[4+length:]
+	}
+
+	switch f.Code {
+	case PADI, PADO, PADR:
+		if f.Session != 0 {
+			return rejectFrame(RejectSessionID, "%s with session ID 0x%04x", pppoeCodeName(f.Code), f.Session)
+		}
+	case PADS:
+		// A PADS refusing the session has session ID 0 and an error tag
+		if f.Session == 0 && !f.hasErrorTag() || f.Session == 0xffff {
+			return rejectFrame(RejectSessionID, "PADS with session ID 0x%04x", f.Session)
+		}
+	case PADT:
+		if f.Session == 0 || f.Session == 0xffff {
+			return rejectFrame(RejectSessionID, "PADT with session ID 0x%04x", f.Session)
+		}
+	}
+	return nil
+}
+
+// hasErrorTag reports whether the frame carries one of the error tags
+func (f *pppoeFrame) hasErrorTag() bool {
+	for _, tag := range f.Tags {
+		switch tag.Type {
+		case TagServiceNameErr, TagACSystemError, TagGenericError:
+			return true
+		}
+	}
+	return false
+}
+
+// parseSession checks the code, session ID and PPP header of a session frame
+func (f *pppoeFrame) parseSession() error {
+	if f.Code != 0 {
+		return rejectFrame(RejectCode, "session frame with code 0x%02x", f.Code)
+	}
+	if f.Session == 0 || f.Session == 0xffff {
+		return rejectFrame(RejectSessionID, "session frame with session ID 0x%04x", f.Session)
+	}
+	if len(f.Payload) < 2 {
+		return rejectFrame(RejectPPP, "session frame without PPP protocol")
+	}
+	f.Protocol = binary.BigEndian.Uint16(f.Payload[0:2])
+	// The low octet of a protocol number is odd and the high one even
+	if f.Protocol&0x0101 != 0x0001 {
+		return rejectFrame(RejectPPP, "invalid PPP protocol 0x%04x", f.Protocol)
+	}
+	if isControlProtocol(f.Protocol) {
+		ppp := f.Payload[2:]
+		if len(ppp) < 4 {
+			return rejectFrame(RejectPPP, "%s packet of %d bytes shorter than its header", pppProtocolName(f.Protocol), len(ppp))
+		}
+		if length := int(binary.BigEndian.Uint16(ppp[2:4])); length < 4 || length > len(ppp) {
+			return rejectFrame(RejectPPP, "%s packet length %d inconsistent with the %d bytes of the payload", pppProtocolName(f.Protocol), length, len(ppp))
+		}
+	}
+	return nil
+}
+
+// isBroadcast reports whether mac is the broadcast address
+func isBroadcast(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// checkStrict reports whether a frame can be processed: with StrictParsing,
+// frames the strict parser rejects are counted by reason and dropped
+func (p *Proxy) checkStrict(direction string, packet []byte) bool {
+	if !p.cfg().StrictParsing {
+		return true
+	}
+	if _, err := parsePPPoE(packet); err != nil {
+		framesRejected.With(direction, err.(*ParseError).Reason).Inc()
+		return false
+	}
+	return true
+}
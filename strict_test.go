@@ -0,0 +1,82 @@
+package pppoeproxy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// testFrames are well-formed frames used as fuzzing seeds
+var testFrames = [][]byte{
+	// PADI with Service-Name and Host-Uniq
+	{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x88, 0x63,
+		0x11, PADI, 0x00, 0x00, 0x00, 0x0c,
+		0x01, 0x01, 0x00, 0x00, 0x01, 0x03, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef,
+	},
+	// PADO with AC-Name, AC-Cookie and End-Of-List, then padding
+	{
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x88, 0x63,
+		0x11, PADO, 0x00, 0x00, 0x00, 0x12,
+		0x01, 0x02, 0x00, 0x02, 'a', 'c', 0x01, 0x04, 0x00, 0x04, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	},
+	// PADS refusing the session
+	{
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x88, 0x63,
+		0x11, PADS, 0x00, 0x00, 0x00, 0x06, 0x02, 0x03, 0x00, 0x02, 'n', 'o',
+	},
+	// PADT on VLAN 10
+	{
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x81, 0x00, 0x00, 0x0a, 0x88, 0x63,
+		0x11, PADT, 0x12, 0x34, 0x00, 0x00,
+	},
+	// LCP Configure-Request of session 0x1234
+	{
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x88, 0x64,
+		0x11, 0x00, 0x12, 0x34, 0x00, 0x0a, 0xc0, 0x21, 0x01, 0x01, 0x00, 0x08, 0x05, 0x06, 0x00, 0x01,
+	},
+	// IPv4 frame of session 0x1234 in QinQ tags
+	{
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x02, 0x88, 0xa8, 0x00, 0x64, 0x81, 0x00, 0x00, 0x0a,
+		0x88, 0x64, 0x11, 0x00, 0x12, 0x34, 0x00, 0x06, 0x00, 0x21, 0x45, 0x00, 0x00, 0x00,
+	},
+}
+
+func FuzzParsePPPoE(f *testing.F) {
+	for _, frame := range testFrames {
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		p, err := parsePPPoE(frame)
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.Reason == "" {
+				t.Fatalf("error %v without reason", err)
+			}
+			return
+		}
+		_, off := framePayload(frame)
+		if off+pppoeHeaderSize+len(p.Payload) > len(frame) {
+			t.Fatalf("payload of %d bytes beyond the frame", len(p.Payload))
+		}
+		if p.EtherType != PPPoEDiscovery {
+			return
+		}
+
+		// Rebuilding the tags gives a frame with the same fields
+		out := rebuildDiscovery(frame, p.Tags)
+		q, err := parsePPPoE(out)
+		if err != nil {
+			t.Fatalf("rebuilt frame %x rejected: %v", out, err)
+		}
+		if q.Code != p.Code || q.Session != p.Session || len(q.Tags) != len(p.Tags) {
+			t.Fatalf("rebuilt frame %x differs from %x", out, frame)
+		}
+		for i := range p.Tags {
+			if q.Tags[i].Type != p.Tags[i].Type || !bytes.Equal(q.Tags[i].Value, p.Tags[i].Value) {
+				t.Fatalf("tag %d rebuilt as %+v, was %+v", i, q.Tags[i], p.Tags[i])
+			}
+		}
+	})
+}
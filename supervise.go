@@ -0,0 +1,105 @@
+package pppoeproxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packet loop supervision: a receive error pauses the loop with backoff
+// instead of stopping it, and failures repeating within loopFailureWindow are
+// reported as persistent and make the proxy unhealthy
+const (
+	loopFailureLimit  = 5
+	loopFailureWindow = time.Minute
+)
+
+// Packet loop metrics
+var (
+	loopRestarts = NewCounterVec("pppoeproxy_packet_loop_restarts_total", "Packet loop restarts after a receive error", "type")
+	loopUp       = NewGaugeVec("pppoeproxy_packet_loop_up", "Whether the packet loop is receiving (1) or waiting to restart after an error (0)", "type")
+)
+
+// loopSupervisor tracks the receive errors of a packet loop
+type loopSupervisor struct {
+	kind     string        // "discovery" or "session"
+	received atomic.Bool   // Set when a frame was received since the last failure
+	closing  chan struct{} // Closed when the handler is closed
+	mu       sync.Mutex
+	backoff  Backoff
+	failures []time.Time // Failures within loopFailureWindow
+	lastErr  error
+}
+
+// newLoopSupervisor returns the supervisor of a packet loop
+func newLoopSupervisor(kind string) *loopSupervisor {
+	loopUp.With(kind).Set(1)
+	return &loopSupervisor{
+		kind:    kind,
+		closing: make(chan struct{}),
+		backoff: Backoff{Min: 100 * time.Millisecond, Max: 30 * time.Second, Factor: 2, Jitter: 0.1},
+	}
+}
+
+// failed records a receive error and returns the delay before the loop
+// restarts, and an error when failures have become persistent, once per run
+// of failures
+func (s *loopSupervisor) failed(err error) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.received.Swap(false) {
+		s.backoff.Reset()
+	}
+	now := time.Now()
+	s.failures = append(s.recentLocked(now), now)
+	s.lastErr = err
+
+	var persistent error
+	if len(s.failures) == loopFailureLimit {
+		persistent = fmt.Errorf("%s packet loop failed %d times within %s: %w", s.kind, loopFailureLimit, loopFailureWindow, err)
+	}
+	return s.backoff.Next(), persistent
+}
+
+// recentLocked returns the failures within loopFailureWindow. s.mu must be
+// held.
+func (s *loopSupervisor) recentLocked(now time.Time) []time.Time {
+	for len(s.failures) > 0 && now.Sub(s.failures[0]) > loopFailureWindow {
+		s.failures = s.failures[1:]
+	}
+	return s.failures
+}
+
+// restart waits for delay before the loop receives again, and returns false if
+// the handler is closed meanwhile
+func (s *loopSupervisor) restart(delay time.Duration) bool {
+	loopUp.With(s.kind).Set(0)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-s.closing:
+		return false
+	case <-timer.C:
+	}
+	loopRestarts.With(s.kind).Inc()
+	loopUp.With(s.kind).Set(1)
+	return true
+}
+
+// close ends a pending restart
+func (s *loopSupervisor) close() {
+	close(s.closing)
+}
+
+// health returns an error if the loop failed repeatedly within
+// loopFailureWindow
+func (s *loopSupervisor) health() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.recentLocked(time.Now())); n >= loopFailureLimit {
+		return fmt.Errorf("%s packet loop failed %d times within %s: %v", s.kind, n, loopFailureWindow, s.lastErr)
+	}
+	return nil
+}
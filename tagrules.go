@@ -0,0 +1,200 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Actions of tag rules
+const (
+	TagStrip = "strip" // Remove the tags of the type
+	TagSet   = "set"   // Replace the value of the tags of the type, adding one if there is none
+	TagAdd   = "add"   // Append a tag
+)
+
+// tagsRewritten counts the tags changed by the tag rules
+var tagsRewritten = NewCounterVec("pppoeproxy_tags_rewritten_total", "Discovery tags stripped, set or added by the tag rules", "direction", "action")
+
+// tagNames maps the names of the discovery tags of RFC 2516 to their type
+var tagNames = map[string]uint16{
+	"service-name":       TagServiceName,
+	"ac-name":            TagACName,
+	"host-uniq":          TagHostUniq,
+	"ac-cookie":          TagACCookie,
+	"vendor-specific":    TagVendorSpecific,
+	"relay-session-id":   TagRelaySessionID,
+	"service-name-error": TagServiceNameErr,
+	"ac-system-error":    TagACSystemError,
+	"generic-error":      TagGenericError,
+}
+
+// tagRule is a change made to the tags of discovery frames
+type tagRule struct {
+	action string
+	tag    uint16
+	value  []byte
+}
+
+// TagRules strips, sets or adds tags of the discovery frames proxied,
+// separately for each direction, for access concentrators or clients picky
+// about the tags they get
+type TagRules struct {
+	rules map[string][]tagRule // By direction
+}
+
+// ParseTagRules builds tag rules from a comma separated list of
+// "<action>:<tag>[=<value>]" entries, where action is strip, set or add, and
+// tag a name (Service-Name, AC-Name, Host-Uniq, AC-Cookie, Vendor-Specific,
+// Relay-Session-Id, Service-Name-Error, AC-System-Error, Generic-Error) or
+// number. The value is text, or hex bytes when prefixed with "0x", and may be
+// empty. Entries prefixed with "rx:" only apply to the frames captured on the
+// interface, and "tx:" to the frames received from the tunnel; others apply
+// to both. Rules apply in order.
+func ParseTagRules(list string) (*TagRules, error) {
+	r := &TagRules{rules: make(map[string][]tagRule)}
+	for _, entry := range splitList(list) {
+		directions := []string{DirectionRx, DirectionTx}
+		if dir, rest, ok := strings.Cut(entry, ":"); ok && (dir == DirectionRx || dir == DirectionTx) {
+			directions = []string{dir}
+			entry = rest
+		}
+		rule, err := parseTagRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range directions {
+			r.rules[dir] = append(r.rules[dir], rule)
+		}
+	}
+	return r, nil
+}
+
+// parseTagRule parses a rule without its direction
+func parseTagRule(entry string) (tagRule, error) {
+	var rule tagRule
+	action, spec, ok := strings.Cut(entry, ":")
+	if !ok {
+		return rule, fmt.Errorf("invalid tag rule %q (<action>:<tag>[=<value>])", entry)
+	}
+	rule.action = strings.ToLower(action)
+	name, value, hasValue := strings.Cut(spec, "=")
+	switch rule.action {
+	case TagStrip:
+		if hasValue {
+			return rule, fmt.Errorf("invalid tag rule %q: strip takes no value", entry)
+		}
+	case TagSet, TagAdd:
+		if !hasValue {
+			return rule, fmt.Errorf("invalid tag rule %q: %s needs a value", entry, rule.action)
+		}
+	default:
+		return rule, fmt.Errorf("invalid tag rule action %q (strip, set or add)", action)
+	}
+
+	var err error
+	if rule.tag, err = parseTagType(name); err != nil {
+		return rule, err
+	}
+	if digits, ok := strings.CutPrefix(value, "0x"); ok {
+		if rule.value, err = hex.DecodeString(digits); err != nil {
+			return rule, fmt.Errorf("invalid tag value %q", value)
+		}
+	} else {
+		rule.value = []byte(value)
+	}
+	if len(rule.value) > 0xffff {
+		return rule, fmt.Errorf("tag value of %d bytes too long", len(rule.value))
+	}
+	return rule, nil
+}
+
+// parseTagType parses a discovery tag name or number
+func parseTagType(s string) (uint16, error) {
+	if tag, ok := tagNames[strings.ToLower(s)]; ok {
+		return tag, nil
+	}
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid discovery tag %q", s)
+	}
+	if v == TagEndOfList {
+		return 0, fmt.Errorf("the End-Of-List tag cannot be changed")
+	}
+	return uint16(v), nil
+}
+
+// Apply returns a discovery frame (including the Ethernet header) going in
+// direction with the tags changed by the rules, or the frame itself when no
+// rule changed it. Frames the strict parser rejects are not changed. A nil
+// TagRules changes nothing.
+func (r *TagRules) Apply(direction string, packet []byte) []byte {
+	if r == nil || len(r.rules[direction]) == 0 {
+		return packet
+	}
+	f, err := parsePPPoE(packet)
+	if err != nil || f.EtherType != PPPoEDiscovery {
+		return packet
+	}
+
+	// The tags are a slice of their own, only their values point into the
+	// frame
+	tags := f.Tags
+	changed := false
+	for _, rule := range r.rules[direction] {
+		switch rule.action {
+		case TagStrip:
+			n := len(tags)
+			tags = slices.DeleteFunc(tags, func(t pppoeTag) bool { return t.Type == rule.tag })
+			if len(tags) != n {
+				tagsRewritten.With(direction, rule.action).Add(uint64(n - len(tags)))
+				changed = true
+			}
+		case TagSet:
+			found := false
+			for i := range tags {
+				if tags[i].Type == rule.tag {
+					tags[i].Value = rule.value
+					found = true
+				}
+			}
+			if !found {
+				tags = append(tags, pppoeTag{rule.tag, rule.value})
+			}
+			tagsRewritten.With(direction, rule.action).Inc()
+			changed = true
+		case TagAdd:
+			tags = append(tags, pppoeTag{rule.tag, rule.value})
+			tagsRewritten.With(direction, rule.action).Inc()
+			changed = true
+		}
+	}
+	if !changed {
+		return packet
+	}
+
+	return rebuildDiscovery(packet, tags)
+}
+
+// rebuildDiscovery returns a copy of a discovery frame accepted by the strict
+// parser with the tags replaced, without the End-Of-List tag and the Ethernet
+// padding, or the frame itself if the tags do not fit
+func rebuildDiscovery(packet []byte, tags []pppoeTag) []byte {
+	_, off := framePayload(packet)
+	hdrEnd := off + pppoeHeaderSize
+	out := append([]byte(nil), packet[:hdrEnd]...)
+	for _, tag := range tags {
+		out = binary.BigEndian.AppendUint16(out, tag.Type)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(tag.Value)))
+		out = append(out, tag.Value...)
+	}
+	length := len(out) - hdrEnd
+	if length > 0xffff {
+		return packet
+	}
+	binary.BigEndian.PutUint16(out[hdrEnd-2:hdrEnd], uint16(length))
+	return out
+}
@@ -0,0 +1,38 @@
+package pppoeproxy
+
+import (
+	"errors"
+	"testing"
+)
+
+func FuzzTagRules(f *testing.F) {
+	for _, rules := range []string{
+		"strip:ac-cookie",
+		"rx:set:host-uniq=0xdeadbeef,tx:add:vendor-specific=0x00000de9",
+		"set:ac-name=proxy,strip:0x0103,add:generic-error=",
+	} {
+		for _, frame := range testFrames {
+			f.Add(rules, frame)
+		}
+	}
+	f.Fuzz(func(t *testing.T, rules string, frame []byte) {
+		r, err := ParseTagRules(rules)
+		if err != nil {
+			return
+		}
+		_, perr := parsePPPoE(frame)
+		for _, direction := range []string{DirectionRx, DirectionTx} {
+			out := r.Apply(direction, frame)
+			if perr != nil || &out[0] == &frame[0] {
+				continue
+			}
+			// Rules may remove tags a frame needs, but the tags are
+			// always well formed
+			_, err := parsePPPoE(out)
+			var rerr *ParseError
+			if errors.As(err, &rerr) && (rerr.Reason == RejectTag || rerr.Reason == RejectLength || rerr.Reason == RejectTruncated) {
+				t.Fatalf("%s rules %q turned %x into malformed %x: %v", direction, rules, frame, out, err)
+			}
+		}
+	})
+}
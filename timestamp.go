@@ -0,0 +1,70 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+)
+
+// timestampHeaderSize is the size of the header of a PacketTypeTimestamped
+// payload: the capture time of the frame in nanoseconds since the Unix epoch
+// (int64) and the packet type of the rest of the payload (uint16), both big
+// endian
+const timestampHeaderSize = 8 + 2
+
+// Forwarding latency metrics, measured by the receiver of timestamped frames
+var (
+	forwardLatency = NewHistogramVec("pppoeproxy_forward_latency_seconds", "One-way latency of the frames from their capture by the tunnel peer to their injection",
+		[]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}, "direction")
+	forwardLatencySkew = NewCounter("pppoeproxy_forward_latency_negative_total", "Timestamped frames injected before their capture time, the clocks of the tunnel peers are not synchronized")
+)
+
+// Directions of the forwarding latency
+const (
+	latencyClientToServer = "client_to_server"
+	latencyServerToClient = "server_to_client"
+)
+
+// unwrapTimestamped returns the capture time and the packet type and payload
+// of a timestamped payload
+func unwrapTimestamped(data []byte) (time.Time, uint16, []byte, error) {
+	if len(data) < timestampHeaderSize {
+		return time.Time{}, 0, nil, fmt.Errorf("timestamped packet too short: %d bytes", len(data))
+	}
+	captured := time.Unix(0, int64(binary.BigEndian.Uint64(data[0:8])))
+	packetType := binary.BigEndian.Uint16(data[8:10])
+	switch packetType {
+	case PacketTypeDiscovery, PacketTypeSession, PacketTypeSequenced:
+	default:
+		return time.Time{}, 0, nil, fmt.Errorf("invalid timestamped packet type %d", packetType)
+	}
+	return captured, packetType, data[timestampHeaderSize:], nil
+}
+
+// handleTimestamped injects a timestamped frame and records its forwarding
+// latency
+func (p *Proxy) handleTimestamped(client *Client, data []byte) {
+	captured, packetType, frame, err := unwrapTimestamped(data)
+	if err == nil && packetType == PacketTypeSequenced {
+		packetType, frame, err = client.unwrapSequenced(frame)
+	}
+	if err != nil {
+		log.Printf("Invalid packet from %s: %v", client.remoteAddr, err)
+		return
+	}
+	if !p.injectFrame(client, packetType, frame) {
+		return
+	}
+
+	latency := time.Since(captured)
+	if latency < 0 {
+		forwardLatencySkew.Inc()
+		return
+	}
+	direction := latencyServerToClient
+	if p.isServer {
+		direction = latencyClientToServer
+	}
+	forwardLatency.With(direction).Observe(latency.Seconds())
+}
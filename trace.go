@@ -0,0 +1,153 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// pcapng options and values written by Tracer, in addition to the block
+// types of the reader
+const (
+	pcapngOptEnd       = 0
+	pcapngOptIfName    = 2
+	pcapngOptIfTsresol = 9
+	pcapngOptEPBFlags  = 2
+	pcapngFlagInbound  = 1
+	pcapngFlagOutbound = 2
+	pcapngNanoseconds  = 9 // if_tsresol of 10^-9 seconds
+)
+
+// tracedFrame is a frame kept by a Tracer, truncated to its snap length
+type tracedFrame struct {
+	time      time.Time
+	direction string
+	length    int // Length of the whole frame
+	data      []byte
+}
+
+// Tracer keeps the last frames forwarded in both directions in memory,
+// truncated to a snap length, so the traffic leading to a problem can be
+// inspected without having started a capture in advance
+type Tracer struct {
+	mu      sync.Mutex
+	snapLen int
+	frames  []tracedFrame // Ring buffer, the oldest frame at next once full
+	next    int
+	full    bool
+}
+
+// NewTracer returns a tracer keeping the last n frames, truncated to snapLen
+// bytes
+func NewTracer(n, snapLen int) *Tracer {
+	return &Tracer{snapLen: snapLen, frames: make([]tracedFrame, n)}
+}
+
+// Trace keeps a frame, replacing the oldest one once the buffer is full.
+// direction is DirectionRx for frames captured on the interface, DirectionTx
+// for frames injected. A nil Tracer does nothing.
+func (t *Tracer) Trace(direction string, frame []byte) {
+	if t == nil || len(t.frames) == 0 {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := &t.frames[t.next]
+	f.time, f.direction, f.length = now, direction, len(frame)
+	// Slots keep their buffer, so tracing does not allocate once the
+	// buffer went around
+	f.data = append(f.data[:0], frame[:min(len(frame), t.snapLen)]...)
+	t.next++
+	if t.next == len(t.frames) {
+		t.next, t.full = 0, true
+	}
+}
+
+// WritePcapng writes the frames kept, oldest first, as a pcapng capture of
+// an Ethernet interface named iface. Frames captured on the interface are
+// flagged inbound and frames injected outbound.
+func (t *Tracer) WritePcapng(w io.Writer, iface string) error {
+	var buf []byte
+	buf = appendPcapngBlock(buf, pcapngSHB, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint32(b, pcapngBOM)
+		b = binary.LittleEndian.AppendUint16(b, 1) // Version 1.0
+		b = binary.LittleEndian.AppendUint16(b, 0)
+		return binary.LittleEndian.AppendUint64(b, ^uint64(0)) // Section length not given
+	})
+	buf = appendPcapngBlock(buf, pcapngIDB, func(b []byte) []byte {
+		b = binary.LittleEndian.AppendUint16(b, linkTypeEther)
+		b = binary.LittleEndian.AppendUint16(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, uint32(t.snapLen))
+		b = appendPcapngOption(b, pcapngOptIfName, []byte(iface))
+		b = appendPcapngOption(b, pcapngOptIfTsresol, []byte{pcapngNanoseconds})
+		return appendPcapngOption(b, pcapngOptEnd, nil)
+	})
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	// Copy the frames so the buffer is not locked while writing to a
+	// slow client
+	t.mu.Lock()
+	frames := make([]tracedFrame, 0, len(t.frames))
+	if t.full {
+		frames = append(frames, t.frames[t.next:]...)
+	}
+	frames = append(frames, t.frames[:t.next]...)
+	for i := range frames {
+		frames[i].data = append([]byte(nil), frames[i].data...)
+	}
+	t.mu.Unlock()
+
+	for _, f := range frames {
+		flags := uint32(pcapngFlagInbound)
+		if f.direction == DirectionTx {
+			flags = pcapngFlagOutbound
+		}
+		buf = appendPcapngBlock(buf[:0], pcapngEPB, func(b []byte) []byte {
+			ts := uint64(f.time.UnixNano())
+			b = binary.LittleEndian.AppendUint32(b, 0) // Interface ID
+			b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+			b = binary.LittleEndian.AppendUint32(b, uint32(ts))
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(f.data)))
+			b = binary.LittleEndian.AppendUint32(b, uint32(f.length))
+			b = appendPcapngPadded(b, f.data)
+			b = appendPcapngOption(b, pcapngOptEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+			return appendPcapngOption(b, pcapngOptEnd, nil)
+		})
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendPcapngBlock appends a block whose body is appended by body, framed by
+// its type and total length
+func appendPcapngBlock(b []byte, blockType uint32, body func([]byte) []byte) []byte {
+	start := len(b)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, 0) // Filled in below
+	b = body(b)
+	length := uint32(len(b) - start + 4)
+	binary.LittleEndian.PutUint32(b[start+4:], length)
+	return binary.LittleEndian.AppendUint32(b, length)
+}
+
+// appendPcapngOption appends an option, padded to 32 bits
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return appendPcapngPadded(b, value)
+}
+
+// appendPcapngPadded appends data padded to 32 bits
+func appendPcapngPadded(b, data []byte) []byte {
+	b = append(b, data...)
+	if n := len(data) % 4; n != 0 {
+		b = append(b, make([]byte, 4-n)...)
+	}
+	return b
+}
@@ -0,0 +1,96 @@
+package pppoeproxy
+
+import "time"
+
+// Tunnel rate limiting metrics
+var tunnelLimited = NewCounterVec("pppoeproxy_tunnel_rate_limited_total", "Tunnel packets delayed to keep the tunnel within its rate", "direction")
+
+// tunnelLimiter caps the tunnel throughput in one direction, for all the
+// peers together
+type tunnelLimiter struct {
+	rate   float64 // Bits per second
+	burst  int     // Bytes
+	bucket *TokenBucket
+}
+
+// newTunnelLimiter returns a limiter of rate bits per second with a burst of
+// burst bytes (0 for a tenth of a second at the rate), or nil if rate is 0
+func newTunnelLimiter(rate float64, burst int) *tunnelLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	size := float64(burst)
+	if size <= 0 {
+		size = rate / 8 / 10
+	}
+	return &tunnelLimiter{
+		rate:   rate,
+		burst:  burst,
+		bucket: NewTokenBucket(rate/8, max(size, minShaperBurst)),
+	}
+}
+
+// setTunnelLimits applies the tunnel rates of the configuration. Limiters
+// whose settings did not change are kept, with their tokens.
+func (p *Proxy) setTunnelLimits(cfg *Config) {
+	update := func(cur *tunnelLimiter, rate float64) *tunnelLimiter {
+		if cur != nil && cur.rate == rate && cur.burst == cfg.TunnelBurst {
+			return cur
+		}
+		return newTunnelLimiter(rate, cfg.TunnelBurst)
+	}
+	p.tunnelOut.Store(update(p.tunnelOut.Load(), cfg.TunnelRateOut))
+	p.tunnelIn.Store(update(p.tunnelIn.Load(), cfg.TunnelRateIn))
+}
+
+// wait waits until n bytes are within the rate, and returns false if done is
+// closed meanwhile. It reports whether it had to wait.
+func (l *tunnelLimiter) wait(n int, done <-chan struct{}) (bool, bool) {
+	size := min(float64(n), l.bucket.burst) // Larger packets would never fit
+	delay := l.bucket.delayN(size)
+	if delay == 0 {
+		return true, false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for delay > 0 {
+		select {
+		case <-done:
+			return false, true
+		case <-timer.C:
+		}
+		if delay = l.bucket.delayN(size); delay > 0 {
+			timer.Reset(delay)
+		}
+	}
+	return true, true
+}
+
+// waitTunnelOut waits until a frame of n bytes may be sent into the tunnel,
+// and returns false if done is closed meanwhile
+func (p *Proxy) waitTunnelOut(n int, done <-chan struct{}) bool {
+	l := p.tunnelOut.Load()
+	if l == nil {
+		return true
+	}
+	ok, waited := l.wait(n, done)
+	if waited {
+		tunnelLimited.With("out").Inc()
+	}
+	return ok
+}
+
+// waitTunnelIn waits until n bytes read from the tunnel are within the
+// incoming rate, so the peers are slowed down by TCP flow control, and
+// returns false if the proxy was closed meanwhile
+func (p *Proxy) waitTunnelIn(n int) bool {
+	l := p.tunnelIn.Load()
+	if l == nil {
+		return true
+	}
+	ok, waited := l.wait(n, p.closedCh)
+	if waited {
+		tunnelLimited.With("in").Inc()
+	}
+	return ok
+}
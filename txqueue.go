@@ -0,0 +1,194 @@
+package pppoeproxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// txQueueSize is the number of frames the send queues of a peer hold together
+const txQueueSize = 512
+
+// Send queues of a tunnel peer, by priority, also naming the kinds of frames
+const (
+	txQueueControl = "control" // Discovery and PPP control frames
+	txQueueData    = "data"    // Other session frames
+)
+
+// txFrame is a captured frame waiting to be sent into the tunnel
+type txFrame struct {
+	packetType uint16
+	data       []byte // Shared by the peers a frame is broadcast to
+	captured   time.Time
+	control    bool      // Discovery or PPP control frame
+	queued     time.Time // Set when a delay is emulated only
+}
+
+// newTxFrame copies a captured frame to queue it
+func newTxFrame(packetType uint16, packet []byte, captured time.Time) txFrame {
+	return txFrame{
+		packetType: packetType,
+		data:       append([]byte(nil), packet...),
+		captured:   captured,
+		control:    isControlFrame(packetType, packet),
+	}
+}
+
+// txQueue holds the frames waiting to be sent to a tunnel peer. Discovery and
+// PPP control frames (LCP, authentication, NCPs) are sent ahead of the other
+// session frames, so sessions are established and kept alive on a congested
+// tunnel.
+type txQueue struct {
+	ready     chan struct{} // Signaled when a frame was queued
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	control []txFrame
+	data    []txFrame
+
+	// Flow control, once the peer announced credits (see credit.go)
+	limited                     bool
+	controlCredits, dataCredits int // Frames of each kind the peer accepts
+	controlSent, dataSent       int
+}
+
+// newTxQueue returns an empty queue
+func newTxQueue() *txQueue {
+	return &txQueue{
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// push queues a frame. When the queues are full, the frame dropped according
+// to policy is returned, which may be f itself. Control frames are never
+// dropped for a data frame.
+func (q *txQueue) push(f txFrame, policy DropPolicy) (txFrame, bool) {
+	q.mu.Lock()
+	var dropped txFrame
+	full := len(q.control)+len(q.data) >= txQueueSize
+	if full {
+		switch {
+		case policy == DropHead && f.control && len(q.control) > 0:
+			dropped = shift(&q.control)
+		case policy == DropHead && len(q.data) > 0:
+			// The oldest data frame for a data frame, or for a control
+			// frame when no control frame is queued
+			dropped = shift(&q.data)
+		case policy == DropKeepControl && f.control && len(q.data) > 0:
+			dropped = shift(&q.data)
+		default:
+			q.mu.Unlock()
+			return f, true
+		}
+	}
+	if f.control {
+		q.control = append(q.control, f)
+	} else {
+		q.data = append(q.data, f)
+	}
+	q.mu.Unlock()
+	q.signal()
+	return dropped, full
+}
+
+// signal wakes up pop
+func (q *txQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the next frame to send, control frames first, and returns
+// false once the queue is closed. Frames of a kind the peer granted no
+// credits for wait.
+func (q *txQueue) pop() (txFrame, bool) {
+	for {
+		q.mu.Lock()
+		for _, queue := range []*[]txFrame{&q.control, &q.data} {
+			if len(*queue) > 0 && q.sendableLocked(queue == &q.control) {
+				f := shift(queue)
+				q.mu.Unlock()
+				return f, true
+			}
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.closed:
+			return txFrame{}, false
+		case <-q.ready:
+		}
+	}
+}
+
+// len returns the number of control and other frames waiting
+func (q *txQueue) len() (control, data int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.control), len(q.data)
+}
+
+// close drops the queued frames and ends pop
+func (q *txQueue) close() {
+	q.closeOnce.Do(func() { close(q.closed) })
+}
+
+// queueFrame queues a captured frame for a tunnel peer
+func (p *Proxy) queueFrame(peer *Client, f txFrame) {
+	cfg := p.cfg()
+	if cfg.Chaos != nil || cfg.TunnelDelayOut > 0 || cfg.TunnelJitterOut > 0 {
+		f.queued = time.Now()
+	}
+	policy := cfg.TunnelQueueDrop.or(DropKeepControl)
+	if dropped, ok := peer.tx.push(f, policy); ok {
+		policy.countDrop("tunnel", dropped)
+	}
+}
+
+// sendQueued sends the frames queued for a tunnel peer, within the outgoing
+// tunnel rate, until the peer is closed
+func (p *Proxy) sendQueued(peer *Client) {
+	var hold chaosHold
+	batch := make([]txFrame, 0, 2)
+	for {
+		f, ok := peer.tx.pop()
+		if !ok {
+			return
+		}
+		cfg := p.cfg()
+		if delay := emulatedDelay(cfg.TunnelDelayOut, cfg.TunnelJitterOut); delay > 0 && !f.queued.IsZero() {
+			// The chaos delay adds up
+			f.queued = f.queued.Add(delay)
+			if !waitUntil(f.queued, peer.tx.closed) {
+				return
+			}
+		}
+		frames := append(batch[:0], f)
+		if chaos := cfg.Chaos; chaos != nil {
+			if frames, ok = p.chaosFrames(chaos, peer, f, &hold, batch[:0]); !ok {
+				return
+			}
+		}
+		for _, f := range frames {
+			if !p.waitTunnelOut(len(f.data), peer.tx.closed) {
+				return
+			}
+			peer.tx.spend(f.control)
+			if err := peer.WriteFrameAt(f.packetType, f.data, p.cfg().SequenceFrames, f.captured); err != nil {
+				p.reportError(ErrorTunnelWrite, peer.remoteAddr, err)
+				kind := "session"
+				if f.packetType == PacketTypeDiscovery {
+					kind = "discovery"
+				}
+				if p.isServer {
+					log.Printf("Error sending %s packet to client %s: %v", kind, peer.remoteAddr, err)
+				} else {
+					log.Printf("Error sending %s packet to server: %v", kind, err)
+				}
+			}
+		}
+	}
+}
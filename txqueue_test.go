@@ -0,0 +1,232 @@
+package pppoeproxy
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testTxFrame returns a control or data frame identified by id
+func testTxFrame(control bool, id int) txFrame {
+	return txFrame{packetType: PacketTypeSession, data: binary.BigEndian.AppendUint32(nil, uint32(id)), control: control}
+}
+
+// txFrameID returns the id of a frame from testTxFrame
+func txFrameID(f txFrame) int {
+	return int(binary.BigEndian.Uint32(f.data))
+}
+
+// dropTests describe the frame dropped from full queues holding control and
+// data frames, to make room for a control or data frame
+var dropTests = []struct {
+	policy        DropPolicy
+	control, data int // Frames queued
+	arriving      bool
+	dropped       string // "arriving", "control" or "data" for the oldest one
+}{
+	{DropTail, 10, 10, false, "arriving"},
+	{DropTail, 10, 10, true, "arriving"},
+	{DropHead, 10, 10, false, "data"},
+	{DropHead, 10, 10, true, "control"},
+	{DropHead, 0, 20, true, "data"},
+	{DropHead, 20, 0, false, "arriving"}, // Never a control frame for a data frame
+	{DropHead, 20, 0, true, "control"},
+	{DropKeepControl, 10, 10, false, "arriving"},
+	{DropKeepControl, 10, 10, true, "data"},
+	{DropKeepControl, 20, 0, true, "arriving"},
+	{DropKeepControl, 0, 20, false, "arriving"},
+}
+
+func TestTxQueueDrop(t *testing.T) {
+	for _, tt := range dropTests {
+		// Frame IDs give the arrival order, control and data frames
+		// alternating while both remain
+		q := newTxQueue()
+		total := txQueueSize
+		control := tt.control * total / (tt.control + tt.data)
+		id := 0
+		for c, d := 0, 0; c+d < total; id++ {
+			isControl := d >= total-control || (c < control && id%2 == 0)
+			if isControl {
+				c++
+			} else {
+				d++
+			}
+			if _, full := q.push(testTxFrame(isControl, id), tt.policy); full {
+				t.Fatalf("queue full after %d frames", id)
+			}
+		}
+		oldest := map[bool]int{true: -1, false: -1}
+		for _, queued := range append(append([]txFrame(nil), q.control...), q.data...) {
+			if oldest[queued.control] < 0 || txFrameID(queued) < oldest[queued.control] {
+				oldest[queued.control] = txFrameID(queued)
+			}
+		}
+
+		dropped, full := q.push(testTxFrame(tt.arriving, id), tt.policy)
+		if !full {
+			t.Fatalf("%s: queue of %d frames not full", tt.policy, total)
+		}
+		want := map[string]int{"arriving": id, "control": oldest[true], "data": oldest[false]}[tt.dropped]
+		if got := txFrameID(dropped); got != want || want < 0 {
+			t.Errorf("%s with %d control and %d data frames queued, control %v arriving: dropped frame %d (control %v), want %s frame %d",
+				tt.policy, len(q.control), len(q.data), tt.arriving, got, dropped.control, tt.dropped, want)
+		}
+		if c, d := q.len(); c+d != total {
+			t.Errorf("%s: %d frames queued after a drop", tt.policy, c+d)
+		}
+	}
+}
+
+func TestDropIndex(t *testing.T) {
+	for _, tt := range dropTests {
+		var queue []txFrame
+		oldest := map[bool]int{true: -1, false: -1}
+		for c, d := 0, 0; c < tt.control || d < tt.data; {
+			isControl := c < tt.control && (d >= tt.data || len(queue)%2 == 1)
+			if isControl {
+				c++
+			} else {
+				d++
+			}
+			if oldest[isControl] < 0 {
+				oldest[isControl] = len(queue)
+			}
+			queue = append(queue, testTxFrame(isControl, len(queue)))
+		}
+		want := map[string]int{"arriving": -1, "control": oldest[true], "data": oldest[false]}[tt.dropped]
+		if got := tt.policy.dropIndex(queue, testTxFrame(tt.arriving, len(queue))); got != want {
+			t.Errorf("%s with %d control and %d data frames queued, control %v arriving: dropped %d, want %d",
+				tt.policy, tt.control, tt.data, tt.arriving, got, want)
+		}
+	}
+}
+
+func TestTxQueuePriority(t *testing.T) {
+	q := newTxQueue()
+	for id, control := range []bool{false, true, false, true} {
+		q.push(testTxFrame(control, id), DropTail)
+	}
+	for _, want := range []int{1, 3, 0, 2} {
+		f, ok := q.pop()
+		if !ok || txFrameID(f) != want {
+			t.Fatalf("popped frame %d, want %d", txFrameID(f), want)
+		}
+	}
+	q.close()
+	if _, ok := q.pop(); ok {
+		t.Fatal("pop on a closed empty queue")
+	}
+}
+
+func TestNewTxFrameKind(t *testing.T) {
+	lcp := testFrame(testACMAC, testHostMAC, PPPoESession, 0, testSession, []byte{0xc0, 0x21, 0x09, 0x01, 0x00, 0x08, 0, 0, 0, 0})
+	ipv4 := testFrame(testACMAC, testHostMAC, PPPoESession, 0, testSession, []byte{0x00, 0x21, 0x45, 0x00})
+	padi := testFrame(testBroadcast, testHostMAC, PPPoEDiscovery, PADI, 0, nil)
+	for _, tt := range []struct {
+		packetType uint16
+		frame      []byte
+		control    bool
+	}{
+		{PacketTypeSession, lcp, true},
+		{PacketTypeSession, ipv4, false},
+		{PacketTypeDiscovery, padi, true},
+	} {
+		if f := newTxFrame(tt.packetType, tt.frame, time.Time{}); f.control != tt.control {
+			t.Errorf("frame %x is control %v, want %v", tt.frame, f.control, tt.control)
+		}
+	}
+}
+
+func TestTxQueueCredits(t *testing.T) {
+	q := newTxQueue()
+	q.push(testTxFrame(false, 0), DropTail)
+	if f, _ := q.pop(); txFrameID(f) != 0 {
+		t.Fatalf("popped frame %d", txFrameID(f))
+	}
+	q.spend(false)
+	// The peer counts the frame sent before its hello as well
+	q.limitCredits(2)
+	for id, control := range []bool{false, false, true} {
+		q.push(testTxFrame(control, id+1), DropTail)
+	}
+
+	popped := make(chan int, 4)
+	go func() {
+		for {
+			f, ok := q.pop()
+			if !ok {
+				close(popped)
+				return
+			}
+			q.spend(f.control)
+			popped <- txFrameID(f)
+		}
+	}()
+	next := func() int {
+		select {
+		case id := <-popped:
+			return id
+		case <-time.After(100 * time.Millisecond):
+			return -1
+		}
+	}
+
+	// One data credit left, control frames have their own
+	for _, want := range []int{3, 1, -1} {
+		if got := next(); got != want {
+			t.Fatalf("popped frame %d, want %d", got, want)
+		}
+	}
+	q.grant(0, 1)
+	if got := next(); got != 2 {
+		t.Fatalf("popped frame %d after a grant, want 2", got)
+	}
+	q.close()
+}
+
+func TestRxCredits(t *testing.T) {
+	c := rxCredits{window: 8}
+	if _, _, ok := c.consume(true); ok {
+		t.Fatal("credits granted to a peer that does not understand them")
+	}
+	c = rxCredits{window: 8, peer: true}
+	var grants [][2]int
+	for _, control := range []bool{false, true, false, true, true, false} {
+		if control, data, ok := c.consume(control); ok {
+			grants = append(grants, [2]int{control, data})
+		}
+	}
+	// Granted once a quarter of the window was used by either kind
+	if len(grants) != 2 || grants[0] != [2]int{1, 2} || grants[1] != [2]int{2, 0} {
+		t.Fatalf("grants %v", grants)
+	}
+}
+
+func TestTunnelFrameControl(t *testing.T) {
+	lcp := testFrame(testACMAC, testHostMAC, PPPoESession, 0, testSession, []byte{0xc0, 0x21, 0x09, 0x01, 0x00, 0x08, 0, 0, 0, 0})
+	ipv4 := testFrame(testACMAC, testHostMAC, PPPoESession, 0, testSession, []byte{0x00, 0x21, 0x45, 0x00})
+	sequenced := func(frame []byte) []byte {
+		return append([]byte{0, 0, 0, 1, 0, PacketTypeSession}, frame...)
+	}
+	timestamped := func(packetType uint16, data []byte) []byte {
+		return append([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, byte(packetType)}, data...)
+	}
+	for _, tt := range []struct {
+		packetType uint16
+		data       []byte
+		control    bool
+	}{
+		{PacketTypeSession, lcp, true},
+		{PacketTypeSession, ipv4, false},
+		{PacketTypeSequenced, sequenced(lcp), true},
+		{PacketTypeSequenced, sequenced(ipv4), false},
+		{PacketTypeTimestamped, timestamped(PacketTypeSequenced, sequenced(lcp)), true},
+		{PacketTypeTimestamped, timestamped(PacketTypeSession, ipv4), false},
+		{PacketTypeDiscovery, testFrame(testBroadcast, testHostMAC, PPPoEDiscovery, PADI, 0, nil), true},
+	} {
+		if got := tunnelFrameControl(tt.packetType, tt.data); got != tt.control {
+			t.Errorf("packet type %d %x is control %v, want %v", tt.packetType, tt.data, got, tt.control)
+		}
+	}
+}
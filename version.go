@@ -0,0 +1,111 @@
+package pppoeproxy
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"runtime"
+	"strings"
+
+	"github.com/KarpelesLab/goupd"
+)
+
+// version is the release version, set at build time with
+// -ldflags "-X github.com/KarpelesLab/pppoeproxy.version=...". The commit and build date are set on the
+// goupd variables by the Makefile and recorded by Go in the build info.
+var version string
+
+// Build information metrics
+var (
+	buildInfo = NewGaugeVec("pppoeproxy_build_info", "Version of this build", "version", "commit", "date", "goversion")
+	peerInfo  = NewGaugeVec("pppoeproxy_tunnel_peer_info", "Version announced by each connected tunnel peer", "peer", "version")
+)
+
+func init() {
+	buildInfo.With(Version(), goupd.GIT_TAG, goupd.DATE_TAG, runtime.Version()).Set(1)
+}
+
+// Version returns the version of this build: the release version when set,
+// the commit otherwise
+func Version() string {
+	switch {
+	case version != "":
+		return version
+	case goupd.GIT_TAG != "":
+		return goupd.GIT_TAG
+	default:
+		return "dev"
+	}
+}
+
+// helloPayload builds the hello sent to a tunnel peer when the connection is
+// established, as "key=value" lines so fields can be added later. Peers that
+// predate the hello skip it as an unknown packet type.
+func helloPayload(fields []string) []byte {
+	b := []byte("version=" + Version() + "\n")
+	for _, f := range fields {
+		b = append(b, f+"\n"...)
+	}
+	return b
+}
+
+// SendHello announces our version to the tunnel peer, along with optional
+// "key=value" fields
+func (c *Client) SendHello(fields ...string) error {
+	return c.WritePacket(PacketTypeHello, helloPayload(fields))
+}
+
+// parseHello returns the fields of a hello payload
+func parseHello(data []byte) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), "="); ok {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// handleHello records the version announced by a tunnel peer
+func (p *Proxy) handleHello(client *Client, data []byte) {
+	fields := parseHello(data)
+	p.checkPeerMTU(client, fields["mtu"])
+	client.peerSequence.Store(fields["seq"] == "1")
+	client.peerTimestamps.Store(fields["ts"] == "1")
+	handleCreditHello(client, fields["credit"])
+	if fields["sessions"] == "1" {
+		p.sendSessions(client)
+	}
+
+	v := fields["version"]
+	if v == "" {
+		v = "unknown"
+	}
+	if old := client.peerVersion.Swap(&v); old != nil {
+		peerInfo.Delete(client.remoteAddr, *old)
+	}
+	peerInfo.With(client.remoteAddr, v).Set(1)
+
+	if v != Version() {
+		log.Printf("Warning: tunnel peer %s runs version %s, this is %s", client.remoteAddr, v, Version())
+	} else {
+		log.Printf("Tunnel peer %s runs version %s", client.remoteAddr, v)
+	}
+}
+
+// forgetPeerVersion removes the version metric of a disconnected peer
+func forgetPeerVersion(client *Client) {
+	if v := client.peerVersion.Load(); v != nil {
+		peerInfo.Delete(client.remoteAddr, *v)
+	}
+}
+
+// PeerVersion returns the version announced by the peer, or an empty string
+// when the peer did not send a hello
+func (c *Client) PeerVersion() string {
+	if v := c.peerVersion.Load(); v != nil {
+		return *v
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package pppoeproxy
+
+import "encoding/binary"
+
+// VLAN tagging
+const (
+	etherTypeVLAN = 0x8100 // 802.1Q tag
+	etherTypeQinQ = 0x88a8 // 802.1ad service tag
+	vlanTagSize   = 4      // TPID and TCI
+)
+
+// framePayload returns the ethertype of a frame and the offset of its
+// payload, after the Ethernet header and any VLAN tags. Frames are untagged
+// unless the kernel stripped a tag on capture and it was put back. The offset
+// is beyond the frame if it is truncated.
+func framePayload(frame []byte) (uint16, int) {
+	off := ethernetHeaderSize
+	if len(frame) < off {
+		return 0, off
+	}
+	ethertype := binary.BigEndian.Uint16(frame[off-2 : off])
+	for (ethertype == etherTypeVLAN || ethertype == etherTypeQinQ) && len(frame) >= off+vlanTagSize {
+		off += vlanTagSize
+		ethertype = binary.BigEndian.Uint16(frame[off-2 : off])
+	}
+	return ethertype, off
+}
+
+// outerVLAN returns the VLAN ID of the outermost tag of a frame, and false if
+// it is untagged
+func outerVLAN(frame []byte) (uint16, bool) {
+	if len(frame) < ethernetHeaderSize+vlanTagSize {
+		return 0, false
+	}
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeVLAN, etherTypeQinQ:
+		return binary.BigEndian.Uint16(frame[14:16]) & 0x0fff, true
+	}
+	return 0, false
+}
+
+// pppoeOffset returns the offset of the PPPoE header of a frame
+func pppoeOffset(frame []byte) int {
+	_, off := framePayload(frame)
+	return off
+}
+
+// insertVLANTag puts back the VLAN tag the kernel stripped from the n bytes
+// frame in buf and returns the new frame length. The tag is not restored if
+// buf is too small.
+func insertVLANTag(buf []byte, n int, tpid, tci uint16) int {
+	if n < 12 || n+vlanTagSize > len(buf) {
+		return n
+	}
+	copy(buf[12+vlanTagSize:n+vlanTagSize], buf[12:n])
+	binary.BigEndian.PutUint16(buf[12:14], tpid)
+	binary.BigEndian.PutUint16(buf[14:16], tci)
+	return n + vlanTagSize
+}
@@ -0,0 +1,57 @@
+package pppoeproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// WaitForInterface waits until an interface named name exists, or one
+// matching the pattern, for instance a USB NIC or a VLAN created after the
+// proxy started. It retries with backoff, and right away when Linux reports a
+// link change, for at most timeout or forever if timeout is negative. It
+// returns immediately when the interface already exists.
+func WaitForInterface(ctx context.Context, name string, timeout time.Duration) error {
+	_, err := FindInterfaces(name)
+	if err == nil {
+		return nil
+	}
+	log.Printf("Waiting for interface %s: %v", name, err)
+
+	if timeout >= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	changed := make(chan struct{}, 1)
+	stop := watchLinks(func(index int, ifname string, removed bool) {
+		if (matchInterface(name, ifname) || index == 0) && !removed {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	})
+	defer stop()
+
+	backoff := Backoff{Min: 100 * time.Millisecond, Max: 5 * time.Second, Factor: 2, Jitter: 0.1}
+	start := time.Now()
+	for {
+		timer := time.NewTimer(backoff.Next())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("interface %s did not appear within %s: %v", name, time.Since(start).Round(time.Second), err)
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		if _, err = FindInterfaces(name); err == nil {
+			log.Printf("Interface %s appeared after %s", name, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+	}
+}